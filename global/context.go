@@ -1,6 +1,7 @@
 package global
 
 import (
+	"bytes"
 	"fmt"
 	"log"
 	"runtime"
@@ -9,6 +10,7 @@ import (
 	"time"
 
 	sidlog "github.com/siddontang/go-log/log"
+	"go.uber.org/atomic"
 	"go-mysql-transfer/util/logs"
 )
 
@@ -19,6 +21,12 @@ var (
 	_leaderNode  string
 	_currentNode string
 	_bootTime    time.Time
+
+	_sourceTimeZone atomic.String // 源库时区，连接源库时查询
+
+	_channelServerID atomic.Uint32 // channel复制通道源库的server_id，连接源库时查询
+
+	_sourceReconnects atomic.Uint64 // binlog复制连接重新连接的次数
 )
 
 func SetLeaderFlag(flag bool) {
@@ -45,6 +53,40 @@ func IsFollower() bool {
 	return !_leaderFlag
 }
 
+func SetSourceTimeZone(tz string) {
+	_sourceTimeZone.Store(tz)
+}
+
+func SourceTimeZone() string {
+	return _sourceTimeZone.Load()
+}
+
+func SetChannelServerID(id uint32) {
+	_channelServerID.Store(id)
+}
+
+// SourceReconnects binlog复制连接断开后重新连接的次数
+func SourceReconnects() uint64 {
+	return _sourceReconnects.Load()
+}
+
+// sourceLogHandler canal未提供复制连接重连的回调，按其重新连接时的日志统计次数
+type sourceLogHandler struct {
+	sidlog.Handler
+}
+
+func (h *sourceLogHandler) Write(p []byte) (int, error) {
+	if bytes.Contains(p, []byte("begin to re-sync from")) {
+		_sourceReconnects.Inc()
+	}
+	return h.Handler.Write(p)
+}
+
+// ChannelServerID 配置了channel时为该复制通道源库的server_id，否则为0
+func ChannelServerID() uint32 {
+	return _channelServerID.Load()
+}
+
 func BootTime() time.Time {
 	return _bootTime
 }
@@ -64,7 +106,7 @@ func Initialize(configPath string) error {
 	if err != nil {
 		return err
 	}
-	agent := sidlog.New(streamHandler, sidlog.Ltime|sidlog.Lfile|sidlog.Llevel)
+	agent := sidlog.New(&sourceLogHandler{Handler: streamHandler}, sidlog.Ltime|sidlog.Lfile|sidlog.Llevel)
 	sidlog.SetDefaultLogger(agent)
 
 	_bootTime = time.Now()
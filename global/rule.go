@@ -18,6 +18,8 @@
 package global
 
 import (
+	"bytes"
+	"encoding/json"
 	"github.com/juju/errors"
 	"github.com/siddontang/go-mysql/schema"
 	"github.com/vmihailenco/msgpack"
@@ -25,13 +27,18 @@ import (
 	"github.com/yuin/gopher-lua/parse"
 	"io/ioutil"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"text/template"
+	"time"
 
 	"go-mysql-transfer/model"
 	"go-mysql-transfer/util/dates"
 	"go-mysql-transfer/util/files"
+	"go-mysql-transfer/util/logs"
 	"go-mysql-transfer/util/stringutil"
 )
 
@@ -41,15 +48,83 @@ const (
 	RedisStructureList      = "List"
 	RedisStructureSet       = "Set"
 	RedisStructureSortedSet = "SortedSet"
+	RedisStructureJson      = "Json" // RedisJSON模块的JSON文档
+
+	RedisExpireSliding = "sliding"
+	RedisExpireFixed   = "fixed"
 
 	ValEncoderJson     = "json"
 	ValEncoderKVCommas = "kv-commas"
 	ValEncoderVCommas  = "v-commas"
+
+	GeneratedColumnsAuto    = "auto"
+	GeneratedColumnsInclude = "include"
+	GeneratedColumnsExclude = "exclude"
+
+	IdentityChangeDeleteInsert = "delete_insert"
+	IdentityChangeUpdate       = "update"
+
+	EmptyKeyWarn      = "warn"
+	EmptyKeySkip      = "skip"
+	EmptyKeySurrogate = "surrogate"
+
+	FieldOrderColumn = "column"
+
+	ColumnNamingLowerCamel = "lower_camel"
+	ColumnNamingUpperCamel = "upper_camel"
+	ColumnNamingSnake      = "snake"
+
+	IntAsStringUnsafe = "unsafe"
+
+	KeyFormatTyped = "typed"
+
+	ValueMapPassthrough = "passthrough"
+	ValueMapNull        = "null"
+	ValueMapFallback    = "fallback"
+
+	LuaErrorHalt       = "halt"
+	LuaErrorSkip       = "skip"
+	LuaErrorDeadLetter = "dead_letter"
+
+	OversizeTruncate = "truncate"
+	OversizeHash     = "hash"
+
+	BitFormatInt    = "int"
+	BitFormatBinary = "binary"
+	BitFormatBool   = "bool"
+
+	MQFormatJson    = "json"
+	MQFormatMaxwell = "maxwell"
+
+	ConflictUpsert = "upsert"
+	ConflictIgnore = "ignore"
+	ConflictError  = "error"
+
+	OrderingStrict = "strict"
+	OrderingPerKey = "per-key"
+)
+
+const (
+	_partitionFormat         = "yyyy-MM"
+	_partitionDateLayout     = "2006-01-02"
+	_partitionDatetimeLayout = "2006-01-02 15:04:05"
+
+	_lookupMaxSize = 10000
+
+	_softDeleteField = "_deleted"
+	_oversizeField   = "_truncated"
+	_eventTimeField  = "@timestamp"
 )
 
 var (
 	_ruleInsMap       = make(map[string]*Rule)
 	_lockOfRuleInsMap sync.RWMutex
+
+	_mqFormats     = make(map[string]bool) // 已注册序列化器的mq_format
+	_lockMQFormats sync.RWMutex
+
+	// postgresql类型，如boolean、timestamp、numeric(10,2)、text[]，拼接在SQL中不允许其他字符
+	_pgTypeExpr = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_ ]*(\(\d+(,\s*\d+)?\))?(\[\])?$`)
 )
 
 type EsMapping struct {
@@ -60,16 +135,122 @@ type EsMapping struct {
 	Format   string `yaml:"format"`   // 日期格式
 }
 
+// ColumnDirective 列注释中的映射指令
+type ColumnDirective struct {
+	Ignore bool   // @ignore、@es_ignore：排除该列
+	Rename string // @rename:名称：输出的字段名称
+	EsType string // @es_type:类型：ES字段类型
+}
+
+// ParseColumnDirective 解析列注释中以@开头的指令，如"用户名 @rename:userName @es_type:keyword"，
+// 不认识的指令忽略，没有指令时返回nil
+func ParseColumnDirective(column, comment string) *ColumnDirective {
+	var directive *ColumnDirective
+	for _, word := range strings.Fields(comment) {
+		if !strings.HasPrefix(word, "@") {
+			continue
+		}
+
+		name, value := word[1:], ""
+		if i := strings.Index(name, ":"); i >= 0 {
+			name, value = name[:i], name[i+1:]
+		}
+		if directive == nil {
+			directive = &ColumnDirective{}
+		}
+		switch strings.ToLower(name) {
+		case "ignore", "es_ignore":
+			directive.Ignore = true
+		case "rename":
+			directive.Rename = value
+		case "es_type":
+			directive.EsType = value
+		default:
+			logs.Debugf("unknown directive %s in comment of column %s", word, column)
+		}
+	}
+	return directive
+}
+
+// Route 按列的值将数据路由到附加接收端
+type Route struct {
+	Column   string `yaml:"column"`   // 路由列
+	Values   string `yaml:"values"`   // 匹配的值，多个用逗号分隔
+	Endpoint string `yaml:"endpoint"` // 附加接收端名称，对应endpoints中的name
+
+	ColumnIndex int
+	ValueSet    map[string]bool
+}
+
+// ValueMap 按映射表替换列的值，如状态码1→active、国家代码→名称
+type ValueMap struct {
+	Column   string                 `yaml:"column"`   // 列名称
+	Values   map[string]interface{} `yaml:"values"`   // 列的值(转换后的值的字符串形式) -> 替换后的值
+	Unmapped string                 `yaml:"unmapped"` // 不在values中的值的处理方式：passthrough(原值)、null、fallback(替换为fallback)，默认passthrough
+	Fallback interface{}            `yaml:"fallback"` // unmapped为fallback时替换的值
+}
+
+// Apply 按映射表替换转换后的列的值，null不替换
+func (s *ValueMap) Apply(value interface{}) interface{} {
+	if value == nil {
+		return nil
+	}
+	if v, ok := s.Values[stringutil.ToString(value)]; ok {
+		return v
+	}
+	switch s.Unmapped {
+	case ValueMapNull:
+		return nil
+	case ValueMapFallback:
+		return s.Fallback
+	}
+	return value
+}
+
+// Lookup 参考表(如字典表)的查找表，启动时全量加载，随参考表的binlog变更更新
+type Lookup struct {
+	Name            string `yaml:"name"`             // 名称，多个规则中同名的须使用相同的参考表
+	Table           string `yaml:"table"`            // 参考表，库名.表名，省略库名时为规则的库
+	KeyColumn       string `yaml:"key_column"`       // 参考表中的键列
+	ValueColumn     string `yaml:"value_column"`     // 参考表中的值列
+	Column          string `yaml:"column"`           // 规则表中与键列关联的列，为空时仅供Lua使用
+	As              string `yaml:"as"`               // 关联到的值输出的字段名称，默认为name
+	RefreshInterval int    `yaml:"refresh_interval"` // 定时全量重新加载的间隔(秒)，默认0不定时加载
+	MaxSize         int    `yaml:"max_size"`         // 最多缓存的条目数，参考表超过时启动失败，默认10000
+
+	Schema      string
+	ColumnIndex int
+}
+
+// SourceOf 参考表的库名和表名
+func (s *Lookup) SourceOf(ruleSchema string) (string, string) {
+	if i := strings.Index(s.Table, "."); i > 0 {
+		return s.Table[:i], s.Table[i+1:]
+	}
+	return ruleSchema, s.Table
+}
+
+// SameSource 是否为同一参考表的相同列
+func (s *Lookup) SameSource(o *Lookup) bool {
+	return s.Schema == o.Schema && s.Table == o.Table &&
+		s.KeyColumn == o.KeyColumn && s.ValueColumn == o.ValueColumn
+}
+
 type Rule struct {
 	Schema                   string `yaml:"schema"`
 	Table                    string `yaml:"table"`
 	OrderByColumn            string `yaml:"order_by_column"`
+	DumpWhere                string `yaml:"dump_where"`                 // 全量数据初始化时的过滤条件，只导出满足条件的数据
+	IncludeTimeZone          bool   `yaml:"include_time_zone"`          // 消息中包含源库时区(time_zone)，用于解释DATETIME等不带时区的值
+	IncludePosition          bool   `yaml:"include_position"`           // 消息中包含行数据在源库binlog中的位置，消费端可据此记录已处理的位置
 	ColumnLowerCase          bool   `yaml:"column_lower_case"`          // 列名称转为小写
 	ColumnUpperCase          bool   `yaml:"column_upper_case"`          // 列名称转为大写
 	ColumnUnderscoreToCamel  bool   `yaml:"column_underscore_to_camel"` // 列名称下划线转驼峰
 	IncludeColumnConfig      string `yaml:"include_columns"`            // 包含的列
+	GeneratedColumns         string `yaml:"generated_columns"`          // 生成列的输出方式：auto、include、exclude，默认auto
 	ExcludeColumnConfig      string `yaml:"exclude_columns"`            // 排除掉的列
 	ColumnMappingConfigs     string `yaml:"column_mappings"`            // 列名称映射
+	ColumnComments           bool   `yaml:"column_comments"`            // 按列注释中的指令(@ignore、@rename:名称、@es_type:类型)排除、重命名列或指定ES字段类型
 	DefaultColumnValueConfig string `yaml:"default_column_values"`      // 默认的字段和值
 	// #值编码，支持json、kv-commas、v-commas；默认为json；json形如：{"id":123,"name":"wangjie"} 、kv-commas形如：id=123,name="wangjie"、v-commas形如：123,wangjie
 	ValueEncoder      string `yaml:"value_encoder"`
@@ -81,6 +262,73 @@ type Rule struct {
 	// datetime格式化模式 可选RFC822 RFC822Z RFC850 RFC1123 RFC1123Z RFC3339 RFC3339Nano 优先级高于DatetimeFormatter
 	DatetimeUse    string `yaml:"datetime_use"`
 	ReserveRawData bool   `yaml:"reserve_raw_data"` // 保留update之前的数据，针对KAFKA、RABBITMQ、ROCKETMQ有效
+	// 消息格式，针对KAFKA、RABBITMQ、ROCKETMQ有效；支持json、maxwell(与Maxwell的输出格式兼容)，默认为json
+	MQFormat string `yaml:"mq_format"`
+	// 输出变更列的old/new结构，insert只有new、delete只有old、update只包含发生变化的列；消息中的diff字段针对KAFKA、RABBITMQ、ROCKETMQ有效，Lua脚本中的rawDiff()对所有接收端有效
+	DiffOutput bool `yaml:"diff_output"`
+	// 下游标识(文档ID、Redis key等)使用的列，多个用逗号分隔，默认使用主键
+	IdentityColumns string `yaml:"identity_columns"`
+	// 标识(文档ID、Redis key等)的格式：typed(按列类型格式化：整数为十进制、浮点数和DECIMAL不使用科学计数法、BINARY和VARBINARY为十六进制、
+	// 其余为原值，多列以冒号分隔)，默认为空，即单列按输出的值、多列直接拼接
+	KeyFormat string `yaml:"key_format"`
+	// update时标识列的值发生变化的处理方式：delete_insert(删除旧标识、插入新标识)、update(按新标识更新)，默认delete_insert
+	IdentityChangePolicy string `yaml:"identity_change_policy"`
+	// 标识列的值均为空(NULL、空字符串)或0时的处理方式：warn(记录警告日志后照常写入)、skip(记录警告日志后丢弃)、surrogate(改用empty_key_surrogate列的值作为标识)，默认warn
+	EmptyKeyPolicy string `yaml:"empty_key_policy"`
+	// empty_key_policy为surrogate时代替标识的列
+	EmptyKeySurrogate string `yaml:"empty_key_surrogate"`
+	// JSON输出的字段顺序：column(按表的列顺序)或逗号分隔的列名称(列出的在前，其余按列顺序)，默认按字段名称排序
+	FieldOrder string `yaml:"field_order"`
+	// 列名称转换方式：lower_camel(userName)、upper_camel(UserName)、snake(user_name)，下划线和驼峰写法的列名称均可转换；
+	// 优先于column_lower_case、column_upper_case、column_underscore_to_camel，column_mappings、es_mappings及列注释中的@rename优先于此项；默认使用全局的column_naming
+	ColumnNaming string `yaml:"column_naming"`
+	// 按列的值路由到附加接收端，依次匹配，均不匹配时发送到target
+	Routes []*Route `yaml:"routes"`
+	// 从参考表加载到内存的查找表，按列的值关联参考表中的标签写入输出，也可在Lua中通过lookupOps.get(name, key)使用
+	Lookups []*Lookup `yaml:"lookups"`
+	// 按该列(date、datetime、timestamp类型)的值写入时间分区的索引或集合，如es_index为events时写入events-2024-01
+	PartitionColumn string `yaml:"partition_column"`
+	// 时间分区的格式，如yyyy-MM(按月)、yyyy-MM-dd(按天)，默认yyyy-MM
+	PartitionFormat string `yaml:"partition_format"`
+	// 在lua_script/lua_file_path之前依次执行的lua脚本文件，前一个的输出作为后一个的输入，返回false或nil时丢弃该行
+	LuaStages []string `yaml:"lua_stages"`
+	// 按映射表替换列的值，用于状态码等枚举值的转换，不需要Lua脚本
+	ValueMaps []*ValueMap `yaml:"value_maps"`
+	// Lua脚本执行失败或调用的参数不正确时的处理方式：halt(停止同步)、skip(记录错误日志后跳过该行)、dead_letter(该行写入死信文件后跳过)，默认halt
+	LuaErrorPolicy string `yaml:"lua_error_policy"`
+	// 同一事务中先删除后插入同一标识的数据在事务提交时合并为一个upsert，避免下游短暂缺失该数据；默认false
+	MergeDeleteInsert bool `yaml:"merge_delete_insert"`
+	// 删除输出为包含删除前数据、删除标记为true的upsert，其余数据的删除标记为false，用于只能追加写入的下游；默认false
+	SoftDelete bool `yaml:"soft_delete"`
+	// soft_delete的删除标记字段名称，默认_deleted
+	SoftDeleteField string `yaml:"soft_delete_field"`
+	// consume_workers大于1时，按标识列将数据分散到多个并发写入；默认false，即该规则的数据固定由一个并发顺序写入
+	Parallel bool `yaml:"parallel"`
+	// 顺序保证：strict(固定由一个并发按binlog顺序写入，不合并变更)、per-key(同parallel，只保证同一标识的顺序)；
+	// 默认开启parallel时为per-key，否则固定由一个并发写入，但consume_coalesce等会合并变更
+	Ordering string `yaml:"ordering"`
+	// 整数输出为字符串：unsafe(仅超出±(2^53-1)的值，JavaScript等按浮点数解析会丢失精度)或逗号分隔的列名称(这些列的值均转为字符串)，默认不转换
+	IntAsString string `yaml:"int_as_string"`
+	// BIT类型的输出格式：int(整数)、binary(二进制字符串，如BIT(4)输出0101)、bool(BIT(1)输出true/false，其余按int)，默认int
+	BitFormat string `yaml:"bit_format"`
+	// 以{unscaled:整数,scale:小数位数}输出的DECIMAL列，逗号分隔的列名称，避免按浮点数输出丢失精度，默认不转换
+	DecimalScaled string `yaml:"decimal_scaled"`
+	// 字符串、二进制值的最大长度(字节)：数字(所有列)和/或逗号分隔的列名称=长度，如1000,CONTENT=5000，超出的按oversize_policy处理，默认不限制
+	MaxValueLength string `yaml:"max_value_length"`
+	// 超出max_value_length的值的处理方式：truncate(截断，字符串不拆分UTF-8字符)、hash(替换为sha256:十六进制摘要)，默认truncate
+	OversizePolicy string `yaml:"oversize_policy"`
+	// 记录被截断或替换的字段名称的字段，默认_truncated，没有超出时不输出
+	OversizeField string `yaml:"oversize_field"`
+	// 按该列(JSON数组或以explode_separator分隔的字符串)的元素将一行拆分为多个文档，每个文档中该列为一个元素，标识为原标识_序号(从1开始)
+	ExplodeColumn string `yaml:"explode_column"`
+	// explode_column为字符串时元素的分隔符，默认逗号
+	ExplodeSeparator string `yaml:"explode_separator"`
+	// 记录该规则最近已写入的行数(按标识+binlog位置)，重连或重新同步后再次收到的这些行不再写入，用于无法幂等写入的接收端；默认0不去重
+	DedupeWindow int `yaml:"dedupe_window"`
+	// 使用binlog事件头中的时间作为下游记录的时间：kafka消息时间戳、rabbitmq消息的timestamp属性、ES和MongoDB文档的event_time_field字段；默认false，即处理时的时间
+	EventTime bool `yaml:"event_time"`
+	// event_time写入ES、MongoDB文档的字段名称，默认@timestamp
+	EventTimeField string `yaml:"event_time_field"`
 
 	// ------------------- REDIS -----------------
 	//对应redis的5种数据类型 String、Hash(字典) 、List(列表) 、Set(集合)、Sorted Set(有序集合)
@@ -88,6 +336,7 @@ type Rule struct {
 	RedisKeyPrefix       string `yaml:"redis_key_prefix"`       //key的前缀
 	RedisKeyColumn       string `yaml:"redis_key_column"`       //使用哪个列的值作为key，不填写默认使用主键
 	RedisExpiredSecond   int64  `yaml:"redis_expired_second"`   // 过期时间 单位是秒 修改自动续期
+	RedisExpireMode      string `yaml:"redis_expire_mode"`      // 过期方式：sliding(每次修改续期)、fixed(创建时设置，修改不续期)，默认sliding
 	RedisDimensionPrefix string `yaml:"redis_dimension_prefix"` // 纬度字段前缀
 	RedisDimensionColumn string `yaml:"redis_dimension_column"` // 其他纬度字段 指向主键 仅使用string
 	// 格式化定义key,如{id}-{name}；{id}表示字段id的值、{name}表示字段name的值
@@ -113,26 +362,56 @@ type Rule struct {
 	MongodbDatabase   string `yaml:"mongodb_database"`   //mongodb database 不能为空
 	MongodbCollection string `yaml:"mongodb_collection"` //mongodb collection，可以为空，默认使用表(Table)名称
 
+	// ------------------- POSTGRESQL -----------------
+	PostgresqlSchema string `yaml:"postgresql_schema"` //postgresql schema，默认public
+	PostgresqlTable  string `yaml:"postgresql_table"`  //postgresql表名称，可以为空，默认使用表(Table)名称
+	// 插入的标识已存在时(如全量导出与增量同步重叠、重放)的处理方式：upsert(ON CONFLICT DO UPDATE)、ignore(ON CONFLICT DO NOTHING)、error(报错，停止写入)，默认upsert
+	ConflictPolicy string   `yaml:"conflict_policy"`
+	PostgresqlKeys []string //标识列输出的列名称，ON CONFLICT和WHERE条件使用
+	// 列(数据库列名称)写入时转换的postgresql类型，如tinyint(1)的列为boolean、datetime的列为timestamp，默认为空按值的类型写入
+	PostgresqlColumnTypes map[string]string `yaml:"postgresql_column_types"`
+	PostgresqlCasts       map[string]string //postgresql_column_types按输出的列名称
+
 	// ------------------- RABBITMQ -----------------
 	RabbitmqQueue string `yaml:"rabbitmq_queue"` //queue名称,可以为空，默认使用表(Table)名称
 
 	// ------------------- KAFKA -----------------
 	KafkaTopic string `yaml:"kafka_topic"` //TOPIC名称,可以为空，默认使用表(Table)名称
+	// 按行数据计算topic的模板，如events-{{.TENANT_ID}}；delete按删除前的数据计算，update中topic变化时拆分为旧topic的delete和新topic的insert
+	KafkaTopicFormatter string `yaml:"kafka_topic_formatter"`
+	KafkaTopicTmpl      *template.Template
 
 	// ------------------- ES -----------------
 	ElsIndex   string       `yaml:"es_index"`    //Elasticsearch Index,可以为空，默认使用表(Table)名称
 	ElsType    string       `yaml:"es_type"`     //es6.x以后一个Index只能拥有一个Type,可以为空，默认使用_doc; es7.x版本此属性无效
 	EsMappings []*EsMapping `yaml:"es_mappings"` //Elasticsearch mappings映射关系,可以为空，为空时根据数据类型自己推导
+	// 写入时使用的ingest pipeline，设置后update也以index请求写入完整文档(update请求不支持pipeline，lua脚本的update除外)，默认为空
+	ElsPipeline string `yaml:"es_pipeline"`
 
 	// --------------- no config ----------------
 	TableInfo             *schema.Table
 	TableColumnSize       int
-	IsCompositeKey        bool //是否联合主键
+	VirtualColumnIndexes  []int    //VIRTUAL生成列的下标，部分版本的binlog行镜像不包含这些列
+	StoredColumns         []string //STORED生成列，generated_columns为exclude时使用
+	IsCompositeKey        bool     //是否联合主键
+	KeyColumnIndexes      []int    //下游标识列的下标，默认为主键
 	DefaultColumnValueMap map[string]string
 	PaddingMap            map[string]*model.Padding
+	OrderedFields         []string        //按field_order排列的输出字段名称，为空时不排序
+	IntStringColumns      map[string]bool //int_as_string为列名称时，值转为字符串的列
+	DecimalScaleColumns   map[string]int  //decimal_scaled中的列及其声明的小数位数
+	MaxLength             int             //max_value_length中未指定列的最大长度，0为不限制
+	MaxLengthColumns      map[string]int  //max_value_length中指定的列及其最大长度
+	PartitionIndex        int             //partition_column的下标，未配置时为-1
+	SurrogateIndex        int             //empty_key_surrogate的下标，未配置时为-1
+	ExplodeIndex          int             //explode_column的下标，未配置时为-1
+	PartitionLayout       string          //partition_format对应的go时间格式
 	LuaProto              *lua.FunctionProto
+	LuaStageProtos        []*lua.FunctionProto //lua_stages编译后的脚本
 	LuaFunction           *lua.LFunction
 	ValueTmpl             *template.Template
+	ColumnDirectives      map[string]*ColumnDirective //column_comments开启时列注释中的指令
+	ValueMapColumns       map[string]*ValueMap        //value_maps按列名称的索引
 }
 
 func RuleDeepClone(res *Rule) (*Rule, error) {
@@ -150,6 +429,21 @@ func RuleDeepClone(res *Rule) (*Rule, error) {
 	return &r, nil
 }
 
+// RegisterMQFormat 注册mq_format名称，由接收端注册序列化器时调用
+func RegisterMQFormat(name string) {
+	_lockMQFormats.Lock()
+	defer _lockMQFormats.Unlock()
+
+	_mqFormats[name] = true
+}
+
+func MQFormatExist(name string) bool {
+	_lockMQFormats.RLock()
+	defer _lockMQFormats.RUnlock()
+
+	return _mqFormats[name]
+}
+
 func RuleKey(schema string, table string) string {
 	return strings.ToLower(schema + ":" + table)
 }
@@ -161,6 +455,14 @@ func AddRuleIns(ruleKey string, r *Rule) {
 	_ruleInsMap[ruleKey] = r
 }
 
+// DeleteRuleIns 删除规则，通配符规则匹配的表被删除时调用
+func DeleteRuleIns(ruleKey string) {
+	_lockOfRuleInsMap.Lock()
+	defer _lockOfRuleInsMap.Unlock()
+
+	delete(_ruleInsMap, ruleKey)
+}
+
 func RuleIns(ruleKey string) (*Rule, bool) {
 	_lockOfRuleInsMap.RLock()
 	defer _lockOfRuleInsMap.RUnlock()
@@ -211,6 +513,62 @@ func RuleKeyList() []string {
 }
 
 func (s *Rule) Initialize() error {
+	if err := s.initColumnNaming(); err != nil {
+		return err
+	}
+
+	if err := s.initIdentity(); err != nil {
+		return err
+	}
+
+	if err := s.initKeyFormat(); err != nil {
+		return err
+	}
+
+	if err := s.initEmptyKey(); err != nil {
+		return err
+	}
+
+	if err := s.initExplode(); err != nil {
+		return err
+	}
+
+	if err := s.initSoftDelete(); err != nil {
+		return err
+	}
+
+	if err := s.initEventTime(); err != nil {
+		return err
+	}
+
+	if err := s.initRoutes(); err != nil {
+		return err
+	}
+
+	if err := s.initLookups(); err != nil {
+		return err
+	}
+
+	if err := s.initValueMaps(); err != nil {
+		return err
+	}
+
+	if err := s.initPartition(); err != nil {
+		return err
+	}
+
+	if len(s.LuaStages) > 0 && !s.LuaEnable() {
+		return errors.Errorf("lua_stages requires lua_script or lua_file_path")
+	}
+
+	if err := s.initLuaErrorPolicy(); err != nil {
+		return err
+	}
+
+	if err := s.initOrdering(); err != nil {
+		return err
+	}
+
 	if err := s.buildPaddingMap(); err != nil {
 		return err
 	}
@@ -242,6 +600,26 @@ func (s *Rule) Initialize() error {
 		s.DefaultColumnValueMap = dm
 	}
 
+	if s.MQFormat != "" {
+		if !_config.IsMQ() {
+			return errors.Errorf("mq_format only supported by kafka、rocketmq、rabbitmq")
+		}
+		if s.LuaEnable() {
+			// lua脚本自行生成消息体
+			return errors.Errorf("mq_format not supported with lua script")
+		}
+		if !MQFormatExist(s.MQFormat) {
+			return errors.Errorf("mq_format %s not registered", s.MQFormat)
+		}
+	}
+
+	if s.BitFormat == "" {
+		s.BitFormat = BitFormatInt
+	}
+	if s.BitFormat != BitFormatInt && s.BitFormat != BitFormatBinary && s.BitFormat != BitFormatBool {
+		return errors.Errorf("bit_format must be int、binary or bool")
+	}
+
 	if s.DateFormatter != "" {
 		s.DateFormatter = dates.ConvertGoFormat(s.DateFormatter)
 	}
@@ -278,6 +656,10 @@ func (s *Rule) Initialize() error {
 		}
 	}
 
+	if err := s.initPostgresqlConfig(); err != nil {
+		return err
+	}
+
 	if _config.IsKafka() {
 		if err := s.initKafkaConfig(); err != nil {
 			return err
@@ -300,6 +682,38 @@ func (s *Rule) Initialize() error {
 }
 
 func (s *Rule) AfterUpdateTableInfo() error {
+	if err := s.initIdentity(); err != nil {
+		return err
+	}
+
+	if err := s.initEmptyKey(); err != nil {
+		return err
+	}
+
+	if err := s.initExplode(); err != nil {
+		return err
+	}
+
+	if err := s.initRoutes(); err != nil {
+		return err
+	}
+
+	if err := s.initLookups(); err != nil {
+		return err
+	}
+
+	if err := s.initValueMaps(); err != nil {
+		return err
+	}
+
+	if err := s.initPartition(); err != nil {
+		return err
+	}
+
+	if len(s.LuaStages) > 0 && !s.LuaEnable() {
+		return errors.Errorf("lua_stages requires lua_script or lua_file_path")
+	}
+
 	if err := s.buildPaddingMap(); err != nil {
 		return err
 	}
@@ -328,6 +742,10 @@ func (s *Rule) AfterUpdateTableInfo() error {
 		}
 	}
 
+	if err := s.initPostgresqlConfig(); err != nil {
+		return err
+	}
+
 	if _config.IsKafka() {
 		if err := s.initKafkaConfig(); err != nil {
 			return err
@@ -349,6 +767,398 @@ func (s *Rule) AfterUpdateTableInfo() error {
 	return nil
 }
 
+func (s *Rule) initIdentity() error {
+	if s.IdentityChangePolicy == "" {
+		s.IdentityChangePolicy = IdentityChangeDeleteInsert
+	}
+	if s.IdentityChangePolicy != IdentityChangeDeleteInsert && s.IdentityChangePolicy != IdentityChangeUpdate {
+		return errors.Errorf("identity_change_policy must be delete_insert or update")
+	}
+
+	if s.IdentityColumns == "" {
+		s.KeyColumnIndexes = s.TableInfo.PKColumns
+		return nil
+	}
+
+	indexes := make([]int, 0)
+	for _, c := range strings.Split(s.IdentityColumns, ",") {
+		_, index := s.TableColumn(strings.TrimSpace(c))
+		if index < 0 {
+			return errors.Errorf("identity_columns must be table column")
+		}
+		indexes = append(indexes, index)
+	}
+	s.KeyColumnIndexes = indexes
+	return nil
+}
+
+// IsCompositeIdentity 下游标识是否由多列组成
+func (s *Rule) IsCompositeIdentity() bool {
+	return len(s.KeyColumnIndexes) > 1
+}
+
+// IdentityChanged update前后下游标识是否发生变化，只有delete_insert策略需要处理
+func (s *Rule) IdentityChanged(old, row []interface{}) bool {
+	if s.IdentityChangePolicy != IdentityChangeDeleteInsert || old == nil {
+		return false
+	}
+	for _, index := range s.KeyColumnIndexes {
+		if index >= len(old) || index >= len(row) {
+			return false
+		}
+		if !reflect.DeepEqual(old[index], row[index]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Rule) initExplode() error {
+	s.ExplodeIndex = -1
+	if s.ExplodeColumn == "" {
+		return nil
+	}
+	if _config.IsRedis() {
+		return errors.Errorf("explode_column not supported by redis")
+	}
+	if s.LuaEnable() {
+		return errors.Errorf("explode_column not supported with lua")
+	}
+	_, index := s.TableColumn(s.ExplodeColumn)
+	if index < 0 {
+		return errors.Errorf("explode_column must be table column")
+	}
+	s.ExplodeIndex = index
+	if s.ExplodeSeparator == "" {
+		s.ExplodeSeparator = ","
+	}
+	return nil
+}
+
+// ExplodeEnable 是否按explode_column拆分
+func (s *Rule) ExplodeEnable() bool {
+	return s.ExplodeColumn != "" && s.ExplodeIndex >= 0
+}
+
+// Explode explode_column的元素：JSON列为数组中的元素(各自序列化为JSON)，其余按explode_separator分隔，忽略空元素
+func (s *Rule) Explode(row []interface{}) []interface{} {
+	if s.ExplodeIndex >= len(row) || row[s.ExplodeIndex] == nil {
+		return nil
+	}
+
+	value := stringutil.ToString(row[s.ExplodeIndex])
+	if s.TableInfo.Columns[s.ExplodeIndex].Type == schema.TYPE_JSON {
+		var array []json.RawMessage
+		if err := json.Unmarshal([]byte(value), &array); err != nil {
+			logs.Warnf("explode_column %s is not json array: %s", s.ExplodeColumn, value)
+			return nil
+		}
+		elements := make([]interface{}, 0, len(array))
+		for _, element := range array {
+			elements = append(elements, string(element))
+		}
+		return elements
+	}
+
+	elements := make([]interface{}, 0)
+	for _, element := range strings.Split(value, s.ExplodeSeparator) {
+		if element = strings.TrimSpace(element); element != "" {
+			elements = append(elements, element)
+		}
+	}
+	return elements
+}
+
+func (s *Rule) initSoftDelete() error {
+	if !s.SoftDelete {
+		return nil
+	}
+	if _config.IsRedis() {
+		return errors.Errorf("soft_delete not supported by redis")
+	}
+	if s.LuaEnable() {
+		return errors.Errorf("soft_delete not supported with lua, set the flag in lua script")
+	}
+	if s.SoftDeleteField == "" {
+		s.SoftDeleteField = _softDeleteField
+	}
+	return nil
+}
+
+func (s *Rule) initColumnNaming() error {
+	if s.ColumnNaming == "" && !s.ColumnLowerCase && !s.ColumnUpperCase && !s.ColumnUnderscoreToCamel {
+		s.ColumnNaming = _config.ColumnNaming
+	}
+	switch s.ColumnNaming {
+	case "", ColumnNamingLowerCamel, ColumnNamingUpperCamel, ColumnNamingSnake:
+		return nil
+	}
+	return errors.Errorf("column_naming must be lower_camel、upper_camel or snake")
+}
+
+func (s *Rule) initEventTime() error {
+	if !s.EventTime {
+		return nil
+	}
+	if _config.IsRedis() {
+		return errors.Errorf("event_time not supported by redis")
+	}
+	if s.EventTimeField == "" {
+		s.EventTimeField = _eventTimeField
+	}
+	return nil
+}
+
+func (s *Rule) initKeyFormat() error {
+	if s.KeyFormat != "" && s.KeyFormat != KeyFormatTyped {
+		return errors.Errorf("key_format must be typed")
+	}
+	return nil
+}
+
+func (s *Rule) initLuaErrorPolicy() error {
+	switch s.LuaErrorPolicy {
+	case "":
+		s.LuaErrorPolicy = LuaErrorHalt
+	case LuaErrorHalt, LuaErrorSkip, LuaErrorDeadLetter:
+	default:
+		return errors.Errorf("lua_error_policy must be halt、skip or dead_letter")
+	}
+	return nil
+}
+
+func (s *Rule) initOrdering() error {
+	switch s.Ordering {
+	case "":
+		if s.Parallel {
+			s.Ordering = OrderingPerKey
+		}
+	case OrderingStrict:
+		if s.Parallel {
+			return errors.Errorf("ordering strict conflicts with parallel")
+		}
+	case OrderingPerKey:
+	default:
+		return errors.Errorf("ordering must be strict or per-key")
+	}
+	return nil
+}
+
+func (s *Rule) initEmptyKey() error {
+	s.SurrogateIndex = -1
+	switch s.EmptyKeyPolicy {
+	case "":
+		s.EmptyKeyPolicy = EmptyKeyWarn
+	case EmptyKeyWarn, EmptyKeySkip:
+	case EmptyKeySurrogate:
+		if _config.IsRedis() {
+			return errors.Errorf("empty_key_policy surrogate not supported by redis")
+		}
+		_, index := s.TableColumn(s.EmptyKeySurrogate)
+		if index < 0 {
+			return errors.Errorf("empty_key_surrogate must be table column")
+		}
+		s.SurrogateIndex = index
+	default:
+		return errors.Errorf("empty_key_policy must be warn、skip or surrogate")
+	}
+	return nil
+}
+
+// IsEmptyKey 标识列的值是否均为空(NULL、空字符串)或0，这类标识在下游相互覆盖
+func (s *Rule) IsEmptyKey(row []interface{}) bool {
+	if len(s.KeyColumnIndexes) == 0 {
+		return false
+	}
+	for _, index := range s.KeyColumnIndexes {
+		if index >= len(row) {
+			return false
+		}
+		if v := stringutil.ToString(row[index]); v != "" && v != "0" {
+			return false
+		}
+	}
+	return true
+}
+
+// UseSurrogate 是否以empty_key_surrogate列的值代替行数据的标识
+func (s *Rule) UseSurrogate(row []interface{}) bool {
+	return s.SurrogateIndex >= 0 && s.SurrogateIndex < len(row) && s.IsEmptyKey(row)
+}
+
+func (s *Rule) initPartition() error {
+	s.PartitionIndex = -1
+	if s.PartitionColumn == "" {
+		return nil
+	}
+
+	if !_config.IsEls() && !_config.IsMongodb() {
+		return errors.Errorf("partition_column only supported by elasticsearch and mongodb")
+	}
+	if s.LuaEnable() {
+		return errors.Errorf("partition_column not supported with lua")
+	}
+	column, index := s.TableColumn(s.PartitionColumn)
+	if index < 0 {
+		return errors.Errorf("partition column %s must be table column", s.PartitionColumn)
+	}
+	if column.Type != schema.TYPE_DATE && column.Type != schema.TYPE_DATETIME && column.Type != schema.TYPE_TIMESTAMP {
+		return errors.Errorf("partition column %s must be date、datetime or timestamp", column.Name)
+	}
+	s.PartitionIndex = index
+
+	if s.PartitionFormat == "" {
+		s.PartitionFormat = _partitionFormat
+	}
+	s.PartitionLayout = dates.ConvertGoFormat(s.PartitionFormat)
+	return nil
+}
+
+// PartitionEnable 是否按partition_column写入时间分区
+func (s *Rule) PartitionEnable() bool {
+	return s.PartitionIndex >= 0 && s.PartitionLayout != ""
+}
+
+// PartitionOf 按行中partition_column的值计算时间分区，值为空或无法解析时返回空字符串
+func (s *Rule) PartitionOf(row []interface{}) string {
+	if !s.PartitionEnable() || s.PartitionIndex >= len(row) {
+		return ""
+	}
+
+	var str string
+	switch v := row[s.PartitionIndex].(type) {
+	case time.Time:
+		if v.IsZero() {
+			return ""
+		}
+		return v.Format(s.PartitionLayout)
+	case string:
+		str = v
+	case []byte:
+		str = string(v)
+	default:
+		return ""
+	}
+
+	layout := _partitionDatetimeLayout
+	if len(str) > len(layout) {
+		str = str[:len(layout)] // 去掉小数秒
+	} else if len(str) == len(_partitionDateLayout) {
+		layout = _partitionDateLayout
+	}
+	t, err := time.Parse(layout, str)
+	if err != nil || t.IsZero() {
+		return ""
+	}
+	return t.Format(s.PartitionLayout)
+}
+
+// PartitionName 目标名称加上时间分区后缀，如events-2024-01；未配置分区或值为空时返回base
+func (s *Rule) PartitionName(base string, row []interface{}) string {
+	if partition := s.PartitionOf(row); partition != "" {
+		return base + "-" + partition
+	}
+	return base
+}
+
+func (s *Rule) initRoutes() error {
+	for _, route := range s.Routes {
+		_, index := s.TableColumn(route.Column)
+		if index < 0 {
+			return errors.Errorf("route column %s must be table column", route.Column)
+		}
+		if route.Values == "" {
+			return errors.Errorf("empty route values not allowed")
+		}
+		if !_config.HasEndpoint(route.Endpoint) {
+			return errors.Errorf("route endpoint %s not defined in endpoints", route.Endpoint)
+		}
+
+		route.ColumnIndex = index
+		route.ValueSet = make(map[string]bool)
+		for _, v := range strings.Split(route.Values, ",") {
+			route.ValueSet[v] = true
+		}
+	}
+	return nil
+}
+
+func (s *Rule) initLookups() error {
+	for _, lookup := range s.Lookups {
+		if lookup.Name == "" || lookup.Table == "" || lookup.KeyColumn == "" || lookup.ValueColumn == "" {
+			return errors.Errorf("lookup name、table、key_column、value_column must not be empty")
+		}
+		if lookup.Schema == "" {
+			lookup.Schema, lookup.Table = lookup.SourceOf(s.Schema)
+		}
+		if lookup.As == "" {
+			lookup.As = lookup.Name
+		}
+		if lookup.MaxSize <= 0 {
+			lookup.MaxSize = _lookupMaxSize
+		}
+
+		lookup.ColumnIndex = -1
+		if lookup.Column != "" {
+			_, index := s.TableColumn(lookup.Column)
+			if index < 0 {
+				return errors.Errorf("lookup column %s must be table column", lookup.Column)
+			}
+			lookup.ColumnIndex = index
+		}
+	}
+	return nil
+}
+
+func (s *Rule) initValueMaps() error {
+	s.ValueMapColumns = make(map[string]*ValueMap, len(s.ValueMaps))
+	for _, vm := range s.ValueMaps {
+		if _, index := s.TableColumn(vm.Column); index < 0 {
+			return errors.Errorf("value_maps column %s must be table column", vm.Column)
+		}
+		if _, ok := s.ValueMapColumns[vm.Column]; ok {
+			return errors.Errorf("duplicate value_maps column %s", vm.Column)
+		}
+		switch vm.Unmapped {
+		case "":
+			vm.Unmapped = ValueMapPassthrough
+		case ValueMapPassthrough, ValueMapNull:
+		case ValueMapFallback:
+			if vm.Fallback == nil {
+				return errors.Errorf("value_maps column %s fallback must not be empty", vm.Column)
+			}
+		default:
+			return errors.Errorf("value_maps unmapped must be passthrough、null or fallback")
+		}
+		for k, v := range vm.Values {
+			switch v.(type) {
+			case map[interface{}]interface{}, []interface{}:
+				return errors.Errorf("value_maps column %s value of %s must be scalar", vm.Column, k)
+			}
+		}
+		s.ValueMapColumns[vm.Column] = vm
+	}
+	return nil
+}
+
+// ValueMapOf 列的映射表，没有配置时为nil
+func (s *Rule) ValueMapOf(column string) *ValueMap {
+	return s.ValueMapColumns[column]
+}
+
+// RouteOf 计算行数据的附加接收端，返回空表示发送到target
+func (s *Rule) RouteOf(row []interface{}) string {
+	for _, route := range s.Routes {
+		if route.ColumnIndex >= len(row) || row[route.ColumnIndex] == nil {
+			continue
+		}
+		if route.ValueSet[stringutil.ToString(row[route.ColumnIndex])] {
+			return route.Endpoint
+		}
+	}
+	return ""
+}
+
 func (s *Rule) buildPaddingMap() error {
 	paddingMap := make(map[string]*model.Padding)
 	mappings := make(map[string]string)
@@ -376,6 +1186,29 @@ func (s *Rule) buildPaddingMap() error {
 		}
 	}
 
+	// 列注释中的@rename，配置的映射优先
+	for column, directive := range s.ColumnDirectives {
+		if _, exist := mappings[strings.ToUpper(column)]; !exist && directive.Rename != "" {
+			mappings[strings.ToUpper(column)] = directive.Rename
+		}
+	}
+
+	if s.GeneratedColumns == "" {
+		s.GeneratedColumns = GeneratedColumnsAuto
+	}
+	if s.GeneratedColumns != GeneratedColumnsAuto &&
+		s.GeneratedColumns != GeneratedColumnsInclude &&
+		s.GeneratedColumns != GeneratedColumnsExclude {
+		return errors.Errorf("generated_columns must be auto or include or exclude")
+	}
+
+	s.VirtualColumnIndexes = s.VirtualColumnIndexes[:0]
+	for index, column := range s.TableInfo.Columns {
+		if column.IsVirtual {
+			s.VirtualColumnIndexes = append(s.VirtualColumnIndexes, index)
+		}
+	}
+
 	var includes []string
 	var excludes []string
 
@@ -396,12 +1229,15 @@ func (s *Rule) buildPaddingMap() error {
 		}
 	} else {
 		for _, column := range s.TableInfo.Columns {
-			include := true
+			include := s.includeGenerated(column)
 			for _, exclude := range excludes {
 				if column.Name == exclude {
 					include = false
 				}
 			}
+			if directive, ok := s.ColumnDirectives[column.Name]; ok && directive.Ignore {
+				include = false
+			}
 			if include {
 				paddingMap[column.Name] = s.newPadding(mappings, column.Name)
 			}
@@ -410,9 +1246,202 @@ func (s *Rule) buildPaddingMap() error {
 
 	s.PaddingMap = paddingMap
 
+	if err := s.buildIntStringColumns(); err != nil {
+		return err
+	}
+	if err := s.buildDecimalScaleColumns(); err != nil {
+		return err
+	}
+	if err := s.buildMaxLengths(); err != nil {
+		return err
+	}
+	return s.buildOrderedFields()
+}
+
+// buildIntStringColumns 解析int_as_string中的列名称
+func (s *Rule) buildIntStringColumns() error {
+	s.IntStringColumns = nil
+	if s.IntAsString == "" || s.IntAsString == IntAsStringUnsafe {
+		return nil
+	}
+
+	s.IntStringColumns = make(map[string]bool)
+	for _, c := range strings.Split(s.IntAsString, ",") {
+		column, index := s.TableColumn(c)
+		if index < 0 {
+			return errors.Errorf("int_as_string must be unsafe or table columns")
+		}
+		s.IntStringColumns[column.Name] = true
+	}
+	return nil
+}
+
+// buildMaxLengths 解析max_value_length中的长度
+func (s *Rule) buildMaxLengths() error {
+	s.MaxLength = 0
+	s.MaxLengthColumns = nil
+	if s.MaxValueLength == "" {
+		return nil
+	}
+
+	switch s.OversizePolicy {
+	case "":
+		s.OversizePolicy = OversizeTruncate
+	case OversizeTruncate, OversizeHash:
+	default:
+		return errors.Errorf("oversize_policy must be truncate or hash")
+	}
+	if s.OversizeField == "" {
+		s.OversizeField = _oversizeField
+	}
+
+	s.MaxLengthColumns = make(map[string]int)
+	for _, item := range strings.Split(s.MaxValueLength, ",") {
+		kv := strings.Split(strings.TrimSpace(item), "=")
+		length, err := strconv.Atoi(strings.TrimSpace(kv[len(kv)-1]))
+		if err != nil || length <= 0 || len(kv) > 2 {
+			return errors.Errorf("max_value_length format error: %s", item)
+		}
+		if len(kv) == 1 {
+			s.MaxLength = length
+			continue
+		}
+		column, index := s.TableColumn(strings.TrimSpace(kv[0]))
+		if index < 0 {
+			return errors.Errorf("max_value_length column %s not exist", strings.TrimSpace(kv[0]))
+		}
+		s.MaxLengthColumns[column.Name] = length
+	}
+	return nil
+}
+
+// MaxLengthOf 列值的最大长度，0为不限制
+func (s *Rule) MaxLengthOf(column string) int {
+	if length, ok := s.MaxLengthColumns[column]; ok {
+		return length
+	}
+	return s.MaxLength
+}
+
+// buildDecimalScaleColumns 解析decimal_scaled中的列名称，小数位数取自列定义，如decimal(10,2)为2
+func (s *Rule) buildDecimalScaleColumns() error {
+	s.DecimalScaleColumns = nil
+	if s.DecimalScaled == "" {
+		return nil
+	}
+
+	s.DecimalScaleColumns = make(map[string]int)
+	for _, c := range strings.Split(s.DecimalScaled, ",") {
+		column, index := s.TableColumn(c)
+		if index < 0 {
+			return errors.Errorf("decimal_scaled column %s not exist", strings.TrimSpace(c))
+		}
+		if column.Type != schema.TYPE_DECIMAL {
+			return errors.Errorf("decimal_scaled column %s is not decimal", column.Name)
+		}
+		s.DecimalScaleColumns[column.Name] = DecimalScale(column.RawType)
+	}
 	return nil
 }
 
+// DecimalScale 从列类型定义中解析小数位数，如decimal(10,2)为2，未声明时为0
+func DecimalScale(rawType string) int {
+	start := strings.Index(rawType, "(")
+	end := strings.Index(rawType, ")")
+	if start < 0 || end < start {
+		return 0
+	}
+	parts := strings.Split(rawType[start+1:end], ",")
+	if len(parts) < 2 {
+		return 0
+	}
+	scale, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if err != nil {
+		return 0
+	}
+	return scale
+}
+
+// buildOrderedFields 按field_order计算输出字段(映射后的名称)的顺序
+func (s *Rule) buildOrderedFields() error {
+	s.OrderedFields = nil
+	if s.FieldOrder == "" {
+		return nil
+	}
+
+	var columns []string
+	if s.FieldOrder != FieldOrderColumn {
+		for _, c := range strings.Split(s.FieldOrder, ",") {
+			column, index := s.TableColumn(c)
+			if index < 0 {
+				return errors.Errorf("field_order must be column or table columns")
+			}
+			columns = append(columns, column.Name)
+		}
+	}
+	for _, column := range s.TableInfo.Columns {
+		columns = append(columns, column.Name)
+	}
+
+	wrapNames := make(map[string]string, len(s.PaddingMap))
+	for _, padding := range s.PaddingMap {
+		wrapNames[padding.ColumnName] = padding.WrapName
+	}
+	for _, c := range columns {
+		if name, ok := wrapNames[c]; ok {
+			s.OrderedFields = append(s.OrderedFields, name)
+			delete(wrapNames, c)
+		}
+	}
+	return nil
+}
+
+// includeGenerated 按generated_columns判断列是否输出，普通列总是输出
+// auto：VIRTUAL生成列的值不一定出现在binlog中，未显式包含时不输出，STORED生成列与普通列一致
+// include：都输出，binlog中缺失的VIRTUAL列值为null
+// exclude：都不输出
+func (s *Rule) includeGenerated(column schema.TableColumn) bool {
+	stored := false
+	for _, name := range s.StoredColumns {
+		if strings.EqualFold(name, column.Name) {
+			stored = true
+		}
+	}
+
+	switch s.GeneratedColumns {
+	case GeneratedColumnsInclude:
+		return true
+	case GeneratedColumnsExclude:
+		return !column.IsVirtual && !stored
+	default:
+		return !column.IsVirtual
+	}
+}
+
+// AlignRow 将binlog行镜像与TableInfo的列对齐
+// 行镜像中缺少VIRTUAL生成列时，在对应位置补nil，避免其后的列错位
+func (s *Rule) AlignRow(row []interface{}) []interface{} {
+	if len(row) == s.TableColumnSize || len(s.VirtualColumnIndexes) == 0 {
+		return row
+	}
+	if len(row) != s.TableColumnSize-len(s.VirtualColumnIndexes) {
+		return row
+	}
+
+	aligned := make([]interface{}, 0, s.TableColumnSize)
+	var virtual, offset int
+	for index := 0; index < s.TableColumnSize; index++ {
+		if virtual < len(s.VirtualColumnIndexes) && s.VirtualColumnIndexes[virtual] == index {
+			aligned = append(aligned, nil)
+			virtual++
+			continue
+		}
+		aligned = append(aligned, row[offset])
+		offset++
+	}
+	return aligned
+}
+
 func (s *Rule) newPadding(mappings map[string]string, columnName string) *model.Padding {
 	column, index := s.TableColumn(columnName)
 
@@ -455,6 +1484,14 @@ func (s *Rule) TableColumn(field string) (*schema.TableColumn, int) {
 }
 
 func (s *Rule) WrapName(fieldName string) string {
+	switch s.ColumnNaming {
+	case ColumnNamingLowerCamel:
+		return stringutil.Case2Camel(stringutil.Camel2Case(fieldName))
+	case ColumnNamingUpperCamel:
+		return stringutil.Ucfirst(stringutil.Case2Camel(stringutil.Camel2Case(fieldName)))
+	case ColumnNamingSnake:
+		return stringutil.Camel2Case(fieldName)
+	}
 	if s.ColumnUnderscoreToCamel {
 		return stringutil.Case2Camel(strings.ToLower(fieldName))
 	}
@@ -476,6 +1513,19 @@ func (s *Rule) LuaEnable() bool {
 }
 
 func (s *Rule) initRedisConfig() error {
+	// list、set等结构以值作为成员，值中不能包含每次变化的位置
+	if s.IncludePosition {
+		return errors.Errorf("include_position not supported by redis")
+	}
+
+	switch s.RedisExpireMode {
+	case "":
+		s.RedisExpireMode = RedisExpireSliding
+	case RedisExpireSliding, RedisExpireFixed:
+	default:
+		return errors.Errorf("redis_expire_mode must be sliding or fixed")
+	}
+
 	if s.LuaEnable() {
 		return nil
 	}
@@ -485,16 +1535,23 @@ func (s *Rule) initRedisConfig() error {
 	}
 
 	switch strings.ToUpper(s.RedisStructure) {
-	case "STRING":
-		s.RedisStructure = RedisStructureString
+	case "STRING", "JSON":
+		if strings.ToUpper(s.RedisStructure) == "JSON" {
+			if s.ValueTmpl != nil || s.ValueEncoder != ValEncoderJson {
+				return errors.New("redis_structure json requires value_encoder json")
+			}
+			s.RedisStructure = RedisStructureJson
+		} else {
+			s.RedisStructure = RedisStructureString
+		}
 		if s.RedisKeyColumn == "" && s.RedisKeyFormatter == "" {
-			if s.IsCompositeKey {
-				for _, v := range s.TableInfo.PKColumns {
+			if s.IsCompositeIdentity() {
+				for _, v := range s.KeyColumnIndexes {
 					s.RedisKeyColumnIndexs = append(s.RedisKeyColumnIndexs, v)
 				}
 				s.RedisKeyColumnIndex = -1
 			} else {
-				s.RedisKeyColumnIndex = s.TableInfo.PKColumns[0]
+				s.RedisKeyColumnIndex = s.KeyColumnIndexes[0]
 			}
 		}
 	case "HASH":
@@ -504,13 +1561,13 @@ func (s *Rule) initRedisConfig() error {
 		}
 		// init hash field
 		if s.RedisHashFieldColumn == "" {
-			if s.IsCompositeKey {
-				for _, v := range s.TableInfo.PKColumns {
+			if s.IsCompositeIdentity() {
+				for _, v := range s.KeyColumnIndexes {
 					s.RedisHashFieldColumnIndexs = append(s.RedisHashFieldColumnIndexs, v)
 				}
 				s.RedisHashFieldColumnIndex = -1
 			} else {
-				s.RedisHashFieldColumnIndex = s.TableInfo.PKColumns[0]
+				s.RedisHashFieldColumnIndex = s.KeyColumnIndexes[0]
 			}
 		} else {
 			_, index := s.TableColumn(s.RedisHashFieldColumn)
@@ -543,7 +1600,7 @@ func (s *Rule) initRedisConfig() error {
 		}
 		s.RedisHashFieldColumnIndex = index
 	default:
-		return errors.Errorf("redis_structure must be string or hash or list or set")
+		return errors.Errorf("redis_structure must be string or hash or list or set or sortedset or json")
 	}
 
 	if s.RedisKeyColumn != "" {
@@ -591,6 +1648,71 @@ func (s *Rule) initMongoConfig() error {
 	return nil
 }
 
+func (s *Rule) initPostgresqlConfig() error {
+	if !_config.IsPostgresql() {
+		if s.ConflictPolicy != "" {
+			return errors.Errorf("conflict_policy only supported by postgresql")
+		}
+		if len(s.PostgresqlColumnTypes) > 0 {
+			return errors.Errorf("postgresql_column_types only supported by postgresql")
+		}
+		return nil
+	}
+	if s.LuaEnable() {
+		return errors.Errorf("lua not supported by postgresql")
+	}
+
+	if s.PostgresqlSchema == "" {
+		s.PostgresqlSchema = "public"
+	}
+	if s.PostgresqlTable == "" {
+		s.PostgresqlTable = s.Table
+	}
+	switch s.ConflictPolicy {
+	case "":
+		s.ConflictPolicy = ConflictUpsert
+	case ConflictUpsert, ConflictIgnore, ConflictError:
+	default:
+		return errors.Errorf("conflict_policy must be upsert、ignore or error")
+	}
+
+	// 标识列须输出，用于ON CONFLICT及update、delete的条件
+	s.PostgresqlKeys = s.PostgresqlKeys[:0]
+	for _, index := range s.KeyColumnIndexes {
+		var name string
+		for _, padding := range s.PaddingMap {
+			if padding.ColumnIndex == index {
+				name = padding.WrapName
+			}
+		}
+		if name == "" {
+			return errors.Errorf("identity column %s excluded, not allowed for postgresql", s.TableInfo.Columns[index].Name)
+		}
+		s.PostgresqlKeys = append(s.PostgresqlKeys, name)
+	}
+	if len(s.PostgresqlKeys) == 0 {
+		return errors.Errorf("%s.%s has no primary key, set identity_columns for postgresql", s.Schema, s.Table)
+	}
+
+	s.PostgresqlCasts = make(map[string]string, len(s.PostgresqlColumnTypes))
+	for column, typ := range s.PostgresqlColumnTypes {
+		if !_pgTypeExpr.MatchString(typ) {
+			return errors.Errorf("postgresql_column_types: invalid type %s of column %s", typ, column)
+		}
+		var name string
+		for _, padding := range s.PaddingMap {
+			if strings.EqualFold(padding.ColumnName, column) {
+				name = padding.WrapName
+			}
+		}
+		if name == "" {
+			return errors.Errorf("postgresql_column_types: column %s not found or excluded", column)
+		}
+		s.PostgresqlCasts[name] = strings.ToLower(typ)
+	}
+	return nil
+}
+
 func (s *Rule) initRabbitmqConfig() error {
 	if !s.LuaEnable() {
 		if s.RabbitmqQueue == "" {
@@ -634,24 +1756,52 @@ func (s *Rule) initKafkaConfig() error {
 		}
 	}
 
+	if s.KafkaTopicFormatter != "" {
+		if s.LuaEnable() {
+			return errors.Errorf("kafka_topic_formatter not supported with lua, set topic in lua script")
+		}
+		tmpl, err := template.New(s.TableInfo.Name).Option("missingkey=zero").Parse(s.KafkaTopicFormatter)
+		if err != nil {
+			return err
+		}
+		s.KafkaTopicTmpl = tmpl
+	}
+
 	return nil
 }
 
+// TopicOf 按kafka_topic_formatter计算行数据的topic，未配置或计算结果为空时为kafka_topic
+func (s *Rule) TopicOf(row []interface{}) string {
+	if s.KafkaTopicTmpl == nil {
+		return s.KafkaTopic
+	}
+
+	kv := make(map[string]interface{}, len(s.TableInfo.Columns))
+	for i, c := range s.TableInfo.Columns {
+		if i < len(row) {
+			kv[c.Name] = stringutil.ToString(row[i])
+		}
+	}
+	var buf bytes.Buffer
+	if err := s.KafkaTopicTmpl.Execute(&buf, kv); err != nil {
+		logs.Errorf("%s kafka_topic_formatter error: %s", s.Table, err.Error())
+		return s.KafkaTopic
+	}
+	if buf.Len() == 0 {
+		return s.KafkaTopic
+	}
+	return buf.String()
+}
+
 // 编译Lua
 func (s *Rule) CompileLuaScript(dataDir string) error {
 	script := s.LuaScript
 	if s.LuaFilePath != "" {
-		var filePath string
-		if files.IsExist(s.LuaFilePath) {
-			filePath = s.LuaFilePath
-		} else {
-			filePath = filepath.Join(dataDir, s.LuaFilePath)
-		}
-		data, err := ioutil.ReadFile(filePath)
+		data, err := readLuaFile(s.LuaFilePath, dataDir)
 		if err != nil {
 			return err
 		}
-		script = string(data)
+		script = data
 	}
 
 	if script == "" {
@@ -696,19 +1846,50 @@ func (s *Rule) CompileLuaScript(dataDir string) error {
 		}
 	}
 
-	reader := strings.NewReader(script)
-	chunk, err := parse.Parse(reader, script)
-	if err != nil {
-		return err
+	// 脚本名称用于错误信息中的位置，如lua/t_user.lua:12:
+	name := s.LuaFilePath
+	if name == "" {
+		name = "lua_script"
 	}
-
-	var proto *lua.FunctionProto
-	proto, err = lua.Compile(chunk, script)
+	proto, err := compileLua(script, name)
 	if err != nil {
 		return err
 	}
-
 	s.LuaProto = proto
 
+	s.LuaStageProtos = make([]*lua.FunctionProto, 0, len(s.LuaStages))
+	for _, stage := range s.LuaStages {
+		data, err := readLuaFile(stage, dataDir)
+		if err != nil {
+			return err
+		}
+		proto, err := compileLua(data, stage)
+		if err != nil {
+			return errors.Annotatef(err, "lua stage %s", stage)
+		}
+		s.LuaStageProtos = append(s.LuaStageProtos, proto)
+	}
+
 	return nil
 }
+
+// readLuaFile 读取lua脚本文件，相对路径时先按当前目录、再按数据目录查找
+func readLuaFile(path, dataDir string) (string, error) {
+	filePath := path
+	if !files.IsExist(path) {
+		filePath = filepath.Join(dataDir, path)
+	}
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func compileLua(script, name string) (*lua.FunctionProto, error) {
+	chunk, err := parse.Parse(strings.NewReader(script), name)
+	if err != nil {
+		return nil, err
+	}
+	return lua.Compile(chunk, name)
+}
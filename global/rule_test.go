@@ -0,0 +1,330 @@
+package global
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/siddontang/go-mysql/schema"
+
+	"go-mysql-transfer/util/dates"
+)
+
+func generatedColumnRule() *Rule {
+	ta := &schema.Table{Schema: "test", Name: "t_generated"}
+	ta.AddColumn("id", "bigint(20)", "", "")
+	ta.AddColumn("price", "int(11)", "", "")
+	ta.AddColumn("price_v", "int(11)", "", "VIRTUAL GENERATED")
+	ta.AddColumn("price_s", "int(11)", "", "STORED GENERATED")
+	ta.AddColumn("name", "varchar(32)", "utf8_general_ci", "")
+	ta.PKColumns = []int{0}
+
+	return &Rule{
+		Schema:          "test",
+		Table:           "t_generated",
+		TableInfo:       ta,
+		TableColumnSize: len(ta.Columns),
+	}
+}
+
+func TestAlignRowWithGeneratedColumns(t *testing.T) {
+	rule := generatedColumnRule()
+	if err := rule.buildPaddingMap(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 行镜像不包含VIRTUAL列
+	aligned := rule.AlignRow([]interface{}{int64(1), int32(10), int32(20), "a"})
+	expect := []interface{}{int64(1), int32(10), nil, int32(20), "a"}
+	if !reflect.DeepEqual(aligned, expect) {
+		t.Errorf("expect %v, but %v", expect, aligned)
+	}
+
+	// 行镜像包含VIRTUAL列
+	full := []interface{}{int64(1), int32(10), int32(20), int32(20), "a"}
+	if aligned := rule.AlignRow(full); !reflect.DeepEqual(aligned, full) {
+		t.Errorf("expect %v, but %v", full, aligned)
+	}
+
+	if _, ok := rule.PaddingMap["price_v"]; ok {
+		t.Errorf("virtual column should not be padded")
+	}
+	padding, ok := rule.PaddingMap["price_s"]
+	if !ok || padding.ColumnIndex != 3 {
+		t.Errorf("stored column should be padded at index 3")
+	}
+	if padding := rule.PaddingMap["name"]; padding.ColumnIndex != 4 {
+		t.Errorf("expect name at index 4, but %d", padding.ColumnIndex)
+	}
+}
+
+func TestGeneratedColumnsOption(t *testing.T) {
+	rule := generatedColumnRule()
+	rule.GeneratedColumns = GeneratedColumnsInclude
+	if err := rule.buildPaddingMap(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := rule.PaddingMap["price_v"]; !ok {
+		t.Errorf("virtual column should be padded when include")
+	}
+	aligned := rule.AlignRow([]interface{}{int64(1), int32(10), int32(20), "a"})
+	if aligned[rule.PaddingMap["price_v"].ColumnIndex] != nil {
+		t.Errorf("virtual column missing from row image should be nil")
+	}
+
+	rule = generatedColumnRule()
+	rule.GeneratedColumns = GeneratedColumnsExclude
+	rule.StoredColumns = []string{"price_s"}
+	if err := rule.buildPaddingMap(); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"price_v", "price_s"} {
+		if _, ok := rule.PaddingMap[name]; ok {
+			t.Errorf("generated column %s should not be padded when exclude", name)
+		}
+	}
+	if len(rule.PaddingMap) != 3 {
+		t.Errorf("expect 3 columns, but %d", len(rule.PaddingMap))
+	}
+
+	rule = generatedColumnRule()
+	rule.GeneratedColumns = "unknown"
+	if err := rule.buildPaddingMap(); err == nil {
+		t.Errorf("expect error for unknown generated_columns")
+	}
+}
+
+func TestFieldOrder(t *testing.T) {
+	rule := generatedColumnRule()
+	rule.FieldOrder = FieldOrderColumn
+	rule.ColumnUpperCase = true
+	if err := rule.buildPaddingMap(); err != nil {
+		t.Fatal(err)
+	}
+	expect := []string{"ID", "PRICE", "PRICE_S", "NAME"}
+	if !reflect.DeepEqual(rule.OrderedFields, expect) {
+		t.Errorf("expect %v, but %v", expect, rule.OrderedFields)
+	}
+
+	rule = generatedColumnRule()
+	rule.FieldOrder = "name,id"
+	if err := rule.buildPaddingMap(); err != nil {
+		t.Fatal(err)
+	}
+	expect = []string{"name", "id", "price", "price_s"}
+	if !reflect.DeepEqual(rule.OrderedFields, expect) {
+		t.Errorf("expect %v, but %v", expect, rule.OrderedFields)
+	}
+
+	rule = generatedColumnRule()
+	rule.FieldOrder = "name,unknown"
+	if err := rule.buildPaddingMap(); err == nil {
+		t.Errorf("expect error for unknown column in field_order")
+	}
+}
+
+func TestIntAsStringColumns(t *testing.T) {
+	rule := generatedColumnRule()
+	rule.IntAsString = "ID,price"
+	if err := rule.buildPaddingMap(); err != nil {
+		t.Fatal(err)
+	}
+	if !rule.IntStringColumns["id"] || !rule.IntStringColumns["price"] || len(rule.IntStringColumns) != 2 {
+		t.Errorf("unexpected int_as_string columns %v", rule.IntStringColumns)
+	}
+
+	rule = generatedColumnRule()
+	rule.IntAsString = "unknown"
+	if err := rule.buildPaddingMap(); err == nil {
+		t.Errorf("expect error for unknown column in int_as_string")
+	}
+}
+
+func TestRouteOf(t *testing.T) {
+	_config = &Config{
+		Endpoints: []*EndpointConfig{{Name: "eu", Addrs: "127.0.0.1:9092"}},
+	}
+	defer func() { _config = nil }()
+
+	rule := generatedColumnRule()
+	rule.Routes = []*Route{{Column: "name", Values: "DE,FR", Endpoint: "eu"}}
+	if err := rule.initRoutes(); err != nil {
+		t.Fatal(err)
+	}
+	if route := rule.RouteOf([]interface{}{int64(1), int32(10), nil, int32(20), "FR"}); route != "eu" {
+		t.Errorf("expect eu, but %s", route)
+	}
+	if route := rule.RouteOf([]interface{}{int64(1), int32(10), nil, int32(20), "US"}); route != "" {
+		t.Errorf("expect default endpoint, but %s", route)
+	}
+
+	rule.Routes = []*Route{{Column: "name", Values: "DE", Endpoint: "us"}}
+	if err := rule.initRoutes(); err == nil {
+		t.Errorf("expect error for undefined endpoint")
+	}
+}
+
+func TestIdentityChanged(t *testing.T) {
+	rule := &Rule{IdentityChangePolicy: IdentityChangeDeleteInsert, KeyColumnIndexes: []int{0}}
+	if !rule.IdentityChanged([]interface{}{int64(1), "a"}, []interface{}{int64(2), "a"}) {
+		t.Errorf("expect changed for single primary key")
+	}
+	if rule.IdentityChanged([]interface{}{int64(1), "a"}, []interface{}{int64(1), "b"}) {
+		t.Errorf("expect unchanged when only other columns change")
+	}
+
+	// 联合主键任意一列变化都视为标识变化
+	rule.KeyColumnIndexes = []int{0, 1}
+	if !rule.IdentityChanged([]interface{}{int64(1), "a", 10}, []interface{}{int64(1), "b", 10}) {
+		t.Errorf("expect changed for composite primary key")
+	}
+	if rule.IdentityChanged([]interface{}{int64(1), "a", 10}, []interface{}{int64(1), "a", 20}) {
+		t.Errorf("expect unchanged for composite primary key")
+	}
+
+	rule.IdentityChangePolicy = IdentityChangeUpdate
+	if rule.IdentityChanged([]interface{}{int64(1), "a", 10}, []interface{}{int64(2), "a", 10}) {
+		t.Errorf("expect update policy ignores identity change")
+	}
+}
+
+func TestIsEmptyKey(t *testing.T) {
+	rule := &Rule{KeyColumnIndexes: []int{0}, SurrogateIndex: -1}
+	for _, v := range []interface{}{nil, int64(0), uint32(0), "", []byte{}} {
+		if !rule.IsEmptyKey([]interface{}{v, "a"}) {
+			t.Errorf("expect empty key for %#v", v)
+		}
+	}
+	if rule.IsEmptyKey([]interface{}{int64(7), "a"}) || rule.IsEmptyKey([]interface{}{"x", "a"}) {
+		t.Errorf("expect non-empty key")
+	}
+
+	// 联合标识的各列均为空时才视为空
+	rule.KeyColumnIndexes = []int{0, 1}
+	if rule.IsEmptyKey([]interface{}{int64(0), "a"}) || !rule.IsEmptyKey([]interface{}{int64(0), ""}) {
+		t.Errorf("unexpected composite empty key")
+	}
+
+	if rule.UseSurrogate([]interface{}{int64(0), ""}) {
+		t.Errorf("expect no surrogate without empty_key_surrogate")
+	}
+	rule.SurrogateIndex = 1
+	if !rule.UseSurrogate([]interface{}{int64(0), ""}) || rule.UseSurrogate([]interface{}{int64(1), "a"}) {
+		t.Errorf("unexpected surrogate")
+	}
+}
+
+func TestTopicOf(t *testing.T) {
+	ta := &schema.Table{Schema: "test", Name: "t_order"}
+	ta.AddColumn("id", "bigint(20)", "", "")
+	ta.AddColumn("tenant_id", "varchar(16)", "", "")
+	rule := &Rule{TableInfo: ta, KafkaTopic: "orders"}
+	if got := rule.TopicOf([]interface{}{int64(1), "acme"}); got != "orders" {
+		t.Errorf("expect kafka_topic without formatter, got %s", got)
+	}
+
+	rule.KafkaTopicFormatter = "orders-{{.tenant_id}}"
+	if err := rule.initKafkaConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if got := rule.TopicOf([]interface{}{int64(1), []byte("acme")}); got != "orders-acme" {
+		t.Errorf("expect orders-acme, got %s", got)
+	}
+
+	rule.KafkaTopicFormatter = "{{.tenant_id}}"
+	rule.initKafkaConfig()
+	if got := rule.TopicOf([]interface{}{int64(1), nil}); got != "orders" {
+		t.Errorf("expect kafka_topic for empty result, got %s", got)
+	}
+}
+
+func TestPartitionName(t *testing.T) {
+	rule := &Rule{PartitionIndex: 1, PartitionLayout: dates.ConvertGoFormat("yyyy-MM")}
+	if v := rule.PartitionName("events", []interface{}{int64(1), "2024-01-15 10:20:30"}); v != "events-2024-01" {
+		t.Errorf("expect events-2024-01, but %s", v)
+	}
+	if v := rule.PartitionName("events", []interface{}{int64(1), []byte("2023-12-31 23:59:59.123456")}); v != "events-2023-12" {
+		t.Errorf("expect events-2023-12, but %s", v)
+	}
+	if v := rule.PartitionName("events", []interface{}{int64(1), nil}); v != "events" {
+		t.Errorf("expect base name for null value, but %s", v)
+	}
+	if v := rule.PartitionName("events", []interface{}{int64(1), "0000-00-00 00:00:00"}); v != "events" {
+		t.Errorf("expect base name for zero date, but %s", v)
+	}
+
+	rule.PartitionLayout = dates.ConvertGoFormat("yyyy.MM.dd")
+	if v := rule.PartitionName("events", []interface{}{int64(1), "2024-02-29"}); v != "events-2024.02.29" {
+		t.Errorf("expect events-2024.02.29, but %s", v)
+	}
+
+	rule.PartitionIndex = -1
+	if v := rule.PartitionName("events", []interface{}{int64(1), "2024-02-29"}); v != "events" {
+		t.Errorf("expect base name without partition, but %s", v)
+	}
+}
+
+func TestParseColumnDirective(t *testing.T) {
+	d := ParseColumnDirective("user_name", "用户名 @rename:userName @es_type:keyword")
+	if d == nil || d.Rename != "userName" || d.EsType != "keyword" || d.Ignore {
+		t.Errorf("unexpected directive %#v", d)
+	}
+	if d := ParseColumnDirective("password", "密码 @es_ignore"); d == nil || !d.Ignore {
+		t.Errorf("expect ignore, but %#v", d)
+	}
+	if d := ParseColumnDirective("remark", "备注，邮箱如a@b.com"); d != nil {
+		t.Errorf("expect nil without directives, but %#v", d)
+	}
+	// 不认识的指令忽略
+	if d := ParseColumnDirective("age", "@unknown:1 @IGNORE"); d == nil || !d.Ignore || d.Rename != "" {
+		t.Errorf("expect unknown directive ignored, but %#v", d)
+	}
+}
+
+func TestValueMap(t *testing.T) {
+	rule := generatedColumnRule()
+	rule.ValueMaps = []*ValueMap{
+		{Column: "price", Values: map[string]interface{}{"1": "active", "2": "disabled"}},
+		{Column: "name", Values: map[string]interface{}{"CN": "China"}, Unmapped: ValueMapFallback, Fallback: "other"},
+	}
+	if err := rule.initValueMaps(); err != nil {
+		t.Fatal(err)
+	}
+
+	price := rule.ValueMapOf("price")
+	if v := price.Apply(int32(1)); v != "active" {
+		t.Errorf("expect active, but %v", v)
+	}
+	if v := price.Apply(int32(3)); v != int32(3) {
+		t.Errorf("expect passthrough 3, but %v", v)
+	}
+	if v := price.Apply(nil); v != nil {
+		t.Errorf("expect nil, but %v", v)
+	}
+	price.Unmapped = ValueMapNull
+	if v := price.Apply(int32(3)); v != nil {
+		t.Errorf("expect nil, but %v", v)
+	}
+
+	name := rule.ValueMapOf("name")
+	if v := name.Apply("CN"); v != "China" {
+		t.Errorf("expect China, but %v", v)
+	}
+	if v := name.Apply("US"); v != "other" {
+		t.Errorf("expect other, but %v", v)
+	}
+	if v := name.Apply(nil); v != nil {
+		t.Errorf("expect nil, but %v", v)
+	}
+	if rule.ValueMapOf("id") != nil {
+		t.Errorf("expect no value map for id")
+	}
+
+	rule.ValueMaps = []*ValueMap{{Column: "missing"}}
+	if err := rule.initValueMaps(); err == nil {
+		t.Errorf("expect error for undefined column")
+	}
+	rule.ValueMaps = []*ValueMap{{Column: "price", Unmapped: "drop"}}
+	if err := rule.initValueMaps(); err == nil {
+		t.Errorf("expect error for invalid unmapped")
+	}
+}
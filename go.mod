@@ -9,15 +9,20 @@ require (
 	github.com/go-gomail/gomail v0.0.0-20160411212932-81ebce5c23df
 	github.com/go-redis/redis v6.15.8+incompatible
 	github.com/go-sql-driver/mysql v1.5.0
+	github.com/golang/snappy v0.0.1
 	github.com/jmoiron/sqlx v1.2.0 // indirect
 	github.com/json-iterator/go v1.1.9
 	github.com/juju/errors v0.0.0-20200330140219-3fe23663418f
 	github.com/juju/testing v0.0.0-20200706033705-4c23f9c453cd // indirect
+	github.com/klauspost/compress v1.10.10
 	github.com/layeh/gopher-json v0.0.0-20190114024228-97fed8db8427
+	github.com/lib/pq v1.10.9
 	github.com/olivere/elastic v6.2.34+incompatible
 	github.com/olivere/elastic/v7 v7.0.19
 	github.com/onsi/ginkgo v1.14.0 // indirect
+	github.com/pierrec/lz4 v2.5.2+incompatible
 	github.com/pingcap/errors v0.11.4
+	github.com/pingcap/parser v0.0.0-20191112053614-3b43b46331d5
 	github.com/pingcap/tidb v1.1.0-beta.0.20191115021711-b274eb2079dc
 	github.com/pkg/errors v0.9.1
 	github.com/pquerna/ffjson v0.0.0-20190930134022-aa0246cd15f7
@@ -43,6 +43,12 @@ var (
 	stockFlag    bool
 	positionFlag bool
 	statusFlag   bool
+	verifyFlag   bool
+	verifyMode   string
+	verifySample int64
+	replayFlag   bool
+	replayFrom   string
+	replayTo     string
 )
 
 func init() {
@@ -51,6 +57,12 @@ func init() {
 	flag.BoolVar(&stockFlag, "stock", false, "stock data import")
 	flag.BoolVar(&positionFlag, "position", false, "set dump position")
 	flag.BoolVar(&statusFlag, "status", false, "display application status")
+	flag.BoolVar(&verifyFlag, "verify", false, "verify destination data against the source, tables(schema.table) as args")
+	flag.StringVar(&verifyMode, "verify_mode", service.VerifyModeFull, "verify mode: count, full or sample")
+	flag.Int64Var(&verifySample, "verify_sample", 1000, "number of rows to sample when verify_mode is sample")
+	flag.BoolVar(&replayFlag, "replay", false, "replay binlog events between replay_from and replay_to to the destination")
+	flag.StringVar(&replayFrom, "replay_from", "", "replay start, binlog position(mysql-bin.000001:4) or GTID set, exclusive")
+	flag.StringVar(&replayTo, "replay_to", "", "replay end, binlog position(mysql-bin.000001:1024) or GTID set, inclusive")
 	flag.Usage = usage
 }
 
@@ -101,6 +113,16 @@ func main() {
 		return
 	}
 
+	if verifyFlag {
+		doVerify()
+		return
+	}
+
+	if replayFlag {
+		doReplay()
+		return
+	}
+
 	// 初始化Storage
 	err = storage.Initialize()
 	if err != nil {
@@ -118,13 +140,13 @@ func main() {
 		return
 	}
 
-	err = service.Initialize()
-	if err != nil {
+	if err := metrics.Initialize(); err != nil {
 		println(errors.ErrorStack(err))
 		return
 	}
 
-	if err := metrics.Initialize(); err != nil {
+	err = service.Initialize()
+	if err != nil {
 		println(errors.ErrorStack(err))
 		return
 	}
@@ -153,10 +175,38 @@ func doStock() {
 	stock.Close()
 }
 
+func doVerify() {
+	verify := service.NewVerifyService()
+	reports, err := verify.Run(verifyMode, verifySample, flag.Args())
+	for _, report := range reports {
+		report.Print()
+	}
+	if err != nil {
+		println(errors.ErrorStack(err))
+	}
+	verify.Close()
+}
+
+func doReplay() {
+	replay := service.NewReplayService()
+	result, err := replay.Run(replayFrom, replayTo)
+	if result != nil {
+		fmt.Printf("replayed %d transactions, %d rows, last position: %s %d \n",
+			result.Transactions, result.Rows, result.End.Name, result.End.Pos)
+	}
+	if err != nil {
+		println(errors.ErrorStack(err))
+	}
+	replay.Close()
+}
+
 func doStatus() {
 	ps := storage.NewPositionStorage()
 	pos, _ := ps.Get()
 	fmt.Printf("The current dump position is : %s %d \n", pos.Name, pos.Pos)
+	if gtid, _ := ps.GetGTID(); gtid != "" {
+		fmt.Printf("The current gtid set is : %s \n", gtid)
+	}
 }
 
 func doPosition() {
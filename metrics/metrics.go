@@ -20,6 +20,8 @@ package metrics
 import (
 	"fmt"
 	"net/http"
+	"sync"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
@@ -36,83 +38,468 @@ const (
 
 	LeaderState   = 1
 	FollowerState = 0
+
+	// transfer_skipped_rows的reason
+	SkipOrigin    = "origin"    // skip_server_ids、marker_table按来源忽略
+	SkipUnmapped  = "unmapped"  // 没有对应的规则
+	SkipNewTable  = "new_table" // 通配符规则匹配但尚未注册的表
+	SkipDuplicate = "duplicate" // dedupe_window内重复投递的事件
+	SkipEmptyKey  = "empty_key" // empty_key_policy为skip时标识为空
+	SkipLua       = "lua"       // lua_stages返回false或nil丢弃
+	SkipLuaError  = "lua_error" // lua_error_policy为skip、dead_letter时Lua执行失败
+
+	// transfer_endpoint_recycles的reason
+	RecycleLifetime = "lifetime" // 连接建立超过conn_max_lifetime
+	RecycleDns      = "dns"      // 接收端地址的解析结果变化
 )
 
 var (
-	leaderState  atomic.Bool
-	destState    atomic.Bool
-	delay        atomic.Uint32
-	insertRecord map[string]*atomic.Uint64
-	updateRecord map[string]*atomic.Uint64
-	deleteRecord map[string]*atomic.Uint64
+	leaderState     atomic.Bool
+	destState       atomic.Bool
+	delay           atomic.Uint32
+	sourceActive    atomic.Int64
+	sourceBeat      atomic.Int64
+	listenerActive  atomic.Int64
+	stalled         atomic.Bool
+	connected       atomic.Int64
+	caughtUp        atomic.Bool
+	failure         atomic.String
+	rawBytes        atomic.Uint64
+	compressedBytes atomic.Uint64
+	positionFailure atomic.Uint64
+	throttled       atomic.Uint64
+	duplicates      atomic.Uint64
+	registered      atomic.Bool // 指标已注册，-stock、-verify、-replay等不启动exporter的运行方式下为false
+	spillBytes      atomic.Int64
+	spillLimit      atomic.Int64
+	bufferedBytes   atomic.Int64
+	replayWindow    atomic.Int64
+	lockOfRecord    sync.RWMutex
+	insertRecord    = make(map[string]*atomic.Uint64)
+	updateRecord    = make(map[string]*atomic.Uint64)
+	deleteRecord    = make(map[string]*atomic.Uint64)
 )
 
 var (
+	leaderStateGauge prometheus.Gauge
+	destStateGauge   prometheus.Gauge
+	delayGauge       prometheus.Gauge
+	sourceGauge      prometheus.Gauge
+	heartbeatGauge   prometheus.Gauge
+	positionFailures prometheus.Counter
+	throttledCounter prometheus.Counter
+	duplicateCounter prometheus.Counter
+	emptyKeyCounter  *prometheus.CounterVec
+	skippedCounter   *prometheus.CounterVec
+	oversizeCounter  *prometheus.CounterVec
+	rejectedCounter  *prometheus.CounterVec
+	luaErrorCounter  *prometheus.CounterVec
+	recycleCounter   *prometheus.CounterVec
+	connOpened       *prometheus.CounterVec
+	connClosed       *prometheus.CounterVec
+	connErrors       *prometheus.CounterVec
+	connActive       *prometheus.GaugeVec
+	partitionCounter *prometheus.CounterVec
+	insertCounter    *prometheus.CounterVec
+	updateCounter    *prometheus.CounterVec
+	deleteCounter    *prometheus.CounterVec
+	payloadHistogram *prometheus.HistogramVec
+	spillGauge       prometheus.Gauge
+	spillLimitGauge  prometheus.Gauge
+	bufferedGauge    prometheus.Gauge
+	positionSaves    prometheus.Counter
+	saveInterval     prometheus.Gauge
+	replayGauge      prometheus.Gauge
+	luaHistogram     *prometheus.HistogramVec
+	stalledGauge     prometheus.Gauge
+	caughtUpGauge    prometheus.Gauge
+	failedGauge      prometheus.Gauge
+	uncompressed     prometheus.Counter
+	compressed       prometheus.Counter
+	compressionRatio prometheus.Gauge
+)
+
+// 指标在配置加载之后注册，以便应用metrics_prefix和metrics_labels
+func register() {
+	namespace := global.Cfg().MetricsPrefix
+	labels := prometheus.Labels{}
+	for k, v := range global.Cfg().MetricsLabels {
+		labels[k] = v
+	}
+	if global.Cfg().SourceId != "" {
+		labels["source_id"] = global.Cfg().SourceId
+	}
+
 	leaderStateGauge = promauto.NewGauge(
 		prometheus.GaugeOpts{
-			Name: "transfer_leader_state",
-			Help: "The cluster leader state: 0=false, 1=true",
+			Namespace:   namespace,
+			Name:        "transfer_leader_state",
+			Help:        "The cluster leader state: 0=false, 1=true",
+			ConstLabels: labels,
 		},
 	)
 
 	destStateGauge = promauto.NewGauge(
 		prometheus.GaugeOpts{
-			Name: "transfer_destination_state",
-			Help: "The destination running state: 0=stopped, 1=ok",
+			Namespace:   namespace,
+			Name:        "transfer_destination_state",
+			Help:        "The destination running state: 0=stopped, 1=ok",
+			ConstLabels: labels,
 		},
 	)
 
 	delayGauge = promauto.NewGauge(
 		prometheus.GaugeOpts{
-			Name: "transfer_delay",
-			Help: "The transfer slave lag",
+			Namespace:   namespace,
+			Name:        "transfer_delay",
+			Help:        "The transfer slave lag",
+			ConstLabels: labels,
+		},
+	)
+
+	sourceGauge = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "transfer_source_last_event_time",
+			Help:        "The unix time of the last event received from the source",
+			ConstLabels: labels,
+		},
+	)
+
+	heartbeatGauge = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "transfer_source_last_heartbeat_time",
+			Help:        "The unix time of the last replication heartbeat received from the source",
+			ConstLabels: labels,
+		},
+	)
+
+	positionFailures = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Namespace:   namespace,
+			Name:        "transfer_position_store_failures",
+			Help:        "The number of position storage operations failed after retries",
+			ConstLabels: labels,
+		},
+	)
+
+	throttledCounter = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Namespace:   namespace,
+			Name:        "transfer_throttled",
+			Help:        "The number of writes rejected by destination throttling and retried after backoff",
+			ConstLabels: labels,
+		},
+	)
+
+	duplicateCounter = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Namespace:   namespace,
+			Name:        "transfer_duplicates_suppressed",
+			Help:        "The number of re-delivered row events skipped by the dedupe window",
+			ConstLabels: labels,
+		},
+	)
+
+	emptyKeyCounter = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace:   namespace,
+			Name:        "transfer_empty_keys",
+			Help:        "The number of rows whose identity columns are empty or zero",
+			ConstLabels: labels,
+		}, []string{"table"},
+	)
+
+	skippedCounter = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace:   namespace,
+			Name:        "transfer_skipped_rows",
+			Help:        "The number of rows skipped before reaching the destination, by reason",
+			ConstLabels: labels,
+		}, []string{"table", "reason"},
+	)
+
+	oversizeCounter = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace:   namespace,
+			Name:        "transfer_oversize_values",
+			Help:        "The number of values truncated or hashed for exceeding max_value_length",
+			ConstLabels: labels,
+		}, []string{"table"},
+	)
+
+	rejectedCounter = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace:   namespace,
+			Name:        "transfer_rejected_items",
+			Help:        "The number of batch items rejected by destination and not retried",
+			ConstLabels: labels,
+		}, []string{"table"},
+	)
+
+	luaErrorCounter = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace:   namespace,
+			Name:        "transfer_lua_errors",
+			Help:        "The number of rows whose Lua script failed or returned an invalid result",
+			ConstLabels: labels,
+		}, []string{"table"},
+	)
+
+	partitionCounter = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace:   namespace,
+			Name:        "transfer_partition_ddl",
+			Help:        "The number of statements that truncated, dropped or exchanged partitions of a table without row events",
+			ConstLabels: labels,
+		}, []string{"table"},
+	)
+
+	promauto.NewCounterFunc(
+		prometheus.CounterOpts{
+			Namespace:   namespace,
+			Name:        "transfer_source_reconnects",
+			Help:        "The number of times the binlog replication connection was reestablished",
+			ConstLabels: labels,
+		},
+		func() float64 {
+			return float64(global.SourceReconnects())
+		},
+	)
+
+	connOpened = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace:   namespace,
+			Name:        "transfer_endpoint_connections_opened",
+			Help:        "The number of TCP connections opened to the destination, by endpoint",
+			ConstLabels: labels,
+		}, []string{"endpoint"},
+	)
+
+	connClosed = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace:   namespace,
+			Name:        "transfer_endpoint_connections_closed",
+			Help:        "The number of TCP connections to the destination closed, by endpoint",
+			ConstLabels: labels,
+		}, []string{"endpoint"},
+	)
+
+	connErrors = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace:   namespace,
+			Name:        "transfer_endpoint_connection_errors",
+			Help:        "The number of failed TCP connection attempts to the destination, by endpoint",
+			ConstLabels: labels,
+		}, []string{"endpoint"},
+	)
+
+	connActive = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "transfer_endpoint_active_connections",
+			Help:        "The number of open TCP connections to the destination, by endpoint",
+			ConstLabels: labels,
+		}, []string{"endpoint"},
+	)
+
+	recycleCounter = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace:   namespace,
+			Name:        "transfer_endpoint_recycles",
+			Help:        "The number of times destination connections were closed and reopened, by reason",
+			ConstLabels: labels,
+		}, []string{"reason"},
+	)
+
+	promauto.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "transfer_endpoint_connection_age_seconds",
+			Help:        "Seconds since the destination connections were (re)opened",
+			ConstLabels: labels,
+		}, func() float64 {
+			return time.Since(EndpointConnectedTime()).Seconds()
 		},
 	)
 
 	insertCounter = promauto.NewCounterVec(
 		prometheus.CounterOpts{
-			Name: "transfer_inserted_num",
-			Help: "The number of data inserted to destination",
+			Namespace:   namespace,
+			Name:        "transfer_inserted_num",
+			Help:        "The number of data inserted to destination",
+			ConstLabels: labels,
 		}, []string{"table"},
 	)
 
 	updateCounter = promauto.NewCounterVec(
 		prometheus.CounterOpts{
-			Name: "transfer_updated_num",
-			Help: "The number of data updated to destination",
+			Namespace:   namespace,
+			Name:        "transfer_updated_num",
+			Help:        "The number of data updated to destination",
+			ConstLabels: labels,
 		}, []string{"table"},
 	)
 
 	deleteCounter = promauto.NewCounterVec(
 		prometheus.CounterOpts{
-			Name: "transfer_deleted_num",
-			Help: "The number of data deleted from destination",
+			Namespace:   namespace,
+			Name:        "transfer_deleted_num",
+			Help:        "The number of data deleted from destination",
+			ConstLabels: labels,
 		}, []string{"table"},
 	)
-)
 
+	payloadHistogram = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace:   namespace,
+			Name:        "transfer_payload_bytes",
+			Help:        "The size of serialized payloads sent to destination",
+			ConstLabels: labels,
+			Buckets:     prometheus.ExponentialBuckets(256, 4, 9), // 256B ~ 16MB
+		}, []string{"table"},
+	)
+
+	spillGauge = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "transfer_spill_bytes",
+			Help:        "The size of the local log holding data while the destination is unavailable",
+			ConstLabels: labels,
+		},
+	)
+
+	spillLimitGauge = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "transfer_spill_limit_bytes",
+			Help:        "The spill_max_size of the local log, transfer blocks once transfer_spill_bytes reaches it",
+			ConstLabels: labels,
+		},
+	)
+
+	positionSaves = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Namespace:   namespace,
+			Name:        "transfer_position_saves",
+			Help:        "The number of times the sync position was saved to the position storage",
+			ConstLabels: labels,
+		},
+	)
+
+	saveInterval = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "transfer_position_save_interval_seconds",
+			Help:        "The time between the last two position saves",
+			ConstLabels: labels,
+		},
+	)
+
+	replayGauge = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "transfer_replay_window_rows",
+			Help:        "The number of rows read after the saved position, which are sent again after a restart",
+			ConstLabels: labels,
+		},
+	)
+
+	bufferedGauge = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "transfer_buffered_bytes",
+			Help:        "The estimated memory of events read from binlog but not yet written to destination",
+			ConstLabels: labels,
+		},
+	)
+
+	luaHistogram = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace:   namespace,
+			Name:        "transfer_lua_duration_seconds",
+			Help:        "The execution time of rule Lua scripts",
+			ConstLabels: labels,
+			Buckets:     prometheus.ExponentialBuckets(0.0001, 4, 8), // 100µs ~ 1.6s
+		}, []string{"table"},
+	)
+
+	stalledGauge = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "transfer_stalled",
+			Help:        "Whether the source is active but no events are processed: 0=false, 1=true",
+			ConstLabels: labels,
+		},
+	)
+
+	caughtUpGauge = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "transfer_caught_up",
+			Help:        "Whether the transfer has caught up with the source (delay below catchup_delay for catchup_duration): 0=false, 1=true",
+			ConstLabels: labels,
+		},
+	)
+
+	failedGauge = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "transfer_failed",
+			Help:        "Whether the transfer gave up after exhausting reconnect attempts: 0=false, 1=true",
+			ConstLabels: labels,
+		},
+	)
+
+	uncompressed = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Namespace:   namespace,
+			Name:        "transfer_payload_uncompressed_bytes",
+			Help:        "The size of message bodies before compression",
+			ConstLabels: labels,
+		},
+	)
+
+	compressed = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Namespace:   namespace,
+			Name:        "transfer_payload_compressed_bytes",
+			Help:        "The size of message bodies after compression",
+			ConstLabels: labels,
+		},
+	)
+
+	compressionRatio = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "transfer_compression_ratio",
+			Help:        "The cumulative ratio of compressed to uncompressed message bytes",
+			ConstLabels: labels,
+		},
+	)
+	registered.Store(true)
+}
+
+// exporting 启用了exporter且指标已注册
+func exporting() bool {
+	return global.Cfg().EnableExporter && registered.Load()
+}
+
+// Initialize 须在service.Initialize之前调用
 func Initialize() error {
 	if global.Cfg().EnableExporter {
+		register()
 		go func() {
 			http.Handle("/", promhttp.Handler())
 			http.ListenAndServe(fmt.Sprintf(":%d", global.Cfg().ExporterPort), nil)
 		}()
 	}
-	if global.Cfg().EnableWebAdmin {
-		insertRecord = make(map[string]*atomic.Uint64)
-		updateRecord = make(map[string]*atomic.Uint64)
-		deleteRecord = make(map[string]*atomic.Uint64)
-		for _, k := range global.RuleKeyList() {
-			insertRecord[k] = &atomic.Uint64{}
-			updateRecord[k] = &atomic.Uint64{}
-			deleteRecord[k] = &atomic.Uint64{}
-		}
-	}
 	return nil
 }
 
 func SetLeaderState(state int) {
-	if global.Cfg().EnableExporter {
+	if exporting() {
 		leaderStateGauge.Set(float64(state))
 	}
 	if global.Cfg().EnableWebAdmin {
@@ -121,7 +508,7 @@ func SetLeaderState(state int) {
 }
 
 func SetDestState(state int) {
-	if global.Cfg().EnableExporter {
+	if exporting() {
 		destStateGauge.Set(float64(state))
 	}
 	if global.Cfg().EnableWebAdmin {
@@ -133,8 +520,12 @@ func DestState() bool {
 	return destState.Load()
 }
 
+func TransferDelay() uint32 {
+	return delay.Load()
+}
+
 func SetTransferDelay(d uint32) {
-	if global.Cfg().EnableExporter {
+	if exporting() {
 		delayGauge.Set(float64(d))
 	}
 	if global.Cfg().EnableWebAdmin {
@@ -142,8 +533,294 @@ func SetTransferDelay(d uint32) {
 	}
 }
 
+// SetSourceActive 记录最近一次从源端收到事件的时间
+func SetSourceActive(t time.Time) {
+	sourceActive.Store(t.Unix())
+	if exporting() {
+		sourceGauge.Set(float64(t.Unix()))
+	}
+}
+
+func SourceActiveTime() time.Time {
+	return time.Unix(sourceActive.Load(), 0)
+}
+
+// SetSourceHeartbeat 记录最近一次从源端收到复制心跳的时间
+func SetSourceHeartbeat(t time.Time) {
+	sourceBeat.Store(t.Unix())
+	if exporting() {
+		heartbeatGauge.Set(float64(t.Unix()))
+	}
+}
+
+func SourceHeartbeatTime() time.Time {
+	return time.Unix(sourceBeat.Load(), 0)
+}
+
+// SourceSeenTime 最近一次从源端收到事件或复制心跳的时间
+func SourceSeenTime() time.Time {
+	if beat := sourceBeat.Load(); beat > sourceActive.Load() {
+		return time.Unix(beat, 0)
+	}
+	return SourceActiveTime()
+}
+
+// SetListenerActive 记录最近一次处理队列中事件的时间
+func SetListenerActive(t time.Time) {
+	listenerActive.Store(t.UnixNano())
+}
+
+func ListenerActiveTime() time.Time {
+	return time.Unix(0, listenerActive.Load())
+}
+
+// SetStalled 源端有事件但长时间未处理
+func SetStalled(v bool) {
+	stalled.Store(v)
+	if exporting() {
+		if v {
+			stalledGauge.Set(1)
+		} else {
+			stalledGauge.Set(0)
+		}
+	}
+}
+
+func Stalled() bool {
+	return stalled.Load()
+}
+
+// SetCaughtUp 延迟低于catchup_delay持续catchup_duration时为true，再次落后时为false
+func SetCaughtUp(v bool) {
+	caughtUp.Store(v)
+	if exporting() {
+		if v {
+			caughtUpGauge.Set(1)
+		} else {
+			caughtUpGauge.Set(0)
+		}
+	}
+}
+
+func CaughtUp() bool {
+	return caughtUp.Load()
+}
+
+// SetFailed 重连次数用尽后进入失败状态，记录最后的错误
+func SetFailed(reason string) {
+	failure.Store(reason)
+	if exporting() {
+		failedGauge.Set(1)
+	}
+}
+
+// Failure 失败状态的原因，未失败时为空
+func Failure() string {
+	return failure.Load()
+}
+
+// IncPositionStoreFailure 位置存储重试后仍失败
+func IncPositionStoreFailure() {
+	positionFailure.Inc()
+	if exporting() {
+		positionFailures.Inc()
+	}
+}
+
+func PositionStoreFailures() uint64 {
+	return positionFailure.Load()
+}
+
+// IncThrottled 接收端限流，退避后重试
+func IncThrottled() {
+	throttled.Inc()
+	if exporting() {
+		throttledCounter.Inc()
+	}
+}
+
+func Throttled() uint64 {
+	return throttled.Load()
+}
+
+// IncDuplicateSuppressed 重新投递的行事件已写入过，不再写入
+func IncDuplicateSuppressed() {
+	duplicates.Inc()
+	if exporting() {
+		duplicateCounter.Inc()
+	}
+}
+
+func DuplicatesSuppressed() uint64 {
+	return duplicates.Load()
+}
+
+// IncEmptyKey 标识列的值为空或0
+func IncEmptyKey(lab string) {
+	if exporting() {
+		emptyKeyCounter.WithLabelValues(lab).Inc()
+	}
+}
+
+// IncSkipped 行数据未写入接收端，reason为Skip开头的常量
+func IncSkipped(lab, reason string, rows int) {
+	if exporting() && rows > 0 {
+		skippedCounter.WithLabelValues(lab, reason).Add(float64(rows))
+	}
+}
+
+// IncOversizeValue 超出max_value_length的值被截断或替换
+func IncOversizeValue(lab string) {
+	if exporting() {
+		oversizeCounter.WithLabelValues(lab).Inc()
+	}
+}
+
+// IncRejectedItem 批量写入中的条目被接收端拒绝
+func IncRejectedItem(lab string) {
+	if exporting() {
+		rejectedCounter.WithLabelValues(lab).Inc()
+	}
+}
+
+// IncLuaError Lua脚本执行失败或返回的结果不正确
+func IncLuaError(lab string) {
+	if exporting() {
+		luaErrorCounter.WithLabelValues(lab).Inc()
+	}
+}
+
+// IncPartitionDDL 监听表的分区被清空、删除或交换
+func IncPartitionDDL(lab string) {
+	if exporting() {
+		partitionCounter.WithLabelValues(lab).Inc()
+	}
+}
+
+// IncEndpointRecycle 关闭并重新连接接收端，reason为Recycle开头的常量
+func IncEndpointRecycle(reason string) {
+	if exporting() {
+		recycleCounter.WithLabelValues(reason).Inc()
+	}
+}
+
+// SetEndpointConnected 记录接收端连接(重新)建立的时间
+func SetEndpointConnected(t time.Time) {
+	connected.Store(t.UnixNano())
+}
+
+func EndpointConnectedTime() time.Time {
+	return time.Unix(0, connected.Load())
+}
+
+// EndpointConnOpened 建立了到接收端的TCP连接，lab为接收端名称
+func EndpointConnOpened(lab string) {
+	if exporting() {
+		connOpened.WithLabelValues(lab).Inc()
+		connActive.WithLabelValues(lab).Inc()
+	}
+}
+
+// EndpointConnClosed 关闭了到接收端的TCP连接
+func EndpointConnClosed(lab string) {
+	if exporting() {
+		connClosed.WithLabelValues(lab).Inc()
+		connActive.WithLabelValues(lab).Dec()
+	}
+}
+
+// IncEndpointConnError 建立到接收端的TCP连接失败
+func IncEndpointConnError(lab string) {
+	if exporting() {
+		connErrors.WithLabelValues(lab).Inc()
+	}
+}
+
+// ObservePayloadSize 记录发送到接收端的序列化数据大小(字节)
+func ObservePayloadSize(lab string, size int) {
+	if exporting() {
+		payloadHistogram.WithLabelValues(lab).Observe(float64(size))
+	}
+}
+
+// ObserveLuaDuration 记录规则Lua脚本的执行耗时，与transfer_delay对照区分源端延迟与脚本耗时
+func ObserveLuaDuration(lab string, d time.Duration) {
+	if exporting() {
+		luaHistogram.WithLabelValues(lab).Observe(d.Seconds())
+	}
+}
+
+// ObserveCompression 记录消息体压缩前后的大小(字节)
+func ObserveCompression(raw, size int) {
+	r := rawBytes.Add(uint64(raw))
+	c := compressedBytes.Add(uint64(size))
+	if exporting() {
+		uncompressed.Add(float64(raw))
+		compressed.Add(float64(size))
+		if r > 0 {
+			compressionRatio.Set(float64(c) / float64(r))
+		}
+	}
+}
+
+// SetSpillBytes 记录接收端不可用时暂存数据的本地日志大小(字节)
+func SetSpillBytes(size int64) {
+	spillBytes.Store(size)
+	if exporting() {
+		spillGauge.Set(float64(size))
+	}
+}
+
+func SpillBytes() int64 {
+	return spillBytes.Load()
+}
+
+// SetSpillLimit 记录本地日志的最大大小(字节)，与transfer_spill_bytes对照设置告警
+func SetSpillLimit(size int64) {
+	spillLimit.Store(size)
+	if exporting() {
+		spillLimitGauge.Set(float64(size))
+	}
+}
+
+func SpillLimit() int64 {
+	return spillLimit.Load()
+}
+
+// PositionSaved 保存了位置，interval为距上次保存的时间
+func PositionSaved(interval time.Duration) {
+	if exporting() {
+		positionSaves.Inc()
+		saveInterval.Set(interval.Seconds())
+	}
+}
+
+// SetReplayWindow 记录已保存的位置之后读取的行数，即重启后会重复发送的行数
+func SetReplayWindow(rows int64) {
+	replayWindow.Store(rows)
+	if exporting() {
+		replayGauge.Set(float64(rows))
+	}
+}
+
+func ReplayWindow() int64 {
+	return replayWindow.Load()
+}
+
+// SetBufferedBytes 记录已读取、未写入接收端的数据估算占用的内存(字节)
+func SetBufferedBytes(size int64) {
+	bufferedBytes.Store(size)
+	if exporting() {
+		bufferedGauge.Set(float64(size))
+	}
+}
+
+func BufferedBytes() int64 {
+	return bufferedBytes.Load()
+}
+
 func UpdateActionNum(action, lab string) {
-	if global.Cfg().EnableExporter {
+	if exporting() {
 		switch action {
 		case canal.InsertAction:
 			insertCounter.WithLabelValues(lab).Inc()
@@ -156,22 +833,35 @@ func UpdateActionNum(action, lab string) {
 	if global.Cfg().EnableWebAdmin {
 		switch action {
 		case canal.InsertAction:
-			if v, ok := insertRecord[lab]; ok {
-				v.Inc()
-			}
+			record(insertRecord, lab).Inc()
 		case canal.UpdateAction:
-			if v, ok := updateRecord[lab]; ok {
-				v.Inc()
-			}
+			record(updateRecord, lab).Inc()
 		case canal.DeleteAction:
-			if v, ok := deleteRecord[lab]; ok {
-				v.Inc()
-			}
+			record(deleteRecord, lab).Inc()
 		}
 	}
 }
 
+func record(records map[string]*atomic.Uint64, lab string) *atomic.Uint64 {
+	lockOfRecord.RLock()
+	v, ok := records[lab]
+	lockOfRecord.RUnlock()
+	if ok {
+		return v
+	}
+
+	lockOfRecord.Lock()
+	defer lockOfRecord.Unlock()
+	if v, ok = records[lab]; !ok {
+		v = &atomic.Uint64{}
+		records[lab] = v
+	}
+	return v
+}
+
 func InsertAmount() uint64 {
+	lockOfRecord.RLock()
+	defer lockOfRecord.RUnlock()
 	var amount uint64
 	for _, v := range insertRecord {
 		amount += v.Load()
@@ -180,6 +870,8 @@ func InsertAmount() uint64 {
 }
 
 func UpdateAmount() uint64 {
+	lockOfRecord.RLock()
+	defer lockOfRecord.RUnlock()
 	var amount uint64
 	for _, v := range updateRecord {
 		amount += v.Load()
@@ -188,6 +880,8 @@ func UpdateAmount() uint64 {
 }
 
 func DeleteAmount() uint64 {
+	lockOfRecord.RLock()
+	defer lockOfRecord.RUnlock()
 	var amount uint64
 	for _, v := range deleteRecord {
 		amount += v.Load()
@@ -196,6 +890,8 @@ func DeleteAmount() uint64 {
 }
 
 func LabInsertAmount(lab string) uint64 {
+	lockOfRecord.RLock()
+	defer lockOfRecord.RUnlock()
 	var nn uint64
 	n, ok := insertRecord[lab]
 	if ok {
@@ -205,6 +901,8 @@ func LabInsertAmount(lab string) uint64 {
 }
 
 func LabUpdateRecord(lab string) uint64 {
+	lockOfRecord.RLock()
+	defer lockOfRecord.RUnlock()
 	var nn uint64
 	n, ok := updateRecord[lab]
 	if ok {
@@ -214,6 +912,8 @@ func LabUpdateRecord(lab string) uint64 {
 }
 
 func LabDeleteRecord(lab string) uint64 {
+	lockOfRecord.RLock()
+	defer lockOfRecord.RUnlock()
 	var nn uint64
 	n, ok := deleteRecord[lab]
 	if ok {
@@ -0,0 +1,65 @@
+package metrics
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/siddontang/go-mysql/canal"
+
+	"go-mysql-transfer/global"
+)
+
+// -stock、-verify、-replay不调用Initialize，启用exporter时各指标方法不能使用未注册的指标
+func TestUnregistered(t *testing.T) {
+	dir, err := ioutil.TempDir("", "transfer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := filepath.Join(dir, "app.yml")
+	data := fmt.Sprintf("target: script\naddr: 127.0.0.1:3306\nuser: root\npass: root\ncharset: utf8\nslave_id: 1001\n"+
+		"data_dir: %s\nenable_exporter: true\nrule:\n  - schema: test\n    table: metrics\n", dir)
+	if err := ioutil.WriteFile(cfg, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := global.Initialize(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	SetLeaderState(LeaderState)
+	SetDestState(DestStateOK)
+	SetTransferDelay(1)
+	SetSourceActive(time.Now())
+	SetSourceHeartbeat(time.Now())
+	SetStalled(true)
+	SetCaughtUp(true)
+	SetFailed("failed")
+	IncPositionStoreFailure()
+	IncThrottled()
+	IncDuplicateSuppressed()
+	IncEmptyKey("test:metrics")
+	IncSkipped("test:metrics", SkipLua, 1)
+	IncOversizeValue("test:metrics")
+	IncRejectedItem("test:metrics")
+	IncLuaError("test:metrics")
+	IncPartitionDDL("test:metrics")
+	IncEndpointRecycle(RecycleDns)
+	EndpointConnOpened("test:metrics")
+	EndpointConnClosed("test:metrics")
+	IncEndpointConnError("test:metrics")
+	ObservePayloadSize("test:metrics", 10)
+	ObserveLuaDuration("test:metrics", time.Millisecond)
+	ObserveCompression(10, 5)
+	SetSpillBytes(1)
+	SetSpillLimit(1)
+	PositionSaved(time.Second)
+	SetReplayWindow(1)
+	SetBufferedBytes(1)
+	UpdateActionNum(canal.InsertAction, "test:metrics")
+	UpdateActionNum(canal.UpdateAction, "test:metrics")
+	UpdateActionNum(canal.DeleteAction, "test:metrics")
+}
@@ -1,6 +1,9 @@
 package model
 
-import "sync"
+import (
+	"sync"
+	"time"
+)
 
 var RowRequestPool = sync.Pool{
 	New: func() interface{} {
@@ -14,12 +17,59 @@ type RowRequest struct {
 	Timestamp uint32
 	Old       []interface{}
 	Row       []interface{}
+	Endpoint  string // 附加接收端名称，为空表示target
+	LogName   string // 行事件所在的binlog文件，全量导入的数据为空
+	LogPos    uint32 // 行事件在binlog中的结束位置
+	Offset    int    // 在同一行事件中的序号
+	GTID      string // 所在事务的GTID，未开启GTID时为空
+	Upsert    bool   // 同一事务中先删除后插入合并成的update，接收端不存在该数据时插入
+	Deleted   bool   // 开启soft_delete的规则由删除转换成的upsert，Row为删除前的数据
+	Element   int    // 按explode_column拆分出的元素序号，从1开始，0表示未拆分
 }
 
 type PosRequest struct {
 	Name  string
 	Pos   uint32
 	Force bool
+	GTID  string // 该位置对应的已执行GTID集合，未跟踪GTID时为空
+}
+
+// DDLRequest 监听表的结构变更
+type DDLRequest struct {
+	Schema    string
+	Query     string
+	Timestamp uint32
+	Name      string
+	Pos       uint32
+	Tables    []*DDLTable
+}
+
+// Size 估算占用的内存(字节)，用于按queue_max_bytes限制缓存的数据
+func (r *RowRequest) Size() int64 {
+	size := int64(64 + len(r.RuleKey) + len(r.Endpoint) + len(r.LogName) + len(r.GTID))
+	return size + rowSize(r.Row) + rowSize(r.Old)
+}
+
+func rowSize(row []interface{}) int64 {
+	size := int64(16 * len(row))
+	for _, v := range row {
+		switch v := v.(type) {
+		case string:
+			size += int64(len(v))
+		case []byte:
+			size += int64(len(v))
+		case time.Time:
+			size += 24
+		default:
+			size += 8
+		}
+	}
+	return size
+}
+
+// BarrierRequest 之前的数据全部写入接收端(或暂存到本地日志)后关闭Done
+type BarrierRequest struct {
+	Done chan struct{}
 }
 
 func BuildRowRequest() *RowRequest {
@@ -26,13 +26,90 @@ var redisRespondPool = sync.Pool{
 	},
 }
 
+// DDLRespond 结构变更事件
+type DDLRespond struct {
+	Type      string      `json:"type"`
+	Database  string      `json:"database"`
+	Query     string      `json:"query"`
+	Timestamp uint32      `json:"timestamp"`
+	Position  string      `json:"position"`
+	Tables    []*DDLTable `json:"tables"`
+
+	Source string `json:"source,omitempty"`
+}
+
+// HeartbeatRespond 心跳消息，position之前的数据均已写入接收端
+type HeartbeatRespond struct {
+	Type      string `json:"type"`
+	Position  string `json:"position"`
+	Timestamp int64  `json:"timestamp"`
+
+	Source string `json:"source,omitempty"`
+}
+
+// SchemaRespond 规则对应的表结构，启动时及表结构变更后发送到schema_topic，表被删除时columns为空
+type SchemaRespond struct {
+	Type      string       `json:"type"`
+	Reason    string       `json:"reason"` // startup、ddl
+	Database  string       `json:"database"`
+	Table     string       `json:"table"`
+	Columns   []*DDLColumn `json:"columns"`
+	PKs       []string     `json:"primary_keys"`
+	Position  string       `json:"position"`
+	Timestamp int64        `json:"timestamp"`
+
+	Source string `json:"source,omitempty"`
+}
+
+type DDLTable struct {
+	Database string       `json:"database"`
+	Table    string       `json:"table"`
+	Columns  []*DDLColumn `json:"columns"`
+	PKs      []string     `json:"primary_keys"`
+}
+
+type DDLColumn struct {
+	Name      string `json:"name"`
+	Type      string `json:"type"`
+	Collation string `json:"collation,omitempty"`
+	Virtual   bool   `json:"virtual,omitempty"`
+}
+
+// Watermark 行数据在源库binlog中的位置，按(position,offset)递增，消费端可据此记录已处理的位置
+type Watermark struct {
+	Position string `json:"position" bson:"position"`
+	Offset   int    `json:"offset" bson:"offset"`
+	GTID     string `json:"gtid,omitempty" bson:"gtid,omitempty"`
+}
+
 type MQRespond struct {
 	Topic     string      `json:"-"`
 	Action    string      `json:"action"`
 	Timestamp uint32      `json:"timestamp"`
 	Raw       interface{} `json:"raw,omitempty"`
+	Diff      interface{} `json:"diff,omitempty"`
+	TimeZone  string      `json:"time_zone,omitempty"`
+	Watermark *Watermark  `json:"watermark,omitempty"`
 	Date      interface{} `json:"date"`
 	ByteArray []byte      `json:"-"`
+
+	Source string `json:"source,omitempty"`
+}
+
+// MaxwellRespond 与Maxwell兼容的消息格式
+type MaxwellRespond struct {
+	Database string      `json:"database"`
+	Table    string      `json:"table"`
+	Type     string      `json:"type"`
+	Ts       uint32      `json:"ts"`
+	TimeZone string      `json:"time_zone,omitempty"`
+	Position string      `json:"position,omitempty"`
+	XOffset  int         `json:"xoffset,omitempty"`
+	GTID     string      `json:"gtid,omitempty"`
+	Data     interface{} `json:"data"`
+	Old      interface{} `json:"old,omitempty"`
+
+	Source string `json:"source,omitempty"`
 }
 
 type ESRespond struct {
@@ -0,0 +1,99 @@
+/*
+ * Copyright 2020-2021 the original author(https://github.com/wj596)
+ *
+ * <p>
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * </p>
+ */
+package service
+
+import (
+	"time"
+
+	"github.com/juju/errors"
+
+	"go-mysql-transfer/global"
+	"go-mysql-transfer/metrics"
+	"go-mysql-transfer/util/httpclient"
+	"go-mysql-transfer/util/logs"
+)
+
+const (
+	_catchupHookTimeout  = 10 // 秒
+	_catchupHookAttempts = 3
+)
+
+// catchupEvent 判定为已追上时POST到catchup_hook的内容
+type catchupEvent struct {
+	Event  string `json:"event"`
+	Source string `json:"source,omitempty"`
+	Delay  uint32 `json:"delay"`
+	Name   string `json:"binName"`
+	Pos    uint32 `json:"binPos"`
+	Time   int64  `json:"time"`
+}
+
+// catchup 追上检测：未在接收mysqldump导出的数据、延迟低于catchup_delay持续catchup_duration时判定为已追上；
+// 每次从落后(启动、积压)到追上只触发一次，仅在startLoop中使用
+type catchup struct {
+	since time.Time // 延迟开始低于catchup_delay的时间
+}
+
+// observe 每个检测周期调用一次，lagging为是否落后，ready为是否正在同步(运行中、未暂停、接收端可用)
+func (c *catchup) observe(lagging, ready bool, delay uint32) bool {
+	if lagging {
+		c.since = time.Time{}
+		if metrics.CaughtUp() {
+			metrics.SetCaughtUp(false)
+			logs.Infof("transfer fell behind (delay %ds), waiting to catch up again", delay)
+		}
+		return false
+	}
+	if !ready {
+		c.since = time.Time{}
+		return false
+	}
+
+	if c.since.IsZero() {
+		c.since = time.Now()
+	}
+	if metrics.CaughtUp() || time.Since(c.since) < time.Duration(global.Cfg().CatchupDuration)*time.Second {
+		return false
+	}
+	metrics.SetCaughtUp(true)
+	logs.Infof("transfer caught up (delay %ds for %ds)", delay, global.Cfg().CatchupDuration)
+	return true
+}
+
+// notifyCatchup POST通知catchup_hook，失败时按间隔翻倍重试
+func notifyCatchup(url string, event catchupEvent) {
+	client := httpclient.NewClient().SetTimeout(_catchupHookTimeout)
+	interval := time.Second
+	for i := 1; ; i++ {
+		entity, err := client.POST(url).SetBodyAsJson(event).DoForEntity()
+		if err == nil && entity.StatusCode() >= 200 && entity.StatusCode() < 300 {
+			logs.Infof("catchup hook %s notified", url)
+			return
+		}
+		if err == nil {
+			err = errors.Errorf("unexpected status %d", entity.StatusCode())
+		}
+		if i >= _catchupHookAttempts {
+			logs.Errorf("catchup hook %s failed after %d attempts: %s", url, i, err.Error())
+			return
+		}
+		logs.Warnf("catchup hook %s failed: %s, retry in %s", url, err.Error(), interval)
+		time.Sleep(interval)
+		interval *= 2
+	}
+}
@@ -0,0 +1,66 @@
+package service
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go-mysql-transfer/global"
+	"go-mysql-transfer/metrics"
+)
+
+func TestCatchupObserve(t *testing.T) {
+	dir, err := ioutil.TempDir("", "transfer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := filepath.Join(dir, "app.yml")
+	data := fmt.Sprintf("target: script\naddr: 127.0.0.1:3306\nuser: root\npass: root\ncharset: utf8\nslave_id: 1001\n"+
+		"data_dir: %s\ncatchup_duration: 30\nrule:\n  - schema: test\n    table: catchup\n", dir)
+	if err := ioutil.WriteFile(cfg, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := global.Initialize(cfg); err != nil {
+		t.Fatal(err)
+	}
+	metrics.SetCaughtUp(false)
+	// elapse 模拟延迟低于catchup_delay已持续超过catchup_duration
+	elapse := func(c *catchup) {
+		c.since = time.Now().Add(-31 * time.Second)
+	}
+
+	var c catchup
+	if c.observe(true, true, 20) || !c.since.IsZero() {
+		t.Fatal("expect no catchup while lagging")
+	}
+	if c.observe(false, true, 0) || c.since.IsZero() {
+		t.Fatal("expect catchup_duration to start counting")
+	}
+	elapse(&c)
+	if !c.observe(false, true, 0) || !metrics.CaughtUp() {
+		t.Fatal("expect caught up after catchup_duration")
+	}
+	if c.observe(false, true, 0) {
+		t.Fatal("expect caught up to be notified only once")
+	}
+
+	// 再次落后后重新计时，追上时再次通知
+	if c.observe(true, true, 20) || metrics.CaughtUp() {
+		t.Fatal("expect fell behind")
+	}
+	elapse(&c)
+	if c.observe(false, false, 0) || !c.since.IsZero() {
+		t.Fatal("expect no catchup while paused or disconnected")
+	}
+	if c.observe(false, true, 0) {
+		t.Fatal("expect catchup_duration to restart after pause")
+	}
+	elapse(&c)
+	if !c.observe(false, true, 0) {
+		t.Fatal("expect caught up again")
+	}
+}
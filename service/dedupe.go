@@ -0,0 +1,262 @@
+/*
+ * Copyright 2020-2021 the original author(https://github.com/wj596)
+ *
+ * <p>
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * </p>
+ */
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/juju/errors"
+
+	"go-mysql-transfer/global"
+	"go-mysql-transfer/metrics"
+	"go-mysql-transfer/model"
+	"go-mysql-transfer/service/endpoint"
+)
+
+// dedupe 最近已写入接收端(或暂存到本地日志)的行事件标识(binlog文件名+事件结束位置)，
+// 重连或从已保存的位置重新同步后，canal再次投递的这些事件不再写入；按先进先出保留最近size个
+type dedupe struct {
+	lock  sync.Mutex
+	size  int
+	ring  []string
+	next  int
+	seen  map[string]struct{}
+	dirty bool // 上次保存到文件后有新增
+}
+
+func newDedupe(size int) *dedupe {
+	return &dedupe{
+		size: size,
+		ring: make([]string, 0, size),
+		seen: make(map[string]struct{}, size),
+	}
+}
+
+func eventKey(name string, pos uint32) string {
+	return fmt.Sprintf("%s:%d", name, pos)
+}
+
+// contains 事件是否已写入
+func (d *dedupe) contains(name string, pos uint32) bool {
+	return d.containsKey(eventKey(name, pos))
+}
+
+func (d *dedupe) containsKey(key string) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	_, ok := d.seen[key]
+	return ok
+}
+
+// add 记录已写入的数据所属的事件，超出窗口时淘汰最早的
+func (d *dedupe) add(requests []*model.RowRequest) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for _, request := range requests {
+		if request.LogName == "" {
+			continue
+		}
+		d.put(eventKey(request.LogName, request.LogPos))
+	}
+}
+
+// put 调用方持有锁
+func (d *dedupe) put(key string) {
+	if _, ok := d.seen[key]; ok {
+		return
+	}
+	if len(d.ring) < d.size {
+		d.ring = append(d.ring, key)
+	} else {
+		delete(d.seen, d.ring[d.next])
+		d.ring[d.next] = key
+		d.next = (d.next + 1) % d.size
+	}
+	d.seen[key] = struct{}{}
+	d.dirty = true
+}
+
+// keys 按写入顺序返回窗口内的标识，并清除dirty
+func (d *dedupe) keys() []string {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.dirty = false
+	keys := make([]string, 0, len(d.ring))
+	keys = append(keys, d.ring[d.next:]...)
+	return append(keys, d.ring[:d.next]...)
+}
+
+func (d *dedupe) changed() bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.dirty
+}
+
+func (d *dedupe) load(keys []string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for _, key := range keys {
+		d.put(key)
+	}
+	d.dirty = false
+}
+
+// rowKey 行数据的标识+所属事件，explode拆分的数据按拆分前的标识记录
+func rowKey(request *model.RowRequest, rule *global.Rule) string {
+	if request.Element > 0 {
+		origin := *request
+		origin.Element = 0
+		request = &origin
+	}
+	return endpoint.Identity(request, rule) + "@" + eventKey(request.LogName, request.LogPos)
+}
+
+// rowDedupes 配置了dedupe_window的规则各自最近已写入的行(标识+binlog位置)
+type rowDedupes struct {
+	lock    sync.Mutex
+	windows map[string]*dedupe
+}
+
+func newRowDedupes() *rowDedupes {
+	return &rowDedupes{
+		windows: make(map[string]*dedupe),
+	}
+}
+
+// of 规则的去重窗口，未配置dedupe_window时为nil
+func (r *rowDedupes) of(rule *global.Rule) *dedupe {
+	if r == nil || rule.DedupeWindow <= 0 {
+		return nil
+	}
+	key := global.RuleKey(rule.Schema, rule.Table)
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	d, ok := r.windows[key]
+	if !ok {
+		d = newDedupe(rule.DedupeWindow)
+		r.windows[key] = d
+	}
+	return d
+}
+
+// filter 去掉已写入的行
+func (r *rowDedupes) filter(rule *global.Rule, requests []*model.RowRequest) []*model.RowRequest {
+	d := r.of(rule)
+	if d == nil {
+		return requests
+	}
+	ret := requests[:0]
+	for _, request := range requests {
+		if request.LogName != "" && d.containsKey(rowKey(request, rule)) {
+			metrics.IncDuplicateSuppressed()
+			metrics.IncSkipped(request.RuleKey, metrics.SkipDuplicate, 1)
+			continue
+		}
+		ret = append(ret, request)
+	}
+	return ret
+}
+
+// add 记录已写入的行
+func (r *rowDedupes) add(requests []*model.RowRequest) {
+	if r == nil {
+		return
+	}
+	for _, request := range requests {
+		if request.LogName == "" {
+			continue
+		}
+		rule, ok := global.RuleIns(request.RuleKey)
+		if !ok {
+			continue
+		}
+		if d := r.of(rule); d != nil {
+			d.lock.Lock()
+			d.put(rowKey(request, rule))
+			d.lock.Unlock()
+		}
+	}
+}
+
+// dedupeState 保存到data_dir/dedupe的去重窗口，重启进程后恢复
+type dedupeState struct {
+	Events []string            `json:"events,omitempty"`
+	Rows   map[string][]string `json:"rows,omitempty"`
+}
+
+// saveDedupe 有新增时写入临时文件后替换，避免写入过程中退出损坏已有的文件
+func saveDedupe(path string, events *dedupe, rows *rowDedupes) error {
+	changed := events != nil && events.changed()
+	rows.lock.Lock()
+	windows := make(map[string]*dedupe, len(rows.windows))
+	for key, d := range rows.windows {
+		windows[key] = d
+		changed = changed || d.changed()
+	}
+	rows.lock.Unlock()
+	if !changed {
+		return nil
+	}
+
+	state := dedupeState{Rows: make(map[string][]string, len(windows))}
+	if events != nil {
+		state.Events = events.keys()
+	}
+	for key, d := range windows {
+		state.Rows[key] = d.keys()
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(os.Rename(tmp, path))
+}
+
+// loadDedupe 恢复保存的去重窗口，文件不存在时忽略
+func loadDedupe(path string, events *dedupe, rows *rowDedupes) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Trace(err)
+	}
+	var state dedupeState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return errors.Annotatef(err, "parse %s", path)
+	}
+	if events != nil {
+		events.load(state.Events)
+	}
+	for key, keys := range state.Rows {
+		if rule, ok := global.RuleIns(key); ok {
+			if d := rows.of(rule); d != nil {
+				d.load(keys)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package service
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go-mysql-transfer/model"
+)
+
+func TestDedupe(t *testing.T) {
+	d := newDedupe(2)
+	d.add([]*model.RowRequest{
+		{LogName: "mysql-bin.000001", LogPos: 100},
+		{LogName: "mysql-bin.000001", LogPos: 100},
+		{LogName: "mysql-bin.000001", LogPos: 200},
+	})
+	if !d.contains("mysql-bin.000001", 100) || !d.contains("mysql-bin.000001", 200) {
+		t.Fatal("delivered events not recorded")
+	}
+
+	d.add([]*model.RowRequest{{LogName: "mysql-bin.000002", LogPos: 100}})
+	if d.contains("mysql-bin.000001", 100) {
+		t.Error("oldest event not evicted")
+	}
+	if !d.contains("mysql-bin.000001", 200) || !d.contains("mysql-bin.000002", 100) {
+		t.Error("recent events evicted")
+	}
+}
+
+func TestDedupePersist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dedupe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dedupe")
+
+	d := newDedupe(2)
+	d.add([]*model.RowRequest{
+		{LogName: "mysql-bin.000001", LogPos: 100},
+		{LogName: "mysql-bin.000001", LogPos: 200},
+		{LogName: "mysql-bin.000001", LogPos: 300},
+	})
+	if err := saveDedupe(path, d, newRowDedupes()); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := newDedupe(2)
+	if err := loadDedupe(path, restored, newRowDedupes()); err != nil {
+		t.Fatal(err)
+	}
+	if restored.contains("mysql-bin.000001", 100) {
+		t.Error("evicted event restored")
+	}
+	if !restored.contains("mysql-bin.000001", 200) || !restored.contains("mysql-bin.000001", 300) {
+		t.Error("recent events not restored")
+	}
+
+	// 保存后没有新增时不重写文件
+	os.Remove(path)
+	if err := saveDedupe(path, d, newRowDedupes()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("unchanged window saved again")
+	}
+}
@@ -0,0 +1,222 @@
+/*
+ * Copyright 2020-2021 the original author(https://github.com/wj596)
+ *
+ * <p>
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * </p>
+ */
+package service
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/schema"
+
+	"go-mysql-transfer/global"
+	"go-mysql-transfer/metrics"
+	"go-mysql-transfer/util/logs"
+)
+
+const _discoveryRetryInterval = time.Minute // 注册失败的表再次尝试注册的间隔
+
+// isWildcard 表名称是否为正则
+func isWildcard(table string) bool {
+	return regexp.QuoteMeta(table) != table
+}
+
+// wildcardTables 查询通配符规则匹配的表
+func wildcardTables(c *canal.Canal, rc *global.Rule) ([]string, error) {
+	sql := fmt.Sprintf(`SELECT table_name FROM information_schema.tables WHERE
+		table_name RLIKE "%s" AND table_schema = "%s";`, rc.Table, rc.Schema)
+	res, err := c.Execute(sql)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	tables := make([]string, 0, res.Resultset.RowNumber())
+	for i := 0; i < res.Resultset.RowNumber(); i++ {
+		table, _ := res.GetString(i, 0)
+		tables = append(tables, table)
+	}
+	return tables, nil
+}
+
+// wildcardRule 匹配该表的通配符规则配置，与RLIKE一致不区分大小写
+func wildcardRule(schemaName, table string) *global.Rule {
+	for _, rc := range global.Cfg().RuleConfigs {
+		if !isWildcard(rc.Table) || !strings.EqualFold(rc.Schema, schemaName) {
+			continue
+		}
+		if ok, _ := regexp.MatchString("(?i)"+rc.Table, table); ok {
+			return rc
+		}
+	}
+	return nil
+}
+
+// discoverTable 为通配符规则新匹配的表注册规则，表已注册、不匹配或不存在时返回nil
+func (s *TransferService) discoverTable(schemaName, table string) (*global.Rule, error) {
+	s.lockOfDiscovery.Lock()
+	defer s.lockOfDiscovery.Unlock()
+
+	ruleKey := global.RuleKey(schemaName, table)
+	if global.RuleInsExist(ruleKey) {
+		return nil, nil
+	}
+	rc := wildcardRule(schemaName, table)
+	if rc == nil {
+		return nil, nil
+	}
+
+	rule, err := global.RuleDeepClone(rc)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	rule.Table = table
+	if err := completeRule(s.canal, rule); err != nil {
+		if isTableNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	global.AddRuleIns(ruleKey, rule)
+	logs.Infof("table %s.%s discovered by wildcard rule %s", rule.Schema, table, rc.Table)
+	return rule, nil
+}
+
+// unregisteredRule 没有规则的表的行数据：通配符规则匹配但尚未注册(如解析不了CREATE TABLE语句、注册失败)时，
+// table_discovery_policy为register则立即注册，失败的在_discoveryRetryInterval后再次尝试；为skip或注册失败时跳过，由定期查询注册
+func (s *handler) unregisteredRule(ruleKey string, e *canal.RowsEvent) *global.Rule {
+	if wildcardRule(e.Table.Schema, e.Table.Name) == nil {
+		skipRows(ruleKey, metrics.SkipUnmapped, e)
+		return nil
+	}
+	if global.Cfg().TableDiscoveryPolicy == global.TableDiscoverySkip || time.Now().Before(s.retryDiscovery[ruleKey]) {
+		skipRows(ruleKey, metrics.SkipNewTable, e)
+		return nil
+	}
+
+	rule, err := _transferService.discoverTable(e.Table.Schema, e.Table.Name)
+	if err != nil {
+		logs.Errorf("register table %s.%s error: %s", e.Table.Schema, e.Table.Name, errors.ErrorStack(err))
+	}
+	if rule == nil {
+		// 并发注册时以已注册的规则为准
+		if rule, ok := global.RuleIns(ruleKey); ok {
+			return rule
+		}
+		s.retryDiscovery[ruleKey] = time.Now().Add(_discoveryRetryInterval)
+		skipRows(ruleKey, metrics.SkipNewTable, e)
+		return nil
+	}
+	delete(s.retryDiscovery, ruleKey)
+	return rule
+}
+
+// isTableNotExist 加载表结构时表已不存在
+func isTableNotExist(err error) bool {
+	return errors.Cause(err) == schema.ErrTableNotExist
+}
+
+// forgetTable 通配符规则匹配的表被删除(或重命名)后移除规则，返回是否已移除
+func (s *TransferService) forgetTable(schemaName, table string) bool {
+	if wildcardRule(schemaName, table) == nil {
+		return false
+	}
+
+	s.lockOfDiscovery.Lock()
+	defer s.lockOfDiscovery.Unlock()
+
+	ruleKey := global.RuleKey(schemaName, table)
+	if !global.RuleInsExist(ruleKey) {
+		return false
+	}
+	global.DeleteRuleIns(ruleKey)
+	logs.Infof("table %s.%s removed, rule deregistered", schemaName, table)
+	return true
+}
+
+// discoverTables 重新查询通配符规则匹配的表，注册新增的表、移除已删除的表
+func (s *TransferService) discoverTables() {
+	s.lockOfCanal.Lock()
+	defer s.lockOfCanal.Unlock()
+
+	if s.canal == nil || !s.Running() {
+		return
+	}
+	for _, rc := range global.Cfg().RuleConfigs {
+		if !isWildcard(rc.Table) {
+			continue
+		}
+		tables, err := wildcardTables(s.canal, rc)
+		if err != nil {
+			logs.Errorf("discover tables for %s.%s error: %s", rc.Schema, rc.Table, err.Error())
+			continue
+		}
+
+		found := make(map[string]bool, len(tables))
+		for _, table := range tables {
+			found[global.RuleKey(rc.Schema, table)] = true
+			rule, err := s.discoverTable(rc.Schema, table)
+			if err != nil {
+				logs.Errorf("discover table %s.%s error: %s", rc.Schema, table, errors.ErrorStack(err))
+				continue
+			}
+			if rule != nil && global.Cfg().TableDiscoveryDump {
+				go s.dumpTable(rule)
+			}
+		}
+		for _, rule := range global.RuleInsList() {
+			if found[global.RuleKey(rule.Schema, rule.Table)] || wildcardRule(rule.Schema, rule.Table) != rc {
+				continue
+			}
+			s.forgetTable(rule.Schema, rule.Table)
+		}
+	}
+}
+
+// dumpTable 导入新发现的表中已有的数据，未配置order_by_column时按主键分页
+func (s *TransferService) dumpTable(rule *global.Rule) {
+	fullName := fmt.Sprintf("%s.%s", rule.Schema, rule.Table)
+	if rule.OrderByColumn == "" {
+		if len(rule.TableInfo.PKColumns) == 0 {
+			logs.Warnf("%s has no order_by_column or PK, existing rows are not dumped", fullName)
+			return
+		}
+		rule.OrderByColumn = rule.TableInfo.GetPKColumn(0).Name
+	}
+
+	stock := NewStockService()
+	stock.canal = s.canal
+	stock.endpoint = s.endpoint
+	columns := stock.exportColumns(rule)
+	var total int64
+	for page := int64(1); ; page++ {
+		s.waitDump()
+		requests, err := stock.export(fullName, columns, page, rule)
+		if err != nil {
+			logs.Errorf("dump %s error: %s", fullName, err.Error())
+			return
+		}
+		if len(requests) == 0 {
+			break
+		}
+		total += s.endpoint.Stock(explode(requests))
+	}
+	logs.Infof("dumped %d rows of discovered table %s", total, fullName)
+}
@@ -0,0 +1,102 @@
+/*
+ * Copyright 2020-2021 the original author(https://github.com/wj596)
+ *
+ * <p>
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * </p>
+ */
+package endpoint
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/juju/errors"
+
+	"go-mysql-transfer/global"
+	"go-mysql-transfer/metrics"
+	"go-mysql-transfer/util/logs"
+)
+
+const (
+	_batchRetries       = 3                      // 一批数据中失败条目的重试次数
+	_batchRetryInterval = 200 * time.Millisecond // 首次重试间隔，之后逐次翻倍
+)
+
+// 批量写入中单个条目的结果
+const (
+	_itemSucceeded = iota
+	_itemRetry     // 可重试：限流、接收端内部错误等
+	_itemRejected  // 不可重试：数据本身被拒绝，如mapping冲突、消息过大
+)
+
+// bulkItemOutcome Elasticsearch bulk响应中单个条目的结果
+func bulkItemOutcome(status int, result string) int {
+	switch {
+	case status >= 200 && status <= 299:
+		return _itemSucceeded
+	case status == http.StatusNotFound && result == "not_found":
+		return _itemSucceeded // 删除不存在的文档
+	case status == http.StatusTooManyRequests || status >= 500:
+		return _itemRetry
+	default:
+		return _itemRejected
+	}
+}
+
+// kafkaItemOutcome kafka单条消息的发送结果
+func kafkaItemOutcome(err error) int {
+	if err == nil {
+		return _itemSucceeded
+	}
+	if _, ok := err.(sarama.PacketEncodingError); ok {
+		return _itemRejected
+	}
+	switch err {
+	case sarama.ErrInvalidMessage, sarama.ErrInvalidMessageSize, sarama.ErrMessageSizeTooLarge:
+		return _itemRejected
+	}
+	return _itemRetry
+}
+
+// rejectItem 条目被接收端拒绝：rejected_item_policy为stop时返回错误(停止同步)，skip时记录错误日志及数据后跳过
+func rejectItem(cfg *global.Config, lab, reason, body string) error {
+	metrics.IncRejectedItem(lab)
+	if cfg.RejectedItemPolicy == global.RejectedItemSkip {
+		logs.Errorf("item rejected and skipped, table: %s, reason: %s, data: %s", lab, reason, body)
+		return nil
+	}
+	return errors.Errorf("item rejected, table: %s, reason: %s", lab, reason)
+}
+
+// retryWait 失败条目重试前等待，第attempt次重试的间隔逐次翻倍
+func retryWait(ctx context.Context, attempt int) error {
+	select {
+	case <-time.After(_batchRetryInterval << uint(attempt)):
+		return nil
+	case <-ctx.Done():
+		return errors.Annotate(ctx.Err(), "write to endpoint")
+	}
+}
+
+// bulkSource bulk请求的内容，用于记录被拒绝的数据
+func bulkSource(req interface{ Source() ([]string, error) }) string {
+	lines, err := req.Source()
+	if err != nil {
+		return err.Error()
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,194 @@
+package endpoint
+
+import (
+	"bufio"
+	"context"
+	stdjson "encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/olivere/elastic/v7"
+
+	"go-mysql-transfer/global"
+)
+
+func TestBulkItemOutcome(t *testing.T) {
+	cases := []struct {
+		status int
+		result string
+		expect int
+	}{
+		{201, "created", _itemSucceeded},
+		{404, "not_found", _itemSucceeded},
+		{404, "", _itemRejected},
+		{400, "", _itemRejected},
+		{429, "", _itemRetry},
+		{503, "", _itemRetry},
+	}
+	for _, c := range cases {
+		if got := bulkItemOutcome(c.status, c.result); got != c.expect {
+			t.Errorf("status %d %s: expect %d, got %d", c.status, c.result, c.expect, got)
+		}
+	}
+	if kafkaItemOutcome(sarama.ErrMessageSizeTooLarge) != _itemRejected || kafkaItemOutcome(sarama.ErrNotLeaderForPartition) != _itemRetry {
+		t.Error("unexpected kafka outcome")
+	}
+}
+
+// 第一次bulk中文档1的index被限流、文档2成功，之后文档1的update须随之重试以保持顺序
+func TestDoBulkRetriesFailedItems(t *testing.T) {
+	var lock sync.Mutex
+	var calls [][]string // 每次bulk请求中各条目的文档ID
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ids []string
+		scanner := bufio.NewScanner(r.Body)
+		for i := 0; scanner.Scan(); i++ {
+			var line map[string]map[string]interface{}
+			stdjson.Unmarshal(scanner.Bytes(), &line)
+			for _, meta := range line {
+				if id, ok := meta["_id"]; ok {
+					ids = append(ids, id.(string))
+				}
+			}
+		}
+		lock.Lock()
+		calls = append(calls, ids)
+		first := len(calls) == 1
+		lock.Unlock()
+
+		var items []string
+		for i, id := range ids {
+			status := 200
+			if first && i == 0 {
+				status = 429
+			}
+			items = append(items, fmt.Sprintf(`{"index":{"_index":"a","_id":"%s","status":%d}}`, id, status))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"took":1,"errors":%t,"items":[%s]}`, first, strings.Join(items, ","))
+	}))
+	defer server.Close()
+
+	client, err := elastic.NewClient(elastic.SetURL(server.URL), elastic.SetSniff(false), elastic.SetHealthcheck(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Elastic7Endpoint{client: client, cfg: &global.Config{}, transport: newRetryAfterTransport()}
+	reqs := []elastic.BulkableRequest{
+		elastic.NewBulkIndexRequest().Index("a").Id("1").Doc(`{"v":1}`),
+		elastic.NewBulkIndexRequest().Index("a").Id("2").Doc(`{"v":2}`),
+		elastic.NewBulkUpdateRequest().Index("a").Id("1").Doc(`{"v":3}`),
+	}
+	if err := s.doBulk(context.Background(), reqs, []string{"t", "t", "t"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(calls) != 2 || strings.Join(calls[1], ",") != "1,1" {
+		t.Fatalf("unexpected bulk calls: %v", calls)
+	}
+}
+
+type fakeSyncProducer struct {
+	calls [][]*sarama.ProducerMessage
+	fail  func(call int, m *sarama.ProducerMessage) error
+}
+
+func (p *fakeSyncProducer) SendMessage(m *sarama.ProducerMessage) (int32, int64, error) {
+	return 0, 0, p.SendMessages([]*sarama.ProducerMessage{m})
+}
+
+func (p *fakeSyncProducer) SendMessages(ms []*sarama.ProducerMessage) error {
+	p.calls = append(p.calls, ms)
+	var errs sarama.ProducerErrors
+	for _, m := range ms {
+		if err := p.fail(len(p.calls), m); err != nil {
+			errs = append(errs, &sarama.ProducerError{Msg: m, Err: err})
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (p *fakeSyncProducer) Close() error {
+	return nil
+}
+
+func TestKafkaSendRetriesFailedMessages(t *testing.T) {
+	producer := &fakeSyncProducer{
+		fail: func(call int, m *sarama.ProducerMessage) error {
+			if call == 1 && string(m.Value.(sarama.StringEncoder)) == "b" {
+				return sarama.ErrNotLeaderForPartition
+			}
+			return nil
+		},
+	}
+	s := &KafkaEndpoint{batch: producer, cfg: &global.Config{}}
+	ms := []*sarama.ProducerMessage{
+		{Topic: "t", Value: sarama.StringEncoder("a")},
+		{Topic: "t", Key: sarama.StringEncoder("k"), Value: sarama.StringEncoder("b")},
+		{Topic: "t", Value: sarama.StringEncoder("c")},
+		{Topic: "t", Partition: 1, Value: sarama.StringEncoder("d")},
+		{Topic: "t", Partition: 2, Key: sarama.StringEncoder("k"), Value: sarama.StringEncoder("e")},
+	}
+	if err := s.send(context.Background(), ms); err != nil {
+		t.Fatal(err)
+	}
+	// 重试失败的消息及其后同一分区、同一key的消息，保持原有顺序
+	if len(producer.calls) != 2 {
+		t.Fatalf("expect one retry, calls: %d", len(producer.calls))
+	}
+	var retried []string
+	for _, m := range producer.calls[1] {
+		retried = append(retried, messageValue(m))
+	}
+	if strings.Join(retried, ",") != "b,c,e" {
+		t.Fatalf("unexpected retried messages %v", retried)
+	}
+}
+
+func TestTimedWritesWaitAbandoned(t *testing.T) {
+	var w timedWrites
+	release := make(chan struct{})
+	var finished bool
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	err := w.do(ctx, func() error {
+		<-release
+		finished = true
+		return nil
+	})
+	cancel()
+	if err == nil {
+		t.Fatal("expect timeout error")
+	}
+
+	// 超时的写入未结束时，新的写入在上下文取消后放弃且不执行
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	err = w.do(ctx, func() error {
+		t.Error("write started before the abandoned write finished")
+		return nil
+	})
+	cancel()
+	if err == nil {
+		t.Fatal("expect error while the abandoned write is running")
+	}
+
+	close(release)
+	err = w.do(context.Background(), func() error {
+		if !finished {
+			t.Error("write started before the abandoned write finished")
+		}
+		return nil
+	})
+	if err != nil || len(w.abandoned) != 0 {
+		t.Fatalf("unexpected %v %d", err, len(w.abandoned))
+	}
+}
@@ -0,0 +1,113 @@
+/*
+ * Copyright 2020-2021 the original author(https://github.com/wj596)
+ *
+ * <p>
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * </p>
+ */
+package endpoint
+
+import (
+	"strconv"
+
+	"github.com/siddontang/go-mysql/canal"
+
+	"go-mysql-transfer/global"
+	"go-mysql-transfer/model"
+	"go-mysql-transfer/util/stringutil"
+)
+
+// coalesceSlot 同一标识在一批数据中合并后的操作，删除总在写入之前
+type coalesceSlot struct {
+	del   *model.RowRequest
+	write *model.RowRequest
+	row   *model.RowRequest // 不参与合并的数据
+	dead  bool
+}
+
+// Coalesce 合并一批数据中同一标识的多次变更，同一标识的操作保持binlog顺序：
+// insert/update后的delete只保留delete；delete后的insert保留delete、insert两个操作；
+// insert后的update合并为insert；合并后的操作位于该标识最后一次变更的位置
+func Coalesce(rows []*model.RowRequest) []*model.RowRequest {
+	slots := make(map[string]*coalesceSlot, len(rows))
+	order := make([]*coalesceSlot, 0, len(rows))
+	for _, row := range rows {
+		rule, ok := global.RuleIns(row.RuleKey)
+		// Lua脚本可能产生任意操作，不合并；strict规则合并会改变不同标识之间的顺序
+		if !ok || rule.LuaEnable() || rule.Ordering == global.OrderingStrict || len(rule.KeyColumnIndexes) == 0 {
+			order = append(order, &coalesceSlot{row: row})
+			continue
+		}
+
+		key := coalesceKey(row, rule)
+		slot := &coalesceSlot{}
+		if last, exist := slots[key]; exist {
+			// 移到最后一次变更的位置，不改变与其他标识之间的相对顺序
+			*slot = *last
+			last.dead = true
+		}
+		slots[key] = slot
+		order = append(order, slot)
+
+		switch row.Action {
+		case canal.DeleteAction:
+			slot.del = row
+			slot.write = nil
+		case canal.UpdateAction:
+			if slot.write != nil && slot.write.Action == canal.InsertAction {
+				v := *row
+				v.Action = canal.InsertAction
+				v.Old = nil
+				slot.write = &v
+			} else {
+				slot.write = row
+			}
+		default:
+			slot.write = row
+		}
+	}
+
+	ret := make([]*model.RowRequest, 0, len(rows))
+	for _, slot := range order {
+		if slot.dead {
+			continue
+		}
+		if slot.row != nil {
+			ret = append(ret, slot.row)
+			continue
+		}
+		if slot.del != nil {
+			ret = append(ret, slot.del)
+		}
+		if slot.write != nil {
+			ret = append(ret, slot.write)
+		}
+	}
+	return ret
+}
+
+func coalesceKey(row *model.RowRequest, rule *global.Rule) string {
+	key := row.RuleKey + "|" + row.Endpoint
+	if row.Element > 0 {
+		key += "|" + strconv.Itoa(row.Element)
+	}
+	if rule.UseSurrogate(row.Row) {
+		return key + "|surrogate|" + stringutil.ToString(row.Row[rule.SurrogateIndex])
+	}
+	for _, index := range rule.KeyColumnIndexes {
+		if index < len(row.Row) {
+			key += "|" + stringutil.ToString(row.Row[index])
+		}
+	}
+	return key
+}
@@ -0,0 +1,81 @@
+package endpoint
+
+import (
+	"testing"
+
+	"github.com/siddontang/go-mysql/canal"
+
+	"go-mysql-transfer/global"
+	"go-mysql-transfer/model"
+)
+
+func TestCoalesce(t *testing.T) {
+	global.AddRuleIns("test:user", &global.Rule{KeyColumnIndexes: []int{0}})
+
+	row := func(action string, id int64, name string) *model.RowRequest {
+		return &model.RowRequest{RuleKey: "test:user", Action: action, Row: []interface{}{id, name}}
+	}
+	expect := func(rows []*model.RowRequest, actions ...string) {
+		t.Helper()
+		if len(rows) != len(actions) {
+			t.Fatalf("expect %d rows, but %d", len(actions), len(rows))
+		}
+		for i, action := range actions {
+			if rows[i].Action != action {
+				t.Errorf("row %d: expect %s, but %s", i, action, rows[i].Action)
+			}
+		}
+	}
+
+	// insert→delete→insert：删除必须在最后一次插入之前
+	rows := Coalesce([]*model.RowRequest{
+		row(canal.InsertAction, 1, "a"),
+		row(canal.DeleteAction, 1, "a"),
+		row(canal.InsertAction, 1, "b"),
+	})
+	expect(rows, canal.DeleteAction, canal.InsertAction)
+	if rows[1].Row[1] != "b" {
+		t.Errorf("expect last insert, but %v", rows[1].Row)
+	}
+
+	// insert→delete：只保留删除
+	rows = Coalesce([]*model.RowRequest{
+		row(canal.InsertAction, 1, "a"),
+		row(canal.DeleteAction, 1, "a"),
+	})
+	expect(rows, canal.DeleteAction)
+
+	// insert→update：合并为插入最新的数据
+	rows = Coalesce([]*model.RowRequest{
+		row(canal.InsertAction, 1, "a"),
+		row(canal.UpdateAction, 1, "b"),
+	})
+	expect(rows, canal.InsertAction)
+	if rows[0].Row[1] != "b" {
+		t.Errorf("expect updated row, but %v", rows[0].Row)
+	}
+
+	// 不同标识互不影响，合并后位于最后一次变更的位置
+	rows = Coalesce([]*model.RowRequest{
+		row(canal.InsertAction, 1, "a"),
+		row(canal.InsertAction, 2, "x"),
+		row(canal.DeleteAction, 1, "a"),
+		row(canal.InsertAction, 1, "b"),
+	})
+	expect(rows, canal.InsertAction, canal.DeleteAction, canal.InsertAction)
+	if rows[0].Row[0] != int64(2) || rows[2].Row[1] != "b" {
+		t.Errorf("unexpected order %v %v %v", rows[0].Row, rows[1].Row, rows[2].Row)
+	}
+
+	// strict规则不合并
+	global.AddRuleIns("test:audit", &global.Rule{KeyColumnIndexes: []int{0}, Ordering: global.OrderingStrict})
+	audit := func(action string, id int64) *model.RowRequest {
+		return &model.RowRequest{RuleKey: "test:audit", Action: action, Row: []interface{}{id}}
+	}
+	rows = Coalesce([]*model.RowRequest{
+		audit(canal.InsertAction, 1),
+		audit(canal.InsertAction, 2),
+		audit(canal.UpdateAction, 1),
+	})
+	expect(rows, canal.InsertAction, canal.InsertAction, canal.UpdateAction)
+}
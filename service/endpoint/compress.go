@@ -0,0 +1,85 @@
+/*
+ * Copyright 2020-2021 the original author(https://github.com/wj596)
+ *
+ * <p>
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * </p>
+ */
+package endpoint
+
+import (
+	"bytes"
+	"compress/gzip"
+
+	"github.com/golang/snappy"
+	"github.com/juju/errors"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4"
+
+	"go-mysql-transfer/global"
+	"go-mysql-transfer/metrics"
+)
+
+// ContentEncodingHeader 消息体经过压缩时，rocketmq的消息属性、rabbitmq的content_encoding记录压缩算法
+const ContentEncodingHeader = "Content-Encoding"
+
+var _zstdEncoder *zstd.Encoder
+
+func init() {
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		panic(errors.Annotate(err, "create zstd encoder"))
+	}
+	_zstdEncoder = encoder
+}
+
+// compressBody 按mq_compression压缩消息体，未配置时原样返回；
+// snappy为块格式(snappy.Encode)，lz4为帧格式，gzip、zstd为标准格式
+func compressBody(cfg *global.Config, body []byte) ([]byte, error) {
+	if !cfg.MQCompressionEnable() {
+		return body, nil
+	}
+
+	var compressed []byte
+	switch cfg.MQCompression {
+	case global.CompressionGzip:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(body); err != nil {
+			return nil, errors.Trace(err)
+		}
+		if err := w.Close(); err != nil {
+			return nil, errors.Trace(err)
+		}
+		compressed = buf.Bytes()
+	case global.CompressionSnappy:
+		compressed = snappy.Encode(nil, body)
+	case global.CompressionLz4:
+		var buf bytes.Buffer
+		w := lz4.NewWriter(&buf)
+		if _, err := w.Write(body); err != nil {
+			return nil, errors.Trace(err)
+		}
+		if err := w.Close(); err != nil {
+			return nil, errors.Trace(err)
+		}
+		compressed = buf.Bytes()
+	case global.CompressionZstd:
+		compressed = _zstdEncoder.EncodeAll(body, nil)
+	default:
+		return nil, errors.Errorf("unsupported mq_compression %s", cfg.MQCompression)
+	}
+
+	metrics.ObserveCompression(len(body), len(compressed))
+	return compressed, nil
+}
@@ -0,0 +1,94 @@
+/*
+ * Copyright 2020-2021 the original author(https://github.com/wj596)
+ *
+ * <p>
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * </p>
+ */
+package endpoint
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"go-mysql-transfer/global"
+	"go-mysql-transfer/metrics"
+)
+
+var _dialer = &net.Dialer{
+	Timeout:   30 * time.Second,
+	KeepAlive: 30 * time.Second,
+}
+
+// connCounter 开启conn_metrics时统计到接收端的TCP连接的建立、关闭及失败，按接收端名称区分；
+// 用于elasticsearch、mongodb、kafka、rabbitmq、postgresql及redis的单机、分片方式，不支持rocketmq和redis的哨兵、集群方式
+type connCounter struct {
+	name string
+}
+
+// newConnCounter 未开启conn_metrics时为nil
+func newConnCounter(cfg *global.Config) *connCounter {
+	if !cfg.ConnMetrics {
+		return nil
+	}
+	return &connCounter{name: cfg.EndpointName()}
+}
+
+func (c *connCounter) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return c.track(_dialer.DialContext(ctx, network, addr))
+}
+
+func (c *connCounter) Dial(network, addr string) (net.Conn, error) {
+	return c.track(_dialer.Dial(network, addr))
+}
+
+func (c *connCounter) DialTimeout(network, addr string, timeout time.Duration) (net.Conn, error) {
+	dialer := *_dialer
+	dialer.Timeout = timeout
+	return c.track(dialer.Dial(network, addr))
+}
+
+// redisDialer 用于redis.Options.Dialer，未开启时为nil即使用默认方式
+func (c *connCounter) redisDialer(addr string) func() (net.Conn, error) {
+	if c == nil {
+		return nil
+	}
+	return func() (net.Conn, error) {
+		return c.Dial("tcp", addr)
+	}
+}
+
+// track 记录dial的结果，返回的连接关闭时记录关闭
+func (c *connCounter) track(conn net.Conn, err error) (net.Conn, error) {
+	if err != nil {
+		metrics.IncEndpointConnError(c.name)
+		return nil, err
+	}
+	metrics.EndpointConnOpened(c.name)
+	return &countedConn{Conn: conn, name: c.name}, nil
+}
+
+type countedConn struct {
+	net.Conn
+	name string
+	once sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(func() {
+		metrics.EndpointConnClosed(c.name)
+	})
+	return c.Conn.Close()
+}
@@ -19,7 +19,9 @@ package endpoint
 
 import (
 	"context"
+	"fmt"
 	"log"
+	"net/http"
 	"sync"
 
 	"github.com/juju/errors"
@@ -40,15 +42,18 @@ type Elastic7Endpoint struct {
 	first  string
 	hosts  []string
 	client *elastic.Client
+	cfg    *global.Config
 
+	transport *retryAfterTransport
 	retryLock sync.Mutex
 }
 
-func newElastic7Endpoint() *Elastic7Endpoint {
-	hosts := elsHosts(global.Cfg().ElsAddr)
+func newElastic7Endpoint(cfg *global.Config) *Elastic7Endpoint {
+	hosts := elsHosts(cfg.ElsAddr)
 	r := &Elastic7Endpoint{}
 	r.hosts = hosts
 	r.first = hosts[0]
+	r.cfg = cfg
 	return r
 }
 
@@ -56,8 +61,13 @@ func (s *Elastic7Endpoint) Connect() error {
 	var options []elastic.ClientOptionFunc
 	options = append(options, elastic.SetErrorLog(logagent.NewElsLoggerAgent()))
 	options = append(options, elastic.SetURL(s.hosts...))
-	if global.Cfg().ElsUser != "" && global.Cfg().ElsPassword != "" {
-		options = append(options, elastic.SetBasicAuth(global.Cfg().ElsUser, global.Cfg().Password))
+	s.transport = newRetryAfterTransport()
+	if counter := newConnCounter(s.cfg); counter != nil {
+		s.transport.RoundTripper.(*http.Transport).DialContext = counter.DialContext
+	}
+	options = append(options, elastic.SetHttpClient(s.transport.client()))
+	if s.cfg.ElsUser != "" && s.cfg.ElsPassword != "" {
+		options = append(options, elastic.SetBasicAuth(s.cfg.ElsUser, s.cfg.Password))
 	}
 
 	client, err := elastic.NewClient(options...)
@@ -71,6 +81,13 @@ func (s *Elastic7Endpoint) Connect() error {
 
 func (s *Elastic7Endpoint) indexMapping() error {
 	for _, rule := range global.RuleInsList() {
+		if rule.PartitionEnable() {
+			if err := s.putIndexTemplate(rule); err != nil {
+				return err
+			}
+			continue
+		}
+
 		exists, err := s.client.IndexExists(rule.ElsIndex).Do(context.Background())
 		if err != nil {
 			return err
@@ -116,6 +133,36 @@ func (s *Elastic7Endpoint) insertIndexMapping(rule *global.Rule) error {
 	return nil
 }
 
+// putIndexTemplate 按时间分区的规则以索引模板定义mappings，分区索引在首次写入时由ES按模板创建
+func (s *Elastic7Endpoint) putIndexTemplate(rule *global.Rule) error {
+	var properties map[string]interface{}
+	if rule.LuaEnable() {
+		properties = buildPropertiesByMappings(rule)
+	} else {
+		properties = buildPropertiesByRule(rule)
+	}
+
+	template := map[string]interface{}{
+		"index_patterns": []string{partitionPattern(rule)},
+		"mappings": map[string]interface{}{
+			"properties": properties,
+		},
+	}
+	body := stringutil.ToJsonString(template)
+
+	ret, err := s.client.IndexPutTemplate(rule.ElsIndex).BodyString(body).Do(context.Background())
+	if err != nil {
+		return err
+	}
+	if !ret.Acknowledged {
+		return errors.Errorf("put index template %s err", rule.ElsIndex)
+	}
+
+	logs.Infof("put index template: %s ,mappings: %s", rule.ElsIndex, body)
+
+	return nil
+}
+
 func (s *Elastic7Endpoint) updateIndexMapping(rule *global.Rule) error {
 	ret, err := s.client.GetMapping().Index(rule.ElsIndex).Do(context.Background())
 	if err != nil {
@@ -180,7 +227,8 @@ func (s *Elastic7Endpoint) Ping() error {
 }
 
 func (s *Elastic7Endpoint) Consume(from mysql.Position, rows []*model.RowRequest) error {
-	bulk := s.client.Bulk()
+	var reqs []elastic.BulkableRequest
+	var labs []string
 	for _, row := range rows {
 		rule, _ := global.RuleIns(row.RuleKey)
 		if rule.TableColumnSize != len(row.Row) {
@@ -194,48 +242,111 @@ func (s *Elastic7Endpoint) Consume(from mysql.Position, rows []*model.RowRequest
 			kvm := rowMap(row, rule, true)
 			ls, err := luaengine.DoESOps(kvm, row.Action, rule)
 			if err != nil {
-				log.Println("Lua 脚本执行失败!!! ,详情请参见日志")
-				return errors.Errorf("lua 脚本执行失败 : %s ", errors.ErrorStack(err))
+				if err = luaFailed(row, rule, kvm, err); err != nil {
+					return err
+				}
+				continue
 			}
 			for _, resp := range ls {
 				logs.Infof("action: %s, Index: %s , Id:%s, value: %v", resp.Action, resp.Index, resp.Id, resp.Date)
-				s.prepareBulk(resp.Action, resp.Index, resp.Id, resp.Date, bulk)
+				if req := s.prepareBulk(resp.Action, resp.Index, resp.Id, resp.Date, luaPipeline(resp.Action, rule)); req != nil {
+					reqs = append(reqs, req)
+					labs = append(labs, row.RuleKey)
+				}
 			}
 		} else {
 			kvm := rowMap(row, rule, false)
+			withWatermark(kvm, row, rule)
+			withSource(kvm)
+			withEventTime(kvm, row, rule, false)
 			id := primaryKey(row, rule)
 			body := encodeValue(rule, kvm)
-			logs.Infof("action: %s, Index: %s , Id:%s, value: %v", row.Action, rule.ElsIndex, id, body)
-			s.prepareBulk(row.Action, rule.ElsIndex, stringutil.ToString(id), body, bulk)
+			observePayload(row, rule, len(body))
+			index := rule.PartitionName(rule.ElsIndex, row.Row)
+			action := row.Action
+			if row.Upsert {
+				action = canal.InsertAction // index请求不存在时插入、存在时整体替换
+			}
+			logs.Infof("action: %s, Index: %s , Id:%s, value: %v", action, index, id, body)
+			if req := s.prepareBulk(action, index, stringutil.ToString(id), body, rule.ElsPipeline); req != nil {
+				reqs = append(reqs, req)
+				labs = append(labs, row.RuleKey)
+			}
 		}
 	}
 
-	if bulk.NumberOfActions() == 0 {
+	if len(reqs) == 0 {
 		return nil
 	}
 
-	r, err := bulk.Do(context.Background())
-	if err != nil {
+	ctx, cancel := writeContext(s.cfg)
+	defer cancel()
+	if err := s.doBulk(ctx, reqs, labs); err != nil {
 		return err
 	}
 
-	if len(r.Failed()) > 0 {
-		for _, f := range r.Failed() {
-			reason := f.Index + " " + f.Type + " " + f.Result
-			if f.Error == nil && "not_found" == f.Result {
-				return nil
+	logs.Infof("处理完成 %d 条数据", len(rows))
+	return nil
+}
+
+// doBulk 批量写入，只重试失败的条目(同一文档其后的条目一并重试以保持顺序)，被拒绝的条目按rejected_item_policy处理
+func (s *Elastic7Endpoint) doBulk(ctx context.Context, reqs []elastic.BulkableRequest, labs []string) error {
+	for attempt := 0; ; attempt++ {
+		r, err := s.client.Bulk().Add(reqs...).Do(ctx)
+		if err != nil {
+			if elastic.IsStatusCode(err, http.StatusTooManyRequests) {
+				return s.transport.throttled(err.Error())
 			}
+			log.Println(err.Error())
+			return err
+		}
 
-			if f.Error != nil {
-				reason = f.Error.Reason
+		var retryReqs []elastic.BulkableRequest
+		var retryLabs []string
+		var reason string
+		throttled := true
+		failed := make(map[string]bool)
+		for i, item := range r.Items {
+			if i >= len(reqs) {
+				break
+			}
+			for _, f := range item {
+				doc := f.Index + "/" + f.Id
+				outcome := bulkItemOutcome(f.Status, f.Result)
+				if outcome == _itemSucceeded && !failed[doc] {
+					continue
+				}
+				if outcome == _itemRejected {
+					if err := rejectItem(s.cfg, labs[i], s.itemReason(f), bulkSource(reqs[i])); err != nil {
+						return err
+					}
+					continue
+				}
+				if outcome == _itemRetry {
+					reason = s.itemReason(f)
+					throttled = throttled && f.Status == http.StatusTooManyRequests
+				}
+				failed[doc] = true
+				retryReqs = append(retryReqs, reqs[i])
+				retryLabs = append(retryLabs, labs[i])
+			}
+		}
+		if len(retryReqs) == 0 {
+			return nil
+		}
+		if attempt >= _batchRetries {
+			if throttled {
+				return s.transport.throttled(reason)
 			}
-			log.Println(reason)
 			return errors.New(reason)
 		}
-	}
 
-	logs.Infof("处理完成 %d 条数据", len(rows))
-	return nil
+		logs.Warnf("%d of %d bulk items failed, retry: %s", len(retryReqs), len(reqs), reason)
+		if err := retryWait(ctx, attempt); err != nil {
+			return err
+		}
+		reqs, labs = retryReqs, retryLabs
+	}
 }
 
 func (s *Elastic7Endpoint) Stock(rows []*model.RowRequest) int64 {
@@ -255,21 +366,32 @@ func (s *Elastic7Endpoint) Stock(rows []*model.RowRequest) int64 {
 			kvm := rowMap(row, rule, true)
 			ls, err := luaengine.DoESOps(kvm, row.Action, rule)
 			if err != nil {
-				logs.Errorf("lua 脚本执行失败 : %s ", errors.ErrorStack(err))
-				break
+				if err = luaFailed(row, rule, kvm, err); err != nil {
+					logs.Error(err.Error())
+					break
+				}
+				continue
 			}
 			for _, resp := range ls {
-				s.prepareBulk(resp.Action, resp.Index, resp.Id, resp.Date, bulk)
+				if req := s.prepareBulk(resp.Action, resp.Index, resp.Id, resp.Date, luaPipeline(resp.Action, rule)); req != nil {
+					bulk.Add(req)
+				}
 			}
 		} else {
 			kvm := rowMap(row, rule, false)
+			withSource(kvm)
 			id := primaryKey(row, rule)
 			body := encodeValue(rule, kvm)
-			s.prepareBulk(row.Action, rule.ElsIndex, stringutil.ToString(id), body, bulk)
+			observePayload(row, rule, len(body))
+			if req := s.prepareBulk(row.Action, rule.PartitionName(rule.ElsIndex, row.Row), stringutil.ToString(id), body, rule.ElsPipeline); req != nil {
+				bulk.Add(req)
+			}
 		}
 	}
 
-	r, err := bulk.Do(context.Background())
+	ctx, cancel := writeContext(s.cfg)
+	defer cancel()
+	r, err := bulk.Do(ctx)
 	if err != nil {
 		logs.Error(errors.ErrorStack(err))
 		return 0
@@ -284,24 +406,76 @@ func (s *Elastic7Endpoint) Stock(rows []*model.RowRequest) int64 {
 	return int64(len(r.Succeeded()))
 }
 
-func (s *Elastic7Endpoint) prepareBulk(action, index, id, doc string, bulk *elastic.BulkService) {
+// itemReason bulk响应中失败条目的原因
+func (s *Elastic7Endpoint) itemReason(f *elastic.BulkResponseItem) string {
+	if f.Error != nil {
+		return fmt.Sprintf("%d %s: %s", f.Status, f.Error.Type, f.Error.Reason)
+	}
+	return fmt.Sprintf("%d %s %s", f.Status, f.Index, f.Result)
+}
+
+// prepareBulk pipeline不为空时insert、update均以index请求经pipeline写入完整文档，lua脚本的update不传入pipeline
+func (s *Elastic7Endpoint) prepareBulk(action, index, id, doc, pipeline string) elastic.BulkableRequest {
+	logs.Infof("index: %s, doc: %s", index, doc)
+	if pipeline != "" && action == canal.UpdateAction {
+		action = canal.InsertAction
+	}
 	switch action {
 	case canal.InsertAction:
 		req := elastic.NewBulkIndexRequest().Index(index).Id(id).Doc(doc)
-		bulk.Add(req)
+		if pipeline != "" {
+			req.Pipeline(pipeline)
+		}
+		return req
 	case canal.UpdateAction:
-		req := elastic.NewBulkUpdateRequest().Index(index).Id(id).Doc(doc)
-		bulk.Add(req)
+		return elastic.NewBulkUpdateRequest().Index(index).Id(id).Doc(doc)
 	case canal.DeleteAction:
-		req := elastic.NewBulkDeleteRequest().Index(index).Id(id)
-		bulk.Add(req)
+		return elastic.NewBulkDeleteRequest().Index(index).Id(id)
 	}
+	return nil
+}
 
-	logs.Infof("index: %s, doc: %s", index, doc)
+func (s *Elastic7Endpoint) Count(rule *global.Rule) (int64, error) {
+	return s.client.Count(partitionPattern(rule)).Do(context.Background())
+}
+
+func (s *Elastic7Endpoint) Fetch(rule *global.Rule, rows []*model.RowRequest) ([]interface{}, error) {
+	ret := make([]interface{}, len(rows))
+	if len(rows) == 0 {
+		return ret, nil
+	}
+
+	mget := s.client.Mget()
+	for _, row := range rows {
+		mget.Add(elastic.NewMultiGetItem().Index(rule.PartitionName(rule.ElsIndex, row.Row)).Id(Identity(row, rule)))
+	}
+	resp, err := mget.Do(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	for i, doc := range resp.Docs {
+		if i < len(ret) && doc.Found {
+			ret[i] = string(doc.Source)
+		}
+	}
+	return ret, nil
+}
+
+func (s *Elastic7Endpoint) Expect(rule *global.Rule, row *model.RowRequest) interface{} {
+	return encodeValue(rule, rowMap(row, rule, false))
 }
 
 func (s *Elastic7Endpoint) Close() {
 	if s.client != nil {
 		s.client.Stop()
 	}
+	if s.transport != nil {
+		s.transport.CloseIdleConnections()
+	}
+}
+
+// Recycle 关闭HTTP空闲连接，之后的请求重新解析地址、建立连接，不重新检查索引映射
+func (s *Elastic7Endpoint) Recycle() error {
+	s.transport.CloseIdleConnections()
+	return nil
 }
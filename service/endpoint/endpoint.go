@@ -19,18 +19,30 @@ package endpoint
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 
 	jsoniter "github.com/json-iterator/go"
+	"github.com/juju/errors"
 	"github.com/siddontang/go-mysql/canal"
 	"github.com/siddontang/go-mysql/mysql"
 	"github.com/siddontang/go-mysql/schema"
 
 	"go-mysql-transfer/global"
+	"go-mysql-transfer/metrics"
 	"go-mysql-transfer/model"
+	"go-mysql-transfer/service/lookup"
 	"go-mysql-transfer/service/luaengine"
+	"go-mysql-transfer/util/consistent"
 	"go-mysql-transfer/util/logs"
 	"go-mysql-transfer/util/stringutil"
 )
@@ -39,6 +51,15 @@ var json = jsoniter.ConfigCompatibleWithStandardLibrary
 
 const defaultDateFormatter = "2006-01-02"
 
+// maxSafeInteger JavaScript等按双精度浮点数解析时可精确表示的最大整数
+const maxSafeInteger = 1<<53 - 1
+
+// schema_topic消息的reason
+const (
+	SchemaReasonStartup = "startup" // 启动时发送所有规则的表结构
+	SchemaReasonDDL     = "ddl"     // 表结构变更后发送变更后的表结构
+)
+
 type Endpoint interface {
 	Connect() error
 	Ping() error
@@ -47,36 +68,67 @@ type Endpoint interface {
 	Close()
 }
 
+// Recycler 不需要重新连接即可回收连接的接收端，如elasticsearch关闭HTTP空闲连接；其余接收端按conn_max_lifetime、dns_refresh_interval回收时关闭后重新连接
+type Recycler interface {
+	Recycle() error
+}
+
+// Recycle 回收接收端的连接：实现了Recycler的直接回收，其余关闭后重新连接
+func Recycle(ep Endpoint) error {
+	if r, ok := ep.(Recycler); ok {
+		return r.Recycle()
+	}
+	ep.Close()
+	return ep.Connect()
+}
+
+// Publisher 支持向指定topic发送消息的接收端，如：kafka、rocketmq、rabbitmq
+type Publisher interface {
+	Publish(topic string, body []byte) error
+}
+
 func NewEndpoint(ds *canal.Canal) Endpoint {
 	cfg := global.Cfg()
 	luaengine.InitActuator(ds)
 
+	if len(cfg.Endpoints) > 0 {
+		return newRouterEndpoint(cfg)
+	}
+
+	return newEndpoint(cfg)
+}
+
+func newEndpoint(cfg *global.Config) Endpoint {
 	if cfg.IsRedis() {
-		return newRedisEndpoint()
+		return newRedisEndpoint(cfg)
 	}
 
 	if cfg.IsMongodb() {
-		return newMongoEndpoint()
+		return newMongoEndpoint(cfg)
 	}
 
 	if cfg.IsRocketmq() {
-		return newRocketEndpoint()
+		return newRocketEndpoint(cfg)
 	}
 
 	if cfg.IsRabbitmq() {
-		return newRabbitEndpoint()
+		return newRabbitEndpoint(cfg)
 	}
 
 	if cfg.IsKafka() {
-		return newKafkaEndpoint()
+		return newKafkaEndpoint(cfg)
+	}
+
+	if cfg.IsPostgresql() {
+		return newPostgresEndpoint(cfg)
 	}
 
 	if cfg.IsEls() {
 		if cfg.ElsVersion == 6 {
-			return newElastic6Endpoint()
+			return newElastic6Endpoint(cfg)
 		}
 		if cfg.ElsVersion == 7 {
-			return newElastic7Endpoint()
+			return newElastic7Endpoint(cfg)
 		}
 	}
 
@@ -121,13 +173,7 @@ func convertColumnData(value interface{}, col *schema.TableColumn, rule *global.
 			return strings.Join(sets, ",")
 		}
 	case schema.TYPE_BIT:
-		switch value := value.(type) {
-		case string:
-			if value == "\x01" {
-				return int64(1)
-			}
-			return int64(0)
-		}
+		return bitValue(value, col, rule)
 	case schema.TYPE_STRING:
 		switch value := value.(type) {
 		case []byte:
@@ -188,7 +234,7 @@ func convertColumnData(value interface{}, col *schema.TableColumn, rule *global.
 				logs.Error(err.Error())
 				return nil
 			}
-			return vv
+			value = vv
 		case []byte:
 			str := string(v)
 			vv, err := strconv.ParseInt(str, 10, 64)
@@ -196,9 +242,13 @@ func convertColumnData(value interface{}, col *schema.TableColumn, rule *global.
 				logs.Error(err.Error())
 				return nil
 			}
-			return vv
+			value = vv
 		}
+		return intAsString(value, col, rule)
 	case schema.TYPE_DECIMAL, schema.TYPE_FLOAT:
+		if scale, ok := rule.DecimalScaleColumns[col.Name]; ok {
+			return decimalScaled(value, scale)
+		}
 		switch v := value.(type) {
 		case string:
 			vv, err := strconv.ParseFloat(v, 64)
@@ -221,6 +271,129 @@ func convertColumnData(value interface{}, col *schema.TableColumn, rule *global.
 	return value
 }
 
+// decimalScaled 将DECIMAL值转为{unscaled,scale}，unscaled为按scale位小数放大后的整数，超出int64时为字符串
+func decimalScaled(value interface{}, scale int) interface{} {
+	var str string
+	switch v := value.(type) {
+	case string:
+		str = v
+	case []byte:
+		str = string(v)
+	case float64:
+		str = strconv.FormatFloat(v, 'f', scale, 64)
+	default:
+		str = fmt.Sprint(v)
+	}
+
+	str = strings.TrimSpace(str)
+	negative := strings.HasPrefix(str, "-")
+	str = strings.TrimLeft(str, "+-")
+	integer, fraction := str, ""
+	if i := strings.Index(str, "."); i >= 0 {
+		integer, fraction = str[:i], str[i+1:]
+	}
+	// 按声明的小数位数补齐或截断，如scale为2时1.5与1.50均为150
+	if len(fraction) < scale {
+		fraction += strings.Repeat("0", scale-len(fraction))
+	} else {
+		fraction = fraction[:scale]
+	}
+
+	digits := strings.TrimLeft(integer+fraction, "0")
+	if digits == "" {
+		digits = "0"
+		negative = false
+	}
+	for _, c := range digits {
+		if c < '0' || c > '9' {
+			logs.Errorf("invalid decimal value: %v", value)
+			return nil
+		}
+	}
+	if negative {
+		digits = "-" + digits
+	}
+
+	var unscaled interface{} = digits
+	if n, err := strconv.ParseInt(digits, 10, 64); err == nil {
+		unscaled = n
+	}
+	return map[string]interface{}{
+		"unscaled": unscaled,
+		"scale":    scale,
+	}
+}
+
+// bitValue 按规则的bit_format转换BIT类型，binlog中为整数，全量导入时为大端字节
+func bitValue(value interface{}, col *schema.TableColumn, rule *global.Rule) interface{} {
+	var n uint64
+	switch v := value.(type) {
+	case int64:
+		n = uint64(v)
+	case []byte:
+		for _, b := range v {
+			n = n<<8 | uint64(b)
+		}
+	case string:
+		for _, b := range []byte(v) {
+			n = n<<8 | uint64(b)
+		}
+	default:
+		return value
+	}
+
+	width := bitWidth(col)
+	switch rule.BitFormat {
+	case global.BitFormatBinary:
+		return fmt.Sprintf("%0*b", width, n)
+	case global.BitFormatBool:
+		if width == 1 {
+			return n != 0
+		}
+	}
+	return int64(n)
+}
+
+// bitWidth BIT(M)的位数M，未指定时为1
+func bitWidth(col *schema.TableColumn) int {
+	raw := strings.ToLower(col.RawType)
+	start := strings.Index(raw, "(")
+	end := strings.Index(raw, ")")
+	if start < 0 || end < start {
+		return 1
+	}
+	width, err := strconv.Atoi(raw[start+1 : end])
+	if err != nil || width <= 0 {
+		return 1
+	}
+	return width
+}
+
+// intAsString 按规则的int_as_string将整数转为字符串，避免下游按浮点数解析丢失精度
+func intAsString(value interface{}, col *schema.TableColumn, rule *global.Rule) interface{} {
+	if rule.IntAsString == "" {
+		return value
+	}
+	if rule.IntAsString != global.IntAsStringUnsafe {
+		if rule.IntStringColumns[col.Name] {
+			return fmt.Sprintf("%d", value)
+		}
+		return value
+	}
+
+	switch v := value.(type) {
+	case int64:
+		if v > maxSafeInteger || v < -maxSafeInteger {
+			return strconv.FormatInt(v, 10)
+		}
+	case uint64:
+		if v > maxSafeInteger {
+			return strconv.FormatUint(v, 10)
+		}
+	}
+	return value
+}
+
 func encodeValue(rule *global.Rule, kv map[string]interface{}) string {
 	if rule.ValueTmpl != nil {
 		var tmplBytes bytes.Buffer
@@ -234,7 +407,7 @@ func encodeValue(rule *global.Rule, kv map[string]interface{}) string {
 	var val string
 	switch rule.ValueEncoder {
 	case global.ValEncoderJson:
-		data, err := json.Marshal(kv)
+		data, err := json.Marshal(orderedData(rule, kv))
 		if err != nil {
 			logs.Error(err.Error())
 			val = ""
@@ -243,15 +416,27 @@ func encodeValue(rule *global.Rule, kv map[string]interface{}) string {
 		}
 	case global.ValEncoderKVCommas:
 		var ls []string
-		for k, v := range kv {
-			str := stringutil.ToString(k) + "=" + stringutil.ToString(v)
-			ls = append(ls, str)
+		if len(rule.OrderedFields) > 0 {
+			for _, k := range orderedKeys(rule, kv) {
+				ls = append(ls, k+"="+stringutil.ToString(kv[k]))
+			}
+		} else {
+			for k, v := range kv {
+				str := stringutil.ToString(k) + "=" + stringutil.ToString(v)
+				ls = append(ls, str)
+			}
 		}
 		val = strings.Join(ls, ",")
 	case global.ValEncoderVCommas:
 		var ls []string
-		for _, v := range kv {
-			ls = append(ls, stringutil.ToString(v))
+		if len(rule.OrderedFields) > 0 {
+			for _, k := range orderedKeys(rule, kv) {
+				ls = append(ls, stringutil.ToString(kv[k]))
+			}
+		} else {
+			for _, v := range kv {
+				ls = append(ls, stringutil.ToString(v))
+			}
 		}
 		val = strings.Join(ls, ",")
 	}
@@ -259,6 +444,329 @@ func encodeValue(rule *global.Rule, kv map[string]interface{}) string {
 	return val
 }
 
+// writeContext 每批数据写入接收端的上下文，超过write_timeout后取消
+func writeContext(cfg *global.Config) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), time.Duration(cfg.WriteTimeout)*time.Second)
+}
+
+// timedWrites 客户端不支持context时限时写入：上下文取消后放弃等待并返回错误，写入仍在后台执行；
+// 之后的写入先等待这些写入结束，避免重试的数据与仍在执行的写入交错导致乱序
+type timedWrites struct {
+	lock      sync.Mutex
+	abandoned []chan struct{} // 已放弃等待的写入，执行结束时关闭
+}
+
+func (w *timedWrites) do(ctx context.Context, fn func() error) error {
+	if err := w.wait(ctx); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	finished := make(chan struct{})
+	go func() {
+		done <- fn()
+		close(finished)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		w.lock.Lock()
+		w.abandoned = append(w.abandoned, finished)
+		w.lock.Unlock()
+		return errors.Annotate(ctx.Err(), "write to endpoint")
+	}
+}
+
+// wait 等待已放弃等待的写入执行结束，上下文取消时返回错误，不开始新的写入
+func (w *timedWrites) wait(ctx context.Context) error {
+	w.lock.Lock()
+	pending := append([]chan struct{}(nil), w.abandoned...)
+	w.lock.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	for _, finished := range pending {
+		select {
+		case <-finished:
+		case <-ctx.Done():
+			return errors.Annotate(ctx.Err(), "wait for the timed out write to endpoint")
+		}
+	}
+
+	w.lock.Lock()
+	running := w.abandoned[:0]
+	for _, finished := range w.abandoned {
+		select {
+		case <-finished:
+		default:
+			running = append(running, finished)
+		}
+	}
+	w.abandoned = running
+	w.lock.Unlock()
+	return nil
+}
+
+// encodeMessage 使用规则在该接收端的mq_format对应的序列化器编码消息体，stock为true表示全量导入的数据
+func encodeMessage(req *model.RowRequest, rule *global.Rule, cfg *global.Config, stock bool) ([]byte, error) {
+	body, err := serializerOf(rule, cfg).Serialize(rule, req, stock)
+	if err == nil {
+		observePayload(req, rule, len(body))
+	}
+	return body, err
+}
+
+// PublishDDL 将结构变更事件发送到ddl_topic
+func PublishDDL(enp Endpoint, req *model.DDLRequest) error {
+	publisher, ok := enp.(Publisher)
+	if !ok {
+		return nil
+	}
+	position := fmt.Sprintf("%s:%d", req.Name, req.Pos)
+	// 开启ignore_ddl前写入本地日志的DDL事件也不再发送
+	if global.Cfg().EmitDDL() {
+		if err := publishDDL(publisher, req, position); err != nil {
+			return err
+		}
+	}
+	// 变更后的表结构在DDL事件之后发送
+	return publishSchemas(publisher, req.Tables, SchemaReasonDDL, position)
+}
+
+func publishDDL(publisher Publisher, req *model.DDLRequest, position string) error {
+	var typ string
+	if fields := strings.Fields(req.Query); len(fields) > 0 {
+		typ = strings.ToUpper(fields[0])
+	}
+	resp := &model.DDLRespond{
+		Type:      typ,
+		Database:  req.Schema,
+		Query:     req.Query,
+		Timestamp: req.Timestamp,
+		Position:  position,
+		Tables:    req.Tables,
+		Source:    global.Cfg().SourceId,
+	}
+	body, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+
+	logs.Infof("topic: %s, ddl: %s", global.Cfg().DDLTopic, string(body))
+	return publisher.Publish(global.Cfg().DDLTopic, body)
+}
+
+// PublishSchemas 发送表结构到schema_topic，pos为已保存的位置
+func PublishSchemas(enp Endpoint, tables []*model.DDLTable, pos mysql.Position) error {
+	publisher, ok := enp.(Publisher)
+	if !ok {
+		return nil
+	}
+	return publishSchemas(publisher, tables, SchemaReasonStartup, fmt.Sprintf("%s:%d", pos.Name, pos.Pos))
+}
+
+func publishSchemas(publisher Publisher, tables []*model.DDLTable, reason, position string) error {
+	topic := global.Cfg().SchemaTopic
+	if topic == "" {
+		return nil
+	}
+	for _, t := range tables {
+		resp := &model.SchemaRespond{
+			Type:      "schema",
+			Reason:    reason,
+			Database:  t.Database,
+			Table:     t.Table,
+			Columns:   t.Columns,
+			PKs:       t.PKs,
+			Position:  position,
+			Timestamp: time.Now().Unix(),
+			Source:    global.Cfg().SourceId,
+		}
+		body, err := json.Marshal(resp)
+		if err != nil {
+			return err
+		}
+		logs.Infof("topic: %s, schema: %s", topic, string(body))
+		if err := publisher.Publish(topic, body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PublishHeartbeat 发送心跳消息到heartbeat_topic，pos为已保存的位置，可作为下游的水位线
+func PublishHeartbeat(enp Endpoint, pos mysql.Position) error {
+	resp := &model.HeartbeatRespond{
+		Type:      "heartbeat",
+		Position:  fmt.Sprintf("%s:%d", pos.Name, pos.Pos),
+		Timestamp: time.Now().Unix(),
+		Source:    global.Cfg().SourceId,
+	}
+	body, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+
+	if topic := global.Cfg().HeartbeatTopic; topic != "" {
+		if publisher, ok := enp.(Publisher); ok {
+			if err := publisher.Publish(topic, body); err != nil {
+				return err
+			}
+		}
+	}
+	if router, ok := enp.(*RouterEndpoint); ok {
+		return router.publishHeartbeat(body)
+	}
+	return nil
+}
+
+// EncodeRow 将行数据按规则转换后编码为JSON，供快照导出使用
+func EncodeRow(req *model.RowRequest, rule *global.Rule) ([]byte, error) {
+	return json.Marshal(orderedData(rule, rowMap(req, rule, false)))
+}
+
+// orderedRow 按规则的field_order顺序序列化为JSON
+type orderedRow struct {
+	keys []string
+	kv   map[string]interface{}
+}
+
+func (r *orderedRow) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, k := range r.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, err := json.Marshal(k)
+		if err != nil {
+			return nil, err
+		}
+		val, err := json.Marshal(r.kv[k])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(val)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// orderedData 规则配置了field_order时返回有序的行数据，否则原样返回
+func orderedData(rule *global.Rule, kv map[string]interface{}) interface{} {
+	if len(rule.OrderedFields) == 0 {
+		return kv
+	}
+	return &orderedRow{
+		keys: orderedKeys(rule, kv),
+		kv:   kv,
+	}
+}
+
+// orderedKeys 先按OrderedFields排列，其余(如默认值列)按名称排序
+func orderedKeys(rule *global.Rule, kv map[string]interface{}) []string {
+	keys := make([]string, 0, len(kv))
+	added := make(map[string]bool, len(kv))
+	for _, k := range rule.OrderedFields {
+		if _, ok := kv[k]; ok {
+			keys = append(keys, k)
+			added[k] = true
+		}
+	}
+
+	var rest []string
+	for k := range kv {
+		if !added[k] {
+			rest = append(rest, k)
+		}
+	}
+	sort.Strings(rest)
+	return append(keys, rest...)
+}
+
+// rowDiff 计算列的变更，insert只有new、delete只有old、update只包含发生变化的列
+func rowDiff(req *model.RowRequest, rule *global.Rule, primitive bool) map[string]map[string]interface{} {
+	diff := make(map[string]map[string]interface{})
+	switch req.Action {
+	case canal.InsertAction:
+		for k, v := range rowMap(req, rule, primitive) {
+			diff[k] = map[string]interface{}{"new": v}
+		}
+	case canal.DeleteAction:
+		for k, v := range rowMap(req, rule, primitive) {
+			diff[k] = map[string]interface{}{"old": v}
+		}
+	case canal.UpdateAction:
+		if req.Old == nil {
+			return diff
+		}
+		kvm := rowMap(req, rule, primitive)
+		for k, v := range oldRowMap(req, rule, primitive) {
+			if !reflect.DeepEqual(v, kvm[k]) {
+				diff[k] = map[string]interface{}{"old": v, "new": kvm[k]}
+			}
+		}
+	}
+	return diff
+}
+
+// luaDiff 规则开启diff_output时，提供给Lua脚本的变更列
+func luaDiff(req *model.RowRequest, rule *global.Rule) map[string]map[string]interface{} {
+	if !rule.DiffOutput {
+		return nil
+	}
+	return rowDiff(req, rule, true)
+}
+
+// watermarkOf 行数据在源库binlog中的位置，未开启include_position或全量导入的数据为nil
+func watermarkOf(req *model.RowRequest, rule *global.Rule) *model.Watermark {
+	if !rule.IncludePosition || req.LogName == "" {
+		return nil
+	}
+	return &model.Watermark{
+		Position: fmt.Sprintf("%s:%d", req.LogName, req.LogPos),
+		Offset:   req.Offset,
+		GTID:     req.GTID,
+	}
+}
+
+// withWatermark ES、MongoDB的文档中以WatermarkField字段记录行数据的位置
+func withWatermark(kvm map[string]interface{}, req *model.RowRequest, rule *global.Rule) {
+	if watermark := watermarkOf(req, rule); watermark != nil {
+		kvm[WatermarkField] = watermark
+	}
+}
+
+// withSource 配置了source_id时ES、MongoDB的文档中以source_id_field字段记录数据来源
+func withSource(kvm map[string]interface{}) {
+	if source := global.Cfg().SourceId; source != "" {
+		kvm[global.Cfg().SourceIdField] = source
+	}
+}
+
+// eventTime 开启event_time时返回binlog事件头中的时间，全量导入的数据没有事件时间
+func eventTime(req *model.RowRequest, rule *global.Rule) (time.Time, bool) {
+	if !rule.EventTime || req.Timestamp == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(req.Timestamp), 0), true
+}
+
+// withEventTime ES、MongoDB的文档中以event_time_field字段记录binlog事件时间，ES为RFC3339字符串，MongoDB为日期
+func withEventTime(kvm map[string]interface{}, req *model.RowRequest, rule *global.Rule, date bool) {
+	if t, ok := eventTime(req, rule); ok {
+		if date {
+			kvm[rule.EventTimeField] = t
+		} else {
+			kvm[rule.EventTimeField] = t.Format(time.RFC3339)
+		}
+	}
+}
+
 // rowMap 行信息转换为map[string]interface{}
 func rowMap(req *model.RowRequest, rule *global.Rule, primitive bool) map[string]interface{} {
 	kv := make(map[string]interface{}, len(rule.PaddingMap))
@@ -273,13 +781,13 @@ func rowMap(req *model.RowRequest, rule *global.Rule, primitive bool) map[string
 		}
 	}
 
-	if primitive {
-		for _, padding := range rule.PaddingMap {
-			kv[padding.ColumnName] = convertColumnData(req.Row[padding.ColumnIndex], padding.ColumnMetadata, rule)
-		}
-	} else {
-		for _, padding := range rule.PaddingMap {
-			kv[padding.WrapName] = convertColumnData(req.Row[padding.ColumnIndex], padding.ColumnMetadata, rule)
+	fillColumns(kv, req.Row, req.RuleKey, rule, primitive)
+	enrich(kv, req.Row, rule, primitive)
+	if rule.SoftDelete {
+		if primitive {
+			kv[rule.SoftDeleteField] = req.Deleted
+		} else {
+			kv[rule.WrapName(rule.SoftDeleteField)] = req.Deleted
 		}
 	}
 	return kv
@@ -298,33 +806,160 @@ func oldRowMap(req *model.RowRequest, rule *global.Rule, primitive bool) map[str
 		}
 	}
 
-	if primitive {
-		for _, padding := range rule.PaddingMap {
-			kv[padding.ColumnName] = convertColumnData(req.Old[padding.ColumnIndex], padding.ColumnMetadata, rule)
+	fillColumns(kv, req.Old, req.RuleKey, rule, primitive)
+	enrich(kv, req.Old, rule, primitive)
+	return kv
+}
+
+// fillColumns 转换列的值，超出max_value_length的按oversize_policy处理并在oversize_field中记录字段名称
+func fillColumns(kv map[string]interface{}, row []interface{}, ruleKey string, rule *global.Rule, primitive bool) {
+	var oversized []string
+	for _, padding := range rule.PaddingMap {
+		name := padding.WrapName
+		if primitive {
+			name = padding.ColumnName
 		}
-	} else {
-		for _, padding := range rule.PaddingMap {
-			kv[padding.WrapName] = convertColumnData(req.Old[padding.ColumnIndex], padding.ColumnMetadata, rule)
+		value := convertColumnData(row[padding.ColumnIndex], padding.ColumnMetadata, rule)
+		if vm := rule.ValueMapOf(padding.ColumnName); vm != nil {
+			value = vm.Apply(value)
+		}
+		if limit := rule.MaxLengthOf(padding.ColumnName); limit > 0 {
+			var over bool
+			if value, over = limitLength(value, limit, rule.OversizePolicy); over {
+				oversized = append(oversized, name)
+				metrics.IncOversizeValue(ruleKey)
+			}
+		}
+		kv[name] = value
+	}
+	if len(oversized) > 0 {
+		sort.Strings(oversized)
+		if primitive {
+			kv[rule.OversizeField] = oversized
+		} else {
+			kv[rule.WrapName(rule.OversizeField)] = oversized
+		}
+	}
+}
+
+// limitLength 字符串、二进制值超出limit(字节)时截断或替换为摘要，字符串截断不拆分UTF-8字符
+func limitLength(value interface{}, limit int, policy string) (interface{}, bool) {
+	var data []byte
+	switch v := value.(type) {
+	case string:
+		if len(v) <= limit {
+			return value, false
+		}
+		if policy == global.OversizeHash {
+			data = []byte(v)
+			break
+		}
+		n := limit
+		for n > 0 && !utf8.RuneStart(v[n]) {
+			n--
+		}
+		return v[:n], true
+	case []byte:
+		if len(v) <= limit {
+			return value, false
+		}
+		if policy != global.OversizeHash {
+			return v[:limit], true
+		}
+		data = v
+	default:
+		return value, false
+	}
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:]), true
+}
+
+// enrich 按规则的lookups以列的值关联参考表中的值，未关联到时为nil
+func enrich(kv map[string]interface{}, row []interface{}, rule *global.Rule, primitive bool) {
+	for _, l := range rule.Lookups {
+		if l.ColumnIndex < 0 || l.ColumnIndex >= len(row) {
+			continue
+		}
+		value, _ := lookup.Get(l.Name, row[l.ColumnIndex])
+		if primitive {
+			kv[l.As] = value
+		} else {
+			kv[rule.WrapName(l.As)] = value
 		}
 	}
-	return kv
 }
 
 func primaryKey(re *model.RowRequest, rule *global.Rule) interface{} {
-	if rule.IsCompositeKey { // 组合ID
+	if re.Element > 0 { // explode_column拆分出的元素
+		return fmt.Sprintf("%s_%d", stringutil.ToString(identity(re, rule)), re.Element)
+	}
+	return identity(re, rule)
+}
+
+func identity(re *model.RowRequest, rule *global.Rule) interface{} {
+	if rule.UseSurrogate(re.Row) {
+		if rule.KeyFormat == global.KeyFormatTyped {
+			return typedKey(re.Row, []int{rule.SurrogateIndex}, rule)
+		}
+		column := rule.TableInfo.Columns[rule.SurrogateIndex]
+		return convertColumnData(re.Row[rule.SurrogateIndex], &column, rule)
+	}
+	if rule.KeyFormat == global.KeyFormatTyped {
+		return typedKey(re.Row, rule.KeyColumnIndexes, rule)
+	}
+	if rule.IsCompositeIdentity() { // 组合ID
 		var key string
-		for _, index := range rule.TableInfo.PKColumns {
+		for _, index := range rule.KeyColumnIndexes {
 			key += stringutil.ToString(re.Row[index])
 		}
 		return key
 	} else {
-		index := rule.TableInfo.PKColumns[0]
+		index := rule.KeyColumnIndexes[0]
 		data := re.Row[index]
 		column := rule.TableInfo.Columns[index]
 		return convertColumnData(data, &column, rule)
 	}
 }
 
+// typedKey key_format为typed时按列类型格式化标识列的值，多列以冒号分隔，写入与删除使用相同的格式
+func typedKey(row []interface{}, indexes []int, rule *global.Rule) string {
+	values := make([]string, 0, len(indexes))
+	for _, index := range indexes {
+		values = append(values, typedKeyValue(row[index], &rule.TableInfo.Columns[index]))
+	}
+	return strings.Join(values, ":")
+}
+
+// typedKeyValue 整数为十进制，浮点数不使用科学计数法，BINARY、VARBINARY为十六进制(BINARY(n)补齐到声明的长度)，其余为原值
+func typedKeyValue(value interface{}, column *schema.TableColumn) string {
+	if value == nil {
+		return ""
+	}
+	if column.Type == schema.TYPE_BINARY {
+		var data []byte
+		switch v := value.(type) {
+		case string:
+			data = []byte(v)
+		case []byte:
+			data = v
+		}
+		var size int
+		if _, err := fmt.Sscanf(column.RawType, "binary(%d)", &size); err == nil && len(data) < size {
+			data = append(data, make([]byte, size-len(data))...)
+		}
+		return hex.EncodeToString(data)
+	}
+	switch v := value.(type) {
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return fmt.Sprintf("%d", v)
+	case float32:
+		return strconv.FormatFloat(float64(v), 'f', -1, 32)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return stringutil.ToString(value)
+}
+
 func elsHosts(addr string) []string {
 	var hosts []string
 	splits := strings.Split(addr, ",")
@@ -339,6 +974,39 @@ func elsHosts(addr string) []string {
 	return hosts
 }
 
+// partitionPattern 按时间分区的规则匹配所有分区索引，如events-*
+func partitionPattern(rule *global.Rule) string {
+	if rule.PartitionEnable() {
+		return rule.ElsIndex + "-*"
+	}
+	return rule.ElsIndex
+}
+
+// shardRing 按分片地址及权重(逗号分隔，与地址一一对应，为空时均为1)创建一致性哈希环，节点序号即分片序号
+func shardRing(addrs []string, weights string, virtualNodes int) *consistent.Ring {
+	var list []string
+	if weights != "" {
+		list = strings.Split(weights, ",")
+	}
+	ring := consistent.New(virtualNodes)
+	for i, addr := range addrs {
+		weight := 1
+		if list != nil {
+			weight, _ = strconv.Atoi(strings.TrimSpace(list[i]))
+		}
+		ring.Add(i, addr, weight)
+	}
+	return ring
+}
+
+// luaPipeline lua脚本的update可能只包含部分字段，仍以update请求写入(不经过es_pipeline)，避免index请求覆盖为部分文档
+func luaPipeline(action string, rule *global.Rule) string {
+	if action == canal.UpdateAction {
+		return ""
+	}
+	return rule.ElsPipeline
+}
+
 func buildPropertiesByRule(rule *global.Rule) map[string]interface{} {
 	properties := make(map[string]interface{})
 	for _, padding := range rule.PaddingMap {
@@ -349,7 +1017,14 @@ func buildPropertiesByRule(rule *global.Rule) map[string]interface{} {
 		case schema.TYPE_NUMBER:
 			property["type"] = "long"
 		case schema.TYPE_DECIMAL:
-			property["type"] = "double"
+			if _, ok := rule.DecimalScaleColumns[padding.ColumnName]; ok {
+				property["properties"] = map[string]interface{}{
+					"unscaled": map[string]interface{}{"type": "long"},
+					"scale":    map[string]interface{}{"type": "integer"},
+				}
+			} else {
+				property["type"] = "double"
+			}
 		case schema.TYPE_FLOAT:
 			property["type"] = "float"
 		case schema.TYPE_DATE:
@@ -361,6 +1036,9 @@ func buildPropertiesByRule(rule *global.Rule) map[string]interface{} {
 		default:
 			property["type"] = "keyword"
 		}
+		if directive, ok := rule.ColumnDirectives[padding.ColumnName]; ok && directive.EsType != "" {
+			property = map[string]interface{}{"type": directive.EsType}
+		}
 		properties[padding.WrapName] = property
 	}
 
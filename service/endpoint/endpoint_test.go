@@ -0,0 +1,312 @@
+package endpoint
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/schema"
+
+	"go-mysql-transfer/global"
+	"go-mysql-transfer/model"
+	"go-mysql-transfer/util/stringutil"
+)
+
+func TestIntAsString(t *testing.T) {
+	col := &schema.TableColumn{Name: "id", Type: schema.TYPE_NUMBER}
+	rule := &global.Rule{IntAsString: global.IntAsStringUnsafe}
+
+	if v := convertColumnData(int64(1<<53), col, rule); v != "9007199254740992" {
+		t.Errorf("expect string for value above 2^53, but %#v", v)
+	}
+	if v := convertColumnData(int64(-(1 << 60)), col, rule); v != "-1152921504606846976" {
+		t.Errorf("expect string for value below -2^53, but %#v", v)
+	}
+	if v := convertColumnData(uint64(18446744073709551615), col, rule); v != "18446744073709551615" {
+		t.Errorf("expect string for unsigned value, but %#v", v)
+	}
+	if v := convertColumnData(int64(1<<53-1), col, rule); v != int64(1<<53-1) {
+		t.Errorf("expect number for safe value, but %#v", v)
+	}
+	if v := convertColumnData("9223372036854775807", col, rule); v != "9223372036854775807" {
+		t.Errorf("expect string for parsed value, but %#v", v)
+	}
+
+	rule = &global.Rule{
+		IntAsString:      "id",
+		IntStringColumns: map[string]bool{"id": true},
+	}
+	if v := convertColumnData(int32(7), col, rule); v != "7" {
+		t.Errorf("expect string for listed column, but %#v", v)
+	}
+	other := &schema.TableColumn{Name: "age", Type: schema.TYPE_NUMBER}
+	if v := convertColumnData(int64(1<<60), other, rule); v != int64(1<<60) {
+		t.Errorf("expect number for unlisted column, but %#v", v)
+	}
+}
+
+func TestBitValue(t *testing.T) {
+	flag := &schema.TableColumn{Name: "flag", Type: schema.TYPE_BIT, RawType: "bit(1)"}
+	mask := &schema.TableColumn{Name: "mask", Type: schema.TYPE_BIT, RawType: "bit(10)"}
+
+	rule := &global.Rule{BitFormat: global.BitFormatInt}
+	if v := convertColumnData(int64(1), flag, rule); v != int64(1) {
+		t.Errorf("expect 1, but %#v", v)
+	}
+	if v := convertColumnData([]byte{0x02, 0x05}, mask, rule); v != int64(517) {
+		t.Errorf("expect 517, but %#v", v)
+	}
+	if v := convertColumnData(nil, mask, rule); v != nil {
+		t.Errorf("expect nil, but %#v", v)
+	}
+
+	rule = &global.Rule{BitFormat: global.BitFormatBinary}
+	if v := convertColumnData(int64(5), mask, rule); v != "0000000101" {
+		t.Errorf("expect 0000000101, but %#v", v)
+	}
+	if v := convertColumnData("\x01", flag, rule); v != "1" {
+		t.Errorf("expect 1, but %#v", v)
+	}
+
+	rule = &global.Rule{BitFormat: global.BitFormatBool}
+	if v := convertColumnData(int64(1), flag, rule); v != true {
+		t.Errorf("expect true, but %#v", v)
+	}
+	if v := convertColumnData([]byte{0x00}, flag, rule); v != false {
+		t.Errorf("expect false, but %#v", v)
+	}
+	if v := convertColumnData(int64(3), mask, rule); v != int64(3) {
+		t.Errorf("expect multi-bit column as int, but %#v", v)
+	}
+}
+
+func TestDecimalScaled(t *testing.T) {
+	price := &schema.TableColumn{Name: "price", Type: schema.TYPE_DECIMAL, RawType: "decimal(10,2)"}
+	rate := &schema.TableColumn{Name: "rate", Type: schema.TYPE_DECIMAL, RawType: "decimal(12,4)"}
+	total := &schema.TableColumn{Name: "total", Type: schema.TYPE_DECIMAL, RawType: "decimal(30)"}
+	rule := &global.Rule{DecimalScaleColumns: map[string]int{
+		"price": global.DecimalScale(price.RawType),
+		"rate":  global.DecimalScale(rate.RawType),
+		"total": global.DecimalScale(total.RawType),
+	}}
+
+	cases := []struct {
+		col      *schema.TableColumn
+		value    interface{}
+		unscaled interface{}
+		scale    int
+	}{
+		{price, "1.50", int64(150), 2},
+		{price, "1.5", int64(150), 2},
+		{price, []byte("-0.05"), int64(-5), 2},
+		{price, "-0.00", int64(0), 2},
+		{price, "12", int64(1200), 2},
+		{rate, "-3.1400", int64(-31400), 4},
+		{rate, "0.0001", int64(1), 4},
+		{total, "42", int64(42), 0},
+		{total, "-123456789012345678901234567890", "-123456789012345678901234567890", 0},
+	}
+	for _, c := range cases {
+		v, ok := convertColumnData(c.value, c.col, rule).(map[string]interface{})
+		if !ok {
+			t.Fatalf("expect map for %v, but %#v", c.value, v)
+		}
+		if v["unscaled"] != c.unscaled || v["scale"] != c.scale {
+			t.Errorf("%v: expect {%v %d}, but %#v", c.value, c.unscaled, c.scale, v)
+		}
+	}
+
+	if v := convertColumnData("1.25", &schema.TableColumn{Name: "other", Type: schema.TYPE_DECIMAL}, rule); v != 1.25 {
+		t.Errorf("expect float for column not in decimal_scaled, but %#v", v)
+	}
+}
+
+func TestLimitLength(t *testing.T) {
+	// "中"占3个字节，截断不拆分字符
+	if v, over := limitLength("ab中文", 4, global.OversizeTruncate); !over || v != "ab" {
+		t.Errorf("expect ab, but %v %v", v, over)
+	}
+	if v, over := limitLength("ab中文", 5, global.OversizeTruncate); !over || v != "ab中" {
+		t.Errorf("expect ab中, but %v %v", v, over)
+	}
+	if v, over := limitLength("abc", 3, global.OversizeTruncate); over || v != "abc" {
+		t.Errorf("expect abc unchanged, but %v %v", v, over)
+	}
+	if v, over := limitLength([]byte{1, 2, 3}, 2, global.OversizeTruncate); !over || len(v.([]byte)) != 2 {
+		t.Errorf("expect 2 bytes, but %v %v", v, over)
+	}
+	v, over := limitLength("abcd", 3, global.OversizeHash)
+	if !over || v != "sha256:88d4266fd4e6338d13b845fcf289579d209c897823b9217da3e161936f031589" {
+		t.Errorf("expect sha256 of abcd, but %v %v", v, over)
+	}
+	if v, over := limitLength(int64(123456), 3, global.OversizeTruncate); over || v != int64(123456) {
+		t.Errorf("expect number unchanged, but %v %v", v, over)
+	}
+}
+
+func TestRegisterSerializer(t *testing.T) {
+	RegisterSerializer("test-csv", SerializerFunc(func(rule *global.Rule, req *model.RowRequest, stock bool) ([]byte, error) {
+		return []byte(req.Action + "," + stringutil.ToString(req.Row[0])), nil
+	}))
+
+	if !global.MQFormatExist("test-csv") {
+		t.Fatal("expect mq_format registered")
+	}
+
+	rule := &global.Rule{MQFormat: "test-csv"}
+	body, err := serializerOf(rule, &global.Config{}).Serialize(rule, &model.RowRequest{Action: "insert", Row: []interface{}{1}}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "insert,1" {
+		t.Errorf("expect custom body, but %s", body)
+	}
+}
+
+func TestSerializerPrecedence(t *testing.T) {
+	for _, name := range []string{"test-a", "test-b"} {
+		body := []byte(name)
+		RegisterSerializer(name, SerializerFunc(func(rule *global.Rule, req *model.RowRequest, stock bool) ([]byte, error) {
+			return body, nil
+		}))
+	}
+	req := &model.RowRequest{Action: "insert", Row: []interface{}{1}}
+	cfg := &global.Config{Target: "kafka", MQFormat: "test-a"}
+	ep := cfg.WithEndpoint(&global.EndpointConfig{Name: "b", Addrs: "127.0.0.1:9092", MQFormat: "test-b"})
+
+	// 规则未配置时使用接收端的格式，附加接收端的格式优先于全局的
+	rule := &global.Rule{}
+	if body, _ := serializerOf(rule, cfg).Serialize(rule, req, false); string(body) != "test-a" {
+		t.Errorf("expect target format, but %s", body)
+	}
+	if body, _ := serializerOf(rule, ep).Serialize(rule, req, false); string(body) != "test-b" {
+		t.Errorf("expect additional endpoint format, but %s", body)
+	}
+	// 规则的格式优先于接收端的
+	rule = &global.Rule{MQFormat: "test-a"}
+	if body, _ := serializerOf(rule, ep).Serialize(rule, req, false); string(body) != "test-a" {
+		t.Errorf("expect rule format, but %s", body)
+	}
+}
+
+func TestWatermark(t *testing.T) {
+	rule := &global.Rule{IncludePosition: true}
+	req := &model.RowRequest{Action: "insert", LogName: "mysql-bin.000003", LogPos: 1234, Offset: 2, GTID: "uuid:7"}
+
+	w := watermarkOf(req, rule)
+	if w == nil || w.Position != "mysql-bin.000003:1234" || w.Offset != 2 || w.GTID != "uuid:7" {
+		t.Errorf("unexpected watermark %#v", w)
+	}
+	if w := watermarkOf(&model.RowRequest{Action: "insert"}, rule); w != nil {
+		t.Errorf("expect nil watermark for stock rows, but %#v", w)
+	}
+	if w := watermarkOf(req, &global.Rule{}); w != nil {
+		t.Errorf("expect nil watermark without include_position, but %#v", w)
+	}
+
+	// 校验时不比较文档中的位置
+	actual := map[string]interface{}{"id": 1, WatermarkField: watermarkOf(req, rule)}
+	if !Equivalent(`{"id":1}`, actual) {
+		t.Errorf("expect watermark ignored by verify")
+	}
+}
+
+func TestTypedKey(t *testing.T) {
+	rule := &global.Rule{
+		KeyFormat: global.KeyFormatTyped,
+		TableInfo: &schema.Table{Columns: []schema.TableColumn{
+			{Name: "id", Type: schema.TYPE_NUMBER, RawType: "bigint(20) unsigned"},
+			{Name: "code", Type: schema.TYPE_STRING, RawType: "char(36)"},
+			{Name: "uid", Type: schema.TYPE_BINARY, RawType: "binary(4)"},
+			{Name: "score", Type: schema.TYPE_FLOAT, RawType: "double"},
+		}},
+	}
+	row := []interface{}{uint64(18446744073709551615), "0f8fad5b-d9cb-469f-a165-70867728950e", "\x01\xab", float64(12345678901)}
+
+	cases := []struct {
+		indexes []int
+		want    string
+	}{
+		{[]int{0}, "18446744073709551615"},
+		{[]int{1}, "0f8fad5b-d9cb-469f-a165-70867728950e"},
+		{[]int{2}, "01ab0000"},
+		{[]int{3}, "12345678901"},
+		{[]int{0, 1}, "18446744073709551615:0f8fad5b-d9cb-469f-a165-70867728950e"},
+	}
+	for _, c := range cases {
+		if got := typedKey(row, c.indexes, rule); got != c.want {
+			t.Errorf("typedKey(%v) = %s, want %s", c.indexes, got, c.want)
+		}
+	}
+
+	rule.KeyColumnIndexes = []int{0, 2}
+	rule.SurrogateIndex = -1
+	insert := &model.RowRequest{Action: canal.InsertAction, Row: row}
+	del := &model.RowRequest{Action: canal.DeleteAction, Row: row}
+	if primaryKey(insert, rule) != primaryKey(del, rule) || primaryKey(del, rule) != "18446744073709551615:01ab0000" {
+		t.Errorf("inconsistent key %v", primaryKey(del, rule))
+	}
+}
+
+func TestSerializeSoftDelete(t *testing.T) {
+	dir, err := ioutil.TempDir("", "transfer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := filepath.Join(dir, "app.yml")
+	data := fmt.Sprintf("target: script\naddr: 127.0.0.1:3306\nuser: root\npass: root\ncharset: utf8\nslave_id: 1001\n"+
+		"data_dir: %s\nrule:\n  - schema: test\n    table: soft\n", dir)
+	if err := ioutil.WriteFile(cfg, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := global.Initialize(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	id := &schema.TableColumn{Name: "id", Type: schema.TYPE_NUMBER}
+	name := &schema.TableColumn{Name: "name", Type: schema.TYPE_STRING}
+	rule := &global.Rule{
+		SoftDelete:      true,
+		SoftDeleteField: "deleted",
+		ReserveRawData:  true,
+		DiffOutput:      true,
+		OrderedFields:   []string{"id", "name", "deleted"},
+		ValueEncoder:    global.ValEncoderJson,
+		PaddingMap: map[string]*model.Padding{
+			"id":   {WrapName: "id", ColumnName: "id", ColumnIndex: 0, ColumnMetadata: id},
+			"name": {WrapName: "name", ColumnName: "name", ColumnIndex: 1, ColumnMetadata: name},
+		},
+	}
+
+	// 删除转换的upsert，变更前的数据为删除的数据
+	row := []interface{}{int64(1), "a"}
+	req := &model.RowRequest{Action: canal.UpdateAction, Upsert: true, Deleted: true, Row: row, Old: row}
+	body, err := serializeJson(rule, req, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp map[string]interface{}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if raw, ok := resp["raw"].(map[string]interface{}); !ok || raw["name"] != "a" {
+		t.Errorf("expect raw data of deleted row, but %s", body)
+	}
+	if date, ok := resp["date"].(map[string]interface{}); !ok || date["deleted"] != true {
+		t.Errorf("expect deleted flag, but %s", body)
+	}
+
+	// 没有变更前的数据时不输出raw
+	req.Old = nil
+	if body, err = serializeJson(rule, req, false); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(body), `"raw"`) {
+		t.Errorf("expect no raw without old row, but %s", body)
+	}
+}
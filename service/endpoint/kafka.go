@@ -18,8 +18,8 @@
 package endpoint
 
 import (
-	"github.com/siddontang/go-mysql/canal"
-	"log"
+	"context"
+	"fmt"
 	"strings"
 	"sync"
 
@@ -37,28 +37,55 @@ import (
 type KafkaEndpoint struct {
 	client   sarama.Client
 	producer sarama.AsyncProducer
+	batch    sarama.SyncProducer // 发送同步数据，获取每条消息的结果
+	admin    sarama.ClusterAdmin // kafka_topic_auto_create为admin时创建topic
+	topics   sync.Map            // 已确认存在的topic
+	cfg      *global.Config
 
 	retryLock sync.Mutex
+
+	writes   timedWrites
+	registry interface{ Get(string) interface{} } // sarama的指标，用于读取压缩比
 }
 
-func newKafkaEndpoint() *KafkaEndpoint {
+func newKafkaEndpoint(cfg *global.Config) *KafkaEndpoint {
 	r := &KafkaEndpoint{}
+	r.cfg = cfg
 	return r
 }
 
 func (s *KafkaEndpoint) Connect() error {
 	cfg := sarama.NewConfig()
 	cfg.Producer.Partitioner = sarama.NewRandomPartitioner
+	// kafka使用producer的压缩，消费者透明解压
+	switch s.cfg.MQCompression {
+	case global.CompressionGzip:
+		cfg.Producer.Compression = sarama.CompressionGZIP
+	case global.CompressionSnappy:
+		cfg.Producer.Compression = sarama.CompressionSnappy
+	case global.CompressionLz4:
+		cfg.Producer.Compression = sarama.CompressionLZ4
+	case global.CompressionZstd:
+		cfg.Producer.Compression = sarama.CompressionZSTD
+		cfg.Version = sarama.V2_1_0_0 // zstd要求kafka 2.1及以上
+	}
+	if !cfg.Version.IsAtLeast(sarama.V0_10_0_0) && eventTimeEnabled() {
+		cfg.Version = sarama.V0_10_0_0 // 消息时间戳要求kafka 0.10及以上
+	}
 
-	if global.Cfg().KafkaSASLUser != "" && global.Cfg().KafkaSASLPassword != "" {
+	if s.cfg.KafkaSASLUser != "" && s.cfg.KafkaSASLPassword != "" {
 		cfg.Net.SASL.Enable = true
-		cfg.Net.SASL.User = global.Cfg().KafkaSASLUser
-		cfg.Net.SASL.Password = global.Cfg().KafkaSASLPassword
+		cfg.Net.SASL.User = s.cfg.KafkaSASLUser
+		cfg.Net.SASL.Password = s.cfg.KafkaSASLPassword
+	}
+	if counter := newConnCounter(s.cfg); counter != nil {
+		cfg.Net.Proxy.Enable = true // sarama只能通过proxy替换dialer
+		cfg.Net.Proxy.Dialer = counter
 	}
 
 	var err error
 	var client sarama.Client
-	ls := strings.Split(global.Cfg().KafkaAddr, ",")
+	ls := strings.Split(s.cfg.KafkaAddr, ",")
 	client, err = sarama.NewClient(ls, cfg)
 	if err != nil {
 		return errors.Errorf("unable to create kafka client: %q", err)
@@ -70,8 +97,30 @@ func (s *KafkaEndpoint) Connect() error {
 		return errors.Errorf("unable to create kafka producer: %q", err)
 	}
 
+	// 同步数据使用单独的同步producer，只重试发送失败的消息
+	batchCfg := *cfg
+	batchCfg.Producer.Return.Successes = true
+	batch, err := sarama.NewSyncProducer(ls, &batchCfg)
+	if err != nil {
+		return errors.Errorf("unable to create kafka producer: %q", err)
+	}
+
+	if s.cfg.KafkaTopicAutoCreate == global.KafkaTopicAutoCreateAdmin {
+		adminCfg := *cfg
+		if !adminCfg.Version.IsAtLeast(sarama.V0_10_1_0) {
+			adminCfg.Version = sarama.V0_10_1_0 // CreateTopics要求kafka 0.10.1及以上
+		}
+		admin, err := sarama.NewClusterAdmin(ls, &adminCfg)
+		if err != nil {
+			return errors.Errorf("unable to create kafka admin: %q", err)
+		}
+		s.admin = admin
+	}
+
 	s.producer = producer
+	s.batch = batch
 	s.client = client
+	s.registry = cfg.MetricRegistry
 
 	return nil
 }
@@ -94,33 +143,244 @@ func (s *KafkaEndpoint) Consume(from mysql.Position, rows []*model.RowRequest) e
 		if rule.LuaEnable() {
 			ls, err := s.buildMessages(row, rule)
 			if err != nil {
-				log.Println("Lua 脚本执行失败!!! ,详情请参见日志")
-				return errors.Errorf("lua 脚本执行失败 : %s ", errors.ErrorStack(err))
+				return err
+			}
+			for _, m := range ls {
+				m.Metadata = row.RuleKey
+				withMessageTime(m, row, rule)
 			}
 			ms = append(ms, ls...)
 		} else {
-			m, err := s.buildMessage(row, rule)
+			m, err := s.buildMessage(row, rule, false)
 			if err != nil {
 				return errors.Errorf(errors.ErrorStack(err))
 			}
+			m.Metadata = row.RuleKey
+			withMessageTime(m, row, rule)
 			ms = append(ms, m)
 		}
 	}
+	if len(ms) == 0 {
+		return nil
+	}
 
-	for _, m := range ms {
-		s.producer.Input() <- m
-		select {
-		case err := <-s.producer.Errors():
-			return err
-		default:
-		}
+	ms, err := s.checkTopics(ms)
+	if err != nil {
+		return err
 	}
+	if len(ms) == 0 {
+		return nil
+	}
+
+	ctx, cancel := writeContext(s.cfg)
+	defer cancel()
+	if err := s.send(ctx, ms); err != nil {
+		return err
+	}
+	s.observeCompression(ms)
 
 	logs.Infof("处理完成 %d 条数据", len(rows))
 	return nil
 }
 
+// send 同步发送一批消息，重试发送失败的消息及其后与之同一分区或同一key的消息以保证顺序，
+// 被拒绝的消息(如消息过大)按rejected_item_policy处理
+func (s *KafkaEndpoint) send(ctx context.Context, ms []*sarama.ProducerMessage) error {
+	for attempt := 0; ; attempt++ {
+		batch := ms
+		err := s.writes.do(ctx, func() error {
+			return s.batch.SendMessages(batch)
+		})
+		if err == nil {
+			return nil
+		}
+		errs, ok := err.(sarama.ProducerErrors)
+		if !ok {
+			return err
+		}
+
+		failed := make(map[*sarama.ProducerMessage]bool)
+		rejected := make(map[*sarama.ProducerMessage]bool)
+		var reason string
+		for _, e := range errs {
+			if kafkaItemOutcome(e.Err) == _itemRejected {
+				lab, _ := e.Msg.Metadata.(string)
+				if err := rejectItem(s.cfg, lab, e.Err.Error(), messageValue(e.Msg)); err != nil {
+					return err
+				}
+				rejected[e.Msg] = true
+				continue
+			}
+			reason = e.Err.Error()
+			failed[e.Msg] = true
+		}
+		if len(failed) == 0 {
+			return nil
+		}
+
+		// 失败消息之后同一分区或同一key的消息即使发送成功也一并重试，避免重试后顺序颠倒
+		partitions := make(map[string]bool)
+		keys := make(map[string]bool)
+		var retry []*sarama.ProducerMessage
+		for _, m := range ms {
+			if rejected[m] {
+				continue
+			}
+			partition := fmt.Sprintf("%s/%d", m.Topic, m.Partition)
+			key := messageKey(m)
+			if !failed[m] && !partitions[partition] && (key == "" || !keys[key]) {
+				continue
+			}
+			partitions[partition] = true
+			if key != "" {
+				keys[key] = true
+			}
+			retry = append(retry, &sarama.ProducerMessage{
+				Topic:     m.Topic,
+				Key:       m.Key,
+				Value:     m.Value,
+				Headers:   m.Headers,
+				Metadata:  m.Metadata,
+				Timestamp: m.Timestamp,
+			})
+		}
+		if attempt >= _batchRetries {
+			return errors.New(reason)
+		}
+
+		logs.Warnf("%d of %d messages failed, retry %d messages: %s", len(failed), len(ms), len(retry), reason)
+		if err := retryWait(ctx, attempt); err != nil {
+			return err
+		}
+		ms = retry
+	}
+}
+
+// observeCompression kafka由producer按批压缩，压缩后的大小按sarama统计的批次压缩比(压缩前/压缩后×100)估算
+func (s *KafkaEndpoint) observeCompression(ms []*sarama.ProducerMessage) {
+	if !s.cfg.MQCompressionEnable() || s.registry == nil {
+		return
+	}
+	ratio, ok := s.registry.Get("compression-ratio").(interface{ Mean() float64 })
+	if !ok || ratio.Mean() <= 0 {
+		return
+	}
+
+	var raw int
+	for _, m := range ms {
+		if m.Key != nil {
+			raw += m.Key.Length()
+		}
+		if m.Value != nil {
+			raw += m.Value.Length()
+		}
+	}
+	metrics.ObserveCompression(raw, int(float64(raw)*100/ratio.Mean()))
+}
+
+// checkTopics 按kafka_topic_auto_create处理不存在的topic：broker由kafka自动创建，admin使用kafka_topic_partitions、
+// kafka_topic_replication创建，none时发送到该topic的消息按rejected_item_policy处理
+func (s *KafkaEndpoint) checkTopics(ms []*sarama.ProducerMessage) ([]*sarama.ProducerMessage, error) {
+	if s.cfg.KafkaTopicAutoCreate == global.KafkaTopicAutoCreateBroker {
+		return ms, nil
+	}
+
+	ret := ms[:0]
+	for _, m := range ms {
+		exist, err := s.ensureTopic(m.Topic)
+		if err != nil {
+			return nil, err
+		}
+		if !exist {
+			lab, _ := m.Metadata.(string)
+			if err := rejectItem(s.cfg, lab, "topic "+m.Topic+" not exists", messageValue(m)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		ret = append(ret, m)
+	}
+	return ret, nil
+}
+
+// ensureTopic topic是否存在，admin方式不存在时创建
+func (s *KafkaEndpoint) ensureTopic(topic string) (bool, error) {
+	if _, ok := s.topics.Load(topic); ok {
+		return true, nil
+	}
+
+	// 刷新全部topic的元数据，指定topic的元数据请求可能触发broker自动创建
+	if err := s.client.RefreshMetadata(); err != nil {
+		return false, err
+	}
+	topics, err := s.client.Topics()
+	if err != nil {
+		return false, err
+	}
+	for _, t := range topics {
+		if t == topic {
+			s.topics.Store(topic, true)
+			return true, nil
+		}
+	}
+
+	if s.admin == nil {
+		return false, nil
+	}
+	err = s.admin.CreateTopic(topic, &sarama.TopicDetail{
+		NumPartitions:     s.cfg.KafkaTopicPartitions,
+		ReplicationFactor: s.cfg.KafkaTopicReplication,
+	}, false)
+	if err != nil {
+		if e, ok := err.(*sarama.TopicError); !ok || e.Err != sarama.ErrTopicAlreadyExists {
+			return false, errors.Annotatef(err, "create topic %s", topic)
+		}
+	}
+	logs.Infof("kafka topic %s created", topic)
+	s.topics.Store(topic, true)
+	return true, nil
+}
+
+// messageKey 消息的topic及key，没有key时为空
+func messageKey(m *sarama.ProducerMessage) string {
+	if m.Key == nil {
+		return ""
+	}
+	key, err := m.Key.Encode()
+	if err != nil {
+		return ""
+	}
+	return m.Topic + "/" + string(key)
+}
+
+func messageValue(m *sarama.ProducerMessage) string {
+	if m.Value == nil {
+		return ""
+	}
+	value, err := m.Value.Encode()
+	if err != nil {
+		return err.Error()
+	}
+	return string(value)
+}
+
 func (s *KafkaEndpoint) Stock(rows []*model.RowRequest) int64 {
+	ctx, cancel := writeContext(s.cfg)
+	defer cancel()
+
+	var sum int64
+	err := s.writes.do(ctx, func() error {
+		sum = s.stock(rows)
+		return nil
+	})
+	if err != nil {
+		logs.Errorf(errors.ErrorStack(err))
+		return 0
+	}
+	return sum
+}
+
+func (s *KafkaEndpoint) stock(rows []*model.RowRequest) int64 {
 	expect := true
 	for _, row := range rows {
 		rule, _ := global.RuleIns(row.RuleKey)
@@ -150,7 +410,7 @@ func (s *KafkaEndpoint) Stock(rows []*model.RowRequest) int64 {
 				break
 			}
 		} else {
-			m, err := s.buildMessage(row, rule)
+			m, err := s.buildMessage(row, rule, true)
 			if err != nil {
 				logs.Errorf(errors.ErrorStack(err))
 				expect = false
@@ -177,9 +437,10 @@ func (s *KafkaEndpoint) Stock(rows []*model.RowRequest) int64 {
 
 func (s *KafkaEndpoint) buildMessages(row *model.RowRequest, rule *global.Rule) ([]*sarama.ProducerMessage, error) {
 	kvm := rowMap(row, rule, true)
-	ls, err := luaengine.DoMQOps(kvm, row.Action, rule)
+	ls, err := luaengine.DoMQOps(kvm, luaDiff(row, rule), row.Action, rule)
 	if err != nil {
-		return nil, errors.Errorf("lua 脚本执行失败 : %s ", err)
+		// 按lua_error_policy跳过时不产生消息
+		return nil, luaFailed(row, rule, kvm, err)
 	}
 
 	var ms []*sarama.ProducerMessage
@@ -195,37 +456,64 @@ func (s *KafkaEndpoint) buildMessages(row *model.RowRequest, rule *global.Rule)
 	return ms, nil
 }
 
-func (s *KafkaEndpoint) buildMessage(row *model.RowRequest, rule *global.Rule) (*sarama.ProducerMessage, error) {
-	kvm := rowMap(row, rule, false)
-	resp := new(model.MQRespond)
-	resp.Action = row.Action
-	resp.Timestamp = row.Timestamp
-	if rule.ValueEncoder == global.ValEncoderJson {
-		resp.Date = kvm
-	} else {
-		resp.Date = encodeValue(rule, kvm)
-	}
-
-	if rule.ReserveRawData && canal.UpdateAction == row.Action {
-		resp.Raw = oldRowMap(row, rule, false)
-	}
-
-	body, err := json.Marshal(resp)
+func (s *KafkaEndpoint) buildMessage(row *model.RowRequest, rule *global.Rule, stock bool) (*sarama.ProducerMessage, error) {
+	body, err := encodeMessage(row, rule, s.cfg, stock)
 	if err != nil {
 		return nil, err
 	}
+	topic := rule.TopicOf(row.Row)
 	m := &sarama.ProducerMessage{
-		Topic: rule.KafkaTopic,
+		Topic: topic,
 		Value: sarama.ByteEncoder(body),
 	}
-	logs.Infof("topic: %s, message: %s", rule.KafkaTopic, string(body))
+	logs.Infof("topic: %s, message: %s", topic, string(body))
 	return m, nil
 }
 
+// eventTimeEnabled 是否有规则开启event_time
+func eventTimeEnabled() bool {
+	for _, rule := range global.RuleInsList() {
+		if rule.EventTime {
+			return true
+		}
+	}
+	return false
+}
+
+// withMessageTime 开启event_time时消息时间戳使用binlog事件时间，topic的message.timestamp.type须为CreateTime
+func withMessageTime(m *sarama.ProducerMessage, row *model.RowRequest, rule *global.Rule) {
+	if t, ok := eventTime(row, rule); ok {
+		m.Timestamp = t
+	}
+}
+
+func (s *KafkaEndpoint) Publish(topic string, body []byte) error {
+	ctx, cancel := writeContext(s.cfg)
+	defer cancel()
+	return s.writes.do(ctx, func() error {
+		s.producer.Input() <- &sarama.ProducerMessage{
+			Topic: topic,
+			Value: sarama.ByteEncoder(body),
+		}
+		select {
+		case err := <-s.producer.Errors():
+			return err
+		default:
+		}
+		return nil
+	})
+}
+
 func (s *KafkaEndpoint) Close() {
 	if s.producer != nil {
 		s.producer.Close()
 	}
+	if s.batch != nil {
+		s.batch.Close()
+	}
+	if s.admin != nil {
+		s.admin.Close()
+	}
 	if s.client != nil {
 		s.client.Close()
 	}
@@ -0,0 +1,103 @@
+/*
+ * Copyright 2020-2021 the original author(https://github.com/wj596)
+ *
+ * <p>
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * </p>
+ */
+package endpoint
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+
+	"go-mysql-transfer/global"
+	"go-mysql-transfer/metrics"
+	"go-mysql-transfer/model"
+	"go-mysql-transfer/util/files"
+	"go-mysql-transfer/util/logs"
+	"go-mysql-transfer/util/stringutil"
+)
+
+const _deadLetterDir = "dead_letter"
+
+var _deadLetterLock sync.Mutex
+
+// deadLetter lua_error_policy为dead_letter时写入data_dir/dead_letter/库名.表名.log的一行
+type deadLetter struct {
+	Time   string                 `json:"time"`
+	Rule   string                 `json:"rule"`
+	Action string                 `json:"action"`
+	Name   string                 `json:"binName,omitempty"`
+	Pos    uint32                 `json:"binPos,omitempty"`
+	Row    map[string]interface{} `json:"row"`
+	Error  string                 `json:"error"`
+}
+
+// luaFailed Lua脚本执行失败或结果不正确时按规则的lua_error_policy处理：halt返回错误(停止同步)，skip记录错误日志、dead_letter写入死信文件后返回nil，由调用方跳过该行
+func luaFailed(row *model.RowRequest, rule *global.Rule, kvm map[string]interface{}, cause error) error {
+	metrics.IncLuaError(row.RuleKey)
+	switch rule.LuaErrorPolicy {
+	case global.LuaErrorSkip:
+		logs.Errorf("lua failed and skipped, table: %s, action: %s, error: %s, data: %s", row.RuleKey, row.Action, cause.Error(), stringutil.ToJsonString(kvm))
+	case global.LuaErrorDeadLetter:
+		path, err := writeDeadLetter(row, kvm, cause)
+		if err != nil {
+			return errors.Annotatef(err, "lua 脚本执行失败 : %s , write dead letter", cause.Error())
+		}
+		logs.Errorf("lua failed and dead-lettered to %s, table: %s, action: %s, error: %s", path, row.RuleKey, row.Action, cause.Error())
+	default:
+		log.Println("Lua 脚本执行失败!!! ,详情请参见日志")
+		return errors.Errorf("lua 脚本执行失败 : %s ", errors.ErrorStack(cause))
+	}
+	metrics.IncSkipped(row.RuleKey, metrics.SkipLuaError, 1)
+	return nil
+}
+
+func writeDeadLetter(row *model.RowRequest, kvm map[string]interface{}, cause error) (string, error) {
+	dir := filepath.Join(global.Cfg().DataDir, _deadLetterDir)
+	if err := files.MkdirIfNecessary(dir); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, row.RuleKey+".log")
+
+	line, err := json.Marshal(deadLetter{
+		Time:   time.Now().Format(time.RFC3339),
+		Rule:   row.RuleKey,
+		Action: row.Action,
+		Name:   row.LogName,
+		Pos:    row.LogPos,
+		Row:    kvm,
+		Error:  cause.Error(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	_deadLetterLock.Lock()
+	defer _deadLetterLock.Unlock()
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return "", err
+	}
+	if _, err = f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return "", err
+	}
+	return path, f.Close()
+}
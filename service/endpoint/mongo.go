@@ -19,9 +19,10 @@ package endpoint
 
 import (
 	"context"
-	"log"
+	"regexp"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/juju/errors"
 	"github.com/siddontang/go-mysql/canal"
@@ -35,18 +36,22 @@ import (
 	"go-mysql-transfer/metrics"
 	"go-mysql-transfer/model"
 	"go-mysql-transfer/service/luaengine"
+	"go-mysql-transfer/util/consistent"
 	"go-mysql-transfer/util/logs"
 	"go-mysql-transfer/util/stringutil"
 )
 
 type cKey struct {
+	shard      int // 分片序号，未配置mongodb_shards时为0
 	database   string
 	collection string
 }
 
 type MongoEndpoint struct {
-	options     *options.ClientOptions
-	client      *mongo.Client
+	cfg         *global.Config
+	options     []*options.ClientOptions
+	clients     []*mongo.Client
+	ring        *consistent.Ring // 配置了mongodb_shards时按_id路由到分片
 	lock        sync.Mutex
 	collections map[cKey]*mongo.Collection
 	collLock    sync.RWMutex
@@ -54,37 +59,56 @@ type MongoEndpoint struct {
 	retryLock sync.Mutex
 }
 
-func newMongoEndpoint() *MongoEndpoint {
-	addrList := strings.Split(global.Cfg().MongodbAddr, ",")
-	opts := &options.ClientOptions{
-		Hosts: addrList,
-	}
+func newMongoEndpoint(cfg *global.Config) *MongoEndpoint {
+	r := &MongoEndpoint{}
+	r.cfg = cfg
+	r.collections = make(map[cKey]*mongo.Collection)
 
-	if global.Cfg().MongodbUsername != "" && global.Cfg().MongodbPassword != "" {
-		opts.Auth = &options.Credential{
-			Username: global.Cfg().MongodbUsername,
-			Password: global.Cfg().MongodbPassword,
+	shards := []string{cfg.MongodbAddr}
+	if len(cfg.MongodbShards) > 0 {
+		shards = cfg.MongodbShards
+		r.ring = shardRing(shards, cfg.MongodbShardWeights, cfg.MongodbVirtualNodes)
+	}
+	counter := newConnCounter(cfg)
+	for _, addrs := range shards {
+		opts := &options.ClientOptions{
+			Hosts: strings.Split(addrs, ","),
+		}
+		if cfg.MongodbUsername != "" && cfg.MongodbPassword != "" {
+			opts.Auth = &options.Credential{
+				Username: cfg.MongodbUsername,
+				Password: cfg.MongodbPassword,
+			}
 		}
+		if counter != nil {
+			opts.SetDialer(counter)
+		}
+		r.options = append(r.options, opts)
 	}
-
-	r := &MongoEndpoint{}
-	r.options = opts
-	r.collections = make(map[cKey]*mongo.Collection)
 	return r
 }
 
 func (s *MongoEndpoint) Connect() error {
-	client, err := mongo.Connect(context.Background(), s.options)
-	if err != nil {
-		return err
+	clients := make([]*mongo.Client, 0, len(s.options))
+	for _, opts := range s.options {
+		client, err := mongo.Connect(context.Background(), opts)
+		if err != nil {
+			for _, c := range clients {
+				c.Disconnect(context.Background())
+			}
+			return err
+		}
+		clients = append(clients, client)
 	}
 
-	s.client = client
+	s.clients = clients
 
 	s.collLock.Lock()
-	for _, rule := range global.RuleInsList() {
-		cc := s.client.Database(rule.MongodbDatabase).Collection(rule.MongodbCollection)
-		s.collections[s.collectionKey(rule.MongodbDatabase, rule.MongodbCollection)] = cc
+	for shard, client := range s.clients {
+		for _, rule := range global.RuleInsList() {
+			cc := client.Database(rule.MongodbDatabase).Collection(rule.MongodbCollection)
+			s.collections[cKey{shard: shard, database: rule.MongodbDatabase, collection: rule.MongodbCollection}] = cc
+		}
 	}
 	s.collLock.Unlock()
 
@@ -92,7 +116,12 @@ func (s *MongoEndpoint) Connect() error {
 }
 
 func (s *MongoEndpoint) Ping() error {
-	return s.client.Ping(context.Background(), readpref.Primary())
+	for _, client := range s.clients {
+		if err := client.Ping(context.Background(), readpref.Primary()); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (s *MongoEndpoint) isDuplicateKeyError(stack string) bool {
@@ -106,6 +135,14 @@ func (s *MongoEndpoint) collectionKey(database, collection string) cKey {
 	}
 }
 
+// shardKey 配置了mongodb_shards时按_id选择分片，同一文档的写入、删除总是路由到同一分片
+func (s *MongoEndpoint) shardKey(key cKey, id interface{}) cKey {
+	if s.ring != nil {
+		key.shard = s.ring.Get(stringutil.ToString(id))
+	}
+	return key
+}
+
 func (s *MongoEndpoint) collection(key cKey) *mongo.Collection {
 	s.collLock.RLock()
 	c, ok := s.collections[key]
@@ -115,7 +152,7 @@ func (s *MongoEndpoint) collection(key cKey) *mongo.Collection {
 	}
 
 	s.collLock.Lock()
-	c = s.client.Database(key.database).Collection(key.collection)
+	c = s.clients[key.shard].Database(key.database).Collection(key.collection)
 	s.collections[key] = c
 	s.collLock.Unlock()
 
@@ -137,7 +174,10 @@ func (s *MongoEndpoint) Consume(from mysql.Position, rows []*model.RowRequest) e
 			kvm := rowMap(row, rule, true)
 			ls, err := luaengine.DoMongoOps(kvm, row.Action, rule)
 			if err != nil {
-				return errors.Errorf("lua 脚本执行失败 : %s ", errors.ErrorStack(err))
+				if err = luaFailed(row, rule, kvm, err); err != nil {
+					return err
+				}
+				continue
 			}
 			for _, resp := range ls {
 				var model mongo.WriteModel
@@ -152,7 +192,7 @@ func (s *MongoEndpoint) Consume(from mysql.Position, rows []*model.RowRequest) e
 					model = mongo.NewDeleteOneModel().SetFilter(bson.M{"_id": resp.Id})
 				}
 
-				key := s.collectionKey(rule.MongodbDatabase, resp.Collection)
+				key := s.shardKey(s.collectionKey(rule.MongodbDatabase, resp.Collection), resp.Id)
 				array, ok := models[key]
 				if !ok {
 					array = make([]mongo.WriteModel, 0)
@@ -167,36 +207,49 @@ func (s *MongoEndpoint) Consume(from mysql.Position, rows []*model.RowRequest) e
 			kvm := rowMap(row, rule, false)
 			id := primaryKey(row, rule)
 			kvm["_id"] = id
+			withWatermark(kvm, row, rule)
+			withSource(kvm)
+			withEventTime(kvm, row, rule, true)
+			s.observeDocument(row, rule, kvm)
 			var model mongo.WriteModel
 			switch row.Action {
 			case canal.InsertAction:
 				model = mongo.NewInsertOneModel().SetDocument(kvm)
 			case canal.UpdateAction:
-				model = mongo.NewUpdateOneModel().SetFilter(bson.M{"_id": id}).SetUpdate(bson.M{"$set": kvm})
+				if row.Upsert {
+					model = mongo.NewReplaceOneModel().SetFilter(bson.M{"_id": id}).SetReplacement(kvm).SetUpsert(true)
+				} else {
+					model = mongo.NewUpdateOneModel().SetFilter(bson.M{"_id": id}).SetUpdate(bson.M{"$set": kvm})
+				}
 			case canal.DeleteAction:
 				model = mongo.NewDeleteOneModel().SetFilter(bson.M{"_id": id})
 			}
 
-			ccKey := s.collectionKey(rule.MongodbDatabase, rule.MongodbCollection)
+			ccKey := s.shardKey(s.collectionKey(rule.MongodbDatabase, rule.PartitionName(rule.MongodbCollection, row.Row)), id)
 			array, ok := models[ccKey]
 			if !ok {
 				array = make([]mongo.WriteModel, 0)
 			}
 
-			logs.Infof("action:%s, collection:%s, id:%v, data:%v", row.Action, rule.MongodbCollection, id, kvm)
+			logs.Infof("action:%s, collection:%s, id:%v, data:%v", row.Action, ccKey.collection, id, kvm)
 
 			array = append(array, model)
 			models[ccKey] = array
 		}
 	}
 
+	ctx, cancel := writeContext(s.cfg)
+	defer cancel()
+
 	var slowly bool
 	for key, model := range models {
 		collection := s.collection(key)
-		_, err := collection.BulkWrite(context.Background(), model)
+		_, err := collection.BulkWrite(ctx, model)
 		if err != nil {
 			if s.isDuplicateKeyError(err.Error()) {
 				slowly = true
+			} else if t, ok := isMongoThrottled(err); ok {
+				return t
 			} else {
 				return err
 			}
@@ -205,16 +258,49 @@ func (s *MongoEndpoint) Consume(from mysql.Position, rows []*model.RowRequest) e
 		}
 	}
 	if slowly {
-		_, err := s.doConsumeSlowly(rows)
+		_, err := s.doConsumeSlowly(ctx, rows)
 		if err != nil {
 			return err
 		}
 	}
 
+	if err := s.writeResumeMarker(ctx, from, rows); err != nil {
+		return err
+	}
+
 	logs.Infof("处理完成 %d 条数据", len(rows))
 	return nil
 }
 
+// writeResumeMarker 每批数据写入成功后记录binlog位置，下游可据此关联change stream与源端binlog
+// 记录的是本批数据读取的起始位置，从此位置重放会再次得到本批数据
+func (s *MongoEndpoint) writeResumeMarker(ctx context.Context, from mysql.Position, rows []*model.RowRequest) error {
+	// 回放等不带位置的写入不记录
+	if global.Cfg().MongodbResumeDatabase == "" || from.Name == "" || len(rows) == 0 {
+		return nil
+	}
+
+	marker := bson.M{
+		"binlog_name": from.Name,
+		"binlog_pos":  from.Pos,
+		"timestamp":   rows[len(rows)-1].Timestamp,
+		"updated_at":  time.Now(),
+	}
+	// 分片时每个分片都写入，各分片的change stream均可关联
+	key := s.collectionKey(global.Cfg().MongodbResumeDatabase, global.Cfg().MongodbResumeCollection)
+	for shard := range s.clients {
+		key.shard = shard
+		_, err := s.collection(key).UpdateOne(ctx,
+			bson.M{"_id": global.Cfg().Addr},
+			bson.M{"$set": marker},
+			options.Update().SetUpsert(true))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (s *MongoEndpoint) Stock(rows []*model.RowRequest) int64 {
 	expect := true
 	models := make(map[cKey][]mongo.WriteModel, 0)
@@ -229,14 +315,16 @@ func (s *MongoEndpoint) Stock(rows []*model.RowRequest) int64 {
 			kvm := rowMap(row, rule, true)
 			ls, err := luaengine.DoMongoOps(kvm, row.Action, rule)
 			if err != nil {
-				log.Println("Lua 脚本执行失败!!! ,详情请参见日志")
-				logs.Errorf("lua 脚本执行失败 : %s ", errors.ErrorStack(err))
-				expect = false
-				break
+				if err = luaFailed(row, rule, kvm, err); err != nil {
+					logs.Error(err.Error())
+					expect = false
+					break
+				}
+				continue
 			}
 
 			for _, resp := range ls {
-				ccKey := s.collectionKey(rule.MongodbDatabase, resp.Collection)
+				ccKey := s.shardKey(s.collectionKey(rule.MongodbDatabase, resp.Collection), resp.Id)
 				model := mongo.NewInsertOneModel().SetDocument(resp.Table)
 				array, ok := models[ccKey]
 				if !ok {
@@ -249,8 +337,10 @@ func (s *MongoEndpoint) Stock(rows []*model.RowRequest) int64 {
 			kvm := rowMap(row, rule, false)
 			id := primaryKey(row, rule)
 			kvm["_id"] = id
+			withSource(kvm)
+			s.observeDocument(row, rule, kvm)
 
-			ccKey := s.collectionKey(rule.MongodbDatabase, rule.MongodbCollection)
+			ccKey := s.shardKey(s.collectionKey(rule.MongodbDatabase, rule.PartitionName(rule.MongodbCollection, row.Row)), id)
 			model := mongo.NewInsertOneModel().SetDocument(kvm)
 			array, ok := models[ccKey]
 			if !ok {
@@ -265,11 +355,14 @@ func (s *MongoEndpoint) Stock(rows []*model.RowRequest) int64 {
 		return 0
 	}
 
+	ctx, cancel := writeContext(s.cfg)
+	defer cancel()
+
 	var slowly bool
 	var sum int64
 	for key, vs := range models {
 		collection := s.collection(key)
-		rr, err := collection.BulkWrite(context.Background(), vs)
+		rr, err := collection.BulkWrite(ctx, vs)
 		if err != nil {
 			if s.isDuplicateKeyError(err.Error()) {
 				slowly = true
@@ -282,7 +375,7 @@ func (s *MongoEndpoint) Stock(rows []*model.RowRequest) int64 {
 
 	if slowly {
 		logs.Info("do consume slowly ... ... ")
-		slowlySum, err := s.doConsumeSlowly(rows)
+		slowlySum, err := s.doConsumeSlowly(ctx, rows)
 		if err != nil {
 			logs.Warnf(err.Error())
 		}
@@ -292,7 +385,7 @@ func (s *MongoEndpoint) Stock(rows []*model.RowRequest) int64 {
 	return sum
 }
 
-func (s *MongoEndpoint) doConsumeSlowly(rows []*model.RowRequest) (int64, error) {
+func (s *MongoEndpoint) doConsumeSlowly(ctx context.Context, rows []*model.RowRequest) (int64, error) {
 	var sum int64
 	for _, row := range rows {
 		rule, _ := global.RuleIns(row.RuleKey)
@@ -305,14 +398,16 @@ func (s *MongoEndpoint) doConsumeSlowly(rows []*model.RowRequest) (int64, error)
 			kvm := rowMap(row, rule, true)
 			ls, err := luaengine.DoMongoOps(kvm, row.Action, rule)
 			if err != nil {
-				logs.Errorf("lua 脚本执行失败 : %s ", errors.ErrorStack(err))
-				return sum, err
+				if err = luaFailed(row, rule, kvm, err); err != nil {
+					return sum, err
+				}
+				continue
 			}
 			for _, resp := range ls {
-				collection := s.collection(s.collectionKey(rule.MongodbDatabase, resp.Collection))
+				collection := s.collection(s.shardKey(s.collectionKey(rule.MongodbDatabase, resp.Collection), resp.Id))
 				switch resp.Action {
 				case canal.InsertAction:
-					_, err := collection.InsertOne(context.Background(), resp.Table)
+					_, err := collection.InsertOne(ctx, resp.Table)
 					if err != nil {
 						if s.isDuplicateKeyError(err.Error()) {
 							logs.Warnf("duplicate key [ %v ]", stringutil.ToJsonString(resp.Table))
@@ -321,12 +416,12 @@ func (s *MongoEndpoint) doConsumeSlowly(rows []*model.RowRequest) (int64, error)
 						}
 					}
 				case canal.UpdateAction:
-					_, err := collection.UpdateOne(context.Background(), bson.M{"_id": resp.Id}, bson.M{"$set": resp.Table})
+					_, err := collection.UpdateOne(ctx, bson.M{"_id": resp.Id}, bson.M{"$set": resp.Table})
 					if err != nil {
 						return sum, err
 					}
 				case canal.DeleteAction:
-					_, err := collection.DeleteOne(context.Background(), bson.M{"_id": resp.Id})
+					_, err := collection.DeleteOne(ctx, bson.M{"_id": resp.Id})
 					if err != nil {
 						return sum, err
 					}
@@ -338,12 +433,16 @@ func (s *MongoEndpoint) doConsumeSlowly(rows []*model.RowRequest) (int64, error)
 			kvm := rowMap(row, rule, false)
 			id := primaryKey(row, rule)
 			kvm["_id"] = id
+			withWatermark(kvm, row, rule)
+			withSource(kvm)
+			withEventTime(kvm, row, rule, true)
+			s.observeDocument(row, rule, kvm)
 
-			collection := s.collection(s.collectionKey(rule.MongodbDatabase, rule.MongodbCollection))
+			collection := s.collection(s.shardKey(s.collectionKey(rule.MongodbDatabase, rule.PartitionName(rule.MongodbCollection, row.Row)), id))
 
 			switch row.Action {
 			case canal.InsertAction:
-				_, err := collection.InsertOne(context.Background(), kvm)
+				_, err := collection.InsertOne(ctx, kvm)
 				if err != nil {
 					if s.isDuplicateKeyError(err.Error()) {
 						logs.Warnf("duplicate key [ %v ]", stringutil.ToJsonString(kvm))
@@ -352,12 +451,17 @@ func (s *MongoEndpoint) doConsumeSlowly(rows []*model.RowRequest) (int64, error)
 					}
 				}
 			case canal.UpdateAction:
-				_, err := collection.UpdateOne(context.Background(), bson.M{"_id": id}, bson.M{"$set": kvm})
+				var err error
+				if row.Upsert {
+					_, err = collection.ReplaceOne(ctx, bson.M{"_id": id}, kvm, options.Replace().SetUpsert(true))
+				} else {
+					_, err = collection.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": kvm})
+				}
 				if err != nil {
 					return sum, err
 				}
 			case canal.DeleteAction:
-				_, err := collection.DeleteOne(context.Background(), bson.M{"_id": id})
+				_, err := collection.DeleteOne(ctx, bson.M{"_id": id})
 				if err != nil {
 					return sum, err
 				}
@@ -370,8 +474,108 @@ func (s *MongoEndpoint) doConsumeSlowly(rows []*model.RowRequest) (int64, error)
 	return sum, nil
 }
 
+// Count 分片时累加所有分片
+func (s *MongoEndpoint) Count(rule *global.Rule) (int64, error) {
+	var sum int64
+	for shard := range s.clients {
+		n, err := s.count(shard, rule)
+		if err != nil {
+			return 0, err
+		}
+		sum += n
+	}
+	return sum, nil
+}
+
+func (s *MongoEndpoint) count(shard int, rule *global.Rule) (int64, error) {
+	if !rule.PartitionEnable() {
+		collection := s.collection(cKey{shard: shard, database: rule.MongodbDatabase, collection: rule.MongodbCollection})
+		return collection.CountDocuments(context.Background(), bson.M{})
+	}
+
+	// 按时间分区时累加所有分区集合
+	names, err := s.clients[shard].Database(rule.MongodbDatabase).ListCollectionNames(context.Background(),
+		bson.M{"name": bson.M{"$regex": "^" + regexp.QuoteMeta(rule.MongodbCollection+"-")}})
+	if err != nil {
+		return 0, err
+	}
+	var sum int64
+	for _, name := range names {
+		n, err := s.collection(cKey{shard: shard, database: rule.MongodbDatabase, collection: name}).CountDocuments(context.Background(), bson.M{})
+		if err != nil {
+			return 0, err
+		}
+		sum += n
+	}
+	return sum, nil
+}
+
+func (s *MongoEndpoint) Fetch(rule *global.Rule, rows []*model.RowRequest) ([]interface{}, error) {
+	ret := make([]interface{}, len(rows))
+	if len(rows) == 0 {
+		return ret, nil
+	}
+
+	// 按时间分区、分片时各行可能位于不同的集合
+	ids := make(map[cKey][]interface{})
+	for _, row := range rows {
+		id := primaryKey(row, rule)
+		key := s.shardKey(s.collectionKey(rule.MongodbDatabase, rule.PartitionName(rule.MongodbCollection, row.Row)), id)
+		ids[key] = append(ids[key], id)
+	}
+
+	docs := make(map[string]bson.M, len(rows))
+	for key, array := range ids {
+		if err := s.fetchDocs(s.collection(key), array, key.collection, docs); err != nil {
+			return nil, err
+		}
+	}
+
+	for i, row := range rows {
+		name := rule.PartitionName(rule.MongodbCollection, row.Row)
+		if doc, ok := docs[name+"/"+Identity(row, rule)]; ok {
+			ret[i] = map[string]interface{}(doc)
+		}
+	}
+	return ret, nil
+}
+
+// fetchDocs 按_id查询集合中的文档，以"集合/_id"为键放入docs
+func (s *MongoEndpoint) fetchDocs(collection *mongo.Collection, ids []interface{}, name string, docs map[string]bson.M) error {
+	cursor, err := collection.Find(context.Background(), bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(context.Background())
+
+	for cursor.Next(context.Background()) {
+		var doc bson.M
+		if err := cursor.Decode(&doc); err != nil {
+			return err
+		}
+		docs[name+"/"+stringutil.ToString(doc["_id"])] = doc
+	}
+	return cursor.Err()
+}
+
+func (s *MongoEndpoint) Expect(rule *global.Rule, row *model.RowRequest) interface{} {
+	kvm := rowMap(row, rule, false)
+	kvm["_id"] = primaryKey(row, rule)
+	return kvm
+}
+
 func (s *MongoEndpoint) Close() {
-	if s.client != nil {
-		s.client.Disconnect(context.Background())
+	for _, client := range s.clients {
+		client.Disconnect(context.Background())
+	}
+}
+
+// observeDocument 文档不经过本地序列化，仅在需要统计时按BSON编码计算大小
+func (s *MongoEndpoint) observeDocument(row *model.RowRequest, rule *global.Rule, kvm map[string]interface{}) {
+	if row.Action == canal.DeleteAction || !payloadObserved() {
+		return
+	}
+	if data, err := bson.Marshal(kvm); err == nil {
+		observePayload(row, rule, len(data))
 	}
 }
@@ -7,6 +7,8 @@ import (
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"go.mongodb.org/mongo-driver/mongo/readpref"
 	"testing"
+
+	"go-mysql-transfer/global"
 )
 
 func TestMongoPing(t *testing.T) {
@@ -52,3 +54,33 @@ func TestCheckData(t *testing.T) {
 	}
 
 }
+
+func TestShardKey(t *testing.T) {
+	cfg := &global.Config{
+		MongodbShards:       []string{"10.0.0.1:27017,10.0.0.2:27017", "10.0.0.3:27017", "10.0.0.4:27017"},
+		MongodbShardWeights: "1,1,2",
+	}
+	s := newMongoEndpoint(cfg)
+	if len(s.options) != 3 || len(s.options[0].Hosts) != 2 {
+		t.Fatalf("expect options for every shard, but %d", len(s.options))
+	}
+
+	// 同一_id的写入、删除路由到同一分片，未分片时总是第一个
+	key := s.collectionKey("db", "user")
+	counts := make(map[int]int)
+	for i := 0; i < 1000; i++ {
+		shard := s.shardKey(key, i).shard
+		if s.shardKey(key, i).shard != shard {
+			t.Fatalf("id %d routed to different shards", i)
+		}
+		counts[shard]++
+	}
+	if len(counts) != 3 || counts[2] < counts[0] {
+		t.Errorf("unexpected distribution %v", counts)
+	}
+
+	single := newMongoEndpoint(&global.Config{MongodbAddr: "127.0.0.1:27017"})
+	if single.shardKey(key, 1).shard != 0 || len(single.options) != 1 {
+		t.Error("expect single shard without mongodb_shards")
+	}
+}
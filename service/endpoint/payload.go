@@ -0,0 +1,76 @@
+/*
+ * Copyright 2020-2021 the original author(https://github.com/wj596)
+ *
+ * <p>
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * </p>
+ */
+package endpoint
+
+import (
+	"sync"
+	"time"
+
+	"go-mysql-transfer/global"
+	"go-mysql-transfer/metrics"
+	"go-mysql-transfer/model"
+	"go-mysql-transfer/util/logs"
+)
+
+var (
+	_lockOfPayload sync.Mutex
+	_largePayloads = make(map[string]*largePayload)
+)
+
+// largePayload 规则在当前记录周期内已记录的最大数据
+type largePayload struct {
+	size int
+	time time.Time
+}
+
+// payloadObserved 是否需要统计数据大小，供需要额外序列化才能得到大小的接收端判断
+func payloadObserved() bool {
+	return global.Cfg().EnableExporter || global.Cfg().PayloadLogThreshold > 0
+}
+
+// observePayload 记录序列化后的数据大小，超过payload_log_threshold时抽样记录主键
+// 每条规则每个payload_log_interval周期内只记录比已记录的更大的数据
+func observePayload(req *model.RowRequest, rule *global.Rule, size int) {
+	metrics.ObservePayloadSize(req.RuleKey, size)
+
+	threshold := global.Cfg().PayloadLogThreshold
+	if threshold <= 0 || size < threshold {
+		return
+	}
+
+	now := time.Now()
+	interval := time.Duration(global.Cfg().PayloadLogInterval) * time.Second
+	_lockOfPayload.Lock()
+	last, ok := _largePayloads[req.RuleKey]
+	if ok && now.Sub(last.time) < interval && size <= last.size {
+		_lockOfPayload.Unlock()
+		return
+	}
+	if !ok || now.Sub(last.time) >= interval {
+		last = &largePayload{time: now}
+		_largePayloads[req.RuleKey] = last
+	}
+	last.size = size
+	_lockOfPayload.Unlock()
+
+	var pk interface{}
+	if len(rule.KeyColumnIndexes) > 0 {
+		pk = primaryKey(req, rule)
+	}
+	logs.Warnf("large payload, rule: %s, action: %s, pk: %v, size: %d bytes", req.RuleKey, req.Action, pk, size)
+}
@@ -0,0 +1,268 @@
+/*
+ * Copyright 2020-2021 the original author(https://github.com/wj596)
+ *
+ * <p>
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * </p>
+ */
+package endpoint
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/lib/pq"
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/mysql"
+
+	"go-mysql-transfer/global"
+	"go-mysql-transfer/metrics"
+	"go-mysql-transfer/model"
+	"go-mysql-transfer/util/logs"
+)
+
+// unique_violation
+const _pgUniqueViolation = "23505"
+
+type PostgresEndpoint struct {
+	cfg *global.Config
+	db  *sql.DB
+}
+
+func newPostgresEndpoint(cfg *global.Config) *PostgresEndpoint {
+	r := &PostgresEndpoint{}
+	r.cfg = cfg
+	return r
+}
+
+func (s *PostgresEndpoint) Connect() error {
+	dsn := url.URL{
+		Scheme:   "postgres",
+		Host:     s.cfg.PostgresqlAddr,
+		Path:     "/" + s.cfg.PostgresqlDatabase,
+		RawQuery: "sslmode=" + url.QueryEscape(s.cfg.PostgresqlSSLMode),
+	}
+	if s.cfg.PostgresqlUser != "" {
+		dsn.User = url.UserPassword(s.cfg.PostgresqlUser, s.cfg.PostgresqlPassword)
+	}
+
+	connector, err := pq.NewConnector(dsn.String())
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if counter := newConnCounter(s.cfg); counter != nil {
+		connector.Dialer(counter)
+	}
+
+	s.db = sql.OpenDB(connector)
+	return nil
+}
+
+func (s *PostgresEndpoint) Ping() error {
+	return s.db.PingContext(context.Background())
+}
+
+func (s *PostgresEndpoint) Consume(from mysql.Position, rows []*model.RowRequest) error {
+	ctx, cancel := writeContext(s.cfg)
+	defer cancel()
+
+	// 一批数据在一个事务中写入，失败时回滚，重试时不会残留部分写入
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	for _, row := range rows {
+		rule, _ := global.RuleIns(row.RuleKey)
+		if rule.TableColumnSize != len(row.Row) {
+			logs.Warnf("%s schema mismatching", row.RuleKey)
+			continue
+		}
+
+		metrics.UpdateActionNum(row.Action, row.RuleKey)
+
+		query, args := pgStatement(row.Action, row.Upsert, rowMap(row, rule, false), rule)
+		if query == "" {
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+			tx.Rollback()
+			return pgError(err, rule)
+		}
+
+		logs.Infof("action:%s, table:%s.%s, data:%v", row.Action, rule.PostgresqlSchema, rule.PostgresqlTable, args)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.Trace(err)
+	}
+
+	logs.Infof("处理完成 %d 条数据", len(rows))
+	return nil
+}
+
+func (s *PostgresEndpoint) Stock(rows []*model.RowRequest) int64 {
+	ctx, cancel := writeContext(s.cfg)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		logs.Error(errors.ErrorStack(err))
+		return 0
+	}
+
+	var sum int64
+	for _, row := range rows {
+		rule, _ := global.RuleIns(row.RuleKey)
+		if rule.TableColumnSize != len(row.Row) {
+			logs.Warnf("%s schema mismatching", row.RuleKey)
+			continue
+		}
+
+		query, args := pgStatement(canal.InsertAction, false, rowMap(row, rule, false), rule)
+		if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+			tx.Rollback()
+			logs.Error(errors.ErrorStack(pgError(err, rule)))
+			return 0
+		}
+		sum++
+	}
+
+	if err := tx.Commit(); err != nil {
+		logs.Error(errors.ErrorStack(err))
+		return 0
+	}
+	return sum
+}
+
+func (s *PostgresEndpoint) Close() {
+	if s.db != nil {
+		s.db.Close()
+	}
+}
+
+// pgStatement 生成行数据对应的SQL语句及参数，标识列以外没有需要更新的列时update返回空语句
+// insert按conflict_policy处理标识冲突；update在upsert策略或upsert请求时以INSERT ... ON CONFLICT DO UPDATE写入，缺失的行会被补齐
+func pgStatement(action string, upsert bool, kvm map[string]interface{}, rule *global.Rule) (string, []interface{}) {
+	keys := make(map[string]bool, len(rule.PostgresqlKeys))
+	for _, k := range rule.PostgresqlKeys {
+		keys[k] = true
+	}
+	columns := make([]string, 0, len(kvm))
+	for k := range kvm {
+		columns = append(columns, k)
+	}
+	sort.Strings(columns)
+
+	table := pq.QuoteIdentifier(rule.PostgresqlSchema) + "." + pq.QuoteIdentifier(rule.PostgresqlTable)
+	args := make([]interface{}, 0, len(columns))
+	// bind 添加列的值作为参数，返回占位符，配置了postgresql_column_types的列转换为对应的类型
+	bind := func(column string) string {
+		args = append(args, pgValue(kvm[column]))
+		holder := fmt.Sprintf("$%d", len(args))
+		if typ, ok := rule.PostgresqlCasts[column]; ok {
+			holder += "::" + typ
+		}
+		return holder
+	}
+	where := func() string {
+		conds := make([]string, 0, len(rule.PostgresqlKeys))
+		for _, k := range rule.PostgresqlKeys {
+			conds = append(conds, pq.QuoteIdentifier(k)+" = "+bind(k))
+		}
+		return strings.Join(conds, " AND ")
+	}
+
+	if action == canal.DeleteAction {
+		return fmt.Sprintf("DELETE FROM %s WHERE %s", table, where()), args
+	}
+
+	policy := rule.ConflictPolicy
+	if action == canal.UpdateAction {
+		if !upsert && policy != global.ConflictUpsert {
+			sets := make([]string, 0, len(columns))
+			for _, c := range columns {
+				if !keys[c] {
+					sets = append(sets, pq.QuoteIdentifier(c)+" = "+bind(c))
+				}
+			}
+			if len(sets) == 0 {
+				return "", nil
+			}
+			return fmt.Sprintf("UPDATE %s SET %s WHERE %s", table, strings.Join(sets, ", "), where()), args
+		}
+		policy = global.ConflictUpsert
+	}
+
+	names := make([]string, 0, len(columns))
+	holders := make([]string, 0, len(columns))
+	for _, c := range columns {
+		names = append(names, pq.QuoteIdentifier(c))
+		holders = append(holders, bind(c))
+	}
+	query := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", table, strings.Join(names, ", "), strings.Join(holders, ", "))
+
+	switch policy {
+	case global.ConflictUpsert:
+		target := make([]string, 0, len(rule.PostgresqlKeys))
+		for _, k := range rule.PostgresqlKeys {
+			target = append(target, pq.QuoteIdentifier(k))
+		}
+		sets := make([]string, 0, len(columns))
+		for _, c := range columns {
+			if !keys[c] {
+				sets = append(sets, fmt.Sprintf("%s = EXCLUDED.%s", pq.QuoteIdentifier(c), pq.QuoteIdentifier(c)))
+			}
+		}
+		if len(sets) == 0 {
+			query += fmt.Sprintf(" ON CONFLICT (%s) DO NOTHING", strings.Join(target, ", "))
+		} else {
+			query += fmt.Sprintf(" ON CONFLICT (%s) DO UPDATE SET %s", strings.Join(target, ", "), strings.Join(sets, ", "))
+		}
+	case global.ConflictIgnore:
+		query += " ON CONFLICT DO NOTHING"
+	}
+	return query, args
+}
+
+// pgValue map、slice类型的值(如json列、oversize_field)以JSON字符串写入
+func pgValue(value interface{}) interface{} {
+	if value == nil {
+		return nil
+	}
+	if _, ok := value.([]byte); ok {
+		return value
+	}
+	switch reflect.TypeOf(value).Kind() {
+	case reflect.Map, reflect.Slice:
+		data, err := json.Marshal(value)
+		if err != nil {
+			return fmt.Sprint(value)
+		}
+		return string(data)
+	}
+	return value
+}
+
+func pgError(err error, rule *global.Rule) error {
+	if e, ok := err.(*pq.Error); ok && e.Code == _pgUniqueViolation {
+		return errors.Annotatef(err, "%s.%s duplicate key with conflict_policy %s", rule.PostgresqlSchema, rule.PostgresqlTable, rule.ConflictPolicy)
+	}
+	return errors.Trace(err)
+}
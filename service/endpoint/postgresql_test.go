@@ -0,0 +1,209 @@
+package endpoint
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/juju/errors"
+	"github.com/lib/pq"
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/schema"
+
+	"go-mysql-transfer/global"
+	"go-mysql-transfer/model"
+)
+
+func TestPgStatement(t *testing.T) {
+	rule := &global.Rule{
+		PostgresqlSchema: "public",
+		PostgresqlTable:  "user",
+		PostgresqlKeys:   []string{"id"},
+	}
+	kvm := map[string]interface{}{"id": 1, "name": "a", "tags": []string{"x"}}
+
+	// 同一主键的两次插入，按conflict_policy处理第二次插入
+	cases := []struct {
+		policy string
+		query  string
+	}{
+		{global.ConflictUpsert, `INSERT INTO "public"."user" ("id", "name", "tags") VALUES ($1, $2, $3) ON CONFLICT ("id") DO UPDATE SET "name" = EXCLUDED."name", "tags" = EXCLUDED."tags"`},
+		{global.ConflictIgnore, `INSERT INTO "public"."user" ("id", "name", "tags") VALUES ($1, $2, $3) ON CONFLICT DO NOTHING`},
+		{global.ConflictError, `INSERT INTO "public"."user" ("id", "name", "tags") VALUES ($1, $2, $3)`},
+	}
+	for _, c := range cases {
+		rule.ConflictPolicy = c.policy
+		query, args := pgStatement(canal.InsertAction, false, kvm, rule)
+		if query != c.query {
+			t.Errorf("%s: unexpected query %s", c.policy, query)
+		}
+		if len(args) != 3 || args[2] != `["x"]` {
+			t.Errorf("%s: unexpected args %v", c.policy, args)
+		}
+	}
+
+	rule.ConflictPolicy = global.ConflictIgnore
+	query, args := pgStatement(canal.UpdateAction, false, kvm, rule)
+	if query != `UPDATE "public"."user" SET "name" = $1, "tags" = $2 WHERE "id" = $3` || args[2] != 1 {
+		t.Errorf("unexpected update %s %v", query, args)
+	}
+	query, _ = pgStatement(canal.UpdateAction, true, kvm, rule)
+	if query != cases[0].query {
+		t.Errorf("expect upsert for upsert request, but %s", query)
+	}
+	query, args = pgStatement(canal.DeleteAction, false, kvm, rule)
+	if query != `DELETE FROM "public"."user" WHERE "id" = $1` || len(args) != 1 {
+		t.Errorf("unexpected delete %s %v", query, args)
+	}
+	query, _ = pgStatement(canal.UpdateAction, false, map[string]interface{}{"id": 1}, rule)
+	if query != "" {
+		t.Errorf("expect no statement without columns to update, but %s", query)
+	}
+
+	// 组合标识及列类型转换
+	rule = &global.Rule{
+		PostgresqlSchema: "public",
+		PostgresqlTable:  "member",
+		PostgresqlKeys:   []string{"org", "uid"},
+		ConflictPolicy:   global.ConflictUpsert,
+		PostgresqlCasts:  map[string]string{"active": "boolean", "uid": "bigint"},
+	}
+	kvm = map[string]interface{}{"org": "a", "uid": 7, "active": int64(1)}
+	query, args = pgStatement(canal.InsertAction, false, kvm, rule)
+	if query != `INSERT INTO "public"."member" ("active", "org", "uid") VALUES ($1::boolean, $2, $3::bigint) ON CONFLICT ("org", "uid") DO UPDATE SET "active" = EXCLUDED."active"` || len(args) != 3 {
+		t.Errorf("unexpected composite insert %s %v", query, args)
+	}
+	query, _ = pgStatement(canal.DeleteAction, false, kvm, rule)
+	if query != `DELETE FROM "public"."member" WHERE "org" = $1 AND "uid" = $2::bigint` {
+		t.Errorf("unexpected composite delete %s", query)
+	}
+}
+
+// fakePg 以第一个参数为主键的内存表，按INSERT的ON CONFLICT子句处理主键冲突
+type fakePg struct {
+	lock sync.Mutex
+	rows map[string][]driver.Value
+}
+
+type fakePgConn struct{ db *fakePg }
+
+type fakePgStmt struct {
+	db    *fakePg
+	query string
+}
+
+func (d *fakePg) Open(string) (driver.Conn, error) { return &fakePgConn{db: d}, nil }
+
+func (c *fakePgConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakePgStmt{db: c.db, query: query}, nil
+}
+func (c *fakePgConn) Close() error              { return nil }
+func (c *fakePgConn) Begin() (driver.Tx, error) { return c, nil }
+func (c *fakePgConn) Commit() error             { return nil }
+func (c *fakePgConn) Rollback() error           { return nil }
+
+func (s *fakePgStmt) Close() error  { return nil }
+func (s *fakePgStmt) NumInput() int { return -1 }
+func (s *fakePgStmt) Query([]driver.Value) (driver.Rows, error) {
+	return nil, errors.NotSupportedf("query")
+}
+
+func (s *fakePgStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.db.lock.Lock()
+	defer s.db.lock.Unlock()
+	key := fmt.Sprint(args[0])
+	if _, ok := s.db.rows[key]; ok {
+		switch {
+		case strings.Contains(s.query, "DO UPDATE"):
+		case strings.Contains(s.query, "DO NOTHING"):
+			return driver.RowsAffected(0), nil
+		default:
+			return nil, &pq.Error{Code: _pgUniqueViolation}
+		}
+	}
+	s.db.rows[key] = args
+	return driver.RowsAffected(1), nil
+}
+
+var _fakePg = &fakePg{}
+
+func init() {
+	sql.Register("fakepg", _fakePg)
+}
+
+func TestPostgresConsumeConflict(t *testing.T) {
+	dir, err := ioutil.TempDir("", "transfer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := filepath.Join(dir, "app.yml")
+	data := fmt.Sprintf("target: script\naddr: 127.0.0.1:3306\nuser: root\npass: root\ncharset: utf8\nslave_id: 1001\n"+
+		"data_dir: %s\nrule:\n  - schema: test\n    table: pg\n", dir)
+	if err := ioutil.WriteFile(cfg, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := global.Initialize(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	id := &schema.TableColumn{Name: "id", Type: schema.TYPE_NUMBER}
+	name := &schema.TableColumn{Name: "name", Type: schema.TYPE_STRING}
+	rule := &global.Rule{
+		TableColumnSize:  2,
+		PostgresqlSchema: "public",
+		PostgresqlTable:  "user",
+		PostgresqlKeys:   []string{"id"},
+		PaddingMap: map[string]*model.Padding{
+			"id":   {WrapName: "id", ColumnName: "id", ColumnIndex: 0, ColumnMetadata: id},
+			"name": {WrapName: "name", ColumnName: "name", ColumnIndex: 1, ColumnMetadata: name},
+		},
+	}
+	global.AddRuleIns("test:pg", rule)
+
+	db, err := sql.Open("fakepg", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	s := &PostgresEndpoint{cfg: global.Cfg(), db: db}
+
+	// 同一主键的两次插入
+	rows := []*model.RowRequest{
+		{RuleKey: "test:pg", Action: canal.InsertAction, Row: []interface{}{int64(1), "a"}},
+		{RuleKey: "test:pg", Action: canal.InsertAction, Row: []interface{}{int64(1), "b"}},
+	}
+	cases := []struct {
+		policy string
+		name   string
+	}{
+		{global.ConflictUpsert, "b"},
+		{global.ConflictIgnore, "a"},
+		{global.ConflictError, ""},
+	}
+	for _, c := range cases {
+		_fakePg.rows = make(map[string][]driver.Value)
+		rule.ConflictPolicy = c.policy
+		err := s.Consume(mysql.Position{}, rows)
+		if c.name == "" {
+			if err == nil || !strings.Contains(err.Error(), "duplicate key with conflict_policy error") {
+				t.Errorf("%s: expect duplicate key error, but %v", c.policy, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", c.policy, err)
+			continue
+		}
+		if v := _fakePg.rows["1"]; len(v) != 2 || v[1] != c.name {
+			t.Errorf("%s: expect name %s, but %v", c.policy, c.name, v)
+		}
+	}
+}
@@ -18,9 +18,10 @@
 package endpoint
 
 import (
-	"github.com/siddontang/go-mysql/canal"
-	"log"
+	"net"
 	"strconv"
+	"sync"
+	"time"
 
 	"github.com/juju/errors"
 	"github.com/siddontang/go-mysql/mysql"
@@ -38,11 +39,16 @@ type RabbitEndpoint struct {
 	rabCon    *amqp.Connection
 	rabChl    *amqp.Channel
 	queues    map[string]bool
+	queueLock sync.Mutex
 	serverUrl string
+	cfg       *global.Config
+
+	writes timedWrites
 }
 
-func newRabbitEndpoint() *RabbitEndpoint {
+func newRabbitEndpoint(cfg *global.Config) *RabbitEndpoint {
 	r := &RabbitEndpoint{}
+	r.cfg = cfg
 	r.queues = make(map[string]bool)
 	return r
 }
@@ -57,12 +63,22 @@ func (s *RabbitEndpoint) Connect() error {
 		s.rabCon = nil
 	}
 
-	con, err := amqp.Dial(global.Cfg().RabbitmqAddr)
+	config := amqp.Config{
+		Heartbeat: 10 * time.Second,
+		Locale:    "en_US",
+	}
+	if counter := newConnCounter(s.cfg); counter != nil {
+		dial := amqp.DefaultDial(30 * time.Second)
+		config.Dial = func(network, addr string) (net.Conn, error) {
+			return counter.track(dial(network, addr))
+		}
+	}
+	con, err := amqp.DialConfig(s.cfg.RabbitmqAddr, config)
 	if err != nil {
 		return err
 	}
 
-	uri, _ := amqp.ParseURI(global.Cfg().RabbitmqAddr)
+	uri, _ := amqp.ParseURI(s.cfg.RabbitmqAddr)
 	s.serverUrl = uri.Host + ":" + strconv.Itoa(uri.Port)
 
 	var chl *amqp.Channel
@@ -95,6 +111,9 @@ func (s *RabbitEndpoint) Ping() error {
 }
 
 func (s *RabbitEndpoint) mergeQueue(name string) {
+	s.queueLock.Lock()
+	defer s.queueLock.Unlock()
+
 	_, ok := s.queues[name]
 	if ok {
 		return
@@ -105,6 +124,14 @@ func (s *RabbitEndpoint) mergeQueue(name string) {
 }
 
 func (s *RabbitEndpoint) Consume(from mysql.Position, rows []*model.RowRequest) error {
+	ctx, cancel := writeContext(s.cfg)
+	defer cancel()
+	return s.writes.do(ctx, func() error {
+		return s.consume(rows)
+	})
+}
+
+func (s *RabbitEndpoint) consume(rows []*model.RowRequest) error {
 	for _, row := range rows {
 		rule, _ := global.RuleIns(row.RuleKey)
 		if rule.TableColumnSize != len(row.Row) {
@@ -120,7 +147,7 @@ func (s *RabbitEndpoint) Consume(from mysql.Position, rows []*model.RowRequest)
 				return err
 			}
 		} else {
-			err := s.doRuleConsume(row, rule)
+			err := s.doRuleConsume(row, rule, false)
 			if err != nil {
 				return err
 			}
@@ -132,6 +159,22 @@ func (s *RabbitEndpoint) Consume(from mysql.Position, rows []*model.RowRequest)
 }
 
 func (s *RabbitEndpoint) Stock(rows []*model.RowRequest) int64 {
+	ctx, cancel := writeContext(s.cfg)
+	defer cancel()
+
+	var sum int64
+	err := s.writes.do(ctx, func() error {
+		sum = s.stock(rows)
+		return nil
+	})
+	if err != nil {
+		logs.Errorf(errors.ErrorStack(err))
+		return 0
+	}
+	return sum
+}
+
+func (s *RabbitEndpoint) stock(rows []*model.RowRequest) int64 {
 	var sum int64
 	for _, row := range rows {
 		rule, _ := global.RuleIns(row.RuleKey)
@@ -147,7 +190,7 @@ func (s *RabbitEndpoint) Stock(rows []*model.RowRequest) int64 {
 				break
 			}
 		} else {
-			err := s.doRuleConsume(row, rule)
+			err := s.doRuleConsume(row, rule, true)
 			if err != nil {
 				logs.Errorf(errors.ErrorStack(err))
 				break
@@ -161,19 +204,21 @@ func (s *RabbitEndpoint) Stock(rows []*model.RowRequest) int64 {
 
 func (s *RabbitEndpoint) doLuaConsume(req *model.RowRequest, rule *global.Rule) error {
 	kvm := rowMap(req, rule, true)
-	ls, err := luaengine.DoMQOps(kvm, req.Action, rule)
+	ls, err := luaengine.DoMQOps(kvm, luaDiff(req, rule), req.Action, rule)
 	if err != nil {
-		log.Println("Lua 脚本执行失败!!! ,详情请参见日志")
-		return errors.Errorf("lua 脚本执行失败 : %s ", err)
+		return luaFailed(req, rule, kvm, err)
 	}
 
 	for _, resp := range ls {
 		s.mergeQueue(resp.Topic)
-		err := s.rabChl.Publish("", resp.Topic, false, false,
-			amqp.Publishing{
-				ContentType: "text/plain",
-				Body:        resp.ByteArray,
-			})
+		msg, err := s.publishing(resp.ByteArray)
+		if err != nil {
+			return err
+		}
+		if t, ok := eventTime(req, rule); ok {
+			msg.Timestamp = t
+		}
+		err = s.rabChl.Publish("", resp.Topic, false, false, msg)
 
 		logs.Infof("topic: %s, message: %s", resp.Topic, string(resp.ByteArray))
 		if err != nil {
@@ -184,37 +229,54 @@ func (s *RabbitEndpoint) doLuaConsume(req *model.RowRequest, rule *global.Rule)
 	return nil
 }
 
-func (s *RabbitEndpoint) doRuleConsume(req *model.RowRequest, rule *global.Rule) error {
-	kvm := rowMap(req, rule, false)
-
-	resp := new(model.MQRespond)
-	resp.Action = req.Action
-	resp.Timestamp = req.Timestamp
-	if rule.ValueEncoder == global.ValEncoderJson {
-		resp.Date = kvm
-	} else {
-		resp.Date = encodeValue(rule, kvm)
-	}
-
-	if rule.ReserveRawData && canal.UpdateAction == req.Action {
-		resp.Raw = oldRowMap(req, rule, false)
+func (s *RabbitEndpoint) doRuleConsume(req *model.RowRequest, rule *global.Rule, stock bool) error {
+	body, err := encodeMessage(req, rule, s.cfg, stock)
+	if err != nil {
+		return err
 	}
-
-	body, err := json.Marshal(resp)
+	msg, err := s.publishing(body)
 	if err != nil {
 		return err
 	}
-	err = s.rabChl.Publish("", rule.RabbitmqQueue, false, false,
-		amqp.Publishing{
-			ContentType: "text/plain",
-			Body:        body,
-		})
+	if t, ok := eventTime(req, rule); ok {
+		msg.Timestamp = t
+	}
+	err = s.rabChl.Publish("", rule.RabbitmqQueue, false, false, msg)
 
 	logs.Infof("topic: %s, message: %s", rule.RabbitmqQueue, string(body))
 
 	return err
 }
 
+func (s *RabbitEndpoint) Publish(topic string, body []byte) error {
+	ctx, cancel := writeContext(s.cfg)
+	defer cancel()
+	return s.writes.do(ctx, func() error {
+		s.mergeQueue(topic)
+		msg, err := s.publishing(body)
+		if err != nil {
+			return err
+		}
+		return s.rabChl.Publish("", topic, false, false, msg)
+	})
+}
+
+// publishing 按mq_compression压缩消息体，content_encoding记录压缩算法
+func (s *RabbitEndpoint) publishing(body []byte) (amqp.Publishing, error) {
+	msg := amqp.Publishing{
+		ContentType: "text/plain",
+	}
+	compressed, err := compressBody(s.cfg, body)
+	if err != nil {
+		return msg, err
+	}
+	if s.cfg.MQCompressionEnable() {
+		msg.ContentEncoding = s.cfg.MQCompression
+	}
+	msg.Body = compressed
+	return msg, nil
+}
+
 func (s *RabbitEndpoint) Close() {
 	if s.rabChl != nil {
 		s.rabChl.Close()
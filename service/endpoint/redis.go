@@ -20,7 +20,6 @@ package endpoint
 import (
 	"bytes"
 	"fmt"
-	"log"
 	"reflect"
 	"strconv"
 	"strings"
@@ -36,20 +35,43 @@ import (
 	"go-mysql-transfer/metrics"
 	"go-mysql-transfer/model"
 	"go-mysql-transfer/service/luaengine"
+	"go-mysql-transfer/util/consistent"
 	"go-mysql-transfer/util/logs"
 	"go-mysql-transfer/util/stringutil"
 )
 
 type RedisEndpoint struct {
+	cfg       *global.Config
 	isCluster bool
 	client    *redis.Client
 	cluster   *redis.ClusterClient
+	shards    []*redis.Client
+	ring      *consistent.Ring
 	retryLock sync.Mutex
+
+	writes timedWrites
 }
 
-func newRedisEndpoint() *RedisEndpoint {
-	cfg := global.Cfg()
+// fixed方式：key无过期时间(新建)时才设置，已有的过期时间保持不变
+var (
+	_fixedExpireScript = redis.NewScript(`if redis.call('TTL', KEYS[1]) == -1 then return redis.call('EXPIRE', KEYS[1], ARGV[1]) end return 0`)
+	_fixedSetScript    = redis.NewScript(`local ttl = redis.call('PTTL', KEYS[1])
+if ttl > 0 then return redis.call('SET', KEYS[1], ARGV[1], 'PX', ttl) end
+return redis.call('SET', KEYS[1], ARGV[1], 'EX', ARGV[2])`)
+)
+
+// redisPipeline 分片模式下每个分片对应一个pipeline
+// 设置了过期时间的规则使用事务pipeline(MULTI/EXEC)，保证写入与续期原子执行
+type redisPipeline struct {
+	endpoint *RedisEndpoint
+	pipes    map[int]redis.Pipeliner
+	txPipes  map[int]redis.Pipeliner
+}
+
+func newRedisEndpoint(cfg *global.Config) *RedisEndpoint {
 	r := &RedisEndpoint{}
+	r.cfg = cfg
+	counter := newConnCounter(cfg)
 
 	list := strings.Split(cfg.RedisAddr, ",")
 	if len(list) == 1 {
@@ -57,6 +79,7 @@ func newRedisEndpoint() *RedisEndpoint {
 			Addr:     cfg.RedisAddr,
 			Password: cfg.RedisPass,
 			DB:       cfg.RedisDatabase,
+			Dialer:   counter.redisDialer(cfg.RedisAddr),
 		})
 	} else {
 		if cfg.RedisGroupType == global.RedisGroupTypeSentinel {
@@ -74,35 +97,143 @@ func newRedisEndpoint() *RedisEndpoint {
 				Password: cfg.RedisPass,
 			})
 		}
+		if cfg.RedisGroupType == global.RedisGroupTypeSharding {
+			r.ring = shardRing(list, cfg.RedisShardWeights, cfg.RedisVirtualNodes)
+			for _, addr := range list {
+				r.shards = append(r.shards, redis.NewClient(&redis.Options{
+					Addr:     addr,
+					Password: cfg.RedisPass,
+					DB:       cfg.RedisDatabase,
+					Dialer:   counter.redisDialer(addr),
+				}))
+			}
+		}
 	}
 
 	return r
 }
 
 func (s *RedisEndpoint) Connect() error {
-	return s.Ping()
+	if err := s.Ping(); err != nil {
+		return err
+	}
+	return s.checkJsonModule()
+}
+
+// checkJsonModule redis_structure为json的规则需要RedisJSON模块，以JSON.TYPE查询不存在的key检测(不依赖MODULE LIST权限)
+func (s *RedisEndpoint) checkJsonModule() error {
+	required := false
+	for _, rule := range global.RuleInsList() {
+		if rule.RedisStructure == global.RedisStructureJson {
+			required = true
+			break
+		}
+	}
+	if !required {
+		return nil
+	}
+
+	var nodes []interface {
+		Do(args ...interface{}) *redis.Cmd
+	}
+	if s.isCluster {
+		nodes = append(nodes, s.cluster)
+	} else if s.ring != nil {
+		for _, shard := range s.shards {
+			nodes = append(nodes, shard)
+		}
+	} else {
+		nodes = append(nodes, s.client)
+	}
+	for _, node := range nodes {
+		if err := node.Do("JSON.TYPE", "go-mysql-transfer:json-probe").Err(); err != nil && err != redis.Nil {
+			return errors.Errorf("redis_structure json requires RedisJSON module: %s", err.Error())
+		}
+	}
+	return nil
 }
 
 func (s *RedisEndpoint) Ping() error {
 	var err error
 	if s.isCluster {
 		_, err = s.cluster.Ping().Result()
+	} else if s.ring != nil {
+		for _, shard := range s.shards {
+			if _, err = shard.Ping().Result(); err != nil {
+				break
+			}
+		}
 	} else {
 		_, err = s.client.Ping().Result()
 	}
 	return err
 }
 
-func (s *RedisEndpoint) pipe() redis.Pipeliner {
-	var pipe redis.Pipeliner
-	if s.isCluster {
-		pipe = s.cluster.Pipeline()
-	} else {
-		pipe = s.client.Pipeline()
+func (s *RedisEndpoint) pipe() *redisPipeline {
+	return &redisPipeline{
+		endpoint: s,
+		pipes:    make(map[int]redis.Pipeliner),
+		txPipes:  make(map[int]redis.Pipeliner),
+	}
+}
+
+// of 返回key所在节点的pipeline，分片模式下相同的key总是路由到相同的分片
+func (p *redisPipeline) of(key string) redis.Pipeliner {
+	return p.pipeOf(key, false)
+}
+
+// txOf 返回key所在节点的事务pipeline
+func (p *redisPipeline) txOf(key string) redis.Pipeliner {
+	return p.pipeOf(key, true)
+}
+
+func (p *redisPipeline) pipeOf(key string, tx bool) redis.Pipeliner {
+	index := 0
+	if p.endpoint.ring != nil {
+		index = p.endpoint.ring.Get(key)
+	}
+
+	pipes := p.pipes
+	if tx {
+		pipes = p.txPipes
+	}
+	pipe, ok := pipes[index]
+	if !ok {
+		var cmdable interface {
+			Pipeline() redis.Pipeliner
+			TxPipeline() redis.Pipeliner
+		}
+		if p.endpoint.isCluster {
+			cmdable = p.endpoint.cluster
+		} else if p.endpoint.ring != nil {
+			cmdable = p.endpoint.shards[index]
+		} else {
+			cmdable = p.endpoint.client
+		}
+		if tx {
+			pipe = cmdable.TxPipeline()
+		} else {
+			pipe = cmdable.Pipeline()
+		}
+		pipes[index] = pipe
 	}
 	return pipe
 }
 
+func (p *redisPipeline) Exec() ([]redis.Cmder, error) {
+	var cmds []redis.Cmder
+	for _, pipes := range []map[int]redis.Pipeliner{p.pipes, p.txPipes} {
+		for _, pipe := range pipes {
+			res, err := pipe.Exec()
+			cmds = append(cmds, res...)
+			if err != nil {
+				return cmds, err
+			}
+		}
+	}
+	return cmds, nil
+}
+
 func (s *RedisEndpoint) Consume(from mysql.Position, rows []*model.RowRequest) error {
 	pipe := s.pipe()
 	for _, row := range rows {
@@ -118,15 +249,17 @@ func (s *RedisEndpoint) Consume(from mysql.Position, rows []*model.RowRequest) e
 			var err error
 			var ls []*model.RedisRespond
 			kvm := rowMap(row, rule, true)
-			if row.Action == canal.UpdateAction {
+			if row.Action == canal.UpdateAction && row.Old != nil {
 				previous := oldRowMap(row, rule, true)
 				ls, err = luaengine.DoRedisOps(kvm, previous, row.Action, rule)
 			} else {
 				ls, err = luaengine.DoRedisOps(kvm, nil, row.Action, rule)
 			}
 			if err != nil {
-				log.Println("Lua 脚本执行失败!!! ,详情请参见日志")
-				return errors.Errorf("Lua 脚本执行失败 : %s ", errors.ErrorStack(err))
+				if err = luaFailed(row, rule, kvm, err); err != nil {
+					return err
+				}
+				continue
 			}
 			for _, resp := range ls {
 				s.preparePipe(resp, pipe, rule)
@@ -140,7 +273,12 @@ func (s *RedisEndpoint) Consume(from mysql.Position, rows []*model.RowRequest) e
 		}
 	}
 
-	_, err := pipe.Exec()
+	ctx, cancel := writeContext(s.cfg)
+	defer cancel()
+	err := s.writes.do(ctx, func() error {
+		_, err := pipe.Exec()
+		return err
+	})
 	if err != nil {
 		return err
 	}
@@ -162,8 +300,11 @@ func (s *RedisEndpoint) Stock(rows []*model.RowRequest) int64 {
 			kvm := rowMap(row, rule, true)
 			ls, err := luaengine.DoRedisOps(kvm, nil, row.Action, rule)
 			if err != nil {
-				logs.Errorf("lua 脚本执行失败 : %s ", errors.ErrorStack(err))
-				break
+				if err = luaFailed(row, rule, kvm, err); err != nil {
+					logs.Error(err.Error())
+					break
+				}
+				continue
 			}
 			for _, resp := range ls {
 				s.preparePipe(resp, pipe, rule)
@@ -176,12 +317,23 @@ func (s *RedisEndpoint) Stock(rows []*model.RowRequest) int64 {
 		}
 	}
 
-	var counter int64
-	res, err := pipe.Exec()
+	ctx, cancel := writeContext(s.cfg)
+	defer cancel()
+	var res []redis.Cmder
+	err := s.writes.do(ctx, func() error {
+		var err error
+		res, err = pipe.Exec()
+		return err
+	})
 	if err != nil {
 		logs.Error(err.Error())
+		if ctx.Err() != nil {
+			return 0
+		}
 	}
 
+	var counter int64
+
 	for _, re := range res {
 		if re.Err() == nil {
 			counter++
@@ -205,12 +357,17 @@ func (s *RedisEndpoint) ruleRespond(row *model.RowRequest, rule *global.Rule) *m
 	if resp.Structure == global.RedisStructureSortedSet {
 		resp.Score = s.encodeSortedSetScoreField(row, rule)
 	}
-	if resp.Action == canal.InsertAction {
+	if resp.Structure == global.RedisStructureJson {
+		// 完整的行数据作为JSON文档，JSON列已解析为嵌套结构
+		if resp.Action != canal.DeleteAction {
+			resp.Val = encodeValue(rule, kvm)
+		}
+	} else if resp.Action == canal.InsertAction {
 		resp.Val = encodeValue(rule, kvm)
 	} else if resp.Action == canal.UpdateAction {
-		if rule.RedisStructure == global.RedisStructureList ||
+		if row.Old != nil && (rule.RedisStructure == global.RedisStructureList ||
 			rule.RedisStructure == global.RedisStructureSet ||
-			rule.RedisStructure == global.RedisStructureSortedSet {
+			rule.RedisStructure == global.RedisStructureSortedSet) {
 			oldKvm := oldRowMap(row, rule, false)
 			resp.OldVal = encodeValue(rule, oldKvm)
 		}
@@ -222,17 +379,30 @@ func (s *RedisEndpoint) ruleRespond(row *model.RowRequest, rule *global.Rule) *m
 			resp.Val = encodeValue(rule, kvm)
 		}
 	}
+	if val, ok := resp.Val.(string); ok {
+		observePayload(row, rule, len(val))
+	}
 
 	return resp
 }
 
-func (s *RedisEndpoint) preparePipe(resp *model.RedisRespond, pipe redis.Cmdable, rule *global.Rule) {
+func (s *RedisEndpoint) preparePipe(resp *model.RedisRespond, pipes *redisPipeline, rule *global.Rule) {
+	var expireTime time.Duration
+	if rule.RedisExpiredSecond >= 1 {
+		expireTime = time.Duration(rule.RedisExpiredSecond) * time.Second
+	}
+
+	// 有过期时间的规则，同一key的写入与续期在同一个事务中执行
+	pipe := pipes.of(resp.Key)
+	if expireTime > 0 {
+		pipe = pipes.txOf(resp.Key)
+	}
 	switch resp.Structure {
 	case global.RedisStructureString:
 		if resp.Action == canal.DeleteAction {
 			pipe.Del(resp.Key)
 		} else {
-			pipe.Set(resp.Key, resp.Val, 0)
+			setWithExpire(pipe, resp.Key, resp.Val, expireTime, rule) // SET EX 本身是原子的
 		}
 	case global.RedisStructureHash:
 		if resp.Action == canal.DeleteAction {
@@ -240,6 +410,12 @@ func (s *RedisEndpoint) preparePipe(resp *model.RedisRespond, pipe redis.Cmdable
 		} else {
 			pipe.HSet(resp.Key, resp.Field, resp.Val)
 		}
+	case global.RedisStructureJson:
+		if resp.Action == canal.DeleteAction {
+			pipe.Do("JSON.DEL", resp.Key)
+		} else {
+			pipe.Do("JSON.SET", resp.Key, "$", resp.Val)
+		}
 	case global.RedisStructureList:
 		if resp.Action == canal.DeleteAction {
 			pipe.LRem(resp.Key, 0, resp.Val)
@@ -270,9 +446,13 @@ func (s *RedisEndpoint) preparePipe(resp *model.RedisRespond, pipe redis.Cmdable
 			pipe.ZAdd(resp.Key, val)
 		}
 	}
-	// 除删除外且过期秒数大于1 设置过期时间
-	if resp.Action != canal.DeleteAction && rule.RedisExpiredSecond >= 1 {
-		pipe.Expire(resp.Key, time.Duration(rule.RedisExpiredSecond)*time.Second)
+	// 除删除外且过期秒数大于1 设置过期时间，sliding方式每次修改自动续期；hash等结构的过期时间作用于整个key
+	if resp.Action != canal.DeleteAction && expireTime > 0 && resp.Structure != global.RedisStructureString {
+		if rule.RedisExpireMode == global.RedisExpireFixed {
+			_fixedExpireScript.Eval(pipe, []string{resp.Key}, rule.RedisExpiredSecond)
+		} else {
+			pipe.Expire(resp.Key, expireTime)
+		}
 	}
 	// 处理纬度信息 纬度默认就用string
 	if len(rule.RedisDimensionColumn) >= 1 {
@@ -292,19 +472,28 @@ func (s *RedisEndpoint) preparePipe(resp *model.RedisRespond, pipe redis.Cmdable
 			k.WriteString(":")
 			k.WriteString(fmt.Sprintf("%v", value))
 			redisKey := k.String()
+			pipe := pipes.of(redisKey)
+			if expireTime > 0 {
+				pipe = pipes.txOf(redisKey)
+			}
 			if resp.Action == canal.DeleteAction {
 				pipe.Del(redisKey)
 			} else {
-				var expireTime time.Duration
-				if rule.RedisExpiredSecond >= 1 {
-					expireTime = time.Duration(rule.RedisExpiredSecond) * time.Second
-				}
-				pipe.Set(redisKey, resp.Key, expireTime)
+				setWithExpire(pipe, redisKey, resp.Key, expireTime, rule)
 			}
 		}
 	}
 }
 
+// setWithExpire fixed方式已存在的key保留剩余的过期时间
+func setWithExpire(pipe redis.Pipeliner, key string, val interface{}, expireTime time.Duration, rule *global.Rule) {
+	if expireTime > 0 && rule.RedisExpireMode == global.RedisExpireFixed {
+		_fixedSetScript.Eval(pipe, []string{key}, val, rule.RedisExpiredSecond)
+		return
+	}
+	pipe.Set(key, val, expireTime)
+}
+
 func (s *RedisEndpoint) encodeKey(req *model.RowRequest, rule *global.Rule) string {
 	if rule.RedisKeyValue != "" {
 		return rule.RedisKeyValue
@@ -321,7 +510,9 @@ func (s *RedisEndpoint) encodeKey(req *model.RowRequest, rule *global.Rule) stri
 	}
 
 	var key string
-	if rule.RedisKeyColumnIndex < 0 {
+	if rule.KeyFormat == global.KeyFormatTyped {
+		key = typedKey(req.Row, redisColumns(rule.RedisKeyColumnIndex, rule.RedisKeyColumnIndexs), rule)
+	} else if rule.RedisKeyColumnIndex < 0 {
 		for _, v := range rule.RedisKeyColumnIndexs {
 			key += stringutil.ToString(req.Row[v])
 		}
@@ -338,7 +529,9 @@ func (s *RedisEndpoint) encodeKey(req *model.RowRequest, rule *global.Rule) stri
 func (s *RedisEndpoint) encodeHashField(req *model.RowRequest, rule *global.Rule) string {
 	var field string
 
-	if rule.RedisHashFieldColumnIndex < 0 {
+	if rule.KeyFormat == global.KeyFormatTyped {
+		field = typedKey(req.Row, redisColumns(rule.RedisHashFieldColumnIndex, rule.RedisHashFieldColumnIndexs), rule)
+	} else if rule.RedisHashFieldColumnIndex < 0 {
 		for _, v := range rule.RedisHashFieldColumnIndexs {
 			field += stringutil.ToString(req.Row[v])
 		}
@@ -353,6 +546,14 @@ func (s *RedisEndpoint) encodeHashField(req *model.RowRequest, rule *global.Rule
 	return field
 }
 
+// redisColumns key、hash field使用的列，index小于0时为多列
+func redisColumns(index int, indexes []int) []int {
+	if index < 0 {
+		return indexes
+	}
+	return []int{index}
+}
+
 func (s *RedisEndpoint) encodeSortedSetScoreField(req *model.RowRequest, rule *global.Rule) float64 {
 	obj := req.Row[rule.RedisHashFieldColumnIndex]
 	if obj == nil {
@@ -363,10 +564,61 @@ func (s *RedisEndpoint) encodeSortedSetScoreField(req *model.RowRequest, rule *g
 	return stringutil.ToFloat64Safe(str)
 }
 
+// cmdable 返回key所在节点的客户端
+func (s *RedisEndpoint) cmdable(key string) redis.Cmdable {
+	if s.isCluster {
+		return s.cluster
+	}
+	if s.ring != nil {
+		return s.shards[s.ring.Get(key)]
+	}
+	return s.client
+}
+
+func (s *RedisEndpoint) Count(rule *global.Rule) (int64, error) {
+	if rule.RedisStructure != global.RedisStructureHash {
+		return -1, nil
+	}
+	return s.cmdable(rule.RedisKeyValue).HLen(rule.RedisKeyValue).Result()
+}
+
+func (s *RedisEndpoint) Fetch(rule *global.Rule, rows []*model.RowRequest) ([]interface{}, error) {
+	if rule.RedisStructure != global.RedisStructureString && rule.RedisStructure != global.RedisStructureHash {
+		return nil, errors.Errorf("verify not supported for redis structure %s", rule.RedisStructure)
+	}
+
+	ret := make([]interface{}, len(rows))
+	for i, row := range rows {
+		var val string
+		var err error
+		key := s.encodeKey(row, rule)
+		if rule.RedisStructure == global.RedisStructureHash {
+			val, err = s.cmdable(key).HGet(key, s.encodeHashField(row, rule)).Result()
+		} else {
+			val, err = s.cmdable(key).Get(key).Result()
+		}
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		ret[i] = val
+	}
+	return ret, nil
+}
+
+func (s *RedisEndpoint) Expect(rule *global.Rule, row *model.RowRequest) interface{} {
+	return encodeValue(rule, rowMap(row, rule, false))
+}
+
 func (s *RedisEndpoint) Close() {
 	if s.client != nil {
 		s.client.Close()
 	}
+	for _, shard := range s.shards {
+		shard.Close()
+	}
 }
 
 func InterfaceIsNil1(i interface{}) bool {
@@ -19,8 +19,6 @@ package endpoint
 
 import (
 	"context"
-	"github.com/siddontang/go-mysql/canal"
-	"log"
 	"strings"
 	"sync"
 
@@ -42,13 +40,15 @@ import (
 const _rocketRetry = 2
 
 type RocketEndpoint struct {
+	cfg       *global.Config
 	client    rocketmq.Producer
 	retryLock sync.Mutex
+
+	writes timedWrites
 }
 
-func newRocketEndpoint() *RocketEndpoint {
+func newRocketEndpoint(cfg *global.Config) *RocketEndpoint {
 	rlog.SetLogger(logagent.NewRocketmqLoggerAgent())
-	cfg := global.Cfg()
 
 	options := make([]producer.Option, 0)
 	serverList := strings.Split(cfg.RocketmqNameServers, ",")
@@ -69,6 +69,7 @@ func newRocketEndpoint() *RocketEndpoint {
 
 	producer, _ := rocketmq.NewProducer(options...)
 	r := &RocketEndpoint{}
+	r.cfg = cfg
 	r.client = producer
 	return r
 }
@@ -82,7 +83,9 @@ func (s *RocketEndpoint) Ping() error {
 		Topic: "BenchmarkTest",
 		Body:  []byte("ping"),
 	}
-	_, err := s.client.SendSync(context.Background(), ping)
+	ctx, cancel := writeContext(s.cfg)
+	defer cancel()
+	_, err := s.client.SendSync(ctx, ping)
 	return err
 }
 
@@ -100,12 +103,11 @@ func (s *RocketEndpoint) Consume(from mysql.Position, rows []*model.RowRequest)
 		if rule.LuaEnable() {
 			ls, err := s.buildMessages(row, rule)
 			if err != nil {
-				log.Println("Lua 脚本执行失败!!! ,详情请参见日志")
-				return errors.Errorf("lua 脚本执行失败 : %s ", errors.ErrorStack(err))
+				return err
 			}
 			ms = append(ms, ls...)
 		} else {
-			m, err := s.buildMessage(row, rule)
+			m, err := s.buildMessage(row, rule, false)
 			if err != nil {
 				return errors.New(errors.ErrorStack(err))
 			}
@@ -117,23 +119,9 @@ func (s *RocketEndpoint) Consume(from mysql.Position, rows []*model.RowRequest)
 		return nil
 	}
 
-	var wg sync.WaitGroup
-	wg.Add(1)
-	var callbackErr error
-	err := s.client.SendAsync(context.Background(),
-		func(ctx context.Context, result *primitive.SendResult, e error) {
-			if e != nil {
-				callbackErr = e
-			}
-			wg.Done()
-		}, ms...)
-
-	if err != nil {
-		return err
-	}
-	wg.Wait()
-
-	if callbackErr != nil {
+	ctx, cancel := writeContext(s.cfg)
+	defer cancel()
+	if err := s.send(ctx, ms); err != nil {
 		return err
 	}
 
@@ -160,7 +148,7 @@ func (s *RocketEndpoint) Stock(rows []*model.RowRequest) int64 {
 			}
 			ms = append(ms, ls...)
 		} else {
-			m, err := s.buildMessage(row, rule)
+			m, err := s.buildMessage(row, rule, true)
 			if err != nil {
 				logs.Errorf(errors.ErrorStack(err))
 				expect = false
@@ -178,77 +166,100 @@ func (s *RocketEndpoint) Stock(rows []*model.RowRequest) int64 {
 		return 0
 	}
 
-	var wg sync.WaitGroup
-	wg.Add(1)
-	err := s.client.SendAsync(context.Background(),
-		func(ctx context.Context, result *primitive.SendResult, e error) {
-			if e != nil {
-				logs.Error(errors.ErrorStack(e))
-				expect = false
-			}
-			wg.Done()
-		}, ms...)
-
-	if err != nil {
+	ctx, cancel := writeContext(s.cfg)
+	defer cancel()
+	if err := s.send(ctx, ms); err != nil {
 		logs.Error(errors.ErrorStack(err))
 		return 0
 	}
+	return int64(len(ms))
+}
 
-	wg.Wait()
-
-	if expect {
-		return int64(len(ms))
-	}
-	return 0
+// send 异步发送一批消息并等待发送结果
+func (s *RocketEndpoint) send(ctx context.Context, ms []*primitive.Message) error {
+	return s.writes.do(ctx, func() error {
+		var wg sync.WaitGroup
+		wg.Add(1)
+		var callbackErr error
+		err := s.client.SendAsync(ctx,
+			func(ctx context.Context, result *primitive.SendResult, e error) {
+				if e != nil {
+					callbackErr = e
+				}
+				wg.Done()
+			}, ms...)
+		if err != nil {
+			return err
+		}
+		wg.Wait()
+		return callbackErr
+	})
 }
 
 func (s *RocketEndpoint) buildMessages(req *model.RowRequest, rule *global.Rule) ([]*primitive.Message, error) {
 	kvm := rowMap(req, rule, true)
-	ls, err := luaengine.DoMQOps(kvm, req.Action, rule)
+	ls, err := luaengine.DoMQOps(kvm, luaDiff(req, rule), req.Action, rule)
 	if err != nil {
-		return nil, errors.Errorf("lua 脚本执行失败 : %s ", err)
+		// 按lua_error_policy跳过时不产生消息
+		return nil, luaFailed(req, rule, kvm, err)
 	}
 
 	var ms []*primitive.Message
 	for _, resp := range ls {
-		m := &primitive.Message{
-			Topic: resp.Topic,
-			Body:  resp.ByteArray,
+		m, err := s.message(resp.Topic, resp.ByteArray)
+		if err != nil {
+			return nil, err
 		}
-		logs.Infof("topic: %s, message: %s", m.Topic, string(m.Body))
+		logs.Infof("topic: %s, message: %s", resp.Topic, string(resp.ByteArray))
 		ms = append(ms, m)
 	}
 
 	return ms, nil
 }
 
-func (s *RocketEndpoint) buildMessage(req *model.RowRequest, rule *global.Rule) (*primitive.Message, error) {
-	kvm := rowMap(req, rule, false)
-	resp := new(model.MQRespond)
-	resp.Action = req.Action
-	resp.Timestamp = req.Timestamp
-	if rule.ValueEncoder == global.ValEncoderJson {
-		resp.Date = kvm
-	} else {
-		resp.Date = encodeValue(rule, kvm)
-	}
-
-	if rule.ReserveRawData && canal.UpdateAction == req.Action {
-		resp.Raw = oldRowMap(req, rule, false)
+func (s *RocketEndpoint) buildMessage(req *model.RowRequest, rule *global.Rule, stock bool) (*primitive.Message, error) {
+	body, err := encodeMessage(req, rule, s.cfg, stock)
+	if err != nil {
+		return nil, err
 	}
 
-	body, err := json.Marshal(resp)
+	m, err := s.message(rule.RocketmqTopic, body)
 	if err != nil {
 		return nil, err
 	}
 
-	m := &primitive.Message{
-		Topic: rule.RocketmqTopic,
-		Body:  body,
+	logs.Infof("topic: %s, message: %s", rule.RocketmqTopic, string(body))
+
+	return m, nil
+}
+
+func (s *RocketEndpoint) Publish(topic string, body []byte) error {
+	m, err := s.message(topic, body)
+	if err != nil {
+		return err
 	}
 
-	logs.Infof("topic: %s, message: %s", m.Topic, string(m.Body))
+	ctx, cancel := writeContext(s.cfg)
+	defer cancel()
+	return s.writes.do(ctx, func() error {
+		_, err := s.client.SendSync(ctx, m)
+		return err
+	})
+}
 
+// message 按mq_compression压缩消息体，消息属性Content-Encoding记录压缩算法
+func (s *RocketEndpoint) message(topic string, body []byte) (*primitive.Message, error) {
+	compressed, err := compressBody(s.cfg, body)
+	if err != nil {
+		return nil, err
+	}
+	m := &primitive.Message{
+		Topic: topic,
+		Body:  compressed,
+	}
+	if s.cfg.MQCompressionEnable() {
+		m.WithProperty(ContentEncodingHeader, s.cfg.MQCompression)
+	}
 	return m, nil
 }
 
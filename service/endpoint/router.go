@@ -0,0 +1,224 @@
+/*
+ * Copyright 2020-2021 the original author(https://github.com/wj596)
+ *
+ * <p>
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * </p>
+ */
+package endpoint
+
+import (
+	"github.com/juju/errors"
+	"github.com/siddontang/go-mysql/mysql"
+
+	"go-mysql-transfer/global"
+	"go-mysql-transfer/model"
+)
+
+// RouterEndpoint 按RowRequest.Endpoint将数据分发到target或附加接收端
+type RouterEndpoint struct {
+	primary Endpoint
+	names   []string
+	routes  map[string]Endpoint
+
+	heartbeats map[string]string // 附加接收端名称 -> heartbeat_topic
+}
+
+func newRouterEndpoint(cfg *global.Config) *RouterEndpoint {
+	r := &RouterEndpoint{
+		primary: newEndpoint(cfg),
+		routes:  make(map[string]Endpoint, len(cfg.Endpoints)),
+
+		heartbeats: make(map[string]string),
+	}
+	for _, ep := range cfg.Endpoints {
+		r.names = append(r.names, ep.Name)
+		r.routes[ep.Name] = newEndpoint(cfg.WithEndpoint(ep))
+		if ep.HeartbeatTopic != "" {
+			r.heartbeats[ep.Name] = ep.HeartbeatTopic
+		}
+	}
+	return r
+}
+
+func (s *RouterEndpoint) Connect() error {
+	if err := s.primary.Connect(); err != nil {
+		return err
+	}
+	for _, name := range s.names {
+		if err := s.routes[name].Connect(); err != nil {
+			return errors.Annotatef(err, "endpoint %s", name)
+		}
+	}
+	return nil
+}
+
+func (s *RouterEndpoint) Ping() error {
+	if err := s.primary.Ping(); err != nil {
+		return err
+	}
+	for _, name := range s.names {
+		if err := s.routes[name].Ping(); err != nil {
+			return errors.Annotatef(err, "endpoint %s", name)
+		}
+	}
+	return nil
+}
+
+func (s *RouterEndpoint) Consume(from mysql.Position, rows []*model.RowRequest) error {
+	primary, routed := s.split(rows)
+	if len(primary) > 0 {
+		if err := s.primary.Consume(from, primary); err != nil {
+			return err
+		}
+	}
+	for _, name := range s.names {
+		if ls, ok := routed[name]; ok {
+			if err := s.routes[name].Consume(from, ls); err != nil {
+				return errors.Annotatef(err, "endpoint %s", name)
+			}
+		}
+	}
+	return nil
+}
+
+func (s *RouterEndpoint) Stock(rows []*model.RowRequest) int64 {
+	primary, routed := s.split(rows)
+	var sum int64
+	if len(primary) > 0 {
+		sum += s.primary.Stock(primary)
+	}
+	for _, name := range s.names {
+		if ls, ok := routed[name]; ok {
+			sum += s.routes[name].Stock(ls)
+		}
+	}
+	return sum
+}
+
+// Publish 非数据消息(如DDL事件)发送到target
+func (s *RouterEndpoint) Publish(topic string, body []byte) error {
+	if publisher, ok := s.primary.(Publisher); ok {
+		return publisher.Publish(topic, body)
+	}
+	return nil
+}
+
+// publishHeartbeat 向配置了heartbeat_topic的附加接收端发送心跳
+func (s *RouterEndpoint) publishHeartbeat(body []byte) error {
+	for _, name := range s.names {
+		topic, ok := s.heartbeats[name]
+		if !ok {
+			continue
+		}
+		if publisher, ok := s.routes[name].(Publisher); ok {
+			if err := publisher.Publish(topic, body); err != nil {
+				return errors.Annotatef(err, "endpoint %s", name)
+			}
+		}
+	}
+	return nil
+}
+
+func (s *RouterEndpoint) Count(rule *global.Rule) (int64, error) {
+	var sum int64
+	for _, enp := range append([]Endpoint{s.primary}, s.endpoints()...) {
+		verifier, ok := enp.(Verifier)
+		if !ok {
+			return -1, nil
+		}
+		n, err := verifier.Count(rule)
+		if err != nil || n < 0 {
+			return n, err
+		}
+		sum += n
+	}
+	return sum, nil
+}
+
+func (s *RouterEndpoint) Fetch(rule *global.Rule, rows []*model.RowRequest) ([]interface{}, error) {
+	ret := make([]interface{}, len(rows))
+	indexes := make(map[string][]int)
+	groups := make(map[string][]*model.RowRequest)
+	for i, row := range rows {
+		indexes[row.Endpoint] = append(indexes[row.Endpoint], i)
+		groups[row.Endpoint] = append(groups[row.Endpoint], row)
+	}
+
+	for name, group := range groups {
+		enp := s.primary
+		if name != "" {
+			enp = s.routes[name]
+		}
+		verifier, ok := enp.(Verifier)
+		if !ok {
+			return nil, errors.New("verify not supported by endpoint")
+		}
+		fetched, err := verifier.Fetch(rule, group)
+		if err != nil {
+			return nil, err
+		}
+		for i, v := range fetched {
+			ret[indexes[name][i]] = v
+		}
+	}
+	return ret, nil
+}
+
+func (s *RouterEndpoint) Expect(rule *global.Rule, row *model.RowRequest) interface{} {
+	if verifier, ok := s.primary.(Verifier); ok {
+		return verifier.Expect(rule, row)
+	}
+	return nil
+}
+
+func (s *RouterEndpoint) endpoints() []Endpoint {
+	ls := make([]Endpoint, 0, len(s.names))
+	for _, name := range s.names {
+		ls = append(ls, s.routes[name])
+	}
+	return ls
+}
+
+func (s *RouterEndpoint) Recycle() error {
+	if err := Recycle(s.primary); err != nil {
+		return err
+	}
+	for _, name := range s.names {
+		if err := Recycle(s.routes[name]); err != nil {
+			return errors.Annotatef(err, "endpoint %s", name)
+		}
+	}
+	return nil
+}
+
+func (s *RouterEndpoint) Close() {
+	s.primary.Close()
+	for _, name := range s.names {
+		s.routes[name].Close()
+	}
+}
+
+// split 按接收端分组，保持每组内的顺序
+func (s *RouterEndpoint) split(rows []*model.RowRequest) ([]*model.RowRequest, map[string][]*model.RowRequest) {
+	primary := make([]*model.RowRequest, 0, len(rows))
+	routed := make(map[string][]*model.RowRequest)
+	for _, row := range rows {
+		if row.Endpoint == "" {
+			primary = append(primary, row)
+			continue
+		}
+		routed[row.Endpoint] = append(routed[row.Endpoint], row)
+	}
+	return primary, routed
+}
@@ -18,9 +18,6 @@
 package endpoint
 
 import (
-	"log"
-
-	"github.com/pingcap/errors"
 	"github.com/siddontang/go-mysql/mysql"
 
 	"go-mysql-transfer/global"
@@ -57,8 +54,9 @@ func (s *ScriptEndpoint) Consume(from mysql.Position, rows []*model.RowRequest)
 		kvm := rowMap(row, rule, true)
 		err := luaengine.DoScript(kvm, row.Action, rule)
 		if err != nil {
-			log.Println("Lua 脚本执行失败!!! ,详情请参见日志")
-			return errors.Errorf("Lua 脚本执行失败 : %s ", errors.ErrorStack(err))
+			if err = luaFailed(row, rule, kvm, err); err != nil {
+				return err
+			}
 		}
 		kvm = nil
 	}
@@ -79,8 +77,11 @@ func (s *ScriptEndpoint) Stock(rows []*model.RowRequest) int64 {
 		kvm := rowMap(row, rule, true)
 		err := luaengine.DoScript(kvm, row.Action, rule)
 		if err != nil {
-			logs.Errorf("lua 脚本执行失败 : %s ", errors.ErrorStack(err))
-			break
+			if err = luaFailed(row, rule, kvm, err); err != nil {
+				logs.Error(err.Error())
+				break
+			}
+			continue
 		}
 		counter++
 	}
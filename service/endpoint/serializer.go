@@ -0,0 +1,156 @@
+/*
+ * Copyright 2020-2021 the original author(https://github.com/wj596)
+ *
+ * <p>
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * </p>
+ */
+package endpoint
+
+import (
+	"reflect"
+	"sync"
+
+	"github.com/siddontang/go-mysql/canal"
+
+	"go-mysql-transfer/global"
+	"go-mysql-transfer/model"
+)
+
+// Serializer 消息体序列化器，rocketmq、kafka、rabbitmq接收端使用规则的mq_format对应的序列化器编码每一行数据
+//
+// 自定义格式实现此接口，在init中调用RegisterSerializer按名称注册后编译进程序，规则中配置mq_format为该名称即可使用；
+// req.Action为insert、update、delete，req.Row为按表结构对齐的行数据(可使用rule.TableInfo解析列)，
+// 开启reserve_raw_data时update的req.Old为变更前的数据；stock为true表示全量导入的数据
+type Serializer interface {
+	Serialize(rule *global.Rule, req *model.RowRequest, stock bool) ([]byte, error)
+}
+
+// SerializerFunc 函数形式的Serializer
+type SerializerFunc func(rule *global.Rule, req *model.RowRequest, stock bool) ([]byte, error)
+
+func (f SerializerFunc) Serialize(rule *global.Rule, req *model.RowRequest, stock bool) ([]byte, error) {
+	return f(rule, req, stock)
+}
+
+var (
+	_serializers    = make(map[string]Serializer)
+	_serializerLock sync.RWMutex
+)
+
+func init() {
+	RegisterSerializer(global.MQFormatJson, SerializerFunc(serializeJson))
+	RegisterSerializer(global.MQFormatMaxwell, SerializerFunc(serializeMaxwell))
+}
+
+// RegisterSerializer 按名称注册序列化器，同名的覆盖之前注册的；须在加载配置之前(如init中)调用
+func RegisterSerializer(name string, serializer Serializer) {
+	_serializerLock.Lock()
+	defer _serializerLock.Unlock()
+
+	_serializers[name] = serializer
+	global.RegisterMQFormat(name)
+}
+
+// serializerOf 规则的序列化器：规则的mq_format优先，其次为接收端的mq_format(附加接收端未配置时沿用全局的)，默认json
+func serializerOf(rule *global.Rule, cfg *global.Config) Serializer {
+	name := rule.MQFormat
+	if name == "" {
+		name = cfg.MQFormat
+	}
+	if name == "" {
+		name = global.MQFormatJson
+	}
+
+	_serializerLock.RLock()
+	defer _serializerLock.RUnlock()
+
+	if s, ok := _serializers[name]; ok {
+		return s
+	}
+	return _serializers[global.MQFormatJson]
+}
+
+// serializeJson 默认的json格式，也是自定义序列化器的参考实现
+func serializeJson(rule *global.Rule, req *model.RowRequest, stock bool) ([]byte, error) {
+	kvm := rowMap(req, rule, false)
+
+	resp := new(model.MQRespond)
+	resp.Action = req.Action
+	resp.Timestamp = req.Timestamp
+	if rule.IncludeTimeZone {
+		resp.TimeZone = global.SourceTimeZone()
+	}
+	resp.Watermark = watermarkOf(req, rule)
+	resp.Source = global.Cfg().SourceId
+	if rule.ValueEncoder == global.ValEncoderJson {
+		resp.Date = orderedData(rule, kvm)
+	} else {
+		resp.Date = encodeValue(rule, kvm)
+	}
+
+	if rule.ReserveRawData && canal.UpdateAction == req.Action && req.Old != nil {
+		resp.Raw = orderedData(rule, oldRowMap(req, rule, false))
+	}
+
+	if rule.DiffOutput {
+		diff := rowDiff(req, rule, false)
+		if len(rule.OrderedFields) > 0 {
+			kv := make(map[string]interface{}, len(diff))
+			for k, v := range diff {
+				kv[k] = v
+			}
+			resp.Diff = orderedData(rule, kv)
+		} else {
+			resp.Diff = diff
+		}
+	}
+
+	return json.Marshal(resp)
+}
+
+// serializeMaxwell 兼容Maxwell的格式
+func serializeMaxwell(rule *global.Rule, req *model.RowRequest, stock bool) ([]byte, error) {
+	kvm := rowMap(req, rule, false)
+
+	resp := &model.MaxwellRespond{
+		Database: rule.Schema,
+		Table:    rule.Table,
+		Type:     req.Action,
+		Ts:       req.Timestamp,
+		Source:   global.Cfg().SourceId,
+	}
+	if stock {
+		resp.Type = "bootstrap-insert"
+	}
+	if rule.IncludeTimeZone {
+		resp.TimeZone = global.SourceTimeZone()
+	}
+	if watermark := watermarkOf(req, rule); watermark != nil {
+		resp.Position = watermark.Position
+		resp.XOffset = watermark.Offset
+		resp.GTID = watermark.GTID
+	}
+	if canal.UpdateAction == req.Action && req.Old != nil {
+		// Maxwell的old只包含发生变化的列
+		old := make(map[string]interface{})
+		for k, v := range oldRowMap(req, rule, false) {
+			if !reflect.DeepEqual(v, kvm[k]) {
+				old[k] = v
+			}
+		}
+		resp.Old = orderedData(rule, old)
+	}
+	resp.Data = orderedData(rule, kvm)
+	return json.Marshal(resp)
+}
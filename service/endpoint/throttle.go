@@ -0,0 +1,125 @@
+/*
+ * Copyright 2020-2021 the original author(https://github.com/wj596)
+ *
+ * <p>
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * </p>
+ */
+package endpoint
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	"go.uber.org/atomic"
+)
+
+// Cosmos DB等云服务的Mongo接口限流时在错误信息中给出建议的重试间隔
+var _retryAfterMs = regexp.MustCompile(`RetryAfterMs=(\d+)`)
+
+// ThrottledError 接收端限流(如Elasticsearch返回429)，按限流退避后重试，不判定为接收端不可用
+type ThrottledError struct {
+	Reason     string
+	RetryAfter time.Duration // 接收端给出的重试间隔(Retry-After)，未给出时为0
+}
+
+func (e *ThrottledError) Error() string {
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("throttled: %s, retry after %s", e.Reason, e.RetryAfter)
+	}
+	return "throttled: " + e.Reason
+}
+
+// IsThrottled 错误是否为接收端限流
+func IsThrottled(err error) (*ThrottledError, bool) {
+	if err == nil {
+		return nil, false
+	}
+	t, ok := errors.Cause(err).(*ThrottledError)
+	return t, ok
+}
+
+// isMongoThrottled Mongo接口的限流错误：TooManyRequests(16500)
+func isMongoThrottled(err error) (*ThrottledError, bool) {
+	msg := err.Error()
+	if !strings.Contains(msg, "16500") && !strings.Contains(msg, "TooManyRequests") {
+		return nil, false
+	}
+	t := &ThrottledError{Reason: msg}
+	if m := _retryAfterMs.FindStringSubmatch(msg); len(m) == 2 {
+		if ms, e := strconv.Atoi(m[1]); e == nil {
+			t.RetryAfter = time.Duration(ms) * time.Millisecond
+		}
+	}
+	return t, true
+}
+
+// retryAfterTransport 记录接收端最近一次限流响应(429)的Retry-After，客户端的错误中不包含响应头
+type retryAfterTransport struct {
+	http.RoundTripper
+	last atomic.Int64
+}
+
+// newRetryAfterTransport 每个客户端使用单独的连接池，关闭时可回收其连接
+func newRetryAfterTransport() *retryAfterTransport {
+	return &retryAfterTransport{RoundTripper: http.DefaultTransport.(*http.Transport).Clone()}
+}
+
+// client 使用该transport的http客户端，超时沿用elastic默认使用的http.DefaultClient
+func (t *retryAfterTransport) client() *http.Client {
+	return &http.Client{Transport: t, Timeout: http.DefaultClient.Timeout}
+}
+
+// CloseIdleConnections 关闭空闲连接，之后的请求重新解析地址、建立连接
+func (t *retryAfterTransport) CloseIdleConnections() {
+	t.RoundTripper.(*http.Transport).CloseIdleConnections()
+}
+
+func (t *retryAfterTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.RoundTripper.RoundTrip(req)
+	if err == nil && resp.StatusCode == http.StatusTooManyRequests {
+		t.last.Store(int64(parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())))
+	}
+	return resp, err
+}
+
+// throttled 以最近一次记录的Retry-After构造限流错误
+func (t *retryAfterTransport) throttled(reason string) error {
+	return &ThrottledError{
+		Reason:     reason,
+		RetryAfter: time.Duration(t.last.Swap(0)),
+	}
+}
+
+// parseRetryAfter Retry-After为秒数或HTTP日期，无法解析时为0
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil && at.After(now) {
+		return at.Sub(now)
+	}
+	return 0
+}
@@ -0,0 +1,41 @@
+package endpoint
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	jujuerrors "github.com/juju/errors"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	cases := map[string]time.Duration{
+		"":                              0,
+		"3":                             3 * time.Second,
+		"-1":                            0,
+		"abc":                           0,
+		"Fri, 01 Jan 2021 00:00:10 GMT": 10 * time.Second,
+		"Thu, 31 Dec 2020 23:59:50 GMT": 0,
+	}
+	for value, expect := range cases {
+		if got := parseRetryAfter(value, now); got != expect {
+			t.Errorf("%q: expect %s, got %s", value, expect, got)
+		}
+	}
+}
+
+func TestIsThrottled(t *testing.T) {
+	err := jujuerrors.Annotate(&ThrottledError{Reason: "es_rejected_execution_exception"}, "endpoint es2")
+	if _, ok := IsThrottled(err); !ok {
+		t.Error("annotated throttled error not detected")
+	}
+	if _, ok := IsThrottled(errors.New("connection refused")); ok {
+		t.Error("generic error detected as throttled")
+	}
+
+	th, ok := isMongoThrottled(errors.New("(TooManyRequests) Error=16500, RetryAfterMs=120, Details='Request rate is large'"))
+	if !ok || th.RetryAfter != 120*time.Millisecond {
+		t.Errorf("mongo throttled error: %v %v", th, ok)
+	}
+}
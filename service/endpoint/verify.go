@@ -0,0 +1,87 @@
+/*
+ * Copyright 2020-2021 the original author(https://github.com/wj596)
+ *
+ * <p>
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * </p>
+ */
+package endpoint
+
+import (
+	stdjson "encoding/json"
+	"reflect"
+	"strings"
+
+	"go-mysql-transfer/global"
+	"go-mysql-transfer/model"
+	"go-mysql-transfer/util/stringutil"
+)
+
+// Verifier 支持按标识读取已写入数据的接收端，用于一致性校验
+type Verifier interface {
+	// Count 接收端中规则对应的数据量，不支持时返回-1
+	Count(rule *global.Rule) (int64, error)
+	// Fetch 按行数据的标识读取接收端数据，与rows一一对应，不存在时为nil
+	Fetch(rule *global.Rule, rows []*model.RowRequest) ([]interface{}, error)
+	// Expect 行数据按规则转换后应写入接收端的数据
+	Expect(rule *global.Rule, row *model.RowRequest) interface{}
+}
+
+// Identity 行数据在接收端的标识
+func Identity(row *model.RowRequest, rule *global.Rule) string {
+	return stringutil.ToString(primaryKey(row, rule))
+}
+
+// WatermarkField 开启include_position时ES、MongoDB文档中记录行数据位置的字段
+const WatermarkField = "_watermark"
+
+// Equivalent 比较期望数据与接收端数据，JSON形式的数据按解析后的结果比较，不比较WatermarkField
+func Equivalent(expect, actual interface{}) bool {
+	e, a := normalize(expect), normalize(actual)
+	if m, ok := e.(map[string]interface{}); ok {
+		delete(m, WatermarkField)
+	}
+	if m, ok := a.(map[string]interface{}); ok {
+		delete(m, WatermarkField)
+	}
+	return reflect.DeepEqual(e, a)
+}
+
+// normalize 统一为JSON解析后的形式，使用标准库以兼容bson等类型
+func normalize(v interface{}) interface{} {
+	switch vv := v.(type) {
+	case nil:
+		return nil
+	case string:
+		if !strings.HasPrefix(strings.TrimSpace(vv), "{") {
+			return vv
+		}
+		var ret interface{}
+		if err := stdjson.Unmarshal([]byte(vv), &ret); err != nil {
+			return vv
+		}
+		return ret
+	case []byte:
+		return normalize(string(vv))
+	}
+
+	data, err := stdjson.Marshal(v)
+	if err != nil {
+		return v
+	}
+	var ret interface{}
+	if err := stdjson.Unmarshal(data, &ret); err != nil {
+		return v
+	}
+	return ret
+}
@@ -0,0 +1,19 @@
+package endpoint
+
+import "testing"
+
+func TestEquivalent(t *testing.T) {
+	expect := map[string]interface{}{"id": int64(1), "name": "a"}
+	if !Equivalent(expect, `{"name":"a","id":1}`) {
+		t.Errorf("json document should be equivalent")
+	}
+	if !Equivalent(expect, map[string]interface{}{"id": int32(1), "name": "a"}) {
+		t.Errorf("numbers should be compared by value")
+	}
+	if Equivalent(expect, `{"name":"b","id":1}`) {
+		t.Errorf("divergent document should not be equivalent")
+	}
+	if !Equivalent("1|a", "1|a") || Equivalent("1|a", "1|b") {
+		t.Errorf("plain values should be compared as string")
+	}
+}
@@ -18,73 +18,467 @@
 package service
 
 import (
+	"fmt"
 	"go-mysql-transfer/metrics"
+	"hash/crc32"
 	"log"
+	"math/rand"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/juju/errors"
 	"github.com/siddontang/go-mysql/canal"
 	"github.com/siddontang/go-mysql/mysql"
 	"github.com/siddontang/go-mysql/replication"
+	"github.com/siddontang/go-mysql/schema"
+	"go.uber.org/atomic"
 
 	"go-mysql-transfer/global"
 	"go-mysql-transfer/model"
+	"go-mysql-transfer/service/endpoint"
+	"go-mysql-transfer/service/lookup"
 	"go-mysql-transfer/util/logs"
+	"go-mysql-transfer/util/stringutil"
 )
 
+const _spillDrainBatches = 100 // 每次最多从本地日志写入接收端的批数，避免长时间不读取队列
+
 type handler struct {
 	queue chan interface{}
 	stop  chan struct{}
+	done  chan struct{} // 监听协程退出时关闭
+
+	buffered atomic.Int64  // 已读取、未写入接收端的数据估算占用的内存(字节)
+	released chan struct{} // 写入接收端后通知等待queue_max_bytes的监听
+
+	dumping    atomic.Bool // 正在接收mysqldump导出的数据
+	awaitDump  atomic.Bool // 本次同步先全量导出，等待导出结束时的位置
+	dumpHeld   atomic.Bool // 全量导出暂停期间mysqldump导出的数据暂存到了本地日志，恢复前不写入接收端
+	coalescing bool        // catchup_coalesce当前是否合并，仅在监听协程中使用
+
+	ddlTables []*model.DDLTable // 当前DDL语句涉及的监听表，在OnTableChanged中收集、OnDDL中发送
+	filter    originFilter
+	gtid      string              // 当前事务的GTID
+	txn       []*model.RowRequest // 开启merge_delete_insert时缓存到事务提交的数据
+	throttles int                 // 接收端连续限流的次数
+
+	retryDiscovery map[string]time.Time // 通配符规则匹配但注册失败的表及再次尝试注册的时间
+
+	executed mysql.GTIDSet // 开启gtid_position时已执行的GTID集合，没有起始GTID集合时为nil，不跟踪
+
+	rulePos *rulePositions // 开启per_rule_position时各规则已确认的位置，未开启时为nil
+
+	// 在canal协程之外更新规则(ReloadRules)时持有写锁，转换行事件及写入接收端时持有读锁
+	ruleLock sync.RWMutex
 }
 
 func newHandler() *handler {
 	return &handler{
 		queue: make(chan interface{}, 4096),
 		stop:  make(chan struct{}, 1),
+		done:  make(chan struct{}),
+
+		released: make(chan struct{}, 1),
+
+		retryDiscovery: make(map[string]time.Time),
 	}
 }
 
 func (s *handler) OnRotate(e *replication.RotateEvent) error {
+	metrics.SetSourceActive(time.Now())
+	s.dumping.Store(false)
+	logs.Infof("binlog rotate to %s %d", string(e.NextLogName), e.Position)
+	s.flushTxn()
+	// 切换binlog文件时不受保存间隔限制，强制保存位置
 	s.queue <- model.PosRequest{
 		Name:  string(e.NextLogName),
 		Pos:   uint32(e.Position),
 		Force: true,
+		GTID:  s.executedGTID(),
 	}
 	return nil
 }
 
 func (s *handler) OnTableChanged(schema, table string) error {
+	if global.Cfg().DDLBarrier && global.RuleInsExist(global.RuleKey(schema, table)) {
+		// 如gh-ost切换表时，之前的数据按旧表结构写入后再更新规则
+		s.drain()
+	}
 	err := _transferService.updateRule(schema, table)
+	if global.Cfg().CollectDDLTables() {
+		s.collectDDLTable(schema, table, err)
+	}
+	if isTableNotExist(err) && _transferService.forgetTable(schema, table) {
+		return nil
+	}
 	if err != nil {
 		return errors.Trace(err)
 	}
 	return nil
 }
 
-func (s *handler) OnDDL(nextPos mysql.Position, _ *replication.QueryEvent) error {
+func (s *handler) OnDDL(nextPos mysql.Position, e *replication.QueryEvent) error {
+	metrics.SetSourceActive(time.Now())
+	if err := checkPartitionDDL(e); err != nil {
+		return err
+	}
+	s.filter.reset()
+	s.commitGTID()
+	s.flushTxn()
+	if len(s.ddlTables) > 0 {
+		s.queue <- model.DDLRequest{
+			Schema:    string(e.Schema),
+			Query:     string(e.Query),
+			Timestamp: uint32(time.Now().Unix()),
+			Name:      nextPos.Name,
+			Pos:       nextPos.Pos,
+			Tables:    s.ddlTables,
+		}
+		s.ddlTables = nil
+	}
 	s.queue <- model.PosRequest{
 		Name:  nextPos.Name,
 		Pos:   nextPos.Pos,
 		Force: true,
+		GTID:  s.executedGTID(),
 	}
 	return nil
 }
 
 func (s *handler) OnXID(nextPos mysql.Position) error {
+	metrics.SetSourceActive(time.Now())
+	s.filter.reset()
+	s.commitGTID()
+	s.flushTxn()
 	s.queue <- model.PosRequest{
 		Name:  nextPos.Name,
 		Pos:   nextPos.Pos,
 		Force: false,
+		GTID:  s.executedGTID(),
 	}
 	return nil
 }
 
+// commitGTID 事务结束，将其GTID加入已执行的GTID集合
+func (s *handler) commitGTID() {
+	if s.executed != nil && s.gtid != "" {
+		if err := s.executed.Update(s.gtid); err != nil {
+			logs.Errorf("update executed gtid set with %s error %v", s.gtid, err)
+		}
+	}
+	s.gtid = ""
+}
+
+func (s *handler) executedGTID() string {
+	if s.executed == nil {
+		return ""
+	}
+	return s.executed.String()
+}
+
 func (s *handler) OnRow(e *canal.RowsEvent) error {
+	metrics.SetSourceActive(time.Now())
+	s.ruleLock.RLock()
+	requests, err := s.rowEvent(e)
+	s.ruleLock.RUnlock()
+	if err != nil || requests == nil {
+		return err
+	}
+	s.reserve(requests)
+	s.queue <- requests
+
+	return nil
+}
+
+// rowEvent 按规则转换行事件，跳过或缓存到事务提交时返回nil
+func (s *handler) rowEvent(e *canal.RowsEvent) ([]*model.RowRequest, error) {
 	ruleKey := global.RuleKey(e.Table.Schema, e.Table.Name)
-	if !global.RuleInsExist(ruleKey) {
-		return nil
+	if s.filter.skip(e) {
+		skipRows(ruleKey, metrics.SkipOrigin, e)
+		return nil, nil
+	}
+	if lookup.Watched(e.Table.Schema, e.Table.Name) {
+		lookup.OnRow(e)
+	}
+	rule, exist := global.RuleIns(ruleKey)
+	if !exist {
+		if rule = s.unregisteredRule(ruleKey, e); rule == nil {
+			return nil, nil
+		}
+	}
+	if err := s.alignSchema(rule, e); err != nil {
+		return nil, err
 	}
 
+	// mysqldump导出的数据没有事件头
+	s.dumping.Store(e.Header == nil)
+	name := _transferService.canal.SyncedPosition().Name
+	if e.Header != nil && s.rulePos.acknowledged(ruleKey, name, e.Header.LogPos) {
+		// 重新同步时该规则在其位置之前的数据已写入
+		metrics.IncSkipped(ruleKey, metrics.SkipDuplicate, rowCount(e))
+		return nil, nil
+	}
+	if dedupe := _transferService.dedupe; dedupe != nil && e.Header != nil && dedupe.contains(name, e.Header.LogPos) {
+		metrics.IncDuplicateSuppressed()
+		metrics.IncSkipped(ruleKey, metrics.SkipDuplicate, rowCount(e))
+		logs.Infof("skip duplicate event %s:%d", name, e.Header.LogPos)
+		return nil, nil
+	}
+	requests := checkEmptyKey(rule, rowRequests(rule, ruleKey, e))
+	if e.Header != nil {
+		markPosition(requests, name, e, s.gtid)
+		requests = _transferService.rowDedupe.filter(rule, requests)
+	}
+	if rule.MergeDeleteInsert || len(s.txn) > 0 {
+		// 缓存到事务提交，其后其他表的数据也一并缓存以保持顺序
+		s.txn = append(s.txn, requests...)
+		return nil, nil
+	}
+	return explode(softDelete(requests)), nil
+}
+
+// skipRows 记录未写入接收端的行数
+func skipRows(ruleKey, reason string, e *canal.RowsEvent) {
+	rows := rowCount(e)
+	metrics.IncSkipped(ruleKey, reason, rows)
+	logs.Debugf("skip %d %s rows of %s: %s", rows, e.Action, ruleKey, reason)
+}
+
+// rowCount 行事件中的行数，update的每行包含变更前后两个镜像
+func rowCount(e *canal.RowsEvent) int {
+	if e.Action == canal.UpdateAction {
+		return len(e.Rows) / 2
+	}
+	return len(e.Rows)
+}
+
+// flushTxn 事务提交时发送缓存的数据
+func (s *handler) flushTxn() {
+	if len(s.txn) > 0 {
+		s.ruleLock.RLock()
+		requests := explode(softDelete(mergeDeleteInsert(s.txn)))
+		s.ruleLock.RUnlock()
+		s.reserve(requests)
+		s.queue <- requests
+		s.txn = nil
+	}
+}
+
+// reserve 记录待写入数据占用的内存，超过queue_max_bytes时等待已缓存的数据写入接收端(或暂存到本地日志)，
+// 缓存为空时不等待，单个超大事件也能写入
+func (s *handler) reserve(requests []*model.RowRequest) {
+	var size int64
+	for _, request := range requests {
+		size += request.Size()
+	}
+
+	limit := global.Cfg().QueueMaxBytes * 1024 * 1024
+	if limit > 0 {
+		for buffered := s.buffered.Load(); buffered > 0 && buffered+size > limit; buffered = s.buffered.Load() {
+			select {
+			case <-s.released:
+			case <-s.done:
+				return
+			}
+		}
+	}
+	metrics.SetBufferedBytes(s.buffered.Add(size))
+}
+
+// release 数据写入接收端(或暂存到本地日志、丢弃)后释放占用的内存
+func (s *handler) release(requests []*model.RowRequest) {
+	var size int64
+	for _, request := range requests {
+		size += request.Size()
+	}
+	metrics.SetBufferedBytes(s.buffered.Sub(size))
+	select {
+	case s.released <- struct{}{}:
+	default:
+	}
+}
+
+// overLimit 缓存的数据是否达到queue_max_bytes，达到时立即写入以释放内存
+func (s *handler) overLimit() bool {
+	limit := global.Cfg().QueueMaxBytes * 1024 * 1024
+	return limit > 0 && s.buffered.Load() >= limit
+}
+
+// drain 等待之前读取的数据全部写入接收端(或暂存到本地日志)，监听协程已退出时直接返回
+func (s *handler) drain() {
+	s.flushTxn()
+	barrier := model.BarrierRequest{Done: make(chan struct{})}
+	select {
+	case s.queue <- barrier:
+	case <-s.done:
+		return
+	}
+
+	start := time.Now()
+	select {
+	case <-barrier.Done:
+		logs.Infof("drained in-flight events before table change in %s", time.Since(start))
+	case <-s.done:
+	}
+}
+
+// softDelete 开启soft_delete的规则，删除转换为带删除标记的upsert，在mergeDeleteInsert之后转换
+func softDelete(requests []*model.RowRequest) []*model.RowRequest {
+	for _, request := range requests {
+		if request.Action != canal.DeleteAction {
+			continue
+		}
+		if rule, ok := global.RuleIns(request.RuleKey); ok && rule.SoftDelete {
+			request.Action = canal.UpdateAction
+			request.Upsert = true
+			request.Deleted = true
+			request.Old = request.Row // 变更前的数据即删除的数据，reserve_raw_data、diff_output等依赖
+		}
+	}
+	return requests
+}
+
+// explode 开启explode_column的规则，按元素将一行拆分为多个：插入、删除各元素；
+// 更新时按序号更新(不存在时插入)新的元素，删除旧数据多出的元素
+func explode(requests []*model.RowRequest) []*model.RowRequest {
+	var ret []*model.RowRequest
+	for i, request := range requests {
+		rule, ok := global.RuleIns(request.RuleKey)
+		if !ok || !rule.ExplodeEnable() {
+			if ret != nil {
+				ret = append(ret, request)
+			}
+			continue
+		}
+		if ret == nil {
+			ret = append(make([]*model.RowRequest, 0, len(requests)), requests[:i]...)
+		}
+
+		elements := rule.Explode(request.Row)
+		var olds []interface{}
+		if request.Action == canal.UpdateAction && request.Old != nil {
+			olds = rule.Explode(request.Old)
+		}
+		for j, element := range elements {
+			child := *request
+			child.Row = explodeRow(rule, request.Row, element)
+			child.Element = j + 1
+			if request.Action == canal.UpdateAction {
+				child.Upsert = true
+				// 变更前的数据为旧数据中同序号的元素，不存在时为新增的元素
+				child.Old = nil
+				if j < len(olds) {
+					child.Old = explodeRow(rule, request.Old, olds[j])
+				}
+			}
+			ret = append(ret, &child)
+		}
+		for j := len(elements); j < len(olds); j++ {
+			child := *request
+			child.Action = canal.DeleteAction
+			child.Row = explodeRow(rule, request.Old, olds[j])
+			child.Old = nil
+			child.Upsert = false
+			child.Deleted = false
+			child.Element = j + 1
+			ret = append(ret, &child)
+		}
+	}
+	if ret == nil {
+		return requests
+	}
+	return ret
+}
+
+// explodeRow 复制行数据，explode_column替换为一个元素
+func explodeRow(rule *global.Rule, row []interface{}, element interface{}) []interface{} {
+	ret := make([]interface{}, len(row))
+	copy(ret, row)
+	ret[rule.ExplodeIndex] = element
+	return ret
+}
+
+// mergeDeleteInsert 开启merge_delete_insert的规则，同一事务中先删除后插入同一标识的数据合并为一个upsert，
+// 位于插入的位置；合并后为update，变更前的数据为删除的数据
+func mergeDeleteInsert(requests []*model.RowRequest) []*model.RowRequest {
+	deletes := make(map[string]int, len(requests))
+	merged := false
+	for i, request := range requests {
+		rule, ok := global.RuleIns(request.RuleKey)
+		if !ok || !rule.MergeDeleteInsert || len(rule.KeyColumnIndexes) == 0 {
+			continue
+		}
+
+		key := txnKey(request, rule)
+		switch request.Action {
+		case canal.DeleteAction:
+			deletes[key] = i
+		case canal.InsertAction:
+			if index, exist := deletes[key]; exist {
+				request.Action = canal.UpdateAction
+				request.Old = requests[index].Row
+				request.Upsert = true
+				requests[index] = nil
+				delete(deletes, key)
+				merged = true
+			}
+		}
+	}
+	if !merged {
+		return requests
+	}
+
+	ret := make([]*model.RowRequest, 0, len(requests))
+	for _, request := range requests {
+		if request != nil {
+			ret = append(ret, request)
+		}
+	}
+	return ret
+}
+
+// txnKey 同一接收端、同一时间分区中的数据标识
+func txnKey(request *model.RowRequest, rule *global.Rule) string {
+	key := request.RuleKey + "|" + request.Endpoint + "|" + rule.PartitionOf(request.Row)
+	for _, index := range rule.KeyColumnIndexes {
+		if index < len(request.Row) {
+			key += "|" + stringutil.ToString(request.Row[index])
+		}
+	}
+	return key
+}
+
+// checkEmptyKey 标识列的值为空或0的数据按empty_key_policy处理：warn照常写入，skip丢弃，surrogate由接收端改用代替列
+func checkEmptyKey(rule *global.Rule, requests []*model.RowRequest) []*model.RowRequest {
+	ret := requests[:0]
+	for _, request := range requests {
+		if !rule.IsEmptyKey(request.Row) {
+			ret = append(ret, request)
+			continue
+		}
+		metrics.IncEmptyKey(request.RuleKey)
+		switch rule.EmptyKeyPolicy {
+		case global.EmptyKeySkip:
+			metrics.IncSkipped(request.RuleKey, metrics.SkipEmptyKey, 1)
+			logs.Warnf("%s %s skipped, empty key: %v", request.RuleKey, request.Action, request.Row)
+			continue
+		case global.EmptyKeySurrogate:
+			logs.Warnf("%s %s empty key, use %s: %v", request.RuleKey, request.Action, rule.EmptyKeySurrogate, request.Row)
+		default:
+			logs.Warnf("%s %s empty key: %v", request.RuleKey, request.Action, request.Row)
+		}
+		ret = append(ret, request)
+	}
+	return ret
+}
+
+// rowRequests 将行事件转换为写入接收端的请求
+func rowRequests(rule *global.Rule, ruleKey string, e *canal.RowsEvent) []*model.RowRequest {
+	timestamp := uint32(time.Now().Unix()) // mysqldump导出的数据没有事件头
+	if e.Header != nil {
+		timestamp = e.Header.Timestamp
+	}
 	var requests []*model.RowRequest
 	if e.Action != canal.UpdateAction {
 		// 定长分配
@@ -94,14 +488,38 @@ func (s *handler) OnRow(e *canal.RowsEvent) error {
 	if e.Action == canal.UpdateAction {
 		for i := 0; i < len(e.Rows); i++ {
 			if (i+1)%2 == 0 {
+				old := rule.AlignRow(e.Rows[i-1])
+				row := rule.AlignRow(e.Rows[i])
+				oldRoute := rule.RouteOf(old)
+				route := rule.RouteOf(row)
+				if rule.IdentityChanged(old, row) || oldRoute != route || rule.PartitionOf(old) != rule.PartitionOf(row) ||
+					rule.TopicOf(old) != rule.TopicOf(row) {
+					// 标识列、路由、时间分区或topic发生变化，拆分为删除旧数据、插入新数据
+					requests = append(requests, &model.RowRequest{
+						RuleKey:   ruleKey,
+						Action:    canal.DeleteAction,
+						Timestamp: timestamp,
+						Row:       old,
+						Endpoint:  oldRoute,
+					}, &model.RowRequest{
+						RuleKey:   ruleKey,
+						Action:    canal.InsertAction,
+						Timestamp: timestamp,
+						Row:       row,
+						Endpoint:  route,
+					})
+					continue
+				}
+
 				v := new(model.RowRequest)
 				v.RuleKey = ruleKey
 				v.Action = e.Action
-				v.Timestamp = e.Header.Timestamp
-				if global.Cfg().IsReserveRawData() {
-					v.Old = e.Rows[i-1]
+				v.Timestamp = timestamp
+				if global.Cfg().IsReserveRawData() || rule.ExplodeEnable() || rule.DiffOutput {
+					v.Old = old
 				}
-				v.Row = e.Rows[i]
+				v.Row = row
+				v.Endpoint = route
 				requests = append(requests, v)
 			}
 		}
@@ -110,48 +528,255 @@ func (s *handler) OnRow(e *canal.RowsEvent) error {
 			v := new(model.RowRequest)
 			v.RuleKey = ruleKey
 			v.Action = e.Action
-			v.Timestamp = e.Header.Timestamp
-			v.Row = row
+			v.Timestamp = timestamp
+			v.Row = rule.AlignRow(row)
+			v.Endpoint = rule.RouteOf(v.Row) // delete的行数据即变更前的镜像
 			requests = append(requests, v)
 		}
 	}
-	s.queue <- requests
+	return requests
+}
 
-	return nil
+// markPosition 记录行数据在源库binlog中的位置，切换binlog文件后canal的同步位置即为当前文件
+func markPosition(requests []*model.RowRequest, name string, e *canal.RowsEvent, gtid string) {
+	for i, request := range requests {
+		request.LogName = name
+		request.LogPos = e.Header.LogPos
+		request.Offset = i
+		request.GTID = gtid
+	}
 }
 
 func (s *handler) OnGTID(gtid mysql.GTIDSet) error {
+	metrics.SetSourceActive(time.Now())
+	// 上一个事务没有以XID或监听的DDL结束(如GRANT等语句)，同样已执行
+	s.commitGTID()
+	s.gtid = gtid.String()
 	return nil
 }
 
 func (s *handler) OnPosSynced(pos mysql.Position, set mysql.GTIDSet, force bool) error {
+	// canal导出结束、开始增量同步前以导出时的位置调用，关闭时也会调用(此时已取消)
+	if force && _transferService.canal.Ctx().Err() == nil && s.awaitDump.CAS(true, false) {
+		if set != nil && set.String() != "" {
+			// 以GTID方式导出时为导出快照对应的GTID集合，之后从该集合增量同步
+			s.executed = set.Clone()
+		}
+		if err := s.dumpDone(pos); err != nil {
+			return err
+		}
+	}
+	metrics.SetTransferDelay(sourceDelay(_transferService.canal))
+	return nil
+}
+
+// dumpDone 全量导出结束：校验导出时的位置，在导出的数据均写入接收端后保存该位置，之后从该位置增量同步；
+// 导出时的位置之前提交的数据都在导出的快照中，之后提交的都在增量binlog中，每行数据恰好一次
+func (s *handler) dumpDone(pos mysql.Position) error {
+	if pos.Name == "" || pos.Pos < 4 {
+		// 未解析到位置时canal会从最早的binlog同步，重复发送全部历史数据，不能继续
+		return errors.Errorf("no binlog position in mysqldump output, make sure log_bin is enabled and mysqldump prints CHANGE MASTER TO")
+	}
+	s.dumping.Store(false)
+	logs.Infof("dump finished, stream from the dump position(%s %d)", pos.Name, pos.Pos)
+	s.queue <- model.PosRequest{
+		Name:  pos.Name,
+		Pos:   pos.Pos,
+		Force: true,
+		GTID:  s.executedGTID(),
+	}
 	return nil
 }
 
+// alignSchema 行数据与表结构的列数不一致时(如ALTER TABLE期间)，在schema_grace_period内按退避间隔重新加载表结构
+// 未配置schema_grace_period时保持原有处理，由接收端跳过不一致的数据
+func (s *handler) alignSchema(rule *global.Rule, e *canal.RowsEvent) error {
+	if global.Cfg().SchemaGracePeriod <= 0 {
+		return nil
+	}
+	if len(e.Rows) == 0 || len(rule.AlignRow(e.Rows[0])) == rule.TableColumnSize {
+		return nil
+	}
+
+	size := len(e.Rows[0])
+	deadline := time.Now().Add(time.Duration(global.Cfg().SchemaGracePeriod) * time.Second)
+	backoff := 100 * time.Millisecond
+	for retries := 1; time.Now().Before(deadline); retries++ {
+		before := rule.TableInfo.Columns
+		_transferService.canal.ClearTableCache([]byte(rule.Schema), []byte(rule.Table))
+		err := _transferService.updateRule(rule.Schema, rule.Table)
+		if err == nil && len(rule.AlignRow(e.Rows[0])) == rule.TableColumnSize {
+			logs.Infof("%s.%s schema reloaded, retry %d: %s", rule.Schema, rule.Table, retries, schemaDiff(before, rule.TableInfo.Columns))
+			return nil
+		}
+		if err != nil {
+			logs.Warnf("%s.%s schema mismatch, row has %d columns, retry %d: %s", rule.Schema, rule.Table, size, retries, err.Error())
+		} else {
+			logs.Warnf("%s.%s schema mismatch, row has %d columns, table has %d, retry %d: %s", rule.Schema, rule.Table, size, rule.TableColumnSize, retries, schemaDiff(before, rule.TableInfo.Columns))
+		}
+
+		time.Sleep(backoff)
+		if backoff < 5*time.Second {
+			backoff *= 2
+		}
+	}
+
+	return errors.Errorf("%s.%s schema mismatch, row has %d columns but table has %d", rule.Schema, rule.Table, size, rule.TableColumnSize)
+}
+
+// schemaDiff 重新加载前后的列差异
+func schemaDiff(before, after []schema.TableColumn) string {
+	names := make(map[string]bool, len(before))
+	for _, c := range before {
+		names[c.Name] = true
+	}
+
+	var added, dropped []string
+	for _, c := range after {
+		if !names[c.Name] {
+			added = append(added, c.Name)
+		}
+		delete(names, c.Name)
+	}
+	for _, c := range before {
+		if names[c.Name] {
+			dropped = append(dropped, c.Name)
+		}
+	}
+	return fmt.Sprintf("added %v, dropped %v", added, dropped)
+}
+
+// collectDDLTable 记录变更后的表结构，表被删除时不包含列
+func (s *handler) collectDDLTable(schema, table string, err error) {
+	rule, ok := global.RuleIns(global.RuleKey(schema, table))
+	if !ok {
+		return
+	}
+
+	if err != nil {
+		s.ddlTables = append(s.ddlTables, &model.DDLTable{
+			Database: rule.Schema,
+			Table:    rule.Table,
+		})
+		return
+	}
+	s.ddlTables = append(s.ddlTables, ddlTableOf(rule))
+}
+
+// ddlTableOf 规则对应的表结构
+func ddlTableOf(rule *global.Rule) *model.DDLTable {
+	t := &model.DDLTable{
+		Database: rule.Schema,
+		Table:    rule.Table,
+	}
+	for _, c := range rule.TableInfo.Columns {
+		t.Columns = append(t.Columns, &model.DDLColumn{
+			Name:      c.Name,
+			Type:      c.RawType,
+			Collation: c.Collation,
+			Virtual:   c.IsVirtual,
+		})
+	}
+	for i := range rule.TableInfo.PKColumns {
+		t.PKs = append(t.PKs, rule.TableInfo.GetPKColumn(i).Name)
+	}
+	return t
+}
+
+// publishSchemas 启动时在发送数据之前发送所有规则的表结构，失败时只记录日志
+func publishSchemas(from mysql.Position) {
+	if global.Cfg().SchemaTopic == "" || !_transferService.endpointEnable.Load() {
+		return
+	}
+	rules := global.RuleInsList()
+	tables := make([]*model.DDLTable, 0, len(rules))
+	for _, rule := range rules {
+		if rule.TableInfo != nil {
+			tables = append(tables, ddlTableOf(rule))
+		}
+	}
+	sort.Slice(tables, func(i, j int) bool {
+		if tables[i].Database != tables[j].Database {
+			return tables[i].Database < tables[j].Database
+		}
+		return tables[i].Table < tables[j].Table
+	})
+	if err := endpoint.PublishSchemas(_transferService.endpoint, tables, from); err != nil {
+		logs.Errorf("publish schemas error: %s", err.Error())
+	}
+}
+
 func (s *handler) String() string {
 	return "TransferHandler"
 }
 
 func (s *handler) startListener() {
+	s.rulePos = nil
+	if global.Cfg().PerRulePosition {
+		from, _ := _transferService.positionDao.Get()
+		s.rulePos = loadRulePositions(from)
+	}
 	go func() {
+		defer close(s.done)
 		interval := time.Duration(global.Cfg().FlushBulkInterval)
 		bulkSize := global.Cfg().BulkSize
 		ticker := time.NewTicker(time.Millisecond * interval)
 		defer ticker.Stop()
 
+		// 心跳与数据在同一协程中发送，携带已保存的位置，不影响事件顺序
+		var heartbeat <-chan time.Time
+		if global.Cfg().HeartbeatEnable() {
+			heartbeatTicker := time.NewTicker(time.Second * time.Duration(global.Cfg().HeartbeatInterval))
+			defer heartbeatTicker.Stop()
+			heartbeat = heartbeatTicker.C
+		}
+
+		// 没有新事件超过flush_idle_interval时写入未满的批次
+		idleInterval := time.Millisecond * time.Duration(global.Cfg().FlushIdleInterval)
+		idleTimer := time.NewTimer(idleInterval)
+		idleTimer.Stop()
+		defer idleTimer.Stop()
+		var idle <-chan time.Time
+
+		// 保存位置的间隔及行数，window为已保存的位置之后读取的行数，sinceLatest为最近一个事务之后读取的行数
+		saveInterval := time.Millisecond * time.Duration(global.Cfg().PositionSaveInterval)
+		saveRows := int64(global.Cfg().PositionSaveRows)
+		var window, sinceLatest int64
+
 		lastSavedTime := time.Now()
+		lastSaved := lastSavedTime
 		requests := make([]*model.RowRequest, 0, bulkSize)
-		var current mysql.Position
+		var ddl *model.DDLRequest
+		var barriers []chan struct{}
+		var current, latest mysql.Position
+		var currentGTID, latestGTID string
 		from, _ := _transferService.positionDao.Get()
+		publishSchemas(from)
 		for {
 			needFlush := false
 			needSavePos := false
+			queue := s.queue
+			if _transferService.Paused() || s.blocked() {
+				queue = nil // 暂停或等待接收端恢复时不读取队列，已读取的数据也不写入
+			}
 			select {
-			case v := <-s.queue:
+			case v := <-queue:
+				metrics.SetListenerActive(time.Now())
+				if idleInterval > 0 {
+					resetTimer(idleTimer, idleInterval)
+					idle = idleTimer.C
+				}
 				switch v := v.(type) {
 				case model.PosRequest:
+					latest = mysql.Position{
+						Name: v.Name,
+						Pos:  v.Pos,
+					}
+					latestGTID = v.GTID
+					s.rulePos.mark(latest)
+					sinceLatest = 0
 					now := time.Now()
-					if v.Force || now.Sub(lastSavedTime) > 3*time.Second {
+					if v.Force || now.Sub(lastSavedTime) > saveInterval || (saveRows > 0 && window >= saveRows) {
 						lastSavedTime = now
 						needFlush = true
 						needSavePos = true
@@ -159,41 +784,392 @@ func (s *handler) startListener() {
 							Name: v.Name,
 							Pos:  v.Pos,
 						}
+						currentGTID = v.GTID
 					}
 				case []*model.RowRequest:
 					requests = append(requests, v...)
-					needFlush = int64(len(requests)) >= global.Cfg().BulkSize
+					window += int64(len(v))
+					sinceLatest += int64(len(v))
+					metrics.SetReplayWindow(window)
+					needFlush = int64(len(requests)) >= global.Cfg().BulkSize || s.overLimit()
+				case model.DDLRequest:
+					// 先发送变更之前的数据，保证顺序
+					ddl = &v
+					needFlush = true
+				case model.BarrierRequest:
+					barriers = append(barriers, v.Done)
+					needFlush = true
 				}
 			case <-ticker.C:
 				needFlush = true
+				s.drainSpill()
+			case <-idle:
+				idle = nil
+				needFlush = true
+				// 已读取的事件均已到达，写入后保存最近一个事务的位置
+				if latest.Name != "" && latest.Compare(from) > 0 {
+					lastSavedTime = time.Now()
+					needSavePos = true
+					current = latest
+					currentGTID = latestGTID
+				}
+			case <-heartbeat:
+				if _transferService.endpointEnable.Load() && (_transferService.spill == nil || _transferService.spill.empty()) {
+					if err := endpoint.PublishHeartbeat(_transferService.endpoint, from); err != nil {
+						logs.Warnf("publish heartbeat error: %s", err.Error())
+					}
+				}
+				continue
 			case <-s.stop:
+				// 正常关闭时写入已读取的数据并保存最近一个事务的位置，减少重启后重复发送的数据
+				if (len(requests) > 0 || ddl != nil) && !_transferService.Paused() && s.write(from, requests, ddl) {
+					s.release(requests)
+					s.rulePos.reset()
+					requests = requests[0:0]
+					ddl = nil
+				}
+				if len(requests) == 0 && ddl == nil && latest.Name != "" && latest.Compare(from) > 0 &&
+					(_transferService.endpointEnable.Load() || _transferService.spill != nil) {
+					logs.Infof("save position %s %d on stop", latest.Name, latest.Pos)
+					if err := _transferService.positionDao.SaveGTID(latest, latestGTID); err != nil {
+						logs.Errorf("save sync position %s err %v", latest, err)
+					}
+				}
 				return
 			}
 
-			if needFlush && len(requests) > 0 && _transferService.endpointEnable.Load() {
-				err := _transferService.endpoint.Consume(from, requests)
-				if err != nil {
-					_transferService.endpointEnable.Store(false)
-					metrics.SetDestState(metrics.DestStateFail)
-					logs.Error(err.Error())
-					go _transferService.stopDump()
+			if needFlush && (len(requests) > 0 || ddl != nil) && !_transferService.Paused() {
+				if s.write(from, requests, ddl) {
+					s.release(requests)
+					s.rulePos.reset()
+					requests = requests[0:0]
+					ddl = nil
 				}
-				requests = requests[0:0]
 			}
-			if needSavePos && _transferService.endpointEnable.Load() {
+			// 之前的数据均已写入接收端或暂存到本地日志后才保存位置，暂停时不保存
+			if needSavePos && len(requests) == 0 && ddl == nil && !_transferService.Paused() &&
+				(_transferService.endpointEnable.Load() || _transferService.spill != nil) {
 				logs.Infof("save position %s %d", current.Name, current.Pos)
-				if err := _transferService.positionDao.Save(current); err != nil {
+				if err := _transferService.positionDao.SaveGTID(current, currentGTID); err != nil {
 					logs.Errorf("save sync position %s err %v, close sync", current, err)
-					_transferService.Close()
+					// Close等待监听协程退出，不能在此协程中调用
+					go _transferService.Close()
 					return
 				}
 				from = current
+				s.rulePos.advance(current)
+				now := time.Now()
+				metrics.PositionSaved(now.Sub(lastSaved))
+				lastSaved = now
+				window = sinceLatest
+				metrics.SetReplayWindow(window)
+			}
+			if len(barriers) > 0 && len(requests) == 0 && ddl == nil {
+				for _, barrier := range barriers {
+					close(barrier)
+				}
+				barriers = nil
 			}
 		}
 	}()
 }
 
+// resetTimer 停止timer并清空未读取的到期信号后重新计时
+func resetTimer(t *time.Timer, d time.Duration) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+	t.Reset(d)
+}
+
+// write 持有规则的读锁写入一批数据，ReloadRules更新规则时等待写入完成
+func (s *handler) write(from mysql.Position, requests []*model.RowRequest, ddl *model.DDLRequest) bool {
+	s.ruleLock.RLock()
+	defer s.ruleLock.RUnlock()
+	return s.flush(from, requests, ddl)
+}
+
+// updateRules 在canal协程之外更新规则，等待正在转换的行事件及正在写入的数据完成，期间不再转换、写入
+func (s *handler) updateRules(update func() error) error {
+	s.ruleLock.Lock()
+	defer s.ruleLock.Unlock()
+	return update()
+}
+
+// flush 写入一批数据，返回是否已处理完(写入接收端、暂存到本地日志或按stop方式丢弃后从已保存的位置重新同步)
+func (s *handler) flush(from mysql.Position, requests []*model.RowRequest, ddl *model.DDLRequest) bool {
+	// 限流或写入失败后按接收端的当前状态重新处理，直到写入、暂存或放弃
+	for {
+		spill := _transferService.spill
+		// mysqldump不能暂停读取(超过net_write_timeout时MySQL断开导出)，全量导出暂停时数据暂存到本地日志
+		holdDump := spill != nil && s.dumping.Load() && _transferService.DumpPaused()
+		// 本地日志中有数据时新数据也写入本地日志，保证顺序
+		if spill != nil && (!_transferService.endpointEnable.Load() || !spill.empty() || holdDump) {
+			if spill.full() {
+				return false
+			}
+			if err := spill.write(from, requests, ddl); err != nil {
+				logs.Errorf("spill error: %s", err.Error())
+				return false
+			}
+			if holdDump {
+				s.dumpHeld.Store(true)
+			}
+			s.delivered(requests)
+			return true
+		}
+
+		if !_transferService.endpointEnable.Load() {
+			return global.Cfg().EndpointUnavailablePolicy == global.EndpointUnavailableStop
+		}
+
+		if len(requests) > 0 {
+			s.recycleEndpoint()
+			if err := s.consumeWithRetry(from, requests); err != nil {
+				if !s.throttled(err) {
+					s.endpointFailed(err)
+				}
+				continue
+			}
+			s.throttles = 0
+			_transferService.health.observe(nil)
+			s.delivered(requests)
+		}
+		if ddl != nil {
+			if err := endpoint.PublishDDL(_transferService.endpoint, ddl); err != nil {
+				s.endpointFailed(err)
+				requests = nil // 数据已写入，只重新发送DDL
+				continue
+			}
+		}
+		return true
+	}
+}
+
+// consumeWithRetry 写入失败(限流除外)时按endpoint_retry_times重新连接接收端后重试整批，成功前不保存位置；
+// 已部分写入的数据会再次写入：elasticsearch、redis按标识覆盖，mongodb逐条写入并跳过主键冲突的插入，消息队列为至少一次
+func (s *handler) consumeWithRetry(from mysql.Position, requests []*model.RowRequest) error {
+	err := s.consume(from, requests)
+	for attempt := 1; err != nil && attempt <= global.Cfg().EndpointRetryTimes; attempt++ {
+		if _, ok := endpoint.IsThrottled(err); ok {
+			return err
+		}
+		logs.Warnf("write %d rows to destination error: %s, reconnect and retry the batch (%d/%d)",
+			len(requests), err.Error(), attempt, global.Cfg().EndpointRetryTimes)
+		time.Sleep(time.Duration(global.Cfg().EndpointRetryInterval) * time.Millisecond)
+		if err = reconnectEndpoint(_transferService.endpoint); err != nil {
+			continue
+		}
+		err = s.consume(from, requests)
+	}
+	return err
+}
+
+// reconnectEndpoint 接收端检测失败时关闭后重新连接
+func reconnectEndpoint(ep endpoint.Endpoint) error {
+	if ep.Ping() == nil {
+		return nil
+	}
+	ep.Close()
+	if err := ep.Connect(); err != nil {
+		return err
+	}
+	metrics.SetEndpointConnected(time.Now())
+	return ep.Ping()
+}
+
+// delivered 记录已写入的行事件；stop方式丢弃的数据未记录，重新同步时照常写入
+func (s *handler) delivered(requests []*model.RowRequest) {
+	if _transferService.dedupe != nil {
+		_transferService.dedupe.add(requests)
+	}
+	_transferService.rowDedupe.add(requests)
+}
+
+// endpointFailed 写入接收端失败，由startLoop检测接收端恢复；stop方式停止读取binlog，恢复后从已保存的位置重新同步
+func (s *handler) endpointFailed(err error) {
+	_transferService.endpointEnable.Store(false)
+	_transferService.health.observe(err)
+	logs.Error(err.Error())
+	if global.Cfg().EndpointUnavailablePolicy == global.EndpointUnavailableStop {
+		go _transferService.stopDump()
+	}
+}
+
+// throttled 接收端限流时按退避间隔等待后由调用方重试，不判定为接收端不可用
+func (s *handler) throttled(err error) bool {
+	t, ok := endpoint.IsThrottled(err)
+	if !ok {
+		return false
+	}
+	s.throttles++
+	metrics.IncThrottled()
+	backoff := throttleBackoff(s.throttles, t.RetryAfter)
+	logs.Warnf("destination throttled(%d), retry after %s: %s", s.throttles, backoff, t.Reason)
+	time.Sleep(backoff)
+	return true
+}
+
+// throttleBackoff 第attempt次连续限流的等待时间：自throttle_backoff起逐次翻倍至throttle_backoff_max，
+// 取其一半到全部之间的随机值，避免多个实例同时重试；接收端给出的Retry-After更长时以其为准
+func throttleBackoff(attempt int, retryAfter time.Duration) time.Duration {
+	backoff := time.Duration(global.Cfg().ThrottleBackoff) * time.Millisecond
+	max := time.Duration(global.Cfg().ThrottleBackoffMax) * time.Millisecond
+	for i := 1; i < attempt && backoff < max; i++ {
+		backoff *= 2
+	}
+	if backoff > max {
+		backoff = max
+	}
+	if half := backoff / 2; half > 0 {
+		backoff = half + time.Duration(rand.Int63n(int64(half)+1))
+	}
+	if retryAfter > backoff {
+		return retryAfter
+	}
+	return backoff
+}
+
+// blocked block方式接收端不可用、spill方式本地日志已满时不再读取队列，binlog读取随队列积压而阻塞
+func (s *handler) blocked() bool {
+	switch global.Cfg().EndpointUnavailablePolicy {
+	case global.EndpointUnavailableBlock:
+		return !_transferService.endpointEnable.Load()
+	case global.EndpointUnavailableSpill:
+		return _transferService.spill.full()
+	}
+	return false
+}
+
+// drainSpill 接收端恢复后按顺序写入本地日志中暂存的数据
+func (s *handler) drainSpill() {
+	spill := _transferService.spill
+	if spill == nil || _transferService.Paused() || (s.dumpHeld.Load() && _transferService.DumpPaused()) {
+		return
+	}
+	s.ruleLock.RLock()
+	defer s.ruleLock.RUnlock()
+	for i := 0; i < _spillDrainBatches && _transferService.endpointEnable.Load(); i++ {
+		entry, err := spill.peek()
+		if err != nil {
+			logs.Errorf("read spill error: %s", err.Error())
+			return
+		}
+		if entry == nil {
+			s.dumpHeld.Store(false)
+			return
+		}
+		if len(entry.Rows) > 0 {
+			if err := s.consume(entry.From, entry.Rows); err != nil {
+				if !s.throttled(err) {
+					s.endpointFailed(err)
+				}
+				return
+			}
+			s.throttles = 0
+		}
+		if entry.DDL != nil {
+			if err := endpoint.PublishDDL(_transferService.endpoint, entry.DDL); err != nil {
+				s.endpointFailed(err)
+				return
+			}
+		}
+		if err := spill.commit(); err != nil {
+			logs.Errorf("commit spill error: %s", err.Error())
+			return
+		}
+	}
+}
+
+// catchingUp 开启catchup_coalesce时，是否正在接收mysqldump导出的数据或binlog延迟达到catchup_delay
+func (s *handler) catchingUp() bool {
+	if !global.Cfg().CatchupCoalesce {
+		return false
+	}
+
+	delay := sourceDelay(_transferService.canal)
+	catchingUp := s.dumping.Load() || delay >= uint32(global.Cfg().CatchupDelay)
+	if catchingUp != s.coalescing {
+		s.coalescing = catchingUp
+		if catchingUp {
+			logs.Infof("catching up (delay %ds), coalesce changes of the same identity", delay)
+		} else {
+			logs.Infof("caught up, write every change")
+		}
+	}
+	return catchingUp
+}
+
+// consume 写入接收端；开启per_rule_position时按规则分别写入
+func (s *handler) consume(from mysql.Position, requests []*model.RowRequest) error {
+	if s.rulePos != nil {
+		return s.consumeByRule(from, requests)
+	}
+	return s.consumeRows(from, requests)
+}
+
+// consumeRows 开启consume_coalesce时先合并同一标识的变更；consume_workers大于1时按规则和标识列分组并发写入，同一分组内保持顺序
+func (s *handler) consumeRows(from mysql.Position, requests []*model.RowRequest) error {
+	if global.Cfg().ConsumeCoalesce || s.catchingUp() {
+		requests = endpoint.Coalesce(requests)
+	}
+
+	workers := global.Cfg().ConsumeWorkers
+	if workers <= 1 {
+		return _transferService.endpoint.Consume(from, requests)
+	}
+
+	groups := make([][]*model.RowRequest, workers)
+	for _, req := range requests {
+		i := workerIndex(req, workers)
+		groups[i] = append(groups[i], req)
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, workers)
+	for i, group := range groups {
+		if len(group) == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, group []*model.RowRequest) {
+			defer wg.Done()
+			errs[i] = _transferService.endpoint.Consume(from, group)
+		}(i, group)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// workerIndex ordering为per-key(或开启parallel)的规则按标识列的值分组，其余按规则固定分组
+func workerIndex(req *model.RowRequest, workers int) int {
+	key := req.RuleKey
+	if rule, ok := global.RuleIns(req.RuleKey); ok && rule.Ordering == global.OrderingPerKey {
+		for _, index := range rule.KeyColumnIndexes {
+			if index < len(req.Row) {
+				key += ":" + stringutil.ToString(req.Row[index])
+			}
+		}
+	}
+	return int(crc32.ChecksumIEEE([]byte(key)) % uint32(workers))
+}
+
 func (s *handler) stopListener() {
 	log.Println("transfer stop")
 	s.stop <- struct{}{}
+	// 等待监听协程写入已读取的数据并保存位置
+	select {
+	case <-s.done:
+	case <-time.After(time.Duration(global.Cfg().WriteTimeout) * time.Second):
+		logs.Warnf("listener did not stop in %d seconds", global.Cfg().WriteTimeout)
+	}
 }
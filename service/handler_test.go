@@ -0,0 +1,645 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	jujuerrors "github.com/juju/errors"
+	pingcap "github.com/pingcap/errors"
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/replication"
+	"github.com/siddontang/go-mysql/schema"
+	"github.com/siddontang/go-mysql/server"
+
+	"go-mysql-transfer/global"
+	"go-mysql-transfer/model"
+)
+
+func TestRowRequestsIdentityChange(t *testing.T) {
+	event := func(rows ...[]interface{}) *canal.RowsEvent {
+		return &canal.RowsEvent{
+			Action: canal.UpdateAction,
+			Rows:   rows,
+			Header: &replication.EventHeader{Timestamp: 1},
+		}
+	}
+
+	// 单列主键变化：删除旧主键的数据，再插入新主键的数据
+	rule := &global.Rule{IdentityChangePolicy: global.IdentityChangeDeleteInsert, KeyColumnIndexes: []int{0}}
+	requests := rowRequests(rule, "test:user", event(
+		[]interface{}{int64(1), "a"},
+		[]interface{}{int64(2), "a"},
+	))
+	if len(requests) != 2 {
+		t.Fatalf("expect 2 requests, but %d", len(requests))
+	}
+	if requests[0].Action != canal.DeleteAction || requests[0].Row[0] != int64(1) {
+		t.Errorf("expect delete of old key, but %s %v", requests[0].Action, requests[0].Row)
+	}
+	if requests[1].Action != canal.InsertAction || requests[1].Row[0] != int64(2) {
+		t.Errorf("expect insert of new key, but %s %v", requests[1].Action, requests[1].Row)
+	}
+
+	// 联合主键中的一列变化
+	rule.KeyColumnIndexes = []int{0, 1}
+	requests = rowRequests(rule, "test:user", event(
+		[]interface{}{int64(1), "a", 10},
+		[]interface{}{int64(1), "b", 10},
+	))
+	if len(requests) != 2 {
+		t.Fatalf("expect 2 requests, but %d", len(requests))
+	}
+	if requests[0].Action != canal.DeleteAction || requests[0].Row[1] != "a" {
+		t.Errorf("expect delete of old key, but %s %v", requests[0].Action, requests[0].Row)
+	}
+	if requests[1].Action != canal.InsertAction || requests[1].Row[1] != "b" {
+		t.Errorf("expect insert of new key, but %s %v", requests[1].Action, requests[1].Row)
+	}
+}
+
+func TestMergeDeleteInsert(t *testing.T) {
+	global.AddRuleIns("test:merge", &global.Rule{MergeDeleteInsert: true, KeyColumnIndexes: []int{0}, PartitionIndex: -1})
+	global.AddRuleIns("test:plain", &global.Rule{KeyColumnIndexes: []int{0}, PartitionIndex: -1})
+
+	requests := mergeDeleteInsert([]*model.RowRequest{
+		{RuleKey: "test:merge", Action: canal.DeleteAction, Row: []interface{}{int64(1), "a"}},
+		{RuleKey: "test:plain", Action: canal.DeleteAction, Row: []interface{}{int64(1), "a"}},
+		{RuleKey: "test:merge", Action: canal.DeleteAction, Row: []interface{}{int64(2), "b"}},
+		{RuleKey: "test:merge", Action: canal.InsertAction, Row: []interface{}{int64(1), "c"}},
+		{RuleKey: "test:plain", Action: canal.InsertAction, Row: []interface{}{int64(1), "c"}},
+	})
+	if len(requests) != 4 {
+		t.Fatalf("expect 4 requests, but %d", len(requests))
+	}
+	// 未开启的规则及未重新插入的删除保持不变
+	if requests[0].RuleKey != "test:plain" || requests[0].Action != canal.DeleteAction {
+		t.Errorf("expect plain delete kept, but %s %s", requests[0].RuleKey, requests[0].Action)
+	}
+	if requests[1].Action != canal.DeleteAction || requests[1].Row[0] != int64(2) {
+		t.Errorf("expect delete of key 2 kept, but %s %v", requests[1].Action, requests[1].Row)
+	}
+	merged := requests[2]
+	if merged.Action != canal.UpdateAction || !merged.Upsert || merged.Old[1] != "a" || merged.Row[1] != "c" {
+		t.Errorf("expect upsert from a to c, but %s %v %v %v", merged.Action, merged.Upsert, merged.Old, merged.Row)
+	}
+	if requests[3].RuleKey != "test:plain" || requests[3].Action != canal.InsertAction {
+		t.Errorf("expect plain insert kept, but %s %s", requests[3].RuleKey, requests[3].Action)
+	}
+}
+
+func TestRowRequestsDiffOutput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "transfer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := filepath.Join(dir, "app.yml")
+	data := fmt.Sprintf("target: elasticsearch\nes_addrs: 127.0.0.1:9200\naddr: 127.0.0.1:3306\nuser: root\npass: root\n"+
+		"charset: utf8\nslave_id: 1001\ndata_dir: %s\nrule:\n  - schema: test\n    table: diff\n", dir)
+	if err := ioutil.WriteFile(cfg, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := global.Initialize(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if global.Cfg().IsReserveRawData() {
+		t.Fatal("expect elasticsearch not to reserve raw data")
+	}
+
+	event := &canal.RowsEvent{
+		Action: canal.UpdateAction,
+		Rows:   [][]interface{}{{int64(1), "a"}, {int64(1), "b"}},
+		Header: &replication.EventHeader{Timestamp: 1},
+	}
+	rule := &global.Rule{KeyColumnIndexes: []int{0}}
+	if requests := rowRequests(rule, "test:diff", event); requests[0].Old != nil {
+		t.Errorf("expect no old row without diff_output, but %v", requests[0].Old)
+	}
+
+	// 开启diff_output时保留变更前的数据，否则rawDiff()及diff字段为空
+	rule.DiffOutput = true
+	requests := rowRequests(rule, "test:diff", event)
+	if len(requests) != 1 || requests[0].Old == nil || requests[0].Old[1] != "a" || requests[0].Row[1] != "b" {
+		t.Errorf("expect old row kept for diff_output, but %v", requests[0].Old)
+	}
+}
+
+func TestSoftDelete(t *testing.T) {
+	global.AddRuleIns("test:soft", &global.Rule{SoftDelete: true})
+	global.AddRuleIns("test:hard", &global.Rule{})
+
+	requests := softDelete([]*model.RowRequest{
+		{RuleKey: "test:soft", Action: canal.DeleteAction, Row: []interface{}{int64(1), "a"}},
+		{RuleKey: "test:soft", Action: canal.InsertAction, Row: []interface{}{int64(2), "b"}},
+		{RuleKey: "test:hard", Action: canal.DeleteAction, Row: []interface{}{int64(1), "a"}},
+	})
+	deleted := requests[0]
+	if deleted.Action != canal.UpdateAction || !deleted.Upsert || !deleted.Deleted || deleted.Row[1] != "a" {
+		t.Errorf("expect flagged upsert of deleted row, but %s %v %v %v", deleted.Action, deleted.Upsert, deleted.Deleted, deleted.Row)
+	}
+	if deleted.Old == nil || deleted.Old[1] != "a" {
+		t.Errorf("expect deleted row as old, but %v", deleted.Old)
+	}
+	if requests[1].Action != canal.InsertAction || requests[1].Deleted {
+		t.Errorf("expect insert kept, but %s %v", requests[1].Action, requests[1].Deleted)
+	}
+	if requests[2].Action != canal.DeleteAction || requests[2].Deleted {
+		t.Errorf("expect hard delete kept, but %s %v", requests[2].Action, requests[2].Deleted)
+	}
+}
+
+func TestExplode(t *testing.T) {
+	global.AddRuleIns("test:explode", &global.Rule{
+		ExplodeColumn:    "tags",
+		ExplodeIndex:     1,
+		ExplodeSeparator: ",",
+		TableInfo: &schema.Table{Columns: []schema.TableColumn{
+			{Name: "id", Type: schema.TYPE_NUMBER},
+			{Name: "tags", Type: schema.TYPE_STRING},
+		}},
+	})
+
+	requests := explode([]*model.RowRequest{
+		{RuleKey: "test:plain", Action: canal.InsertAction, Row: []interface{}{int64(9), "x"}},
+		{RuleKey: "test:explode", Action: canal.UpdateAction,
+			Old: []interface{}{int64(1), "a, b,c"},
+			Row: []interface{}{int64(1), "d,,e"}},
+	})
+	if len(requests) != 4 {
+		t.Fatalf("expect 4 requests, but %d", len(requests))
+	}
+	if requests[0].RuleKey != "test:plain" || requests[0].Element != 0 {
+		t.Errorf("expect plain insert kept, but %s %d", requests[0].RuleKey, requests[0].Element)
+	}
+	// 新的元素按序号upsert，旧数据多出的第3个元素删除
+	for i, tag := range []string{"d", "e"} {
+		r := requests[i+1]
+		if r.Action != canal.UpdateAction || !r.Upsert || r.Element != i+1 || r.Row[1] != tag {
+			t.Errorf("expect upsert of %s, but %s %v %d %v", tag, r.Action, r.Upsert, r.Element, r.Row)
+		}
+	}
+	// 变更前的数据为旧数据中同序号的元素
+	for i, tag := range []string{"a", "b"} {
+		if r := requests[i+1]; r.Old == nil || r.Old[1] != tag {
+			t.Errorf("expect old element %s, but %v", tag, r.Old)
+		}
+	}
+	if r := requests[3]; r.Action != canal.DeleteAction || r.Element != 3 || r.Row[1] != "c" {
+		t.Errorf("expect delete of element 3, but %s %d %v", r.Action, r.Element, r.Row)
+	}
+}
+
+// flakyEndpoint 第一次写入到一半时连接断开，重新连接后正常写入
+type flakyEndpoint struct {
+	connected bool
+	broken    bool
+	connects  int
+	written   map[interface{}]interface{}
+}
+
+func (s *flakyEndpoint) Connect() error {
+	s.connects++
+	s.connected = true
+	return nil
+}
+
+func (s *flakyEndpoint) Ping() error {
+	if !s.connected {
+		return errors.New("connection closed")
+	}
+	return nil
+}
+
+func (s *flakyEndpoint) Consume(_ mysql.Position, requests []*model.RowRequest) error {
+	for i, request := range requests {
+		if !s.connected {
+			return errors.New("connection closed")
+		}
+		s.written[request.Row[0]] = request.Row[1]
+		if !s.broken && i == len(requests)/2 {
+			s.broken = true
+			s.connected = false
+		}
+	}
+	return nil
+}
+
+func (s *flakyEndpoint) Stock([]*model.RowRequest) int64 { return 0 }
+
+func (s *flakyEndpoint) Close() { s.connected = false }
+
+func TestFlushRetryAfterDisconnect(t *testing.T) {
+	dir, err := ioutil.TempDir("", "transfer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := filepath.Join(dir, "app.yml")
+	data := fmt.Sprintf("target: script\naddr: 127.0.0.1:3306\nuser: root\npass: root\ncharset: utf8\nslave_id: 1001\n"+
+		"data_dir: %s\nendpoint_retry_times: 2\nendpoint_retry_interval: 1\nrule:\n  - schema: test\n    table: retry\n", dir)
+	if err := ioutil.WriteFile(cfg, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := global.Initialize(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	ep := &flakyEndpoint{connected: true, written: make(map[interface{}]interface{})}
+	_transferService = &TransferService{endpoint: ep, health: newDestHealth()}
+	_transferService.endpointEnable.Store(true)
+	defer func() { _transferService = nil }()
+
+	requests := make([]*model.RowRequest, 0, 10)
+	for i := 0; i < 10; i++ {
+		requests = append(requests, &model.RowRequest{RuleKey: "test:retry", Action: canal.InsertAction, Row: []interface{}{i, "v"}})
+	}
+	if !newHandler().flush(mysql.Position{}, requests, nil) {
+		t.Fatal("expect batch flushed")
+	}
+	if !_transferService.endpointEnable.Load() {
+		t.Error("expect endpoint still enabled")
+	}
+	if ep.connects != 1 {
+		t.Errorf("expect reconnect once, but %d", ep.connects)
+	}
+	for i := 0; i < 10; i++ {
+		if _, ok := ep.written[i]; !ok {
+			t.Errorf("row %d lost", i)
+		}
+	}
+}
+
+func TestDumpDone(t *testing.T) {
+	h := newHandler()
+	if err := h.dumpDone(mysql.Position{}); err == nil {
+		t.Error("expect error for missing dump position")
+	}
+	if len(h.queue) != 0 {
+		t.Fatal("expect no position queued")
+	}
+
+	// 导出的数据在队列中位于导出时的位置之前，写入后才保存该位置
+	h.queue <- []*model.RowRequest{{RuleKey: "test:dump", Action: canal.InsertAction, Row: []interface{}{1}}}
+	if err := h.dumpDone(mysql.Position{Name: "mysql-bin.000003", Pos: 154}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := (<-h.queue).([]*model.RowRequest); !ok {
+		t.Error("expect dumped row first")
+	}
+	pos, ok := (<-h.queue).(model.PosRequest)
+	if !ok || !pos.Force || pos.Name != "mysql-bin.000003" || pos.Pos != 154 {
+		t.Errorf("expect forced dump position, but %v", pos)
+	}
+}
+
+func TestCommitGTID(t *testing.T) {
+	h := newHandler()
+	h.gtid = "3e11fa47-71ca-11e1-9e33-c80aa9429562:6"
+	h.commitGTID()
+	if h.executedGTID() != "" || h.gtid != "" {
+		t.Error("expect gtid not tracked without a starting set")
+	}
+
+	h.executed, _ = mysql.ParseGTIDSet(mysql.MySQLFlavor, "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-5")
+	h.gtid = "3e11fa47-71ca-11e1-9e33-c80aa9429562:6"
+	h.commitGTID()
+	if got := h.executedGTID(); got != "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-6" {
+		t.Errorf("expect gtid merged into executed set, but %s", got)
+	}
+}
+
+func TestPartitionChanges(t *testing.T) {
+	changes := partitionChanges("test", "ALTER TABLE orders TRUNCATE PARTITION p0, p1")
+	if len(changes) != 1 || changes[0].schema != "test" || changes[0].table != "orders" || changes[0].operation != "truncate partition" {
+		t.Errorf("expect truncate partition of test.orders, but %v", changes)
+	}
+	changes = partitionChanges("test", "ALTER TABLE shop.orders EXCHANGE PARTITION p0 WITH TABLE orders_archive")
+	if len(changes) != 2 || changes[0].schema != "shop" || changes[1].schema != "test" || changes[1].table != "orders_archive" {
+		t.Errorf("expect both tables of exchange partition, but %v", changes)
+	}
+	// 不改变数据的分区维护语句
+	for _, query := range []string{
+		"ALTER TABLE orders ADD PARTITION (PARTITION p3 VALUES LESS THAN (2000))",
+		"ALTER TABLE orders REORGANIZE PARTITION p0 INTO (PARTITION p0 VALUES LESS THAN (10), PARTITION p1 VALUES LESS THAN (20))",
+		"ALTER TABLE orders ADD COLUMN c INT",
+	} {
+		if changes := partitionChanges("test", query); len(changes) != 0 {
+			t.Errorf("expect no change for %s, but %v", query, changes)
+		}
+	}
+}
+
+func TestUnregisteredRule(t *testing.T) {
+	dir, err := ioutil.TempDir("", "transfer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := filepath.Join(dir, "app.yml")
+	data := fmt.Sprintf("target: script\naddr: 127.0.0.1:3306\nuser: root\npass: root\ncharset: utf8\nslave_id: 1001\n"+
+		"data_dir: %s\nrule:\n  - schema: test\n    table: order_[0-9]+\n", dir)
+	if err := ioutil.WriteFile(cfg, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := global.Initialize(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	event := func(table string) *canal.RowsEvent {
+		return &canal.RowsEvent{
+			Table:  &schema.Table{Schema: "test", Name: table},
+			Action: canal.InsertAction,
+			Rows:   [][]interface{}{{1}},
+		}
+	}
+	h := newHandler()
+	if rule := h.unregisteredRule("test:user", event("user")); rule != nil {
+		t.Error("expect unmapped table skipped")
+	}
+	// 注册失败后在重试间隔内跳过，不再尝试注册
+	h.retryDiscovery["test:order_3"] = time.Now().Add(time.Minute)
+	if rule := h.unregisteredRule("test:order_3", event("order_3")); rule != nil {
+		t.Error("expect table skipped before retry")
+	}
+
+	global.Cfg().TableDiscoveryPolicy = global.TableDiscoverySkip
+	if rule := h.unregisteredRule("test:order_4", event("order_4")); rule != nil {
+		t.Error("expect table skipped by skip policy")
+	}
+	if _, ok := h.retryDiscovery["test:order_4"]; ok {
+		t.Error("expect no registration attempt by skip policy")
+	}
+}
+
+type ruleFailEndpoint struct {
+	flakyEndpoint
+	failRule string
+}
+
+func (s *ruleFailEndpoint) Consume(_ mysql.Position, requests []*model.RowRequest) error {
+	for _, request := range requests {
+		if request.RuleKey == s.failRule {
+			return errors.New("rejected")
+		}
+		s.written[request.Row[0]] = request.RuleKey
+	}
+	return nil
+}
+
+type memPositionStorage struct {
+	pos   mysql.Position
+	rules map[string]mysql.Position
+}
+
+func (s *memPositionStorage) Initialize() error                           { return nil }
+func (s *memPositionStorage) Save(pos mysql.Position) error               { s.pos = pos; return nil }
+func (s *memPositionStorage) Get() (mysql.Position, error)                { return s.pos, nil }
+func (s *memPositionStorage) SaveGTID(pos mysql.Position, _ string) error { return s.Save(pos) }
+func (s *memPositionStorage) GetGTID() (string, error)                    { return "", nil }
+func (s *memPositionStorage) GetByRule(ruleKey string) (mysql.Position, error) {
+	return s.rules[ruleKey], nil
+}
+func (s *memPositionStorage) SaveByRule(ruleKey string, pos mysql.Position) error {
+	s.rules[ruleKey] = pos
+	return nil
+}
+
+func TestConsumeByRule(t *testing.T) {
+	dir, err := ioutil.TempDir("", "transfer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := filepath.Join(dir, "app.yml")
+	data := fmt.Sprintf("target: script\naddr: 127.0.0.1:3306\nuser: root\npass: root\ncharset: utf8\nslave_id: 1001\n"+
+		"data_dir: %s\nper_rule_position: true\nrule:\n  - schema: test\n    table: a\n", dir)
+	if err := ioutil.WriteFile(cfg, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := global.Initialize(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	ep := &ruleFailEndpoint{flakyEndpoint: flakyEndpoint{written: make(map[interface{}]interface{})}, failRule: "test:b"}
+	dao := &memPositionStorage{rules: make(map[string]mysql.Position)}
+	_transferService = &TransferService{endpoint: ep, positionDao: dao}
+	defer func() { _transferService = nil }()
+
+	h := newHandler()
+	h.rulePos = loadRulePositions(mysql.Position{})
+	boundary := mysql.Position{Name: "mysql-bin.000001", Pos: 500}
+	h.rulePos.mark(boundary)
+	requests := []*model.RowRequest{
+		{RuleKey: "test:a", Action: canal.InsertAction, Row: []interface{}{1}, LogName: "mysql-bin.000001", LogPos: 200},
+		{RuleKey: "test:b", Action: canal.InsertAction, Row: []interface{}{2}, LogName: "mysql-bin.000001", LogPos: 300},
+		{RuleKey: "test:c", Action: canal.InsertAction, Row: []interface{}{3}, LogName: "mysql-bin.000001", LogPos: 600},
+	}
+	if err := h.consume(mysql.Position{}, requests); err == nil {
+		t.Fatal("expect error of rule test:b")
+	}
+	// 其他规则不受影响；test:c的数据在未结束的事务中，不保存位置
+	if ep.written[1] != "test:a" || ep.written[3] != "test:c" {
+		t.Errorf("expect other rules written, but %v", ep.written)
+	}
+	if dao.rules["test:a"] != boundary {
+		t.Errorf("expect position of test:a saved, but %v", dao.rules["test:a"])
+	}
+	if _, ok := dao.rules["test:c"]; ok {
+		t.Error("expect no position of test:c")
+	}
+	if !h.rulePos.acknowledged("test:a", "mysql-bin.000001", 200) || h.rulePos.acknowledged("test:b", "mysql-bin.000001", 300) {
+		t.Error("unexpected acknowledged rows")
+	}
+
+	// 重试时已确认的规则不再写入
+	delete(ep.written, 1)
+	ep.failRule = ""
+	if err := h.consume(mysql.Position{}, requests); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ep.written[1]; ok {
+		t.Error("expect acknowledged rule skipped on retry")
+	}
+	if ep.written[2] != "test:b" {
+		t.Error("expect failed rule retried")
+	}
+
+	// 重新加载时，与全局位置不属于同一组binlog文件的规则位置(如RESET MASTER后)被清除
+	global.AddRuleIns("test:a", &global.Rule{})
+	if r := loadRulePositions(mysql.Position{Name: "mysql-bin.000001", Pos: 100}); !r.acknowledged("test:a", "mysql-bin.000001", 200) {
+		t.Error("expect position of test:a loaded")
+	}
+	r := loadRulePositions(mysql.Position{Name: "mysql-bin.000120", Pos: 4})
+	if r.acknowledged("test:a", "mysql-bin.000001", 200) || dao.rules["test:a"].Name != "" {
+		t.Errorf("expect position of test:a discarded, but %v", dao.rules["test:a"])
+	}
+
+	dao.rules["test:a"] = boundary
+	r = loadRulePositions(mysql.Position{Name: "mysql-bin.000001", Pos: 100})
+	r.discard()
+	if r.acknowledged("test:a", "mysql-bin.000001", 200) || dao.rules["test:a"].Name != "" {
+		t.Error("expect position of test:a discarded")
+	}
+}
+
+func TestConnectionLost(t *testing.T) {
+	lost := pingcap.Trace(pingcap.Wrapf(mysql.ErrBadConn, "io.ReadFull(header) failed"))
+	if !connectionLost(jujuerrors.Trace(lost)) {
+		t.Error("expect connection lost for bad connection")
+	}
+	if connectionLost(jujuerrors.Trace(errors.New("handler failed"))) {
+		t.Error("expect no connection lost for handler error")
+	}
+	if connectionLost(jujuerrors.Trace(&mysql.MyError{Code: 1236})) {
+		t.Error("expect no connection lost for server error")
+	}
+}
+
+// binlogFormatHandler 只应答canal启动时检查binlog_format的查询
+type binlogFormatHandler struct {
+	server.EmptyHandler
+}
+
+func (h binlogFormatHandler) HandleQuery(string) (*mysql.Result, error) {
+	rs, err := mysql.BuildSimpleTextResultset([]string{"Variable_name", "Value"}, [][]interface{}{{"binlog_format", "ROW"}})
+	if err != nil {
+		return nil, err
+	}
+	return &mysql.Result{Resultset: rs}, nil
+}
+
+// newTestCanal 连接到只应答binlog_format查询的MySQL服务端创建canal，不导出、不同步
+func newTestCanal(t *testing.T) *canal.Canal {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn, err := server.NewConn(c, "root", "root", binlogFormatHandler{})
+				if err != nil {
+					return
+				}
+				for conn.HandleCommand() == nil {
+				}
+			}()
+		}
+	}()
+
+	cfg := canal.NewDefaultConfig()
+	cfg.Addr = l.Addr().String()
+	cfg.User = "root"
+	cfg.Password = "root"
+	cfg.Dump.ExecutionPath = ""
+	c, err := canal.NewCanal(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Close)
+	return c
+}
+
+// recordEndpoint 按顺序记录写入的数据及保存的位置
+type recordEndpoint struct {
+	flakyEndpoint
+	lock sync.Mutex
+	log  []string
+}
+
+func (s *recordEndpoint) record(v string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.log = append(s.log, v)
+}
+
+func (s *recordEndpoint) Consume(_ mysql.Position, requests []*model.RowRequest) error {
+	for _, request := range requests {
+		s.record(fmt.Sprintf("row %v", request.Row[0]))
+	}
+	return nil
+}
+
+type recordPositionStorage struct {
+	memPositionStorage
+	ep *recordEndpoint
+}
+
+func (s *recordPositionStorage) Save(pos mysql.Position) error {
+	s.ep.record("save " + pos.String())
+	return s.memPositionStorage.Save(pos)
+}
+
+func (s *recordPositionStorage) SaveGTID(pos mysql.Position, _ string) error { return s.Save(pos) }
+
+func TestDumpExactlyOnce(t *testing.T) {
+	dir, err := ioutil.TempDir("", "transfer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := filepath.Join(dir, "app.yml")
+	data := fmt.Sprintf("target: script\naddr: 127.0.0.1:3306\nuser: root\npass: root\ncharset: utf8\nslave_id: 1001\n"+
+		"data_dir: %s\nflush_bulk_interval: 60000\nrule:\n  - schema: test\n    table: dump\n", dir)
+	if err := ioutil.WriteFile(cfg, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := global.Initialize(cfg); err != nil {
+		t.Fatal(err)
+	}
+	global.AddRuleIns("test:dump", &global.Rule{Schema: "test", Table: "dump", TableColumnSize: 2, KeyColumnIndexes: []int{0}})
+
+	ep := &recordEndpoint{flakyEndpoint: flakyEndpoint{connected: true}}
+	dao := &recordPositionStorage{ep: ep}
+	_transferService = &TransferService{endpoint: ep, positionDao: dao, health: newDestHealth(), canal: newTestCanal(t)}
+	_transferService.endpointEnable.Store(true)
+	defer func() { _transferService = nil }()
+
+	h := newHandler()
+	h.awaitDump.Store(true)
+	h.startListener()
+
+	table := &schema.Table{Schema: "test", Name: "dump"}
+	// mysqldump导出的数据没有事件头，导出结束后canal以导出时的位置强制调用OnPosSynced
+	dumped := &canal.RowsEvent{Table: table, Action: canal.InsertAction, Rows: [][]interface{}{{1, "a"}, {2, "b"}}}
+	if err := h.OnRow(dumped); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.OnPosSynced(mysql.Position{Name: "mysql-bin.000003", Pos: 154}, nil, true); err != nil {
+		t.Fatal(err)
+	}
+	// 导出时的位置之后提交的数据
+	streamed := &canal.RowsEvent{
+		Table:  table,
+		Action: canal.InsertAction,
+		Rows:   [][]interface{}{{3, "c"}},
+		Header: &replication.EventHeader{Timestamp: 1, LogPos: 300},
+	}
+	if err := h.OnRow(streamed); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.OnXID(mysql.Position{Name: "mysql-bin.000003", Pos: 300}); err != nil {
+		t.Fatal(err)
+	}
+	h.drain()
+	h.stopListener()
+
+	expect := []string{"row 1", "row 2", "save (mysql-bin.000003, 154)", "row 3", "save (mysql-bin.000003, 300)"}
+	if !reflect.DeepEqual(ep.log, expect) {
+		t.Errorf("expect %v, but %v", expect, ep.log)
+	}
+}
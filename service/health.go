@@ -0,0 +1,64 @@
+/*
+ * Copyright 2020-2021 the original author(https://github.com/wj596)
+ *
+ * <p>
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * </p>
+ */
+package service
+
+import (
+	"sync"
+
+	"go-mysql-transfer/global"
+	"go-mysql-transfer/metrics"
+	"go-mysql-transfer/util/logs"
+)
+
+// destHealth 接收端状态去抖：连续失败health_check_failures次才判定为不可用，连续成功health_check_successes次才恢复；
+// 只影响状态指标，写入失败时仍立即按endpoint_unavailable_policy处理
+type destHealth struct {
+	lock      sync.Mutex
+	healthy   bool
+	failures  int
+	successes int
+}
+
+func newDestHealth() *destHealth {
+	return &destHealth{healthy: true}
+}
+
+// observe 记录一次写入或检测的结果
+func (h *destHealth) observe(err error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if err != nil {
+		h.successes = 0
+		h.failures++
+		if h.healthy && h.failures >= global.Cfg().HealthCheckFailures {
+			h.healthy = false
+			metrics.SetDestState(metrics.DestStateFail)
+			logs.Warnf("destination marked unavailable after %d consecutive failures, last error: %s", h.failures, err.Error())
+		}
+		return
+	}
+
+	h.failures = 0
+	h.successes++
+	if !h.healthy && h.successes >= global.Cfg().HealthCheckSuccesses {
+		h.healthy = true
+		metrics.SetDestState(metrics.DestStateOK)
+		logs.Infof("destination marked available after %d consecutive successes", h.successes)
+	}
+}
@@ -0,0 +1,243 @@
+/*
+ * Copyright 2020-2021 the original author(https://github.com/wj596)
+ *
+ * <p>
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * </p>
+ */
+package lookup
+
+import (
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-mysql/canal"
+
+	"go-mysql-transfer/global"
+	"go-mysql-transfer/util/logs"
+	"go-mysql-transfer/util/stringutil"
+)
+
+// cache 参考表在内存中的副本：键列的值 -> 值列的值
+type cache struct {
+	lock     sync.RWMutex
+	def      *global.Lookup
+	values   map[string]interface{}
+	loadTime time.Time
+}
+
+var (
+	_lock   sync.RWMutex
+	_caches map[string]*cache // name -> cache
+	_tables map[string][]*cache
+	_ds     *canal.Canal
+	_stop   chan struct{}
+)
+
+// Initialize 启动时加载规则lookups中的参考表，refresh_interval大于0的定时重新加载；重复调用时不再加载
+func Initialize(ds *canal.Canal) error {
+	_lock.Lock()
+	defer _lock.Unlock()
+
+	if _caches != nil {
+		return nil
+	}
+
+	caches := make(map[string]*cache)
+	tables := make(map[string][]*cache)
+	for _, rule := range global.RuleInsList() {
+		for _, def := range rule.Lookups {
+			if c, exist := caches[def.Name]; exist {
+				if !c.def.SameSource(def) {
+					return errors.Errorf("lookup %s defined with different sources", def.Name)
+				}
+				continue
+			}
+			c := &cache{def: def}
+			if err := c.load(ds); err != nil {
+				return err
+			}
+			caches[def.Name] = c
+			key := global.RuleKey(def.Schema, def.Table)
+			tables[key] = append(tables[key], c)
+		}
+	}
+
+	_ds = ds
+	_caches = caches
+	_tables = tables
+	_stop = make(chan struct{})
+	for _, c := range caches {
+		if c.def.RefreshInterval > 0 {
+			go c.refreshLoop(_stop)
+		}
+	}
+	return nil
+}
+
+// Close 停止定时重新加载
+func Close() {
+	_lock.Lock()
+	defer _lock.Unlock()
+
+	if _stop != nil {
+		close(_stop)
+		_stop = nil
+	}
+}
+
+// Get 按键查找参考表中的值，不存在时返回false
+func Get(name string, key interface{}) (interface{}, bool) {
+	_lock.RLock()
+	c, ok := _caches[name]
+	_lock.RUnlock()
+	if !ok || key == nil {
+		return nil, false
+	}
+
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	v, ok := c.values[stringutil.ToString(key)]
+	return v, ok
+}
+
+// Watched 表是否为某个lookup的参考表
+func Watched(schema, table string) bool {
+	_lock.RLock()
+	defer _lock.RUnlock()
+	_, ok := _tables[global.RuleKey(schema, table)]
+	return ok
+}
+
+// OnRow 参考表的行变更同步到缓存，与监听表的数据按binlog顺序处理
+func OnRow(e *canal.RowsEvent) {
+	_lock.RLock()
+	caches := _tables[global.RuleKey(e.Table.Schema, e.Table.Name)]
+	_lock.RUnlock()
+
+	for _, c := range caches {
+		c.apply(e)
+	}
+}
+
+// TableRegex 参考表须加入canal监听的表，才能收到其变更
+func TableRegex() []string {
+	var ls []string
+	for _, rc := range global.Cfg().RuleConfigs {
+		for _, def := range rc.Lookups {
+			schema, table := def.SourceOf(rc.Schema)
+			ls = append(ls, regexp.QuoteMeta(schema)+"\\."+regexp.QuoteMeta(table))
+		}
+	}
+	return ls
+}
+
+// load 全量加载参考表，超过max_size时不加载，保留原有的数据
+func (c *cache) load(ds *canal.Canal) error {
+	def := c.def
+	sql := fmt.Sprintf("SELECT `%s`, `%s` FROM `%s`.`%s` LIMIT %d",
+		def.KeyColumn, def.ValueColumn, def.Schema, def.Table, def.MaxSize+1)
+	res, err := ds.Execute(sql)
+	if err != nil {
+		return errors.Annotatef(err, "load lookup %s", def.Name)
+	}
+
+	rowNumber := res.Resultset.RowNumber()
+	if rowNumber > def.MaxSize {
+		return errors.Errorf("lookup %s: table %s.%s exceeds max_size %d", def.Name, def.Schema, def.Table, def.MaxSize)
+	}
+
+	values := make(map[string]interface{}, rowNumber)
+	for i := 0; i < rowNumber; i++ {
+		key, err := res.GetValue(i, 0)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		value, err := res.GetValue(i, 1)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		values[stringutil.ToString(key)] = normalize(value)
+	}
+
+	c.lock.Lock()
+	c.values = values
+	c.loadTime = time.Now()
+	c.lock.Unlock()
+	logs.Infof("lookup %s loaded %d entries", def.Name, rowNumber)
+	return nil
+}
+
+func (c *cache) refreshLoop(stop chan struct{}) {
+	ticker := time.NewTicker(time.Duration(c.def.RefreshInterval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.load(_ds); err != nil {
+				c.lock.RLock()
+				loadTime := c.loadTime
+				c.lock.RUnlock()
+				logs.Errorf("refresh lookup %s error, keep entries loaded at %s: %s",
+					c.def.Name, loadTime.Format(time.RFC3339), err.Error())
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (c *cache) apply(e *canal.RowsEvent) {
+	keyIndex := e.Table.FindColumn(c.def.KeyColumn)
+	valueIndex := e.Table.FindColumn(c.def.ValueColumn)
+	if keyIndex < 0 || valueIndex < 0 {
+		logs.Warnf("lookup %s: column %s or %s not found in %s.%s",
+			c.def.Name, c.def.KeyColumn, c.def.ValueColumn, e.Table.Schema, e.Table.Name)
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for i, row := range e.Rows {
+		if keyIndex >= len(row) || valueIndex >= len(row) {
+			continue
+		}
+		key := stringutil.ToString(row[keyIndex])
+		switch {
+		case e.Action == canal.DeleteAction:
+			delete(c.values, key)
+		case e.Action == canal.UpdateAction && i%2 == 0:
+			// 变更前的数据，键改变时删除旧的键
+			if next := i + 1; next < len(e.Rows) && keyIndex < len(e.Rows[next]) &&
+				stringutil.ToString(e.Rows[next][keyIndex]) != key {
+				delete(c.values, key)
+			}
+		default:
+			if _, exist := c.values[key]; !exist && len(c.values) >= c.def.MaxSize {
+				logs.Warnf("lookup %s reached max_size %d, key %s not cached", c.def.Name, c.def.MaxSize, key)
+				continue
+			}
+			c.values[key] = normalize(row[valueIndex])
+		}
+	}
+}
+
+func normalize(value interface{}) interface{} {
+	if b, ok := value.([]byte); ok {
+		return string(b)
+	}
+	return value
+}
@@ -0,0 +1,37 @@
+package lookup
+
+import (
+	"testing"
+
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/schema"
+
+	"go-mysql-transfer/global"
+)
+
+func TestApply(t *testing.T) {
+	table := &schema.Table{
+		Schema:  "test",
+		Name:    "dict_status",
+		Columns: []schema.TableColumn{{Name: "code"}, {Name: "label"}},
+	}
+	c := &cache{
+		def:    &global.Lookup{Name: "status", KeyColumn: "code", ValueColumn: "label", MaxSize: 2},
+		values: map[string]interface{}{"1": "new"},
+	}
+
+	c.apply(&canal.RowsEvent{Table: table, Action: canal.InsertAction, Rows: [][]interface{}{{int64(2), "paid"}, {int64(3), "sent"}}})
+	if c.values["2"] != "paid" || len(c.values) != 2 {
+		t.Fatalf("insert: %v", c.values)
+	}
+
+	c.apply(&canal.RowsEvent{Table: table, Action: canal.UpdateAction, Rows: [][]interface{}{{int64(2), "paid"}, {int64(4), "done"}}})
+	if _, ok := c.values["2"]; ok || c.values["4"] != "done" {
+		t.Fatalf("update key: %v", c.values)
+	}
+
+	c.apply(&canal.RowsEvent{Table: table, Action: canal.DeleteAction, Rows: [][]interface{}{{int64(1), "new"}}})
+	if _, ok := c.values["1"]; ok {
+		t.Fatalf("delete: %v", c.values)
+	}
+}
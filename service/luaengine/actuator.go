@@ -19,12 +19,19 @@ package luaengine
 
 import (
 	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/juju/errors"
 	luaJson "github.com/layeh/gopher-json"
 	"github.com/siddontang/go-mysql/canal"
 	"github.com/yuin/gopher-lua"
 
+	"go-mysql-transfer/global"
+	"go-mysql-transfer/metrics"
 	"go-mysql-transfer/util/byteutil"
 	"go-mysql-transfer/util/httpclient"
 	"go-mysql-transfer/util/stringutil"
@@ -78,6 +85,7 @@ func (p *luaStatePool) New() *lua.LState {
 	L.PreloadModule("scriptOps", scriptModule)
 	L.PreloadModule("dbOps", dbModule)
 	L.PreloadModule("httpOps", httpModule)
+	L.PreloadModule("lookupOps", lookupModule)
 
 	L.PreloadModule("redisOps", redisModule)
 	L.PreloadModule("mqOps", mqModule)
@@ -100,6 +108,113 @@ func (p *luaStatePool) Shutdown() {
 	}
 }
 
+// callRule 依次执行规则的lua_stages及Lua脚本，并记录执行耗时；某个stage丢弃该行时不再执行后续脚本，不产生任何操作；
+// 执行失败或返回的结果不正确时返回包含规则、脚本名称及行号的错误
+func callRule(L *lua.LState, rule *global.Rule) error {
+	start := time.Now()
+	defer func() {
+		metrics.ObserveLuaDuration(global.RuleKey(rule.Schema, rule.Table), time.Since(start))
+	}()
+
+	for i, proto := range rule.LuaStageProtos {
+		keep, err := callStage(L, proto)
+		if err != nil {
+			return errors.Annotatef(err, "rule %s lua stage %s", global.RuleKey(rule.Schema, rule.Table), rule.LuaStages[i])
+		}
+		if !keep {
+			metrics.IncSkipped(global.RuleKey(rule.Schema, rule.Table), metrics.SkipLua, 1)
+			return nil
+		}
+	}
+
+	top := L.GetTop()
+	L.Push(L.NewFunctionFromProto(rule.LuaProto))
+	err := L.PCall(0, lua.MultRet, nil)
+	L.SetTop(top)
+	if err != nil {
+		return errors.Annotatef(err, "rule %s lua script", global.RuleKey(rule.Schema, rule.Table))
+	}
+	return nil
+}
+
+// callStage 执行一个stage：返回table时作为后续脚本的行数据(rawRow)，返回false或nil时丢弃该行，无返回值或返回true时保留(可能已修改的)行数据；
+// 返回其他类型(如拼写错误返回了某列的值)时返回错误
+func callStage(L *lua.LState, proto *lua.FunctionProto) (bool, error) {
+	top := L.GetTop()
+	L.Push(L.NewFunctionFromProto(proto))
+	if err := L.PCall(0, lua.MultRet, nil); err != nil {
+		return false, err
+	}
+	if L.GetTop() == top {
+		return true, nil
+	}
+
+	ret := L.Get(top + 1)
+	L.SetTop(top)
+	switch ret.Type() {
+	case lua.LTTable:
+		L.SetGlobal(_globalROW, ret)
+		return true, nil
+	case lua.LTBool, lua.LTNil:
+		return lua.LVAsBool(ret), nil
+	}
+	return false, errors.Errorf("must return a table, boolean or nil, got %s", ret.Type().String())
+}
+
+// checkKey 索引、集合、文档ID、topic等参数必须是非空字符串或数字，否则抛出包含脚本行号的错误
+func checkKey(L *lua.LState, n int) lua.LValue {
+	v := L.CheckAny(n)
+	switch v.Type() {
+	case lua.LTString:
+		if lua.LVAsString(v) != "" {
+			return v
+		}
+	case lua.LTNumber:
+		return v
+	}
+	L.ArgError(n, fmt.Sprintf("non-empty string or number expected, got %s", describe(v)))
+	return lua.LNil
+}
+
+// checkValue 写入的值不能为nil、函数等无法序列化的类型
+func checkValue(L *lua.LState, n int) lua.LValue {
+	v := L.CheckAny(n)
+	switch v.Type() {
+	case lua.LTNil, lua.LTFunction, lua.LTUserData, lua.LTThread, lua.LTChannel:
+		L.ArgError(n, fmt.Sprintf("value expected, got %s", describe(v)))
+	}
+	return v
+}
+
+// checkScore 分数可以是数字或可转换为数字的值(如decimal列的字符串)
+func checkScore(L *lua.LState, n int) lua.LNumber {
+	v := L.CheckAny(n)
+	if num, ok := v.(lua.LNumber); ok {
+		return num
+	}
+	num, err := strconv.ParseFloat(strings.TrimSpace(lvToString(v)), 64)
+	if err != nil {
+		L.ArgError(n, fmt.Sprintf("number expected, got %s %q", v.Type().String(), lvToString(v)))
+	}
+	return lua.LNumber(num)
+}
+
+// checkDocument 文档必须是键值形式的table
+func checkDocument(L *lua.LState, n int) *lua.LTable {
+	t := L.CheckTable(n)
+	if t.MaxN() > 0 {
+		L.ArgError(n, "key-value table expected, got array")
+	}
+	return t
+}
+
+func describe(v lua.LValue) string {
+	if v.Type() == lua.LTString {
+		return "empty string"
+	}
+	return v.Type().String()
+}
+
 func rawRow(L *lua.LState) int {
 	row := L.GetGlobal(_globalROW)
 	L.Push(row)
@@ -232,9 +347,8 @@ func lvToInterface(lv lua.LValue, tableToJson bool) interface{} {
 func lvToMap(lv lua.LValue) (map[string]interface{}, bool) {
 	switch lv.Type() {
 	case lua.LTTable:
-		t := lvToInterface(lv, false)
-		ret := t.(map[string]interface{})
-		return ret, true
+		ret, ok := lvToInterface(lv, false).(map[string]interface{})
+		return ret, ok
 	default:
 		return nil, false
 	}
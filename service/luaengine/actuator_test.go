@@ -0,0 +1,105 @@
+package luaengine
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+func compileStage(t *testing.T, script string) *lua.FunctionProto {
+	chunk, err := parse.Parse(strings.NewReader(script), "stage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proto, err := lua.Compile(chunk, "stage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return proto
+}
+
+func TestCallStage(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+
+	row := L.NewTable()
+	L.SetField(row, "ID", lua.LNumber(1))
+	L.SetField(row, "NAME", lua.LString("a"))
+	L.SetGlobal(_globalROW, row)
+
+	// 无返回值：保留修改后的行
+	keep, err := callStage(L, compileStage(t, `___ROW___["NAME"] = "b"`))
+	if err != nil || !keep {
+		t.Fatalf("expect keep, but %v %v", keep, err)
+	}
+	if v := L.GetField(L.GetGlobal(_globalROW), "NAME"); v.String() != "b" {
+		t.Errorf("expect modified row, but %s", v)
+	}
+
+	// 返回table：替换后续脚本的行数据
+	keep, err = callStage(L, compileStage(t, `return {ID = ___ROW___["ID"], TAG = "x"}`))
+	if err != nil || !keep {
+		t.Fatalf("expect keep, but %v %v", keep, err)
+	}
+	if v := L.GetField(L.GetGlobal(_globalROW), "TAG"); v.String() != "x" {
+		t.Errorf("expect replaced row, but %s", v)
+	}
+
+	// 返回false或nil：丢弃
+	for _, script := range []string{`return false`, `return nil`} {
+		keep, err = callStage(L, compileStage(t, script))
+		if err != nil || keep {
+			t.Errorf("%s: expect drop, but %v %v", script, keep, err)
+		}
+	}
+	// 返回其他类型：错误
+	if _, err = callStage(L, compileStage(t, `return ___ROW___["ID"]`)); err == nil {
+		t.Errorf("expect error for number result")
+	}
+	if L.GetTop() != 0 {
+		t.Errorf("expect clean stack, but %d", L.GetTop())
+	}
+}
+
+func TestCheckKey(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+
+	L.SetGlobal("INSERT", L.NewFunction(func(L *lua.LState) int {
+		checkKey(L, 1)
+		checkValue(L, 2)
+		return 0
+	}))
+	L.SetGlobal("ZADD", L.NewFunction(func(L *lua.LState) int {
+		if checkScore(L, 1) != 1.5 {
+			L.RaiseError("unexpected score")
+		}
+		return 0
+	}))
+
+	for script, expect := range map[string]string{
+		`INSERT("t_user", {ID = 1})`:            "",
+		`INSERT(1, "a")`:                        "",
+		"local row = {}\nINSERT(row.ID, \"a\")": "stage:2: bad argument #1",
+		`INSERT("", "a")`:                       "empty string",
+		`INSERT("t_user", nil)`:                 "bad argument #2",
+		`ZADD(1.5)`:                             "",
+		`ZADD(" 1.5")`:                          "",
+		`ZADD("abc")`:                           "number expected",
+		`ZADD(true)`:                            "number expected",
+	} {
+		L.Push(L.NewFunctionFromProto(compileStage(t, script)))
+		err := L.PCall(0, 0, nil)
+		if expect == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", script, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), expect) {
+			t.Errorf("%s: expect error containing %q, but %v", script, expect, err)
+		}
+	}
+}
@@ -43,9 +43,9 @@ var _esModuleApi = map[string]lua.LGFunction{
 }
 
 func esInsert(L *lua.LState) int {
-	index := L.CheckAny(1)
-	id := L.CheckAny(2)
-	body := L.CheckAny(3)
+	index := checkKey(L, 1)
+	id := checkKey(L, 2)
+	body := checkValue(L, 3)
 
 	data := L.NewTable()
 	L.SetTable(data, lua.LString("index"), index)
@@ -59,9 +59,9 @@ func esInsert(L *lua.LState) int {
 }
 
 func esUpdate(L *lua.LState) int {
-	index := L.CheckAny(1)
-	id := L.CheckAny(2)
-	body := L.CheckAny(3)
+	index := checkKey(L, 1)
+	id := checkKey(L, 2)
+	body := checkValue(L, 3)
 
 	data := L.NewTable()
 	L.SetTable(data, lua.LString("index"), index)
@@ -75,8 +75,8 @@ func esUpdate(L *lua.LState) int {
 }
 
 func esDelete(L *lua.LState) int {
-	index := L.CheckAny(1)
-	id := L.CheckAny(2)
+	index := checkKey(L, 1)
+	id := checkKey(L, 2)
 
 	data := L.NewTable()
 	L.SetTable(data, lua.LString("index"), index)
@@ -99,9 +99,7 @@ func DoESOps(input map[string]interface{}, action string, rule *global.Rule) ([]
 	L.SetGlobal(_globalROW, row)
 	L.SetGlobal(_globalACT, lua.LString(action))
 
-	funcFromProto := L.NewFunctionFromProto(rule.LuaProto)
-	L.Push(funcFromProto)
-	err := L.PCall(0, lua.MultRet, nil)
+	err := callRule(L, rule)
 	if err != nil {
 		return nil, err
 	}
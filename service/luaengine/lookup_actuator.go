@@ -0,0 +1,49 @@
+/*
+ * Copyright 2020-2021 the original author(https://github.com/wj596)
+ *
+ * <p>
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * </p>
+ */
+package luaengine
+
+import (
+	"github.com/yuin/gopher-lua"
+
+	"go-mysql-transfer/service/lookup"
+)
+
+func lookupModule(L *lua.LState) int {
+	t := L.NewTable()
+	L.SetFuncs(t, _lookupModuleApi)
+	L.Push(t)
+	return 1
+}
+
+var _lookupModuleApi = map[string]lua.LGFunction{
+	"get": lookupGet,
+}
+
+// lookupGet 按键查找规则lookups中加载的参考表，不存在时返回nil
+func lookupGet(L *lua.LState) int {
+	name := L.CheckString(1)
+	key := lvToInterface(L.CheckAny(2), false)
+
+	value, ok := lookup.Get(name, key)
+	if !ok {
+		L.Push(lua.LNil)
+		return 1
+	}
+	L.Push(interfaceToLv(value))
+	return 1
+}
@@ -45,8 +45,8 @@ var _mongoModuleApi = map[string]lua.LGFunction{
 }
 
 func mongoInsert(L *lua.LState) int {
-	collection := L.CheckAny(1)
-	table := L.CheckAny(2)
+	collection := checkKey(L, 1)
+	table := checkDocument(L, 2)
 
 	data := L.NewTable()
 	L.SetTable(data, lua.LString("collection"), collection)
@@ -59,9 +59,9 @@ func mongoInsert(L *lua.LState) int {
 }
 
 func mongoUpdate(L *lua.LState) int {
-	collection := L.CheckAny(1)
-	id := L.CheckAny(2)
-	table := L.CheckAny(3)
+	collection := checkKey(L, 1)
+	id := checkKey(L, 2)
+	table := checkDocument(L, 3)
 
 	data := L.NewTable()
 	L.SetTable(data, lua.LString("collection"), collection)
@@ -75,9 +75,9 @@ func mongoUpdate(L *lua.LState) int {
 }
 
 func mongoUpsert(L *lua.LState) int {
-	collection := L.CheckAny(1)
-	id := L.CheckAny(2)
-	table := L.CheckAny(3)
+	collection := checkKey(L, 1)
+	id := checkKey(L, 2)
+	table := checkDocument(L, 3)
 
 	data := L.NewTable()
 	L.SetTable(data, lua.LString("collection"), collection)
@@ -91,8 +91,8 @@ func mongoUpsert(L *lua.LState) int {
 }
 
 func mongoDelete(L *lua.LState) int {
-	collection := L.CheckAny(1)
-	id := L.CheckAny(2)
+	collection := checkKey(L, 1)
+	id := checkKey(L, 2)
 
 	data := L.NewTable()
 	L.SetTable(data, lua.LString("collection"), collection)
@@ -115,9 +115,7 @@ func DoMongoOps(input map[string]interface{}, action string, rule *global.Rule)
 	L.SetGlobal(_globalROW, row)
 	L.SetGlobal(_globalACT, lua.LString(action))
 
-	funcFromProto := L.NewFunctionFromProto(rule.LuaProto)
-	L.Push(funcFromProto)
-	err := L.PCall(0, lua.MultRet, nil)
+	err := callRule(L, rule)
 	if err != nil {
 		return nil, err
 	}
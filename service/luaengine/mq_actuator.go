@@ -24,6 +24,8 @@ import (
 	"go-mysql-transfer/model"
 )
 
+const _globalDIFF = "___DIFF___"
+
 func mqModule(L *lua.LState) int {
 	t := L.NewTable()
 	L.SetFuncs(t, _mqModuleApi)
@@ -34,20 +36,27 @@ func mqModule(L *lua.LState) int {
 var _mqModuleApi = map[string]lua.LGFunction{
 	"rawRow":    rawRow,
 	"rawAction": rawAction,
+	"rawDiff":   rawDiff,
 
 	"SEND": msgSend,
 }
 
 func msgSend(L *lua.LState) int {
-	topic := L.CheckAny(1)
-	msg := L.CheckAny(2)
+	topic := checkKey(L, 1)
+	msg := checkValue(L, 2)
 
 	ret := L.GetGlobal(_globalRET)
 	L.SetTable(ret, msg, topic)
 	return 0
 }
 
-func DoMQOps(input map[string]interface{}, action string, rule *global.Rule) ([]*model.MQRespond, error) {
+func rawDiff(L *lua.LState) int {
+	diff := L.GetGlobal(_globalDIFF)
+	L.Push(diff)
+	return 1
+}
+
+func DoMQOps(input map[string]interface{}, diff map[string]map[string]interface{}, action string, rule *global.Rule) ([]*model.MQRespond, error) {
 	L := _pool.Get()
 	defer _pool.Put(L)
 
@@ -58,9 +67,15 @@ func DoMQOps(input map[string]interface{}, action string, rule *global.Rule) ([]
 	L.SetGlobal(_globalROW, row)
 	L.SetGlobal(_globalACT, lua.LString(action))
 
-	funcFromProto := L.NewFunctionFromProto(rule.LuaProto)
-	L.Push(funcFromProto)
-	err := L.PCall(0, lua.MultRet, nil)
+	diffTable := L.NewTable()
+	for column, values := range diff {
+		t := L.NewTable()
+		paddingTable(L, t, values)
+		L.SetTable(diffTable, lua.LString(column), t)
+	}
+	L.SetGlobal(_globalDIFF, diffTable)
+
+	err := callRule(L, rule)
 	if err != nil {
 		return nil, err
 	}
@@ -64,7 +64,7 @@ func rawOldRow(L *lua.LState) int {
 
 func redisSet(L *lua.LState) int {
 	key := L.CheckString(1)
-	val := L.CheckAny(2)
+	val := checkValue(L, 2)
 	ret := L.GetGlobal(_globalRET)
 	L.SetTable(ret, lua.LString("insert_1_"+key), val)
 	return 0
@@ -79,8 +79,8 @@ func redisDel(L *lua.LState) int {
 
 func redisHSet(L *lua.LState) int {
 	key := L.CheckString(1)
-	field := L.CheckAny(2)
-	val := L.CheckAny(3)
+	field := checkKey(L, 2)
+	val := checkValue(L, 3)
 
 	hash := L.NewTable()
 	L.SetTable(hash, lua.LString("key"), lua.LString(key))
@@ -93,8 +93,8 @@ func redisHSet(L *lua.LState) int {
 }
 
 func redisHDel(L *lua.LState) int {
-	key := L.CheckAny(1)
-	field := L.CheckAny(2)
+	key := checkKey(L, 1)
+	field := checkKey(L, 2)
 
 	hash := L.NewTable()
 	L.SetTable(hash, lua.LString("key"), key)
@@ -108,7 +108,7 @@ func redisHDel(L *lua.LState) int {
 
 func redisRPush(L *lua.LState) int {
 	key := L.CheckString(1)
-	val := L.CheckAny(2)
+	val := checkValue(L, 2)
 
 	ret := L.GetGlobal(_globalRET)
 	L.SetTable(ret, lua.LString("insert_3_"+key), val)
@@ -117,7 +117,7 @@ func redisRPush(L *lua.LState) int {
 
 func redisLRem(L *lua.LState) int {
 	key := L.CheckString(1)
-	val := L.CheckAny(2)
+	val := checkValue(L, 2)
 
 	ret := L.GetGlobal(_globalRET)
 	L.SetTable(ret, lua.LString("delete_3_"+key), val)
@@ -126,7 +126,7 @@ func redisLRem(L *lua.LState) int {
 
 func redisSAdd(L *lua.LState) int {
 	key := L.CheckString(1)
-	val := L.CheckAny(2)
+	val := checkValue(L, 2)
 
 	ret := L.GetGlobal(_globalRET)
 	L.SetTable(ret, lua.LString("insert_4_"+key), val)
@@ -135,7 +135,7 @@ func redisSAdd(L *lua.LState) int {
 
 func redisSRem(L *lua.LState) int {
 	key := L.CheckString(1)
-	val := L.CheckAny(2)
+	val := checkValue(L, 2)
 
 	ret := L.GetGlobal(_globalRET)
 	L.SetTable(ret, lua.LString("delete_4_"+key), val)
@@ -144,8 +144,8 @@ func redisSRem(L *lua.LState) int {
 
 func redisZAdd(L *lua.LState) int {
 	key := L.CheckString(1)
-	score := L.CheckAny(2)
-	val := L.CheckAny(3)
+	score := checkScore(L, 2)
+	val := checkValue(L, 3)
 
 	hash := L.NewTable()
 	L.SetTable(hash, lua.LString("key"), lua.LString(key))
@@ -159,7 +159,7 @@ func redisZAdd(L *lua.LState) int {
 
 func redisZRem(L *lua.LState) int {
 	key := L.CheckString(1)
-	val := L.CheckAny(2)
+	val := checkValue(L, 2)
 
 	ret := L.GetGlobal(_globalRET)
 	L.SetTable(ret, lua.LString("delete_5_"+key), val)
@@ -183,9 +183,7 @@ func DoRedisOps(input map[string]interface{}, previous map[string]interface{}, a
 		L.SetGlobal(_globalOLDROW, oldRow)
 	}
 
-	funcFromProto := L.NewFunctionFromProto(rule.LuaProto)
-	L.Push(funcFromProto)
-	err := L.PCall(0, lua.MultRet, nil)
+	err := callRule(L, rule)
 	if err != nil {
 		return nil, err
 	}
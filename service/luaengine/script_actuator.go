@@ -28,9 +28,7 @@ func DoScript(input map[string]interface{}, action string, rule *global.Rule) er
 	L.SetGlobal(_globalROW, row)
 	L.SetGlobal(_globalACT, lua.LString(action))
 
-	funcFromProto := L.NewFunctionFromProto(rule.LuaProto)
-	L.Push(funcFromProto)
-	err := L.PCall(0, lua.MultRet, nil)
+	err := callRule(L, rule)
 	if err != nil {
 		return err
 	}
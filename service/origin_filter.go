@@ -0,0 +1,59 @@
+/*
+ * Copyright 2020-2021 the original author(https://github.com/wj596)
+ *
+ * <p>
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * </p>
+ */
+package service
+
+import (
+	"regexp"
+
+	"github.com/siddontang/go-mysql/canal"
+
+	"go-mysql-transfer/global"
+)
+
+// originFilter 按来源忽略行数据：skip_server_ids中的server_id产生的，配置了channel时不是该复制通道源库产生的，
+// 或事务中先写入了marker_table的(该事务剩余的行数据均忽略，直到事务提交)
+type originFilter struct {
+	marked bool
+}
+
+func (f *originFilter) skip(e *canal.RowsEvent) bool {
+	if e.Header != nil && global.Cfg().SkipServerID(e.Header.ServerID) {
+		return true
+	}
+	if id := global.ChannelServerID(); id != 0 && e.Header != nil && e.Header.ServerID != id {
+		return true
+	}
+	if global.Cfg().IsMarkerTable(e.Table.Schema, e.Table.Name) {
+		f.marked = true
+		return true
+	}
+	return f.marked
+}
+
+// reset 事务提交或DDL后清除标记
+func (f *originFilter) reset() {
+	f.marked = false
+}
+
+// markerTableRegex 标记表须加入canal监听的表，才能收到其行数据
+func markerTableRegex() []string {
+	if global.Cfg().MarkerTable == "" {
+		return nil
+	}
+	return []string{regexp.QuoteMeta(global.Cfg().MarkerTable)}
+}
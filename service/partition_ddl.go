@@ -0,0 +1,102 @@
+/*
+ * Copyright 2020-2021 the original author(https://github.com/wj596)
+ *
+ * <p>
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * </p>
+ */
+package service
+
+import (
+	"github.com/juju/errors"
+	"github.com/pingcap/parser"
+	"github.com/pingcap/parser/ast"
+	"github.com/siddontang/go-mysql/replication"
+
+	"go-mysql-transfer/global"
+	"go-mysql-transfer/metrics"
+	"go-mysql-transfer/util/logs"
+)
+
+// partitionChange 清空、删除或交换分区的表，这些语句以DDL记录在binlog中，不产生被删除或移动的行的行事件
+type partitionChange struct {
+	schema    string
+	table     string
+	operation string
+}
+
+// partitionChanges 解析语句中清空、删除、交换分区的表，交换分区时两个表的数据都发生变化；
+// 分区表的行事件、mysqldump导出均使用逻辑表名，其余分区维护语句(ADD、REORGANIZE、COALESCE等)不改变数据
+func partitionChanges(schemaName, query string) []partitionChange {
+	stmts, _, err := parser.New().Parse(query, "", "")
+	if err != nil {
+		return nil
+	}
+
+	var changes []partitionChange
+	for _, stmt := range stmts {
+		alter, ok := stmt.(*ast.AlterTableStmt)
+		if !ok {
+			continue
+		}
+		for _, spec := range alter.Specs {
+			var operation string
+			switch spec.Tp {
+			case ast.AlterTableTruncatePartition:
+				operation = "truncate partition"
+			case ast.AlterTableDropPartition:
+				operation = "drop partition"
+			case ast.AlterTableExchangePartition:
+				operation = "exchange partition"
+			default:
+				continue
+			}
+			changes = append(changes, partitionChange{
+				schema:    schemaOf(alter.Table, schemaName),
+				table:     alter.Table.Name.String(),
+				operation: operation,
+			})
+			if spec.NewTable != nil {
+				changes = append(changes, partitionChange{
+					schema:    schemaOf(spec.NewTable, schemaName),
+					table:     spec.NewTable.Name.String(),
+					operation: operation,
+				})
+			}
+		}
+	}
+	return changes
+}
+
+func schemaOf(table *ast.TableName, schemaName string) string {
+	if table.Schema.String() != "" {
+		return table.Schema.String()
+	}
+	return schemaName
+}
+
+// checkPartitionDDL 监听表的分区被清空、删除或交换时，下游不会收到相应的删除或插入，按partition_ddl_policy记录警告或停止同步
+func checkPartitionDDL(e *replication.QueryEvent) error {
+	for _, change := range partitionChanges(string(e.Schema), string(e.Query)) {
+		ruleKey := global.RuleKey(change.schema, change.table)
+		if !global.RuleInsExist(ruleKey) {
+			continue
+		}
+		metrics.IncPartitionDDL(ruleKey)
+		if global.Cfg().PartitionDDLPolicy == global.PartitionDDLHalt {
+			return errors.Errorf("%s of %s.%s changed rows without row events, sync halted: %s", change.operation, change.schema, change.table, string(e.Query))
+		}
+		logs.Warnf("%s of %s.%s changed rows without row events, the destination may be inconsistent: %s", change.operation, change.schema, change.table, string(e.Query))
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+/*
+ * Copyright 2020-2021 the original author(https://github.com/wj596)
+ *
+ * <p>
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * </p>
+ */
+package service
+
+import (
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"go-mysql-transfer/global"
+	"go-mysql-transfer/metrics"
+	"go-mysql-transfer/service/endpoint"
+	"go-mysql-transfer/util/logs"
+)
+
+// lookupHost 解析主机名，测试中替换
+var lookupHost = net.LookupHost
+
+// recycleEndpoint 接收端连接建立超过conn_max_lifetime、或dns_refresh_interval检测到地址解析结果变化时，关闭并重新连接，
+// 之后的写入重新解析地址、连接到当前的后端；在监听协程中写入批次前调用，不与写入并发
+func (s *handler) recycleEndpoint() {
+	var reason string
+	if _transferService.dnsChanged.CAS(true, false) {
+		reason = metrics.RecycleDns
+	} else if lifetime := time.Duration(global.Cfg().ConnMaxLifetime) * time.Second; lifetime > 0 && time.Since(metrics.EndpointConnectedTime()) >= lifetime {
+		reason = metrics.RecycleLifetime
+	}
+	if reason == "" {
+		return
+	}
+
+	err := endpoint.Recycle(_transferService.endpoint)
+	// 失败时由写入的错误处理(endpoint_retry_times重新连接或按endpoint_unavailable_policy处理)
+	metrics.SetEndpointConnected(time.Now())
+	if err != nil {
+		logs.Errorf("recycle destination connections (%s) error: %s", reason, err.Error())
+		return
+	}
+	metrics.IncEndpointRecycle(reason)
+	logs.Infof("destination connections recycled (%s)", reason)
+}
+
+// checkDns 重新解析接收端地址中的主机名，与上次的结果不同时标记重新连接；resolved为上次的结果，仅在startLoop中使用
+func (s *TransferService) checkDns(resolved map[string]string) {
+	for _, addr := range global.Cfg().EndpointAddrs() {
+		host := endpointHost(addr)
+		if host == "" || net.ParseIP(host) != nil {
+			continue
+		}
+		ips, err := lookupHost(host)
+		if err != nil {
+			logs.Warnf("resolve destination host %s error: %s", host, err.Error())
+			continue
+		}
+		sort.Strings(ips)
+		current := strings.Join(ips, ",")
+		if previous, ok := resolved[host]; ok && previous != current {
+			logs.Infof("destination host %s resolved to %s (was %s), recycle connections", host, current, previous)
+			s.dnsChanged.Store(true)
+		}
+		resolved[host] = current
+	}
+}
+
+// endpointHost 从host:port或URL(如http://es:9200、amqp://guest:guest@mq:5672/)中取主机名
+func endpointHost(addr string) string {
+	if strings.Contains(addr, "://") {
+		u, err := url.Parse(addr)
+		if err != nil {
+			return ""
+		}
+		return u.Hostname()
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
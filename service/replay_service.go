@@ -0,0 +1,285 @@
+/*
+ * Copyright 2020-2021 the original author(https://github.com/wj596)
+ *
+ * <p>
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * </p>
+ */
+package service
+
+import (
+	"regexp"
+	"strconv"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/mysql"
+	"go.uber.org/atomic"
+
+	"go-mysql-transfer/global"
+	"go-mysql-transfer/model"
+	"go-mysql-transfer/service/endpoint"
+	"go-mysql-transfer/util/logs"
+)
+
+var _replayPositionRegexp = regexp.MustCompile(`^(.+\.\d+):(\d+)$`)
+
+// ReplayResult 回放结果
+type ReplayResult struct {
+	Transactions int64
+	Rows         int64
+	End          mysql.Position
+}
+
+// ReplayService 将指定区间的binlog事件重新写入接收端，不读取、不保存同步位置
+type ReplayService struct {
+	canal    *canal.Canal
+	endpoint endpoint.Endpoint
+}
+
+func NewReplayService() *ReplayService {
+	return &ReplayService{}
+}
+
+// Run 回放from之后、to之前(含)的事务；from、to为binlog位置(如mysql-bin.000001:4)或GTID集合
+func (s *ReplayService) Run(from, to string) (*ReplayResult, error) {
+	fromPos, fromGTID, err := parseReplayPoint(from)
+	if err != nil {
+		return nil, errors.Annotate(err, "replay_from")
+	}
+	toPos, toGTID, err := parseReplayPoint(to)
+	if err != nil {
+		return nil, errors.Annotate(err, "replay_to")
+	}
+	if (fromGTID == nil) != (toGTID == nil) {
+		return nil, errors.New("replay_from and replay_to must both be positions or GTID sets")
+	}
+	if fromGTID == nil && toPos.Compare(fromPos) <= 0 {
+		return nil, errors.New("replay_to must be after replay_from")
+	}
+
+	canalCfg := canal.NewDefaultConfig()
+	canalCfg.Addr = global.Cfg().Addr
+	canalCfg.User = global.Cfg().User
+	canalCfg.Password = global.Cfg().Password
+	canalCfg.Charset = global.Cfg().Charset
+	canalCfg.Flavor = global.Cfg().Flavor
+	canalCfg.ServerID = global.Cfg().SlaveID + 1 // 与增量同步的复制连接区分
+	canalCfg.Dump.ExecutionPath = ""
+	for _, rc := range global.Cfg().RuleConfigs {
+		canalCfg.IncludeTableRegex = append(canalCfg.IncludeTableRegex, rc.Schema+"\\."+rc.Table)
+	}
+	canalCfg.IncludeTableRegex = append(canalCfg.IncludeTableRegex, markerTableRegex()...)
+
+	c, err := canal.NewCanal(canalCfg)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	s.canal = c
+
+	if err := completeStockRules(s.canal); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if toGTID == nil {
+		if err := s.checkEnd(toPos); err != nil {
+			return nil, err
+		}
+	}
+
+	enp := endpoint.NewEndpoint(s.canal)
+	if err := enp.Connect(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	s.endpoint = enp
+
+	h := &replayHandler{
+		canal:    s.canal,
+		endpoint: s.endpoint,
+		endPos:   toPos,
+		endGTID:  toGTID,
+		finished: make(chan error, 2),
+	}
+	s.canal.SetEventHandler(h)
+
+	go func() {
+		var err error
+		if fromGTID != nil {
+			logs.Infof("replay from gtid(%s)", fromGTID.String())
+			err = s.canal.StartFromGTID(fromGTID)
+		} else {
+			logs.Infof("replay from position(%s %d)", fromPos.Name, fromPos.Pos)
+			err = s.canal.RunFrom(fromPos)
+		}
+		if err == nil {
+			err = errors.New("canal closed before replay finished")
+		}
+		h.finished <- err
+	}()
+
+	err = <-h.finished
+	h.done.Store(true)
+	return &ReplayResult{
+		Transactions: h.transactions,
+		Rows:         h.rows,
+		End:          h.last,
+	}, err
+}
+
+// checkEnd 结束位置不能超过源库当前的位置，否则回放不会结束
+func (s *ReplayService) checkEnd(end mysql.Position) error {
+	rr, err := s.canal.Execute("SHOW MASTER STATUS")
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if rr.RowNumber() == 0 {
+		return errors.New("binlog is not enabled")
+	}
+	name, _ := rr.GetString(0, 0)
+	pos, _ := rr.GetInt(0, 1)
+	current := mysql.Position{Name: name, Pos: uint32(pos)}
+	if end.Compare(current) > 0 {
+		return errors.Errorf("replay_to %s is after the current master position %s", end, current)
+	}
+	return nil
+}
+
+func (s *ReplayService) Close() {
+	if s.canal != nil {
+		s.canal.Close()
+	}
+	if s.endpoint != nil {
+		s.endpoint.Close()
+	}
+}
+
+// parseReplayPoint 解析binlog位置(文件名:位置)，否则按GTID集合解析
+func parseReplayPoint(v string) (mysql.Position, mysql.GTIDSet, error) {
+	if v == "" {
+		return mysql.Position{}, nil, errors.New("empty position not allowed")
+	}
+	if m := _replayPositionRegexp.FindStringSubmatch(v); m != nil {
+		pos, err := strconv.ParseUint(m[2], 10, 32)
+		if err != nil {
+			return mysql.Position{}, nil, errors.Trace(err)
+		}
+		return mysql.Position{Name: m[1], Pos: uint32(pos)}, nil, nil
+	}
+	set, err := mysql.ParseGTIDSet(global.Cfg().Flavor, v)
+	if err != nil {
+		return mysql.Position{}, nil, errors.Trace(err)
+	}
+	return mysql.Position{}, set, nil
+}
+
+// replayHandler 以事务为单位写入接收端，到达结束位置后停止
+type replayHandler struct {
+	canal.DummyEventHandler
+
+	canal    *canal.Canal
+	endpoint endpoint.Endpoint
+	endPos   mysql.Position
+	endGTID  mysql.GTIDSet
+
+	pending      []*model.RowRequest // 当前事务的数据
+	filter       originFilter
+	gtid         string // 当前事务的GTID
+	batch        []*model.RowRequest
+	transactions int64
+	rows         int64
+	last         mysql.Position
+
+	done     atomic.Bool
+	finished chan error
+}
+
+func (h *replayHandler) OnTableChanged(schema, table string) error {
+	return updateRuleTable(h.canal, schema, table)
+}
+
+func (h *replayHandler) OnRow(e *canal.RowsEvent) error {
+	if h.done.Load() || h.filter.skip(e) {
+		return nil
+	}
+	ruleKey := global.RuleKey(e.Table.Schema, e.Table.Name)
+	rule, exist := global.RuleIns(ruleKey)
+	if !exist {
+		return nil
+	}
+	requests := rowRequests(rule, ruleKey, e)
+	markPosition(requests, h.canal.SyncedPosition().Name, e, h.gtid)
+	h.pending = append(h.pending, requests...)
+	return nil
+}
+
+func (h *replayHandler) OnGTID(gtid mysql.GTIDSet) error {
+	h.gtid = gtid.String()
+	return nil
+}
+
+func (h *replayHandler) OnPosSynced(pos mysql.Position, set mysql.GTIDSet, force bool) error {
+	h.filter.reset()
+	h.gtid = ""
+	if h.done.Load() {
+		return nil
+	}
+
+	// 按位置结束时，提交位置在结束位置之后的事务不回放
+	if h.endGTID == nil && pos.Compare(h.endPos) > 0 {
+		h.pending = nil
+		h.finish(h.flush())
+		return nil
+	}
+
+	if len(h.pending) > 0 {
+		h.pending = mergeDeleteInsert(h.pending)
+		h.batch = append(h.batch, h.pending...)
+		h.rows += int64(len(h.pending))
+		h.transactions++
+		h.pending = nil
+	}
+	h.last = pos
+	if int64(len(h.batch)) >= global.Cfg().BulkSize {
+		if err := h.flush(); err != nil {
+			h.finish(err)
+			return nil
+		}
+	}
+
+	if h.endGTID != nil {
+		if set != nil && set.Contain(h.endGTID) {
+			h.finish(h.flush())
+		}
+	} else if pos.Compare(h.endPos) == 0 {
+		h.finish(h.flush())
+	}
+	return nil
+}
+
+func (h *replayHandler) flush() error {
+	if len(h.batch) == 0 {
+		return nil
+	}
+	// 不传递位置，接收端不记录回放数据的位置
+	err := h.endpoint.Consume(mysql.Position{}, h.batch)
+	h.batch = h.batch[0:0]
+	return err
+}
+
+func (h *replayHandler) finish(err error) {
+	h.done.Store(true)
+	h.finished <- err
+}
+
+func (h *replayHandler) String() string {
+	return "ReplayHandler"
+}
@@ -0,0 +1,214 @@
+/*
+ * Copyright 2020-2021 the original author(https://github.com/wj596)
+ *
+ * <p>
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * </p>
+ */
+package service
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/siddontang/go-mysql/mysql"
+
+	"go-mysql-transfer/global"
+	"go-mysql-transfer/model"
+	"go-mysql-transfer/util/logs"
+)
+
+// rulePositions 开启per_rule_position时记录各规则已被接收端确认的位置：
+// 一批数据按规则分别写入，部分规则失败时已写入的规则重试时不再写入，其位置领先于全局位置时单独保存；
+// 全局位置在所有规则都写入后才保存，即各规则位置的最小值，重新同步时从全局位置开始，跳过规则在其位置之前的数据
+type rulePositions struct {
+	lock  sync.RWMutex
+	saved map[string]mysql.Position // 领先于全局位置的规则位置
+
+	boundary mysql.Position  // 最近一个事务结束的位置，仅监听协程访问
+	acked    map[string]bool // 待写入的数据中已被接收端确认的规则，仅监听协程访问
+}
+
+// loadRulePositions 读取已保存的规则位置，不领先于全局位置的不再使用；
+// 与全局位置不属于同一组binlog文件的(如RESET MASTER、切换主库后重新设置了位置)无法比较，清除
+func loadRulePositions(from mysql.Position) *rulePositions {
+	r := &rulePositions{
+		saved: make(map[string]mysql.Position),
+		acked: make(map[string]bool),
+	}
+	for _, ruleKey := range global.RuleKeyList() {
+		pos, err := _transferService.positionDao.GetByRule(ruleKey)
+		if err != nil {
+			logs.Errorf("get position of rule %s error %v", ruleKey, err)
+			continue
+		}
+		if pos.Name == "" {
+			continue
+		}
+		if !sameBinlogSeries(pos, from) {
+			logs.Warnf("rule %s position %s is not comparable with position %s, discarded", ruleKey, pos, from)
+			r.clear(ruleKey)
+			continue
+		}
+		if pos.Compare(from) > 0 {
+			logs.Infof("rule %s is ahead at position %s, skip its rows before it", ruleKey, pos)
+			r.saved[ruleKey] = pos
+		}
+	}
+	return r
+}
+
+// sameBinlogSeries 规则位置是否可与全局位置比较：binlog文件名称前缀相同，且至多领先一个文件(规则位置只领先一批数据)
+func sameBinlogSeries(pos, from mysql.Position) bool {
+	prefix, index, ok := splitBinlogName(pos.Name)
+	fromPrefix, fromIndex, fromOk := splitBinlogName(from.Name)
+	if !ok || !fromOk || prefix != fromPrefix {
+		return false
+	}
+	return index == fromIndex || index == fromIndex+1
+}
+
+// splitBinlogName 拆分binlog文件名称，如mysql-bin.000003为mysql-bin和3
+func splitBinlogName(name string) (string, int, bool) {
+	i := strings.LastIndex(name, ".")
+	if i < 0 {
+		return "", 0, false
+	}
+	index, err := strconv.Atoi(name[i+1:])
+	if err != nil {
+		return "", 0, false
+	}
+	return name[:i], index, true
+}
+
+// discard 不是从保存的位置继续同步时(全量导出、从主库当前位置或first_run_position开始)，清除所有规则位置
+func (r *rulePositions) discard() {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for ruleKey := range r.saved {
+		logs.Infof("rule %s position %s discarded, not streaming from the stored position", ruleKey, r.saved[ruleKey])
+		r.clear(ruleKey)
+		delete(r.saved, ruleKey)
+	}
+}
+
+// clear 清除已保存的规则位置
+func (r *rulePositions) clear(ruleKey string) {
+	if err := _transferService.positionDao.SaveByRule(ruleKey, mysql.Position{}); err != nil {
+		logs.Errorf("clear position of rule %s error %v", ruleKey, err)
+	}
+}
+
+// acknowledged 该规则在此位置的行事件已被接收端确认
+func (r *rulePositions) acknowledged(ruleKey string, name string, logPos uint32) bool {
+	if r == nil {
+		return false
+	}
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	pos, ok := r.saved[ruleKey]
+	return ok && mysql.Position{Name: name, Pos: logPos}.Compare(pos) < 0
+}
+
+// mark 读取到事务结束的位置
+func (r *rulePositions) mark(pos mysql.Position) {
+	if r != nil {
+		r.boundary = pos
+	}
+}
+
+// advance 全局位置保存后，不再领先的规则位置无需保留
+func (r *rulePositions) advance(pos mysql.Position) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for ruleKey, saved := range r.saved {
+		if saved.Compare(pos) <= 0 || !sameBinlogSeries(saved, pos) {
+			delete(r.saved, ruleKey)
+		}
+	}
+}
+
+// reset 一批数据处理完成(写入、暂存到本地日志或丢弃)
+func (r *rulePositions) reset() {
+	if r != nil && len(r.acked) > 0 {
+		r.acked = make(map[string]bool)
+	}
+}
+
+// ack 规则的数据已被接收端确认；都在最近一个事务结束之前时保存该位置
+func (r *rulePositions) ack(ruleKey string, rows []*model.RowRequest) {
+	r.acked[ruleKey] = true
+	if r.boundary.Name == "" {
+		return
+	}
+	for _, row := range rows {
+		if row.LogName != "" && (mysql.Position{Name: row.LogName, Pos: row.LogPos}).Compare(r.boundary) > 0 {
+			return // 包含未结束的事务
+		}
+	}
+
+	r.lock.RLock()
+	saved, ok := r.saved[ruleKey]
+	r.lock.RUnlock()
+	if ok && saved.Compare(r.boundary) >= 0 {
+		return
+	}
+	if err := _transferService.positionDao.SaveByRule(ruleKey, r.boundary); err != nil {
+		logs.Errorf("save position of rule %s error %v", ruleKey, err)
+		return
+	}
+	r.lock.Lock()
+	r.saved[ruleKey] = r.boundary
+	r.lock.Unlock()
+}
+
+// consumeByRule 按规则分别写入，一个规则失败时继续写入其他规则，返回第一个错误；已确认的规则重试时跳过
+func (s *handler) consumeByRule(from mysql.Position, requests []*model.RowRequest) error {
+	var order []string
+	groups := make(map[string][]*model.RowRequest)
+	for _, req := range requests {
+		if s.rulePos.acked[req.RuleKey] {
+			continue
+		}
+		if _, ok := groups[req.RuleKey]; !ok {
+			order = append(order, req.RuleKey)
+		}
+		groups[req.RuleKey] = append(groups[req.RuleKey], req)
+	}
+
+	var first error
+	var done []string
+	for _, ruleKey := range order {
+		if err := s.consumeRows(from, groups[ruleKey]); err != nil {
+			if first == nil {
+				first = err
+			}
+			continue
+		}
+		done = append(done, ruleKey)
+	}
+	// 全部写入时随后保存全局位置，不需要单独保存
+	if first != nil {
+		for _, ruleKey := range done {
+			s.rulePos.ack(ruleKey, groups[ruleKey])
+		}
+	}
+	return first
+}
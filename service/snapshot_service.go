@@ -0,0 +1,358 @@
+/*
+ * Copyright 2020-2021 the original author(https://github.com/wj596)
+ *
+ * <p>
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * </p>
+ */
+package service
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/client"
+
+	"go-mysql-transfer/global"
+	"go-mysql-transfer/model"
+	"go-mysql-transfer/service/endpoint"
+	"go-mysql-transfer/util/files"
+	"go-mysql-transfer/util/logs"
+)
+
+const (
+	SnapshotTargetFile     = "file"
+	SnapshotTargetEndpoint = "endpoint"
+)
+
+const (
+	SnapshotStateRunning  = "running"
+	SnapshotStateFinished = "finished"
+	SnapshotStateFailed   = "failed"
+)
+
+var (
+	_lockOfSnapshot sync.RWMutex
+	_lastSnapshot   *SnapshotResult
+)
+
+type SnapshotTable struct {
+	RuleKey string `json:"rule"`
+	File    string `json:"file,omitempty"`
+	Rows    int64  `json:"rows"`
+}
+
+type SnapshotResult struct {
+	Name   string           `json:"binlog_name"`
+	Pos    uint32           `json:"binlog_pos"`
+	GTID   string           `json:"gtid,omitempty"`
+	Target string           `json:"target"`
+	State  string           `json:"state"`
+	Error  string           `json:"error,omitempty"`
+	Tables []*SnapshotTable `json:"tables"`
+}
+
+// Snapshot 以一致性读导出规则对应表的当前数据到文件或接收端，返回快照对应的binlog位置
+// 下游先加载快照，再从返回的位置开始订阅，即可实现先全量后增量
+// 位置确定后即返回，数据在后台导出，进度通过LastSnapshot查看
+func (s *TransferService) Snapshot(ruleKeys []string, target string) (*SnapshotResult, error) {
+	rules := make([]*global.Rule, 0, len(ruleKeys))
+	for _, key := range ruleKeys {
+		rule, ok := global.RuleIns(key)
+		if !ok {
+			return nil, errors.Errorf("rule %s not found", key)
+		}
+		rules = append(rules, rule)
+	}
+	if len(rules) == 0 {
+		return nil, errors.New("empty rules not allowed")
+	}
+	if target != SnapshotTargetFile && target != SnapshotTargetEndpoint {
+		return nil, errors.Errorf("unsupported snapshot target %s", target)
+	}
+
+	_lockOfSnapshot.Lock()
+	defer _lockOfSnapshot.Unlock()
+	if _lastSnapshot != nil && _lastSnapshot.State == SnapshotStateRunning {
+		return nil, errors.New("another snapshot is running")
+	}
+
+	cfg := global.Cfg()
+	conn, err := client.Connect(cfg.Addr, cfg.User, cfg.Password, "")
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err := conn.SetCharset(cfg.Charset); err != nil {
+		conn.Close()
+		return nil, errors.Trace(err)
+	}
+
+	// 全局读锁下开启一致性快照并读取位置，确保快照与位置对应
+	if _, err := conn.Execute("FLUSH TABLES WITH READ LOCK"); err != nil {
+		conn.Close()
+		return nil, errors.Annotate(err, "snapshot requires RELOAD privilege")
+	}
+	if _, err := conn.Execute("START TRANSACTION WITH CONSISTENT SNAPSHOT"); err != nil {
+		conn.Close()
+		return nil, errors.Trace(err)
+	}
+	result, err := snapshotPosition(conn)
+	if _, err := conn.Execute("UNLOCK TABLES"); err != nil {
+		conn.Close()
+		return nil, errors.Trace(err)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, errors.Trace(err)
+	}
+
+	var sink snapshotSink
+	if target == SnapshotTargetEndpoint {
+		// 使用独立的接收端连接，不与增量同步共用
+		enp := endpoint.NewEndpoint(s.canal)
+		if err := enp.Connect(); err != nil {
+			conn.Close()
+			return nil, errors.Trace(err)
+		}
+		sink = &endpointSnapshotSink{endpoint: enp}
+	} else {
+		dir := filepath.Join(cfg.DataDir, "snapshot")
+		if err := files.MkdirIfNecessary(dir); err != nil {
+			conn.Close()
+			return nil, errors.Trace(err)
+		}
+		sink = &fileSnapshotSink{dir: dir}
+	}
+
+	result.Target = target
+	result.State = SnapshotStateRunning
+	_lastSnapshot = result
+	logs.Infof("snapshot at position(%s %d) started", result.Name, result.Pos)
+
+	go func() {
+		defer conn.Close()
+		defer sink.release()
+
+		for _, rule := range rules {
+			table := &SnapshotTable{
+				RuleKey: global.RuleKey(rule.Schema, rule.Table),
+			}
+			_lockOfSnapshot.Lock()
+			result.Tables = append(result.Tables, table)
+			_lockOfSnapshot.Unlock()
+
+			if err := snapshotTable(conn, rule, table, sink); err != nil {
+				logs.Errorf("snapshot %s error: %s", table.RuleKey, errors.ErrorStack(err))
+				_lockOfSnapshot.Lock()
+				result.State = SnapshotStateFailed
+				result.Error = err.Error()
+				_lockOfSnapshot.Unlock()
+				return
+			}
+		}
+		conn.Commit()
+
+		_lockOfSnapshot.Lock()
+		result.State = SnapshotStateFinished
+		_lockOfSnapshot.Unlock()
+		logs.Infof("snapshot at position(%s %d) finished", result.Name, result.Pos)
+	}()
+
+	return result.clone(), nil
+}
+
+// LastSnapshot 最近一次快照的状态
+func LastSnapshot() *SnapshotResult {
+	_lockOfSnapshot.RLock()
+	defer _lockOfSnapshot.RUnlock()
+
+	if _lastSnapshot == nil {
+		return nil
+	}
+	return _lastSnapshot.clone()
+}
+
+func (r *SnapshotResult) clone() *SnapshotResult {
+	c := *r
+	c.Tables = make([]*SnapshotTable, 0, len(r.Tables))
+	for _, t := range r.Tables {
+		tt := *t
+		c.Tables = append(c.Tables, &tt)
+	}
+	return &c
+}
+
+func snapshotPosition(conn *client.Conn) (*SnapshotResult, error) {
+	rr, err := conn.Execute("SHOW MASTER STATUS")
+	if err != nil {
+		return nil, err
+	}
+	if rr.RowNumber() == 0 {
+		return nil, errors.New("binlog is not enabled")
+	}
+
+	result := new(SnapshotResult)
+	result.Name, _ = rr.GetString(0, 0)
+	pos, _ := rr.GetInt(0, 1)
+	result.Pos = uint32(pos)
+	if len(rr.Fields) > 4 {
+		result.GTID, _ = rr.GetString(0, 4)
+	}
+	return result, nil
+}
+
+func snapshotTable(conn *client.Conn, rule *global.Rule, table *SnapshotTable, sink snapshotSink) error {
+	orderBy := rule.OrderByColumn
+	if orderBy == "" {
+		if len(rule.TableInfo.PKColumns) == 0 {
+			return errors.Errorf("%s.%s need order_by_column for snapshot", rule.Schema, rule.Table)
+		}
+		orderBy = rule.TableInfo.GetPKColumn(0).Name
+	}
+
+	file, err := sink.open(rule)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer sink.close()
+	_lockOfSnapshot.Lock()
+	table.File = file
+	_lockOfSnapshot.Unlock()
+
+	size := global.Cfg().BulkSize
+	var offset int64
+	for {
+		_transferService.waitDump()
+		sql := fmt.Sprintf("select * from %s.%s%s order by %s limit %d,%d", rule.Schema, rule.Table, dumpWhere(rule), orderBy, offset, size)
+		rr, err := conn.Execute(sql)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		requests := make([]*model.RowRequest, 0, rr.RowNumber())
+		for i := 0; i < rr.RowNumber(); i++ {
+			row := make([]interface{}, 0, len(rule.TableInfo.Columns))
+			for j := 0; j < len(rule.TableInfo.Columns); j++ {
+				val, _ := rr.GetValue(i, j)
+				row = append(row, val)
+			}
+			requests = append(requests, &model.RowRequest{
+				RuleKey:  table.RuleKey,
+				Action:   canal.InsertAction,
+				Row:      row,
+				Endpoint: rule.RouteOf(row),
+			})
+		}
+
+		n, err := sink.write(rule, requests)
+		_lockOfSnapshot.Lock()
+		table.Rows += n
+		_lockOfSnapshot.Unlock()
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		if int64(rr.RowNumber()) < size {
+			break
+		}
+		offset += size
+	}
+
+	return sink.flush()
+}
+
+type snapshotSink interface {
+	open(rule *global.Rule) (string, error)
+	write(rule *global.Rule, requests []*model.RowRequest) (int64, error)
+	flush() error
+	close()
+	release()
+}
+
+// fileSnapshotSink 每张表一个文件，每行一条JSON
+type fileSnapshotSink struct {
+	dir    string
+	file   *os.File
+	writer *bufio.Writer
+}
+
+func (k *fileSnapshotSink) open(rule *global.Rule) (string, error) {
+	name := fmt.Sprintf("%s.%s.%s.json", rule.Schema, rule.Table, time.Now().Format("20060102150405"))
+	path := filepath.Join(k.dir, name)
+	f, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	k.file = f
+	k.writer = bufio.NewWriter(f)
+	return path, nil
+}
+
+func (k *fileSnapshotSink) write(rule *global.Rule, requests []*model.RowRequest) (int64, error) {
+	var n int64
+	for _, req := range requests {
+		data, err := endpoint.EncodeRow(req, rule)
+		if err != nil {
+			return n, err
+		}
+		k.writer.Write(data)
+		if err := k.writer.WriteByte('\n'); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+func (k *fileSnapshotSink) flush() error {
+	return k.writer.Flush()
+}
+
+func (k *fileSnapshotSink) close() {
+	k.file.Close()
+}
+
+func (k *fileSnapshotSink) release() {}
+
+// endpointSnapshotSink 以全量导入的方式写入接收端
+type endpointSnapshotSink struct {
+	endpoint endpoint.Endpoint
+}
+
+func (k *endpointSnapshotSink) open(_ *global.Rule) (string, error) {
+	return "", nil
+}
+
+func (k *endpointSnapshotSink) write(rule *global.Rule, requests []*model.RowRequest) (int64, error) {
+	n := k.endpoint.Stock(requests)
+	if n < int64(len(requests)) {
+		return n, errors.Errorf("%s.%s snapshot rows failed to import, %d of %d succeeded", rule.Schema, rule.Table, n, len(requests))
+	}
+	return n, nil
+}
+
+func (k *endpointSnapshotSink) flush() error {
+	return nil
+}
+
+func (k *endpointSnapshotSink) close() {}
+
+func (k *endpointSnapshotSink) release() {
+	k.endpoint.Close()
+}
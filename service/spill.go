@@ -0,0 +1,139 @@
+/*
+ * Copyright 2020-2021 the original author(https://github.com/wj596)
+ *
+ * <p>
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * </p>
+ */
+package service
+
+import (
+	"bytes"
+	"encoding/gob"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-mysql/mysql"
+
+	"go-mysql-transfer/metrics"
+	"go-mysql-transfer/model"
+	"go-mysql-transfer/util/logs"
+	"go-mysql-transfer/util/wal"
+)
+
+// spillEntry 暂存到本地日志的一批数据，from为读取这批数据时已保存的位置
+type spillEntry struct {
+	From mysql.Position
+	Rows []*model.RowRequest
+	DDL  *model.DDLRequest
+}
+
+// spill 接收端不可用时将数据暂存到本地日志，恢复后按顺序写入接收端
+type spill struct {
+	log      *wal.Log
+	maxSize  int64
+	warnSize int64 // spill_warn_percent对应的大小
+	level    int   // 已记录日志的级别：0未达到warnSize、1达到warnSize、2已满
+}
+
+func openSpill(dir string, maxSize int64, warnPercent int) (*spill, error) {
+	log, err := wal.Open(dir)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	s := &spill{log: log, maxSize: maxSize, warnSize: maxSize * int64(warnPercent) / 100}
+	metrics.SetSpillLimit(maxSize)
+	s.observe()
+	return s, nil
+}
+
+// observe 更新本地日志大小，接近、达到spill_max_size时各记录一次日志，降到警告大小以下后重新计
+func (s *spill) observe() {
+	size := s.log.Size()
+	metrics.SetSpillBytes(size)
+	level := 0
+	if size >= s.maxSize {
+		level = 2
+	} else if size >= s.warnSize {
+		level = 1
+	}
+	if level > s.level {
+		if level == 2 {
+			logs.Errorf("spill log is full (%d bytes), reading binlog is blocked until the destination recovers", size)
+		} else {
+			logs.Warnf("spill log reached %d bytes, %d%% of spill_max_size", size, size*100/s.maxSize)
+		}
+	}
+	if level == 0 && s.level > 0 {
+		logs.Infof("spill log drained to %d bytes", size)
+	}
+	if level > s.level || level == 0 {
+		s.level = level
+	}
+}
+
+func (s *spill) write(from mysql.Position, rows []*model.RowRequest, ddl *model.DDLRequest) error {
+	data, err := encodeSpillEntry(&spillEntry{From: from, Rows: rows, DDL: ddl})
+	if err != nil {
+		return err
+	}
+	if err := s.log.Append(data); err != nil {
+		return err
+	}
+	s.observe()
+	return nil
+}
+
+// peek 返回最早暂存的一批数据，没有时返回nil
+func (s *spill) peek() (*spillEntry, error) {
+	data, err := s.log.Peek()
+	if err != nil || data == nil {
+		return nil, err
+	}
+	return decodeSpillEntry(data)
+}
+
+func (s *spill) commit() error {
+	err := s.log.Commit()
+	s.observe()
+	return err
+}
+
+func (s *spill) empty() bool {
+	return s.log.Empty()
+}
+
+// full 本地日志达到spill_max_size，不再暂存
+func (s *spill) full() bool {
+	return s.log.Size() >= s.maxSize
+}
+
+func (s *spill) close() {
+	s.log.Close()
+}
+
+// encodeSpillEntry 使用gob编码，保留行数据中各列值的类型
+func encodeSpillEntry(entry *spillEntry) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(entry); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeSpillEntry(data []byte) (*spillEntry, error) {
+	entry := new(spillEntry)
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(entry); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return entry, nil
+}
@@ -0,0 +1,46 @@
+package service
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/mysql"
+
+	"go-mysql-transfer/model"
+)
+
+func TestSpillEntry(t *testing.T) {
+	entry := &spillEntry{
+		From: mysql.Position{Name: "mysql-bin.000001", Pos: 4},
+		Rows: []*model.RowRequest{{
+			RuleKey: "test:user",
+			Action:  canal.InsertAction,
+			Row:     []interface{}{int64(1), "a", nil, []byte{1, 2}, float64(1.5), uint32(7)},
+		}},
+	}
+	data, err := encodeSpillEntry(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := decodeSpillEntry(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.From != entry.From || decoded.DDL != nil {
+		t.Errorf("unexpected entry %v %v", decoded.From, decoded.DDL)
+	}
+	// 列值的类型须保持不变
+	if !reflect.DeepEqual(decoded.Rows[0].Row, entry.Rows[0].Row) {
+		t.Errorf("expect %#v, but %#v", entry.Rows[0].Row, decoded.Rows[0].Row)
+	}
+
+	data, _ = encodeSpillEntry(&spillEntry{DDL: &model.DDLRequest{Schema: "test", Query: "alter table user add c int"}})
+	decoded, err = decodeSpillEntry(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.DDL == nil || decoded.DDL.Query != "alter table user add c int" || len(decoded.Rows) != 0 {
+		t.Errorf("unexpected ddl entry %v", decoded.DDL)
+	}
+}
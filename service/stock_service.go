@@ -30,6 +30,7 @@ import (
 	"go-mysql-transfer/global"
 	"go-mysql-transfer/model"
 	"go-mysql-transfer/service/endpoint"
+	"go-mysql-transfer/service/lookup"
 	"go-mysql-transfer/util/dates"
 	"go-mysql-transfer/util/logs"
 )
@@ -77,6 +78,9 @@ func (s *StockService) Run() error {
 	if err := s.completeRules(); err != nil {
 		return errors.Trace(err)
 	}
+	if err := lookup.Initialize(s.canal); err != nil {
+		return errors.Trace(err)
+	}
 	s.addDumpDatabaseOrTable()
 
 	enp := endpoint.NewEndpoint(s.canal)
@@ -97,7 +101,7 @@ func (s *StockService) Run() error {
 		fullName := fmt.Sprintf("%s.%s", rule.Schema, rule.Table)
 		log.Println(fmt.Sprintf("开始导出 %s", fullName))
 
-		res, err := s.canal.Execute(fmt.Sprintf("select count(1) from %s", fullName))
+		res, err := s.canal.Execute(fmt.Sprintf("select count(1) from %s%s", fullName, dumpWhere(rule)))
 		if err != nil {
 			return err
 		}
@@ -186,6 +190,7 @@ func (s *StockService) export(fullName, columns string, batch int64, rule *globa
 			request.RuleKey = global.RuleKey(rule.Schema, rule.Table)
 			request.Row = rowValues
 		}
+		request.Endpoint = rule.RouteOf(request.Row)
 		requests = append(requests, request)
 	}
 
@@ -195,23 +200,32 @@ func (s *StockService) export(fullName, columns string, batch int64, rule *globa
 // 构造SQL
 func (s *StockService) buildSql(fullName, columns string, offset int64, rule *global.Rule) string {
 	size := global.Cfg().BulkSize
+	where := dumpWhere(rule)
 	if len(rule.TableInfo.PKColumns) == 0 {
-		return fmt.Sprintf("select %s from %s order by %s limit %d,%d", columns, fullName, rule.OrderByColumn, offset, size)
+		return fmt.Sprintf("select %s from %s%s order by %s limit %d,%d", columns, fullName, where, rule.OrderByColumn, offset, size)
 	}
 
 	i := rule.TableInfo.PKColumns[0]
 	n := rule.TableInfo.GetPKColumn(i).Name
-	t := "select b.* from (select %s from %s order by %s limit %d,%d) a left join %s b on a.%s=b.%s"
-	sql := fmt.Sprintf(t, n, fullName, rule.OrderByColumn, offset, size, fullName, n, n)
+	t := "select b.* from (select %s from %s%s order by %s limit %d,%d) a left join %s b on a.%s=b.%s"
+	sql := fmt.Sprintf(t, n, fullName, where, rule.OrderByColumn, offset, size, fullName, n, n)
 	return sql
 }
 
+// dumpWhere 规则配置了dump_where时返回where子句
+func dumpWhere(rule *global.Rule) string {
+	if rule.DumpWhere == "" {
+		return ""
+	}
+	return fmt.Sprintf(" where (%s)", rule.DumpWhere)
+}
+
 func (s *StockService) imports(fullName string, requests []*model.RowRequest) {
 	if s.shutoff.Load() {
 		return
 	}
 
-	succeeds := s.endpoint.Stock(requests)
+	succeeds := s.endpoint.Stock(explode(requests))
 	count := s.incCounter(fullName, succeeds)
 	log.Println(fmt.Sprintf("%s 导入数据 %d 条", fullName, count))
 }
@@ -290,6 +304,11 @@ func (s *StockService) incCounter(name string, n int64) int64 {
 }
 
 func (s *StockService) completeRules() error {
+	return completeStockRules(s.canal)
+}
+
+// completeStockRules 按配置生成规则实例并加载表结构，不涉及binlog
+func completeStockRules(c *canal.Canal) error {
 	wildcards := make(map[string]bool)
 	for _, rc := range global.Cfg().RuleConfigs {
 		if rc.Table == "*" {
@@ -307,7 +326,7 @@ func (s *StockService) completeRules() error {
 			}
 			sql := fmt.Sprintf(`SELECT table_name FROM information_schema.tables WHERE
 					table_name RLIKE "%s" AND table_schema = "%s";`, tableName, rc.Schema)
-			res, err := s.canal.Execute(sql)
+			res, err := c.Execute(sql)
 			if err != nil {
 				return errors.Trace(err)
 			}
@@ -332,7 +351,7 @@ func (s *StockService) completeRules() error {
 	}
 
 	for _, rule := range global.RuleInsList() {
-		tableMata, err := s.canal.GetTable(rule.Schema, rule.Table)
+		tableMata, err := c.GetTable(rule.Schema, rule.Table)
 		if err != nil {
 			return errors.Trace(err)
 		}
@@ -348,6 +367,14 @@ func (s *StockService) completeRules() error {
 		rule.TableInfo = tableMata
 		rule.TableColumnSize = len(tableMata.Columns)
 
+		if err := loadStoredColumns(c, rule); err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := loadColumnComments(c, rule); err != nil {
+			return errors.Trace(err)
+		}
+
 		if err := rule.ValidRedisDimensionColumn(); err != nil {
 			return errors.Trace(err)
 		}
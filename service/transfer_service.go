@@ -18,26 +18,35 @@
 package service
 
 import (
+	"database/sql/driver"
 	"fmt"
+	"io"
 	"log"
-	"regexp"
+	"net"
+	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/juju/errors"
 	"github.com/siddontang/go-mysql/canal"
 	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/schema"
 	"go.uber.org/atomic"
 
 	"go-mysql-transfer/global"
 	"go-mysql-transfer/metrics"
 	"go-mysql-transfer/service/endpoint"
+	"go-mysql-transfer/service/lookup"
 	"go-mysql-transfer/storage"
 	"go-mysql-transfer/util/logs"
 )
 
 const _transferLoopInterval = 1
 
+// 超过该值的复制延迟来自心跳事件(约2001年之后的unix时间)
+const _heartbeatDelay = 1000000000
+
 type TransferService struct {
 	canal        *canal.Canal
 	canalCfg     *canal.Config
@@ -49,8 +58,20 @@ type TransferService struct {
 	wg             sync.WaitGroup
 	endpoint       endpoint.Endpoint
 	endpointEnable atomic.Bool
+	paused         atomic.Bool
+	dumpPaused     atomic.Bool
+	spill          *spill // endpoint_unavailable_policy为spill时暂存数据的本地日志
 	positionDao    storage.PositionStorage
 	loopStopSignal chan struct{}
+
+	dedupe          *dedupe    // 开启dedupe_window时最近已写入的行事件，重启同步后仍保留
+	lockOfDiscovery sync.Mutex // 通配符规则注册、移除表
+	dumped          bool       // startup_mode为dump时已全量导出，重启同步时不再导出
+	health          *destHealth
+
+	rowDedupe *rowDedupes // 配置了规则dedupe_window时各规则最近已写入的行，重启同步后仍保留
+
+	dnsChanged atomic.Bool // dns_refresh_interval检测到接收端地址的解析结果变化，由监听协程在下一批写入前重新连接
 }
 
 func (s *TransferService) initialize() error {
@@ -61,6 +82,9 @@ func (s *TransferService) initialize() error {
 	s.canalCfg.Charset = global.Cfg().Charset
 	s.canalCfg.Flavor = global.Cfg().Flavor
 	s.canalCfg.ServerID = global.Cfg().SlaveID
+	s.canalCfg.HeartbeatPeriod = time.Duration(global.Cfg().HeartbeatPeriod) * time.Second
+	s.canalCfg.ReadTimeout = time.Duration(global.Cfg().ReadTimeout) * time.Second
+	s.canalCfg.MaxReconnectAttempts = global.Cfg().MaxReconnectAttempts
 	s.canalCfg.Dump.ExecutionPath = global.Cfg().DumpExec
 	s.canalCfg.Dump.DiscardErr = false
 	s.canalCfg.Dump.SkipMasterData = global.Cfg().SkipMasterData
@@ -73,6 +97,22 @@ func (s *TransferService) initialize() error {
 		return errors.Trace(err)
 	}
 
+	if err := lookup.Initialize(s.canal); err != nil {
+		return errors.Trace(err)
+	}
+
+	if err := s.checkBinlogFormat(); err != nil {
+		return errors.Trace(err)
+	}
+
+	if err := s.checkRowImage(); err != nil {
+		return errors.Trace(err)
+	}
+
+	if err := s.checkChannel(); err != nil {
+		return errors.Trace(err)
+	}
+
 	s.addDumpDatabaseOrTable()
 
 	positionDao := storage.NewPositionStorage()
@@ -81,13 +121,30 @@ func (s *TransferService) initialize() error {
 	}
 	s.positionDao = positionDao
 
+	if global.Cfg().EndpointUnavailablePolicy == global.EndpointUnavailableSpill {
+		spill, err := openSpill(filepath.Join(global.Cfg().DataDir, "spill"), global.Cfg().SpillMaxSize*1024*1024, global.Cfg().SpillWarnPercent)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		s.spill = spill
+	}
+	if global.Cfg().DedupeWindow > 0 {
+		s.dedupe = newDedupe(global.Cfg().DedupeWindow)
+	}
+	s.rowDedupe = newRowDedupes()
+	if global.Cfg().DedupePersistInterval > 0 {
+		if err := loadDedupe(s.dedupePath(), s.dedupe, s.rowDedupe); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
 	// endpoint
 	endpoint := endpoint.NewEndpoint(s.canal)
 	if err := endpoint.Connect(); err != nil {
 		return errors.Trace(err)
 	}
 	// 异步，必须要ping下才能确定连接成功
-	if global.Cfg().IsMongodb() {
+	if global.Cfg().IsMongodb() || global.Cfg().IsPostgresql() {
 		err := endpoint.Ping()
 		if err != nil {
 			return err
@@ -95,9 +152,12 @@ func (s *TransferService) initialize() error {
 	}
 	s.endpoint = endpoint
 	s.endpointEnable.Store(true)
+	metrics.SetEndpointConnected(time.Now())
+	s.health = newDestHealth()
 	metrics.SetDestState(metrics.DestStateOK)
 
 	s.firstsStart.Store(true)
+	metrics.SetListenerActive(time.Now())
 	s.startLoop()
 
 	return nil
@@ -108,12 +168,111 @@ func (s *TransferService) run() error {
 	if err != nil {
 		return err
 	}
+	stored := current
+
+	var gtid mysql.GTIDSet
+	trackGTID, err := s.gtidEnabled()
+	if err != nil {
+		return err
+	}
+	if trackGTID {
+		stored, err := s.positionDao.GetGTID()
+		if err != nil {
+			return err
+		}
+		if stored != "" {
+			if gtid, err = mysql.ParseGTIDSet(global.Cfg().Flavor, stored); err != nil {
+				return errors.Trace(err)
+			}
+		}
+	}
+
+	if current.Name == "" && gtid == nil && global.Cfg().FirstRunPosition != nil {
+		first := global.Cfg().FirstRunPosition
+		if first.GTID != "" {
+			gtid, err = mysql.ParseGTIDSet(global.Cfg().Flavor, first.GTID)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			log.Println(fmt.Sprintf("no stored position, first_run_position applied: gtid(%s)", first.GTID))
+		} else {
+			current = mysql.Position{
+				Name: first.BinlogName,
+				Pos:  first.BinlogPos,
+			}
+			log.Println(fmt.Sprintf("no stored position, first_run_position applied: position(%s %d)", current.Name, current.Pos))
+		}
+		logs.Infof("first_run_position applied, it will be ignored once a position is stored")
+	}
+
+	// 是否全量导出：canal仅在没有起始位置且配置了mysqldump时导出
+	var decision string
+	switch {
+	case global.Cfg().StartupMode == global.StartupDump && !s.dumped:
+		current, gtid = mysql.Position{}, nil
+		s.dumped = true
+		decision = "startup_mode dump, dump with mysqldump and stream from the dump position"
+	case gtid != nil:
+		decision = fmt.Sprintf("skip dump, stream from gtid(%s)", gtid.String())
+	case current.Name != "":
+		decision = fmt.Sprintf("skip dump, stream from position(%s %d)", current.Name, current.Pos)
+		if trackGTID {
+			logs.Warnf("gtid_position: no gtid stored with position(%s %d), gtid is tracked after the next dump or startup from master gtid", current.Name, current.Pos)
+		}
+	case global.Cfg().StartupMode == global.StartupStream && trackGTID:
+		gtid, err = s.canal.GetMasterGTIDSet()
+		if err != nil {
+			return errors.Trace(err)
+		}
+		decision = fmt.Sprintf("startup_mode stream, no stored position, skip dump and stream from master gtid(%s)", gtid.String())
+	case global.Cfg().StartupMode == global.StartupStream:
+		current, err = s.canal.GetMasterPos()
+		if err != nil {
+			return errors.Trace(err)
+		}
+		decision = fmt.Sprintf("startup_mode stream, no stored position, skip dump and stream from master position(%s %d)", current.Name, current.Pos)
+	case global.Cfg().DumpExec != "":
+		decision = "no stored position, dump with mysqldump and stream from the dump position"
+	default:
+		decision = "no stored position and no mysqldump, skip dump and stream from the earliest binlog"
+	}
+	log.Println(decision)
+	logs.Info(decision)
+	dump := current.Name == "" && gtid == nil && global.Cfg().DumpExec != ""
+	if dump {
+		s.canalHandler.awaitDump.Store(true)
+		if global.Cfg().SkipMasterData {
+			logs.Warnf("skip_master_data: the dump position is read before the dump without lock, rows changed during the dump may be sent twice")
+		}
+	}
+	// 规则位置只能与保存的位置之后的事件比较
+	if gtid != nil || stored.Name == "" || current != stored {
+		s.canalHandler.rulePos.discard()
+	}
+	// 跟踪GTID时需要起始的GTID集合；全量导出时以空集合启动，canal记录导出快照对应的GTID集合
+	s.canalHandler.executed = nil
+	s.canalHandler.gtid = ""
+	if gtid != nil && trackGTID {
+		s.canalHandler.executed = gtid.Clone()
+	}
+	if dump && trackGTID {
+		if gtid, err = mysql.ParseGTIDSet(global.Cfg().Flavor, ""); err != nil {
+			return errors.Trace(err)
+		}
+	}
 
 	s.wg.Add(1)
 	go func(p mysql.Position) {
 		s.canalEnable.Store(true)
-		log.Println(fmt.Sprintf("transfer run from position(%s %d)", p.Name, p.Pos))
-		if err := s.canal.RunFrom(p); err != nil {
+		var err error
+		if gtid != nil {
+			log.Println(fmt.Sprintf("transfer run from gtid(%s)", gtid.String()))
+			err = s.canal.StartFromGTID(gtid)
+		} else {
+			log.Println(fmt.Sprintf("transfer run from position(%s %d)", p.Name, p.Pos))
+			err = s.canal.RunFrom(p)
+		}
+		if err != nil {
 			log.Println(fmt.Sprintf("start transfer : %v", err))
 			logs.Errorf("canal : %v", errors.ErrorStack(err))
 			if s.canalHandler != nil {
@@ -125,6 +284,16 @@ func (s *TransferService) run() error {
 		s.canalEnable.Store(false)
 		s.canal = nil
 		s.wg.Done()
+		if err != nil && global.Cfg().MaxReconnectAttempts > 0 {
+			// 限制了重连次数时进入失败状态，由运维人员处理后重启；只有连接错误会重连，其他错误直接失败
+			if connectionLost(err) {
+				logs.Errorf("transfer failed, gave up after %d reconnect attempts, last error: %v", global.Cfg().MaxReconnectAttempts, err)
+			} else {
+				logs.Errorf("transfer failed: %v", err)
+			}
+			metrics.SetFailed(err.Error())
+			return
+		}
 		// 确保有一种良性退出机制 假设运行在docker可以重新运行
 		panic("canal err , transfer stop and exit...")
 	}(current)
@@ -134,6 +303,35 @@ func (s *TransferService) run() error {
 	return nil
 }
 
+// connectionLost 是否为与MySQL的连接断开或无法建立连接，binlog同步只在此类错误时按max_reconnect_attempts重连
+func connectionLost(err error) bool {
+	for err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF || err == mysql.ErrBadConn || err == driver.ErrBadConn {
+			return true
+		}
+		if _, ok := err.(net.Error); ok {
+			return true
+		}
+		var next error
+		switch e := err.(type) {
+		case interface{ Cause() error }:
+			next = e.Cause()
+		case interface{ Unwrap() error }:
+			next = e.Unwrap()
+		}
+		if next == nil {
+			if e, ok := err.(interface{ Underlying() error }); ok {
+				next = e.Underlying()
+			}
+		}
+		if next == err {
+			return false
+		}
+		err = next
+	}
+	return false
+}
+
 func (s *TransferService) StartUp() {
 	s.lockOfCanal.Lock()
 	defer s.lockOfCanal.Unlock()
@@ -156,6 +354,10 @@ func (s *TransferService) restart() {
 	}
 
 	s.createCanal()
+	// 复制通道的源库可能已切换
+	if err := s.checkChannel(); err != nil {
+		logs.Errorf("check replication channel: %s", err.Error())
+	}
 	s.addDumpDatabaseOrTable()
 	s.canalHandler = newHandler()
 	s.canal.SetEventHandler(s.canalHandler)
@@ -186,9 +388,169 @@ func (s *TransferService) stopDump() {
 	log.Println("dumper stopped")
 }
 
+func (s *TransferService) dedupePath() string {
+	return filepath.Join(global.Cfg().DataDir, "dedupe")
+}
+
+// saveDedupe 保存去重窗口，失败时只记录日志，重启后可能重复写入
+func (s *TransferService) saveDedupe() {
+	if err := saveDedupe(s.dedupePath(), s.dedupe, s.rowDedupe); err != nil {
+		logs.Errorf("save dedupe window error: %s", err.Error())
+	}
+}
+
 func (s *TransferService) Close() {
 	s.stopDump()
 	s.loopStopSignal <- struct{}{}
+	lookup.Close()
+	if s.spill != nil {
+		s.spill.close()
+	}
+	if global.Cfg().DedupePersistInterval > 0 {
+		s.saveDedupe()
+	}
+}
+
+// Pause 暂停写入接收端，binlog读取随队列积压而阻塞，位置不再推进
+func (s *TransferService) Pause() {
+	s.paused.Store(true)
+	logs.Info("transfer paused")
+}
+
+// Resume 恢复写入接收端
+func (s *TransferService) Resume() {
+	s.paused.Store(false)
+	logs.Info("transfer resumed")
+}
+
+func (s *TransferService) Paused() bool {
+	return s.paused.Load()
+}
+
+// PauseDump 暂停全量导出(启动时的mysqldump、快照及新发现表的导出)，不影响binlog同步；
+// mysqldump继续读取，spill方式下数据暂存到本地日志，恢复后写入接收端
+func (s *TransferService) PauseDump() {
+	s.dumpPaused.Store(true)
+	if h := s.canalHandler; h != nil && h.dumping.Load() && s.spill == nil {
+		logs.Warn("dump paused, but the running mysqldump keeps writing without endpoint_unavailable_policy spill")
+		return
+	}
+	logs.Info("dump paused")
+}
+
+// ResumeDump 恢复全量导出
+func (s *TransferService) ResumeDump() {
+	s.dumpPaused.Store(false)
+	logs.Info("dump resumed")
+}
+
+func (s *TransferService) DumpPaused() bool {
+	return s.dumpPaused.Load()
+}
+
+// waitDump 快照、新发现表的导出暂停时在每批数据导出前等待恢复；mysqldump不等待，暂停期间的数据暂存到本地日志
+func (s *TransferService) waitDump() {
+	for s.DumpPaused() && s.Running() {
+		time.Sleep(time.Second)
+	}
+}
+
+// QueueDepth 等待写入接收端的事件数量
+func (s *TransferService) QueueDepth() int {
+	if h := s.canalHandler; h != nil {
+		return len(h.queue)
+	}
+	return 0
+}
+
+// ReloadRules 重新加载所有规则的表结构
+func (s *TransferService) ReloadRules() error {
+	s.lockOfCanal.Lock()
+	defer s.lockOfCanal.Unlock()
+
+	if s.canal == nil {
+		return errors.New("transfer is not running")
+	}
+	// 与行事件的转换、写入接收端互斥，避免读取到更新了一半的规则
+	err := s.canalHandler.updateRules(func() error {
+		for _, rule := range global.RuleInsList() {
+			s.canal.ClearTableCache([]byte(rule.Schema), []byte(rule.Table))
+			if err := s.updateRule(rule.Schema, rule.Table); err != nil {
+				return errors.Trace(err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	logs.Info("rules reloaded")
+	return nil
+}
+
+// sourceDelay 源端复制延迟；canal按当前时间减事件头时间计算延迟，心跳事件的事件头时间为0，
+// 此时的延迟即为收到心跳的unix时间，记录为最近一次心跳时间并视为没有延迟
+func sourceDelay(c *canal.Canal) uint32 {
+	if c == nil {
+		return 0
+	}
+	delay := c.GetDelay()
+	if delay >= _heartbeatDelay {
+		metrics.SetSourceHeartbeat(time.Unix(int64(delay), 0))
+		return 0
+	}
+	return delay
+}
+
+// checkStalled 连接正常、未暂停，源端在最近一次处理事件之后仍有新事件，且超过stall_timeout未处理时判定为停滞(如写入协程死锁)
+func (s *TransferService) checkStalled() {
+	timeout := time.Duration(global.Cfg().StallTimeout) * time.Second
+	if timeout <= 0 {
+		return
+	}
+
+	stalled := false
+	if s.Running() && s.endpointEnable.Load() && !s.Paused() {
+		active := metrics.ListenerActiveTime()
+		stalled = metrics.SourceActiveTime().After(active) && time.Since(active) > timeout
+	}
+	if stalled && !metrics.Stalled() {
+		logs.Errorf("transfer stalled: source is active but no events processed since %s, queue depth %d, delay %d",
+			metrics.ListenerActiveTime().Format(time.RFC3339), s.QueueDepth(), metrics.TransferDelay())
+	}
+	if !stalled && metrics.Stalled() {
+		logs.Info("transfer recovered from stall")
+	}
+	metrics.SetStalled(stalled)
+}
+
+// checkCaughtUp 未在接收mysqldump导出的数据、延迟低于catchup_delay持续catchup_duration时判定为已追上，通知catchup_hook
+func (s *TransferService) checkCaughtUp(c *catchup) {
+	delay := sourceDelay(s.canal)
+	dumping := false
+	if h := s.canalHandler; h != nil {
+		dumping = h.dumping.Load()
+	}
+	lagging := dumping || delay >= uint32(global.Cfg().CatchupDelay)
+	ready := s.Running() && s.endpointEnable.Load() && !s.Paused()
+	if !c.observe(lagging, ready, delay) || global.Cfg().CatchupHook == "" {
+		return
+	}
+
+	pos, _ := s.Position()
+	go notifyCatchup(global.Cfg().CatchupHook, catchupEvent{
+		Event:  "caught_up",
+		Source: global.Cfg().SourceId,
+		Delay:  delay,
+		Name:   pos.Name,
+		Pos:    pos.Pos,
+		Time:   time.Now().Unix(),
+	})
+}
+
+// Running 是否正在读取binlog
+func (s *TransferService) Running() bool {
+	return s.canalEnable.Load()
 }
 
 func (s *TransferService) Position() (mysql.Position, error) {
@@ -199,9 +561,154 @@ func (s *TransferService) createCanal() error {
 	for _, rc := range global.Cfg().RuleConfigs {
 		s.canalCfg.IncludeTableRegex = append(s.canalCfg.IncludeTableRegex, rc.Schema+"\\."+rc.Table)
 	}
+	s.canalCfg.IncludeTableRegex = append(s.canalCfg.IncludeTableRegex, markerTableRegex()...)
+	s.canalCfg.IncludeTableRegex = append(s.canalCfg.IncludeTableRegex, lookup.TableRegex()...)
 	var err error
 	s.canal, err = canal.NewCanal(s.canalCfg)
-	return errors.Trace(err)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	s.loadTimeZone()
+	return nil
+}
+
+// loadTimeZone 查询源库时区，time_zone为SYSTEM时取操作系统时区；每次连接源库时刷新
+func (s *TransferService) loadTimeZone() {
+	rr, err := s.canal.Execute("SELECT @@global.time_zone, @@system_time_zone")
+	if err != nil {
+		logs.Warnf("query time_zone error: %s", err.Error())
+		return
+	}
+	tz, _ := rr.GetString(0, 0)
+	if tz == "SYSTEM" {
+		tz, _ = rr.GetString(0, 1)
+	}
+	previous := global.SourceTimeZone()
+	if previous != "" && previous != tz {
+		logs.Warnf("source time_zone changed from %s to %s", previous, tz)
+	}
+	global.SetSourceTimeZone(tz)
+}
+
+// checkBinlogFormat 检查源库的binlog_format，STATEMENT、MIXED格式时数据变更记录为SQL语句，无法解析出行数据
+func (s *TransferService) checkBinlogFormat() error {
+	rr, err := s.canal.Execute("SELECT @@global.binlog_format")
+	if err != nil {
+		return errors.Trace(err)
+	}
+	format, _ := rr.GetString(0, 0)
+	if strings.ToUpper(format) == "ROW" {
+		return nil
+	}
+	return errors.Errorf("binlog_format is %s, rows can't be decoded from binlog, "+
+		"set binlog_format=ROW on the source (SET GLOBAL binlog_format=ROW and binlog_format=ROW in my.cnf)", format)
+}
+
+// checkRowImage 检查源库的binlog_row_image：MINIMAL时更新前后的数据均只包含部分列，
+// NOBLOB时未变化的BLOB、TEXT、JSON列不在binlog中，缺少的列被当作null写入接收端
+func (s *TransferService) checkRowImage() error {
+	rr, err := s.canal.Execute("SELECT @@global.binlog_row_image")
+	if err != nil {
+		// MySQL 5.6之前没有此参数，总是记录完整的数据
+		logs.Warnf("query binlog_row_image error: %s", err.Error())
+		return nil
+	}
+	image, _ := rr.GetString(0, 0)
+	image = strings.ToUpper(image)
+
+	var problem string
+	switch image {
+	case "", "FULL":
+		return nil
+	case "NOBLOB":
+		for _, rule := range global.RuleInsList() {
+			for _, col := range rule.TableInfo.Columns {
+				if col.Type == schema.TYPE_JSON || strings.Contains(col.RawType, "blob") || strings.Contains(col.RawType, "text") {
+					problem = fmt.Sprintf("column %s.%s.%s is omitted from binlog when unchanged", rule.Schema, rule.Table, col.Name)
+					break
+				}
+			}
+			if problem != "" {
+				break
+			}
+		}
+		if problem == "" {
+			return nil
+		}
+	default:
+		problem = "rows only contain key and changed columns"
+	}
+
+	if global.Cfg().RowImagePolicy == global.RowImageWarn {
+		logs.Warnf("binlog_row_image is %s: %s, missing columns will be written as null", image, problem)
+		return nil
+	}
+	return errors.Errorf("binlog_row_image is %s (%s), set binlog_row_image=FULL on the source or row_image_policy: warn", image, problem)
+}
+
+// gtidEnabled 开启gtid_position且源库开启了GTID模式时跟踪GTID集合，MariaDB始终记录GTID
+func (s *TransferService) gtidEnabled() (bool, error) {
+	if !global.Cfg().GTIDPosition {
+		return false, nil
+	}
+	if global.Cfg().Flavor == mysql.MariaDBFlavor {
+		return true, nil
+	}
+
+	rr, err := s.canal.Execute("SELECT @@GLOBAL.gtid_mode")
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+	mode, _ := rr.GetString(0, 0)
+	if mode != "ON" {
+		logs.Warnf("gtid_position: gtid_mode is %s on the source, use binlog file and position", mode)
+		return false, nil
+	}
+	return true, nil
+}
+
+// checkChannel 配置了channel时查询该复制通道源库的server_id，只同步其复制来的行数据；
+// 源库须开启log_slave_updates，复制来的数据才会写入其binlog
+func (s *TransferService) checkChannel() error {
+	channel := global.Cfg().Channel
+	if channel == "" {
+		return nil
+	}
+
+	rr, err := s.canal.Execute("SELECT @@global.log_slave_updates")
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if enabled, _ := rr.GetInt(0, 0); enabled == 0 {
+		return errors.Errorf("log_slave_updates is OFF, rows replicated through channel %s are not written to the binlog", channel)
+	}
+
+	query := fmt.Sprintf("SHOW SLAVE STATUS FOR CHANNEL '%s'", channel)
+	if global.Cfg().Flavor == mysql.MariaDBFlavor {
+		query = fmt.Sprintf("SHOW SLAVE '%s' STATUS", channel)
+	}
+	rr, err = s.canal.Execute(query)
+	if err != nil {
+		return errors.Annotatef(err, "query replication channel %s", channel)
+	}
+	if rr.RowNumber() == 0 {
+		return errors.Errorf("replication channel %s not found", channel)
+	}
+	id, err := rr.GetUintByName(0, "Master_Server_Id")
+	if err != nil {
+		return errors.Annotatef(err, "query replication channel %s", channel)
+	}
+	if id == 0 {
+		return errors.Errorf("replication channel %s has never connected to its source, server_id unknown", channel)
+	}
+	uuid, _ := rr.GetStringByName(0, "Master_UUID")
+
+	if previous := global.ChannelServerID(); previous != 0 && previous != uint32(id) {
+		logs.Warnf("source server_id of replication channel %s changed from %d to %d", channel, previous, id)
+	}
+	global.SetChannelServerID(uint32(id))
+	logs.Infof("replication channel %s, source server_id %d, uuid %s", channel, id, uuid)
+	return nil
 }
 
 func (s *TransferService) completeRules() error {
@@ -211,23 +718,16 @@ func (s *TransferService) completeRules() error {
 			return errors.Errorf("wildcard * is not allowed for table name")
 		}
 
-		if regexp.QuoteMeta(rc.Table) != rc.Table { //通配符
+		if isWildcard(rc.Table) { //通配符
 			if _, ok := wildcards[global.RuleKey(rc.Schema, rc.Schema)]; ok {
 				return errors.Errorf("duplicate wildcard table defined for %s.%s", rc.Schema, rc.Table)
 			}
 
-			tableName := rc.Table
-			if rc.Table == "*" {
-				tableName = "." + rc.Table
-			}
-			sql := fmt.Sprintf(`SELECT table_name FROM information_schema.tables WHERE
-					table_name RLIKE "%s" AND table_schema = "%s";`, tableName, rc.Schema)
-			res, err := s.canal.Execute(sql)
+			tables, err := wildcardTables(s.canal, rc)
 			if err != nil {
 				return errors.Trace(err)
 			}
-			for i := 0; i < res.Resultset.RowNumber(); i++ {
-				tableName, _ := res.GetString(i, 0)
+			for _, tableName := range tables {
 				newRule, err := global.RuleDeepClone(rc)
 				if err != nil {
 					return errors.Trace(err)
@@ -247,34 +747,51 @@ func (s *TransferService) completeRules() error {
 	}
 
 	for _, rule := range global.RuleInsList() {
-		tableMata, err := s.canal.GetTable(rule.Schema, rule.Table)
-		if err != nil {
-			return errors.Trace(err)
-		}
-		if len(tableMata.PKColumns) == 0 {
-			if !global.Cfg().SkipNoPkTable {
-				return errors.Errorf("%s.%s must have a PK for a column", rule.Schema, rule.Table)
-			}
-		}
-		if len(tableMata.PKColumns) > 1 {
-			rule.IsCompositeKey = true // 组合主键
+		if err := completeRule(s.canal, rule); err != nil {
+			return err
 		}
+	}
 
-		rule.TableInfo = tableMata
-		rule.TableColumnSize = len(tableMata.Columns)
+	return nil
+}
 
-		if err := rule.ValidRedisDimensionColumn(); err != nil {
-			return errors.Trace(err)
+// completeRule 加载规则对应的表结构并初始化规则
+func completeRule(c *canal.Canal, rule *global.Rule) error {
+	tableMata, err := c.GetTable(rule.Schema, rule.Table)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if len(tableMata.PKColumns) == 0 {
+		if !global.Cfg().SkipNoPkTable {
+			return errors.Errorf("%s.%s must have a PK for a column", rule.Schema, rule.Table)
 		}
+	}
+	if len(tableMata.PKColumns) > 1 {
+		rule.IsCompositeKey = true // 组合主键
+	}
 
-		if err := rule.Initialize(); err != nil {
-			return errors.Trace(err)
-		}
+	rule.TableInfo = tableMata
+	rule.TableColumnSize = len(tableMata.Columns)
 
-		if rule.LuaEnable() {
-			if err := rule.CompileLuaScript(global.Cfg().DataDir); err != nil {
-				return err
-			}
+	if err := loadStoredColumns(c, rule); err != nil {
+		return errors.Trace(err)
+	}
+
+	if err := loadColumnComments(c, rule); err != nil {
+		return errors.Trace(err)
+	}
+
+	if err := rule.ValidRedisDimensionColumn(); err != nil {
+		return errors.Trace(err)
+	}
+
+	if err := rule.Initialize(); err != nil {
+		return errors.Trace(err)
+	}
+
+	if rule.LuaEnable() {
+		if err := rule.CompileLuaScript(global.Cfg().DataDir); err != nil {
+			return err
 		}
 	}
 
@@ -302,9 +819,21 @@ func (s *TransferService) addDumpDatabaseOrTable() {
 }
 
 func (s *TransferService) updateRule(schema, table string) error {
+	if !global.RuleInsExist(global.RuleKey(schema, table)) {
+		// 新匹配的表注册失败(如没有主键)不停止同步，其行数据按new_table跳过
+		if _, err := s.discoverTable(schema, table); err != nil {
+			logs.Errorf("register table %s.%s error: %s", schema, table, errors.ErrorStack(err))
+		}
+		return nil
+	}
+	return updateRuleTable(s.canal, schema, table)
+}
+
+// updateRuleTable 表结构变更后重新加载规则对应的表结构
+func updateRuleTable(c *canal.Canal, schema, table string) error {
 	rule, ok := global.RuleIns(global.RuleKey(schema, table))
 	if ok {
-		tableInfo, err := s.canal.GetTable(schema, table)
+		tableInfo, err := c.GetTable(schema, table)
 		if err != nil {
 			return errors.Trace(err)
 		}
@@ -322,6 +851,14 @@ func (s *TransferService) updateRule(schema, table string) error {
 		rule.TableInfo = tableInfo
 		rule.TableColumnSize = len(tableInfo.Columns)
 
+		if err := loadStoredColumns(c, rule); err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := loadColumnComments(c, rule); err != nil {
+			return errors.Trace(err)
+		}
+
 		// if update table column define
 		if err := rule.ValidRedisDimensionColumn(); err != nil {
 			return errors.Trace(err)
@@ -336,15 +873,90 @@ func (s *TransferService) updateRule(schema, table string) error {
 	return nil
 }
 
+// loadColumnComments 查询列注释并解析其中的映射指令
+func loadColumnComments(c *canal.Canal, rule *global.Rule) error {
+	if !rule.ColumnComments {
+		return nil
+	}
+
+	sql := fmt.Sprintf(`SELECT column_name, column_comment FROM information_schema.columns WHERE table_schema = "%s"
+		AND table_name = "%s";`, rule.Schema, rule.Table)
+	res, err := c.Execute(sql)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	directives := make(map[string]*global.ColumnDirective)
+	for i := 0; i < res.Resultset.RowNumber(); i++ {
+		name, _ := res.GetString(i, 0)
+		comment, _ := res.GetString(i, 1)
+		if directive := global.ParseColumnDirective(name, comment); directive != nil {
+			directives[name] = directive
+		}
+	}
+	rule.ColumnDirectives = directives
+	return nil
+}
+
+// loadStoredColumns 查询STORED生成列，canal的表结构只能识别VIRTUAL生成列
+func loadStoredColumns(c *canal.Canal, rule *global.Rule) error {
+	if rule.GeneratedColumns != global.GeneratedColumnsExclude {
+		return nil
+	}
+
+	sql := fmt.Sprintf(`SELECT column_name FROM information_schema.columns WHERE table_schema = "%s"
+		AND table_name = "%s" AND (extra LIKE "%%STORED GENERATED%%" OR extra LIKE "%%PERSISTENT GENERATED%%");`,
+		rule.Schema, rule.Table)
+	res, err := c.Execute(sql)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	columns := make([]string, 0, res.Resultset.RowNumber())
+	for i := 0; i < res.Resultset.RowNumber(); i++ {
+		name, _ := res.GetString(i, 0)
+		columns = append(columns, name)
+	}
+	rule.StoredColumns = columns
+	return nil
+}
+
 func (s *TransferService) startLoop() {
 	go func() {
 		ticker := time.NewTicker(_transferLoopInterval * time.Second)
 		defer ticker.Stop()
+		discovered := time.Now()
+		checked := time.Now()
+		persisted := time.Now()
+		resolved := time.Now()
+		addrs := make(map[string]string)
+		var caught catchup
 		for {
 			select {
 			case <-ticker.C:
-				if !s.endpointEnable.Load() {
+				s.checkStalled()
+				s.checkCaughtUp(&caught)
+				if interval := time.Duration(global.Cfg().TableDiscoveryInterval) * time.Second; interval > 0 && time.Since(discovered) >= interval {
+					s.discoverTables()
+					discovered = time.Now()
+				}
+				if interval := time.Duration(global.Cfg().DnsRefreshInterval) * time.Second; interval > 0 && time.Since(resolved) >= interval {
+					s.checkDns(addrs)
+					resolved = time.Now()
+				}
+				if interval := time.Duration(global.Cfg().DedupePersistInterval) * time.Second; interval > 0 && time.Since(persisted) >= interval {
+					s.saveDedupe()
+					persisted = time.Now()
+				}
+				if s.endpointEnable.Load() {
+					if time.Since(checked) >= time.Duration(global.Cfg().HealthCheckInterval)*time.Second {
+						s.health.observe(s.endpoint.Ping())
+						checked = time.Now()
+					}
+				} else {
+					// 不可用时每次都检测，尽快恢复写入
 					err := s.endpoint.Ping()
+					s.health.observe(err)
 					if err != nil {
 						log.Println("destination not available,see the log file for details")
 						logs.Error(err.Error())
@@ -352,9 +964,12 @@ func (s *TransferService) startLoop() {
 						s.endpointEnable.Store(true)
 						if global.Cfg().IsRabbitmq() {
 							s.endpoint.Connect()
+							metrics.SetEndpointConnected(time.Now())
+						}
+						// block、spill方式未停止读取binlog，由监听协程继续写入
+						if global.Cfg().EndpointUnavailablePolicy == global.EndpointUnavailableStop {
+							s.StartUp()
 						}
-						s.StartUp()
-						metrics.SetDestState(metrics.DestStateOK)
 					}
 				}
 			case <-s.loopStopSignal:
@@ -0,0 +1,265 @@
+/*
+ * Copyright 2020-2021 the original author(https://github.com/wj596)
+ *
+ * <p>
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * </p>
+ */
+package service
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-mysql/canal"
+
+	"go-mysql-transfer/global"
+	"go-mysql-transfer/model"
+	"go-mysql-transfer/service/endpoint"
+	"go-mysql-transfer/util/logs"
+)
+
+const (
+	VerifyModeCount  = "count"  // 只比较数据量
+	VerifyModeFull   = "full"   // 全表扫描，比较每一行
+	VerifyModeSample = "sample" // 随机抽样比较
+
+	_verifyPrintLimit = 20
+)
+
+// VerifyReport 单表的校验结果
+type VerifyReport struct {
+	RuleKey     string
+	SourceRows  int64
+	TargetRows  int64 // -1表示接收端不支持计数
+	Scanned     int64
+	Missing     []string
+	Divergent   []string
+	Unsupported string
+}
+
+// Extra 接收端多出的数据量，仅全表扫描且接收端支持计数时有效
+func (r *VerifyReport) Extra() int64 {
+	if r.TargetRows < 0 {
+		return 0
+	}
+	if extra := r.TargetRows - (r.Scanned - int64(len(r.Missing))); extra > 0 {
+		return extra
+	}
+	return 0
+}
+
+// VerifyService 校验接收端与源端数据是否一致，只读，不影响增量同步
+type VerifyService struct {
+	canal    *canal.Canal
+	endpoint endpoint.Endpoint
+}
+
+func NewVerifyService() *VerifyService {
+	return &VerifyService{}
+}
+
+func (s *VerifyService) Run(mode string, sample int64, tables []string) ([]*VerifyReport, error) {
+	if mode != VerifyModeCount && mode != VerifyModeFull && mode != VerifyModeSample {
+		return nil, errors.Errorf("unsupported verify mode %s", mode)
+	}
+
+	canalCfg := canal.NewDefaultConfig()
+	canalCfg.Addr = global.Cfg().Addr
+	canalCfg.User = global.Cfg().User
+	canalCfg.Password = global.Cfg().Password
+	canalCfg.Charset = global.Cfg().Charset
+	canalCfg.Flavor = global.Cfg().Flavor
+	canalCfg.ServerID = global.Cfg().SlaveID
+	canalCfg.Dump.ExecutionPath = ""
+
+	c, err := canal.NewCanal(canalCfg)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	s.canal = c
+
+	if err := completeStockRules(s.canal); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	enp := endpoint.NewEndpoint(s.canal)
+	if err := enp.Connect(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	s.endpoint = enp
+
+	verifier, ok := enp.(endpoint.Verifier)
+	if !ok {
+		return nil, errors.Errorf("verify not supported by target %s", global.Cfg().Target)
+	}
+
+	var reports []*VerifyReport
+	for _, rule := range global.RuleInsList() {
+		if !s.selected(rule, tables) {
+			continue
+		}
+		report, err := s.verify(verifier, rule, mode, sample)
+		if err != nil {
+			return reports, errors.Trace(err)
+		}
+		reports = append(reports, report)
+	}
+
+	return reports, nil
+}
+
+func (s *VerifyService) selected(rule *global.Rule, tables []string) bool {
+	if len(tables) == 0 {
+		return true
+	}
+	for _, t := range tables {
+		if strings.EqualFold(t, rule.Schema+"."+rule.Table) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *VerifyService) verify(verifier endpoint.Verifier, rule *global.Rule, mode string, sample int64) (*VerifyReport, error) {
+	fullName := fmt.Sprintf("%s.%s", rule.Schema, rule.Table)
+	report := &VerifyReport{
+		RuleKey: global.RuleKey(rule.Schema, rule.Table),
+	}
+
+	res, err := s.canal.Execute(fmt.Sprintf("select count(1) from %s", fullName))
+	if err != nil {
+		return nil, err
+	}
+	report.SourceRows, _ = res.GetInt(0, 0)
+
+	if rule.LuaEnable() {
+		report.TargetRows = -1
+		report.Unsupported = "lua script rule"
+		return report, nil
+	}
+
+	report.TargetRows, err = verifier.Count(rule)
+	if err != nil {
+		return nil, err
+	}
+	if mode == VerifyModeCount {
+		return report, nil
+	}
+
+	orderBy := rule.OrderByColumn
+	if orderBy == "" {
+		if len(rule.TableInfo.PKColumns) == 0 {
+			return nil, errors.Errorf("%s need order_by_column for verify", fullName)
+		}
+		orderBy = rule.TableInfo.GetPKColumn(0).Name
+	}
+
+	size := global.Cfg().BulkSize
+	var offset int64
+	for {
+		var sql string
+		if mode == VerifyModeSample {
+			sql = fmt.Sprintf("select * from %s order by rand() limit %d", fullName, sample)
+		} else {
+			sql = fmt.Sprintf("select * from %s order by %s limit %d,%d", fullName, orderBy, offset, size)
+		}
+		rs, err := s.canal.Execute(sql)
+		if err != nil {
+			return nil, err
+		}
+
+		rows := make([]*model.RowRequest, 0, rs.RowNumber())
+		for i := 0; i < rs.RowNumber(); i++ {
+			values := make([]interface{}, 0, len(rule.TableInfo.Columns))
+			for j := 0; j < len(rule.TableInfo.Columns); j++ {
+				val, _ := rs.GetValue(i, j)
+				values = append(values, val)
+			}
+			rows = append(rows, &model.RowRequest{
+				RuleKey:  report.RuleKey,
+				Action:   canal.InsertAction,
+				Row:      values,
+				Endpoint: rule.RouteOf(values),
+			})
+		}
+
+		fetched, err := verifier.Fetch(rule, rows)
+		if err != nil {
+			return nil, err
+		}
+		for i, row := range rows {
+			id := endpoint.Identity(row, rule)
+			if fetched[i] == nil {
+				report.Missing = append(report.Missing, id)
+				logs.Warnf("verify %s missing: %s", fullName, id)
+				continue
+			}
+			if !endpoint.Equivalent(verifier.Expect(rule, row), fetched[i]) {
+				report.Divergent = append(report.Divergent, id)
+				logs.Warnf("verify %s divergent: %s", fullName, id)
+			}
+		}
+		report.Scanned += int64(len(rows))
+
+		if mode == VerifyModeSample || int64(rs.RowNumber()) < size {
+			break
+		}
+		offset += size
+	}
+
+	if mode == VerifyModeSample {
+		// 抽样时无法推算多出的数据
+		report.TargetRows = -1
+	}
+	return report, nil
+}
+
+func (s *VerifyService) Close() {
+	if s.endpoint != nil {
+		s.endpoint.Close()
+	}
+	if s.canal != nil {
+		s.canal.Close()
+	}
+}
+
+// Print 输出校验结果
+func (r *VerifyReport) Print() {
+	fmt.Println(fmt.Sprintf("表： %s，源端：%d 条数据", r.RuleKey, r.SourceRows))
+	if r.TargetRows >= 0 {
+		fmt.Println(fmt.Sprintf("  接收端：%d 条数据", r.TargetRows))
+	}
+	if r.Unsupported != "" {
+		fmt.Println(fmt.Sprintf("  不支持逐行校验：%s", r.Unsupported))
+		return
+	}
+	if r.Scanned == 0 {
+		return
+	}
+	fmt.Println(fmt.Sprintf("  校验：%d 条，缺失：%d 条，不一致：%d 条，多出：%d 条", r.Scanned, len(r.Missing), len(r.Divergent), r.Extra()))
+	printIds("  缺失", r.Missing)
+	printIds("  不一致", r.Divergent)
+}
+
+func printIds(title string, ids []string) {
+	if len(ids) == 0 {
+		return
+	}
+	if len(ids) > _verifyPrintLimit {
+		fmt.Println(fmt.Sprintf("%s(前%d条，全部请至日志查看)：%s", title, _verifyPrintLimit, strings.Join(ids[:_verifyPrintLimit], ",")))
+		return
+	}
+	fmt.Println(fmt.Sprintf("%s：%s", title, strings.Join(ids, ",")))
+}
@@ -22,6 +22,8 @@ import (
 	"github.com/siddontang/go-mysql/mysql"
 	"github.com/vmihailenco/msgpack"
 	"go.etcd.io/bbolt"
+
+	"go-mysql-transfer/global"
 )
 
 type boltPositionStorage struct {
@@ -29,10 +31,18 @@ type boltPositionStorage struct {
 	Pos  uint32
 }
 
+// positionId 配置了channel时每个复制通道单独保存位置
+func positionId() []byte {
+	if channel := global.Cfg().Channel; channel != "" {
+		return []byte("channel-" + channel)
+	}
+	return _fixPositionId
+}
+
 func (s *boltPositionStorage) Initialize() error {
 	return _bolt.Update(func(tx *bbolt.Tx) error {
 		bt := tx.Bucket(_positionBucket)
-		data := bt.Get(_fixPositionId)
+		data := bt.Get(positionId())
 		if data != nil {
 			return nil
 		}
@@ -41,26 +51,40 @@ func (s *boltPositionStorage) Initialize() error {
 		if err != nil {
 			return err
 		}
-		return bt.Put(_fixPositionId, bytes)
+		return bt.Put(positionId(), bytes)
 	})
 }
 
 func (s *boltPositionStorage) Save(pos mysql.Position) error {
+	return s.SaveGTID(pos, "")
+}
+
+func (s *boltPositionStorage) SaveGTID(pos mysql.Position, gtid string) error {
 	return _bolt.Update(func(tx *bbolt.Tx) error {
 		bt := tx.Bucket(_positionBucket)
-		data, err := msgpack.Marshal(pos)
+		data, err := msgpack.Marshal(gtidPosition{Name: pos.Name, Pos: pos.Pos, GTID: gtid})
 		if err != nil {
 			return err
 		}
-		return bt.Put(_fixPositionId, data)
+		return bt.Put(positionId(), data)
 	})
 }
 
 func (s *boltPositionStorage) Get() (mysql.Position, error) {
-	var entity mysql.Position
+	entity, err := s.get()
+	return entity.position(), err
+}
+
+func (s *boltPositionStorage) GetGTID() (string, error) {
+	entity, err := s.get()
+	return entity.GTID, err
+}
+
+func (s *boltPositionStorage) get() (gtidPosition, error) {
+	var entity gtidPosition
 	err := _bolt.View(func(tx *bbolt.Tx) error {
 		bt := tx.Bucket(_positionBucket)
-		data := bt.Get(_fixPositionId)
+		data := bt.Get(positionId())
 		if data == nil {
 			return errors.NotFoundf("PositionStorage")
 		}
@@ -69,3 +93,34 @@ func (s *boltPositionStorage) Get() (mysql.Position, error) {
 
 	return entity, err
 }
+
+// rulePositionId 规则单独保存的位置，配置了channel时按复制通道区分
+func rulePositionId(ruleKey string) []byte {
+	if channel := global.Cfg().Channel; channel != "" {
+		return []byte("channel-" + channel + ":" + ruleKey)
+	}
+	return []byte(ruleKey)
+}
+
+func (s *boltPositionStorage) GetByRule(ruleKey string) (mysql.Position, error) {
+	var entity mysql.Position
+	err := _bolt.View(func(tx *bbolt.Tx) error {
+		data := tx.Bucket(_rulePositionBucket).Get(rulePositionId(ruleKey))
+		if data == nil {
+			return nil
+		}
+		return msgpack.Unmarshal(data, &entity)
+	})
+
+	return entity, err
+}
+
+func (s *boltPositionStorage) SaveByRule(ruleKey string, pos mysql.Position) error {
+	return _bolt.Update(func(tx *bbolt.Tx) error {
+		data, err := msgpack.Marshal(pos)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(_rulePositionBucket).Put(rulePositionId(ruleKey), data)
+	})
+}
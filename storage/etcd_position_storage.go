@@ -20,6 +20,7 @@ package storage
 import (
 	"encoding/json"
 
+	"github.com/juju/errors"
 	"github.com/siddontang/go-mysql/mysql"
 
 	"go-mysql-transfer/global"
@@ -44,7 +45,11 @@ func (s *etcdPositionStorage) Initialize() error {
 }
 
 func (s *etcdPositionStorage) Save(pos mysql.Position) error {
-	data, err := json.Marshal(pos)
+	return s.SaveGTID(pos, "")
+}
+
+func (s *etcdPositionStorage) SaveGTID(pos mysql.Position, gtid string) error {
+	data, err := json.Marshal(gtidPosition{Name: pos.Name, Pos: pos.Pos, GTID: gtid})
 	if err != nil {
 		return err
 	}
@@ -53,7 +58,17 @@ func (s *etcdPositionStorage) Save(pos mysql.Position) error {
 }
 
 func (s *etcdPositionStorage) Get() (mysql.Position, error) {
-	var entity mysql.Position
+	entity, err := s.get()
+	return entity.position(), err
+}
+
+func (s *etcdPositionStorage) GetGTID() (string, error) {
+	entity, err := s.get()
+	return entity.GTID, err
+}
+
+func (s *etcdPositionStorage) get() (gtidPosition, error) {
+	var entity gtidPosition
 
 	data, _, err := etcds.Get(global.Cfg().ZkPositionDir(), _etcdOps)
 	if err != nil {
@@ -64,3 +79,28 @@ func (s *etcdPositionStorage) Get() (mysql.Position, error) {
 
 	return entity, err
 }
+
+func (s *etcdPositionStorage) GetByRule(ruleKey string) (mysql.Position, error) {
+	var entity mysql.Position
+
+	data, _, err := etcds.Get(global.Cfg().ZkRulePositionDir()+"/"+ruleKey, _etcdOps)
+	if errors.IsNotFound(err) {
+		return entity, nil
+	}
+	if err != nil {
+		return entity, err
+	}
+
+	err = json.Unmarshal(data, &entity)
+
+	return entity, err
+}
+
+func (s *etcdPositionStorage) SaveByRule(ruleKey string, pos mysql.Position) error {
+	data, err := json.Marshal(pos)
+	if err != nil {
+		return err
+	}
+
+	return etcds.UpdateOrCreate(global.Cfg().ZkRulePositionDir()+"/"+ruleKey, string(data), _etcdOps)
+}
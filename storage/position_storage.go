@@ -27,9 +27,31 @@ type PositionStorage interface {
 	Initialize() error
 	Save(pos mysql.Position) error
 	Get() (mysql.Position, error)
+	SaveGTID(pos mysql.Position, gtid string) error // 同时保存该位置对应的已执行GTID集合，gtid为空时同Save
+	GetGTID() (string, error)                       // 已保存的GTID集合，未保存时为空
+
+	GetByRule(ruleKey string) (mysql.Position, error) // 开启per_rule_position时规则单独保存的位置，未保存时为空
+	SaveByRule(ruleKey string, pos mysql.Position) error
+}
+
+// gtidPosition 保存的位置，GTID为空时与mysql.Position的存储格式相同
+type gtidPosition struct {
+	Name string
+	Pos  uint32
+	GTID string `json:",omitempty" msgpack:",omitempty"`
+}
+
+func (p gtidPosition) position() mysql.Position {
+	return mysql.Position{Name: p.Name, Pos: p.Pos}
 }
 
 func NewPositionStorage() PositionStorage {
+	return &retryPositionStorage{
+		delegate: newPositionStorage(),
+	}
+}
+
+func newPositionStorage() PositionStorage {
 	if global.Cfg().IsCluster() {
 		if global.Cfg().IsZk() {
 			return &zkPositionStorage{}
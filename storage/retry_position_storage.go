@@ -0,0 +1,158 @@
+/*
+ * Copyright 2020-2021 the original author(https://github.com/wj596)
+ *
+ * <p>
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * </p>
+ */
+package storage
+
+import (
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-mysql/mysql"
+
+	"go-mysql-transfer/global"
+	"go-mysql-transfer/metrics"
+	"go-mysql-transfer/util/logs"
+)
+
+// retryPositionStorage 为位置存储增加失败重试；
+// position_failure_policy为continue时，重试后仍失败则将位置保存在内存中继续运行
+type retryPositionStorage struct {
+	delegate PositionStorage
+
+	lock     sync.RWMutex
+	last     mysql.Position
+	lastGTID string
+	hasLast  bool
+}
+
+func (s *retryPositionStorage) Initialize() error {
+	return s.retry("initialize", s.delegate.Initialize)
+}
+
+func (s *retryPositionStorage) Save(pos mysql.Position) error {
+	return s.SaveGTID(pos, "")
+}
+
+func (s *retryPositionStorage) SaveGTID(pos mysql.Position, gtid string) error {
+	err := s.retry("save", func() error {
+		return s.delegate.SaveGTID(pos, gtid)
+	})
+	if err != nil {
+		metrics.IncPositionStoreFailure()
+		if global.Cfg().PositionFailurePolicy != global.PositionFailureContinue {
+			return err
+		}
+		logs.Errorf("position storage unreachable, position %s kept in memory only, err: %s", pos, err.Error())
+	}
+
+	s.lock.Lock()
+	s.last = pos
+	s.lastGTID = gtid
+	s.hasLast = true
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *retryPositionStorage) Get() (mysql.Position, error) {
+	var pos mysql.Position
+	err := s.retry("get", func() error {
+		var err error
+		pos, err = s.delegate.Get()
+		return err
+	})
+	// 尚未保存过位置不是存储故障
+	if err == nil || errors.IsNotFound(err) {
+		return pos, err
+	}
+
+	metrics.IncPositionStoreFailure()
+	if global.Cfg().PositionFailurePolicy == global.PositionFailureContinue {
+		s.lock.RLock()
+		defer s.lock.RUnlock()
+		if s.hasLast {
+			logs.Errorf("position storage unreachable, use in-memory position %s, err: %s", s.last, err.Error())
+			return s.last, nil
+		}
+	}
+	return pos, err
+}
+
+func (s *retryPositionStorage) GetGTID() (string, error) {
+	var gtid string
+	err := s.retry("get", func() error {
+		var err error
+		gtid, err = s.delegate.GetGTID()
+		return err
+	})
+	// 尚未保存过位置不是存储故障
+	if err == nil || errors.IsNotFound(err) {
+		return gtid, err
+	}
+
+	metrics.IncPositionStoreFailure()
+	if global.Cfg().PositionFailurePolicy == global.PositionFailureContinue {
+		s.lock.RLock()
+		defer s.lock.RUnlock()
+		if s.hasLast {
+			logs.Errorf("position storage unreachable, use in-memory gtid %s, err: %s", s.lastGTID, err.Error())
+			return s.lastGTID, nil
+		}
+	}
+	return gtid, err
+}
+
+func (s *retryPositionStorage) GetByRule(ruleKey string) (mysql.Position, error) {
+	var pos mysql.Position
+	err := s.retry("get rule", func() error {
+		var err error
+		pos, err = s.delegate.GetByRule(ruleKey)
+		return err
+	})
+	return pos, err
+}
+
+// SaveByRule 规则的位置只用于减少重复写入，失败时不影响同步
+func (s *retryPositionStorage) SaveByRule(ruleKey string, pos mysql.Position) error {
+	err := s.retry("save rule", func() error {
+		return s.delegate.SaveByRule(ruleKey, pos)
+	})
+	if err != nil {
+		metrics.IncPositionStoreFailure()
+	}
+	return err
+}
+
+func (s *retryPositionStorage) retry(op string, fn func() error) error {
+	interval := time.Duration(global.Cfg().PositionRetryInterval) * time.Millisecond
+	times := global.Cfg().PositionRetryTimes
+
+	var err error
+	for i := 0; ; i++ {
+		// 尚未保存过位置时直接返回，不重试
+		if err = fn(); err == nil || errors.IsNotFound(err) {
+			return err
+		}
+		if i >= times {
+			break
+		}
+		logs.Warnf("position storage %s failed, retry after %s, err: %s", op, interval, err.Error())
+		time.Sleep(interval)
+		interval *= 2
+	}
+	return errors.Annotatef(err, "position storage %s failed after %d retries", op, times)
+}
@@ -46,6 +46,8 @@ var (
 	_positionBucket = []byte("Position")
 	_fixPositionId  = byteutil.Uint64ToBytes(uint64(1))
 
+	_rulePositionBucket = []byte("RulePosition")
+
 	_bolt           *bbolt.DB
 	_zkConn         *zk.Conn
 	_zkStatusSignal <-chan zk.Event
@@ -89,6 +91,7 @@ func initBolt() error {
 
 	err = bolt.Update(func(tx *bbolt.Tx) error {
 		tx.CreateBucketIfNotExists(_positionBucket)
+		tx.CreateBucketIfNotExists(_rulePositionBucket)
 		return nil
 	})
 
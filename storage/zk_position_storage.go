@@ -20,6 +20,7 @@ package storage
 import (
 	"encoding/json"
 
+	"github.com/samuel/go-zookeeper/zk"
 	"github.com/siddontang/go-mysql/mysql"
 
 	"go-mysql-transfer/global"
@@ -40,17 +41,28 @@ func (s *zkPositionStorage) Initialize() error {
 		return err
 	}
 
+	if global.Cfg().PerRulePosition {
+		err = zookeepers.CreateDirIfNecessary(global.Cfg().ZkRulePositionDir(), _zkConn)
+		if err != nil {
+			return err
+		}
+	}
+
 	err = zookeepers.CreateDirIfNecessary(global.Cfg().ZkNodesDir(), _zkConn)
 	return err
 }
 
 func (s *zkPositionStorage) Save(pos mysql.Position) error {
+	return s.SaveGTID(pos, "")
+}
+
+func (s *zkPositionStorage) SaveGTID(pos mysql.Position, gtid string) error {
 	_, stat, err := _zkConn.Get(global.Cfg().ZkPositionDir())
 	if err != nil {
 		return err
 	}
 
-	data, err := json.Marshal(pos)
+	data, err := json.Marshal(gtidPosition{Name: pos.Name, Pos: pos.Pos, GTID: gtid})
 	if err != nil {
 		return err
 	}
@@ -61,7 +73,17 @@ func (s *zkPositionStorage) Save(pos mysql.Position) error {
 }
 
 func (s *zkPositionStorage) Get() (mysql.Position, error) {
-	var entity mysql.Position
+	entity, err := s.get()
+	return entity.position(), err
+}
+
+func (s *zkPositionStorage) GetGTID() (string, error) {
+	entity, err := s.get()
+	return entity.GTID, err
+}
+
+func (s *zkPositionStorage) get() (gtidPosition, error) {
+	var entity gtidPosition
 
 	data, _, err := _zkConn.Get(global.Cfg().ZkPositionDir())
 	if err != nil {
@@ -72,3 +94,35 @@ func (s *zkPositionStorage) Get() (mysql.Position, error) {
 
 	return entity, err
 }
+
+func (s *zkPositionStorage) GetByRule(ruleKey string) (mysql.Position, error) {
+	var entity mysql.Position
+
+	data, _, err := _zkConn.Get(global.Cfg().ZkRulePositionDir() + "/" + ruleKey)
+	if err == zk.ErrNoNode {
+		return entity, nil
+	}
+	if err != nil {
+		return entity, err
+	}
+
+	err = json.Unmarshal(data, &entity)
+
+	return entity, err
+}
+
+func (s *zkPositionStorage) SaveByRule(ruleKey string, pos mysql.Position) error {
+	data, err := json.Marshal(pos)
+	if err != nil {
+		return err
+	}
+
+	node := global.Cfg().ZkRulePositionDir() + "/" + ruleKey
+	err = zookeepers.CreateDirWithDataIfNecessary(node, data, _zkConn)
+	if err != nil {
+		return err
+	}
+	_, err = _zkConn.Set(node, data, -1)
+
+	return err
+}
@@ -0,0 +1,77 @@
+/*
+ * Copyright 2020-2021 the original author(https://github.com/wj596)
+ *
+ * <p>
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * </p>
+ */
+package consistent
+
+import (
+	"hash/crc32"
+	"sort"
+	"strconv"
+)
+
+const DefaultVirtualNodes = 160
+
+// Ring 一致性哈希环，节点增减时只影响相邻区间的key
+type Ring struct {
+	virtualNodes int
+	hashes       []uint32
+	owners       map[uint32]int
+}
+
+// New 创建哈希环，virtualNodes为每单位权重对应的虚拟节点数
+func New(virtualNodes int) *Ring {
+	if virtualNodes <= 0 {
+		virtualNodes = DefaultVirtualNodes
+	}
+	return &Ring{
+		virtualNodes: virtualNodes,
+		owners:       make(map[uint32]int),
+	}
+}
+
+// Add 添加节点，index为节点序号，name用于计算虚拟节点位置，weight为权重
+func (r *Ring) Add(index int, name string, weight int) {
+	if weight <= 0 {
+		weight = 1
+	}
+	for i := 0; i < r.virtualNodes*weight; i++ {
+		h := crc32.ChecksumIEEE([]byte(name + "#" + strconv.Itoa(i)))
+		if _, ok := r.owners[h]; ok {
+			continue
+		}
+		r.owners[h] = index
+		r.hashes = append(r.hashes, h)
+	}
+	sort.Slice(r.hashes, func(i, j int) bool {
+		return r.hashes[i] < r.hashes[j]
+	})
+}
+
+// Get 返回key所属节点的序号，环为空时返回-1
+func (r *Ring) Get(key string) int {
+	if len(r.hashes) == 0 {
+		return -1
+	}
+	h := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(r.hashes), func(i int) bool {
+		return r.hashes[i] >= h
+	})
+	if i == len(r.hashes) {
+		i = 0
+	}
+	return r.owners[r.hashes[i]]
+}
@@ -0,0 +1,42 @@
+package consistent
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestRingGet(t *testing.T) {
+	r := New(0)
+	r.Add(0, "127.0.0.1:6379", 1)
+	r.Add(1, "127.0.0.1:6380", 1)
+	r.Add(2, "127.0.0.1:6381", 2)
+
+	counts := make(map[int]int)
+	before := make(map[string]int)
+	for i := 0; i < 10000; i++ {
+		key := "USER:" + strconv.Itoa(i)
+		n := r.Get(key)
+		if n != r.Get(key) {
+			t.Fatalf("key %s routed to different shards", key)
+		}
+		counts[n]++
+		before[key] = n
+	}
+	if counts[2] < counts[0] || counts[2] < counts[1] {
+		t.Errorf("weighted shard should own the most keys: %v", counts)
+	}
+
+	r.Add(3, "127.0.0.1:6382", 1)
+	moved := 0
+	for key, n := range before {
+		if m := r.Get(key); m != n {
+			if m != 3 {
+				t.Fatalf("key %s moved between old shards %d -> %d", key, n, m)
+			}
+			moved++
+		}
+	}
+	if moved == 0 || moved > 4000 {
+		t.Errorf("unexpected moved keys: %d", moved)
+	}
+}
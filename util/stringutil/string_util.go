@@ -250,17 +250,20 @@ func HmacMD5(plaintext string, key string) string {
 	return fmt.Sprintf("%X", hash.Sum(nil))
 }
 
-// 驼峰式写法转为下划线写法
+// 驼峰式写法转为下划线写法，如userName、UserID、USER_NAME分别转为user_name、user_id、user_name
 func Camel2Case(name string) string {
+	runes := []rune(name)
 	buffer := new(bytes.Buffer)
-	for i, r := range name {
+	for i, r := range runes {
 		if unicode.IsUpper(r) {
-			if i != 0 {
+			// 小写字母、数字之后或连续大写字母的最后一个(其后为小写字母)之前分隔
+			if i > 0 && runes[i-1] != '_' && (unicode.IsLower(runes[i-1]) || unicode.IsDigit(runes[i-1]) ||
+				(unicode.IsUpper(runes[i-1]) && i+1 < len(runes) && unicode.IsLower(runes[i+1]))) {
 				buffer.WriteByte('_')
 			}
 			buffer.WriteRune(unicode.ToLower(r))
 		} else {
-			buffer.WriteString(strconv.FormatInt(int64(r), 10))
+			buffer.WriteRune(r)
 		}
 	}
 	return buffer.String()
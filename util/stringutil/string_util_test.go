@@ -10,3 +10,22 @@ func TestIsChineseChar(t *testing.T) {
 	println(IsChineseChar("a我b"))
 	println(IsChineseChar("，"))
 }
+
+func TestCamel2Case(t *testing.T) {
+	cases := map[string]string{
+		"userName":   "user_name",
+		"UserID":     "user_id",
+		"USER_NAME":  "user_name",
+		"user_name":  "user_name",
+		"HTTPServer": "http_server",
+		"id":         "id",
+	}
+	for name, want := range cases {
+		if got := Camel2Case(name); got != want {
+			t.Errorf("Camel2Case(%s) = %s, want %s", name, got, want)
+		}
+	}
+	if got := Case2Camel(Camel2Case("USER_NAME")); got != "userName" {
+		t.Errorf("got %s, want userName", got)
+	}
+}
@@ -0,0 +1,215 @@
+/*
+ * Copyright 2020-2021 the original author(https://github.com/wj596)
+ *
+ * <p>
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * </p>
+ */
+package wal
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/juju/errors"
+
+	"go-mysql-transfer/util/files"
+)
+
+const (
+	_logFile    = "wal.log"
+	_offsetFile = "wal.offset"
+	_headerSize = 8 // 数据长度(4字节) + crc32(4字节)
+)
+
+// Log 本地追加写日志，记录按写入顺序读取，全部读取确认后清空
+//
+// 每条记录写入后立即fsync；读取位置单独保存，进程重启后从上次确认的位置继续读取；
+// 写入中途崩溃造成的不完整记录在打开时截断
+type Log struct {
+	lock   sync.Mutex
+	dir    string
+	file   *os.File
+	size   int64 // 日志文件大小
+	offset int64 // 已确认读取的位置
+	next   int64 // 最近一次Peek的记录之后的位置
+}
+
+// Open 打开dir目录下的日志，不存在则创建
+func Open(dir string) (*Log, error) {
+	if err := files.MkdirIfNecessary(dir); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	file, err := os.OpenFile(filepath.Join(dir, _logFile), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	l := &Log{dir: dir, file: file}
+	if err := l.recover(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// recover 读取确认位置，截断末尾不完整的记录
+func (l *Log) recover() error {
+	data, err := ioutil.ReadFile(filepath.Join(l.dir, _offsetFile))
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Trace(err)
+	}
+	if len(data) > 0 {
+		if l.offset, err = strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64); err != nil {
+			return errors.Annotate(err, "wal offset")
+		}
+	}
+
+	stat, err := l.file.Stat()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if l.offset > stat.Size() {
+		l.offset = 0
+	}
+
+	valid := l.offset
+	for valid < stat.Size() {
+		_, n, err := l.read(valid)
+		if err != nil {
+			break
+		}
+		valid += n
+	}
+	if valid < stat.Size() {
+		if err := l.file.Truncate(valid); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	l.size = valid
+	l.next = l.offset
+	return nil
+}
+
+// Append 追加一条记录并落盘
+func (l *Log) Append(data []byte) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	buf := make([]byte, _headerSize+len(data))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(data))
+	copy(buf[_headerSize:], data)
+
+	if _, err := l.file.WriteAt(buf, l.size); err != nil {
+		return errors.Trace(err)
+	}
+	if err := l.file.Sync(); err != nil {
+		return errors.Trace(err)
+	}
+	l.size += int64(len(buf))
+	return nil
+}
+
+// Peek 返回最早一条未确认的记录，没有时返回nil
+func (l *Log) Peek() ([]byte, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.offset >= l.size {
+		return nil, nil
+	}
+	data, n, err := l.read(l.offset)
+	if err != nil {
+		return nil, err
+	}
+	l.next = l.offset + n
+	return data, nil
+}
+
+// Commit 确认Peek返回的记录已处理，全部确认后清空日志
+func (l *Log) Commit() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.next <= l.offset {
+		return nil
+	}
+	l.offset = l.next
+	if l.offset >= l.size {
+		if err := l.file.Truncate(0); err != nil {
+			return errors.Trace(err)
+		}
+		l.size, l.offset, l.next = 0, 0, 0
+	}
+	return l.saveOffset()
+}
+
+func (l *Log) saveOffset() error {
+	path := filepath.Join(l.dir, _offsetFile)
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(strconv.FormatInt(l.offset, 10)), 0644); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(os.Rename(tmp, path))
+}
+
+func (l *Log) read(offset int64) ([]byte, int64, error) {
+	header := make([]byte, _headerSize)
+	if _, err := l.file.ReadAt(header, offset); err != nil {
+		return nil, 0, errors.Trace(err)
+	}
+	length := binary.BigEndian.Uint32(header[0:4])
+	data := make([]byte, length)
+	if _, err := l.file.ReadAt(data, offset+_headerSize); err != nil {
+		if err == io.EOF {
+			return nil, 0, errors.New("incomplete wal record")
+		}
+		return nil, 0, errors.Trace(err)
+	}
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, 0, errors.New("wal record checksum mismatch")
+	}
+	return data, int64(_headerSize + length), nil
+}
+
+// Empty 是否没有未确认的记录
+func (l *Log) Empty() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.offset >= l.size
+}
+
+// Size 日志文件占用的字节数
+func (l *Log) Size() int64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.size
+}
+
+func (l *Log) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.file.Close()
+}
@@ -0,0 +1,62 @@
+package wal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"a", "bb", "ccc"} {
+		if err := l.Append([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, _ := l.Peek()
+	if string(data) != "a" {
+		t.Fatalf("expect a, but %s", data)
+	}
+	if err := l.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+
+	// 模拟写入中途崩溃留下的不完整记录
+	f, _ := os.OpenFile(filepath.Join(dir, _logFile), os.O_APPEND|os.O_WRONLY, 0644)
+	f.Write([]byte{0, 0, 0, 9, 1})
+	f.Close()
+
+	l, err = Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expect := range []string{"bb", "ccc"} {
+		data, err := l.Peek()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != expect {
+			t.Fatalf("expect %s, but %s", expect, data)
+		}
+		l.Commit()
+	}
+	if !l.Empty() || l.Size() != 0 {
+		t.Errorf("expect empty log after all committed, size %d", l.Size())
+	}
+	if data, _ := l.Peek(); data != nil {
+		t.Errorf("expect nil, but %s", data)
+	}
+	l.Close()
+}
@@ -9,6 +9,7 @@ import (
 	"net/http"
 	"path"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -35,6 +36,16 @@ func Start() error {
 	g.Static("/statics", statics)
 	g.LoadHTMLFiles(index)
 	g.GET("/", webAdminFunc)
+	g.StaticFile("/dashboard", path.Join(statics, "dashboard.html"))
+	g.GET("/healthz", healthzFunc)
+	g.GET("/api/status", statusFunc)
+	g.POST("/api/pause", pauseFunc)
+	g.POST("/api/resume", resumeFunc)
+	g.POST("/api/dump/pause", pauseDumpFunc)
+	g.POST("/api/dump/resume", resumeDumpFunc)
+	g.POST("/api/reload", reloadFunc)
+	g.POST("/api/snapshot", snapshotFunc)
+	g.GET("/api/snapshot", snapshotStateFunc)
 
 	port := global.Cfg().WebAdminPort
 	listen := fmt.Sprintf(":%s", strconv.Itoa(port))
@@ -125,6 +136,139 @@ func webAdminFunc(c *gin.Context) {
 	c.HTML(200, "index.html", h)
 }
 
+func healthzFunc(c *gin.Context) {
+	running := service.TransferServiceIns().Running()
+	h := gin.H{
+		"sourceRunning":     running,
+		"lastEventTime":     dates.Layout(metrics.SourceSeenTime(), dates.DayTimeSecondFormatter),
+		"lastHeartbeatTime": dates.Layout(metrics.SourceHeartbeatTime(), dates.DayTimeSecondFormatter),
+		"heartbeatPeriod":   global.Cfg().HeartbeatPeriod,
+		"destState":         metrics.DestState(),
+		"stalled":           metrics.Stalled(),
+		"delay":             metrics.TransferDelay(),
+	}
+	if failure := metrics.Failure(); failure != "" {
+		h["failed"] = true
+		h["error"] = failure
+	}
+
+	if !running || metrics.Stalled() {
+		c.JSON(http.StatusServiceUnavailable, h)
+		return
+	}
+	c.JSON(http.StatusOK, h)
+}
+
+// statusFunc 运行状态，供dashboard页面定时刷新
+func statusFunc(c *gin.Context) {
+	transfer := service.TransferServiceIns()
+	pos, _ := transfer.Position()
+
+	var rules []gin.H
+	for _, v := range global.RuleKeyList() {
+		rules = append(rules, gin.H{
+			"rule":   v,
+			"insert": metrics.LabInsertAmount(v),
+			"update": metrics.LabUpdateRecord(v),
+			"delete": metrics.LabDeleteRecord(v),
+		})
+	}
+
+	h := gin.H{
+		"running":       transfer.Running(),
+		"paused":        transfer.Paused(),
+		"dumpPaused":    transfer.DumpPaused(),
+		"destState":     metrics.DestState(),
+		"destName":      global.Cfg().DestStdName(),
+		"delay":         metrics.TransferDelay(),
+		"stalled":       metrics.Stalled(),
+		"caughtUp":      metrics.CaughtUp(),
+		"failed":        metrics.Failure() != "",
+		"throttled":     metrics.Throttled(),
+		"queueDepth":    transfer.QueueDepth(),
+		"bufferedBytes": metrics.BufferedBytes(),
+		"spillBytes":    metrics.SpillBytes(),
+		"spillLimit":    metrics.SpillLimit(),
+		"binName":       pos.Name,
+		"binPos":        pos.Pos,
+		"replayWindow":  metrics.ReplayWindow(),
+		"lastEventTime": dates.Layout(metrics.SourceSeenTime(), dates.DayTimeSecondFormatter),
+		"bootTime":      dates.Layout(global.BootTime(), dates.DayTimeMinuteFormatter),
+		"rules":         rules,
+	}
+	if global.Cfg().Channel != "" {
+		h["channel"] = global.Cfg().Channel
+		h["channelServerId"] = global.ChannelServerID()
+	}
+	if global.Cfg().IsCluster() {
+		h["isLeader"] = global.IsLeader()
+		h["leader"] = global.LeaderNode()
+	}
+	c.JSON(http.StatusOK, h)
+}
+
+func pauseFunc(c *gin.Context) {
+	service.TransferServiceIns().Pause()
+	c.JSON(http.StatusOK, gin.H{"paused": true})
+}
+
+func resumeFunc(c *gin.Context) {
+	service.TransferServiceIns().Resume()
+	c.JSON(http.StatusOK, gin.H{"paused": false})
+}
+
+func pauseDumpFunc(c *gin.Context) {
+	service.TransferServiceIns().PauseDump()
+	c.JSON(http.StatusOK, gin.H{"dumpPaused": true})
+}
+
+func resumeDumpFunc(c *gin.Context) {
+	service.TransferServiceIns().ResumeDump()
+	c.JSON(http.StatusOK, gin.H{"dumpPaused": false})
+}
+
+func reloadFunc(c *gin.Context) {
+	if err := service.TransferServiceIns().ReloadRules(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"reloaded": len(global.RuleKeyList())})
+}
+
+// snapshotFunc 触发一致性快照导出，如：POST /api/snapshot?rules=db.t1,db.t2&target=file
+// target支持file(导出到data_dir/snapshot目录)、endpoint(写入当前接收端)，默认file
+func snapshotFunc(c *gin.Context) {
+	var ruleKeys []string
+	for _, v := range strings.Split(c.Query("rules"), ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		v = strings.Replace(v, ".", ":", 1)
+		ruleKeys = append(ruleKeys, strings.ToLower(v))
+	}
+	if len(ruleKeys) == 0 {
+		ruleKeys = global.RuleKeyList()
+	}
+
+	target := c.DefaultQuery("target", service.SnapshotTargetFile)
+	result, err := service.TransferServiceIns().Snapshot(ruleKeys, target)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+func snapshotStateFunc(c *gin.Context) {
+	result := service.LastSnapshot()
+	if result == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no snapshot"})
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
 func Close() {
 	if _server == nil {
 		return